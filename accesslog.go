@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// --- Access log ---
+// Middleware mux пишет строку на каждый ответ: метод, путь, код, время, размер тела и адрес клиента.
+// ACCESS_LOG выбирает формат: common (по умолчанию; Common Log Format, после него — время ответа в секундах
+// и id запроса), json (строка JSON с маршрутом mux, request_id и trace_id) или off. Строки идут
+// в ACCESS_LOG_PATH (дозапись) или в stdout, отдельно от лога приложения в stderr. Адрес клиента — адрес
+// соединения; с ACCESS_LOG_TRUST_PROXY=true — первый адрес X-Forwarded-For, если сервис стоит за прокси.
+// Частые опросы /healthz, /readyz и /metrics не пишутся.
+
+// probeRoutes — служебные маршруты, которые опрашиваются часто.
+var probeRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+type accessLogOptions struct {
+	Format     string // common, json или off
+	Path       string // пусто — stdout
+	TrustProxy bool
+}
+
+type accessLogger struct {
+	opts accessLogOptions
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// accessEntry — строка журнала доступа в формате json.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Route      string    `json:"route,omitempty"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	TraceID    string    `json:"trace_id,omitempty"`
+}
+
+func newAccessLogger(opts accessLogOptions) (*accessLogger, error) {
+	switch opts.Format {
+	case "common", "json", "off":
+	default:
+		return nil, fmt.Errorf("ACCESS_LOG: unknown format %q (common, json or off)", opts.Format)
+	}
+	l := &accessLogger{opts: opts, out: os.Stdout}
+	if opts.Path != "" {
+		f, err := os.OpenFile(opts.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("access log: open %s: %w", opts.Path, err)
+		}
+		l.out = f
+	}
+	return l, nil
+}
+
+// clientIP — адрес клиента без порта.
+func (l *accessLogger) clientIP(r *http.Request) string {
+	if l.opts.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// dash — значение поля Common Log Format; пустое — "-".
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (l *accessLogger) write(e accessEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.opts.Format == "json" {
+		json.NewEncoder(l.out).Encode(e)
+		return
+	}
+	target := e.Path
+	if e.Query != "" {
+		target += "?" + e.Query
+	}
+	fmt.Fprintf(l.out, "%s - %s [%s] %q %d %d %.6f %s\n", e.ClientIP, dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+target+" "+e.Proto, e.Status, e.Bytes, e.DurationMs/1000, dash(e.RequestID))
+}
+
+// middleware — звено mux; ставится после requestIDs и traceHTTP, чтобы в строке были их id.
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	if l.opts.Format == "off" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if cr := mux.CurrentRoute(r); cr != nil {
+			var err error
+			if route, err = cr.GetPathTemplate(); err != nil {
+				// маршрут без шаблона — прослойка registerLegacyAPI: строку запишет переписанный запрос
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if probeRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		e := accessEntry{
+			Time: start, ClientIP: l.clientIP(r), User: r.Header.Get("X-User-ID"),
+			Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Route: route, Proto: r.Proto,
+			Status: rec.status, Bytes: rec.bytes, DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			UserAgent: r.UserAgent(), RequestID: requestIDFrom(r.Context()),
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			e.TraceID = sc.TraceID().String()
+		}
+		l.write(e)
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// --- Admin IP allowlist ---
+// С ADMIN_ALLOWED_CIDRS (10.0.0.0/8,192.168.1.10 — сети или отдельные адреса, IPv4 и IPv6) маршруты
+// /admin/*, разрушительные операции (DELETE и маршруты из adminActions: массовая отмена, удаление
+// персональных данных, подписки webhooks) принимаются только с этих адресов — сверх аутентификации
+// и RBAC, а не вместо них. Проверка идёт до аутентификации: с чужого адреса даже верный ключ получает 403.
+// Адрес клиента — адрес соединения, а если оно пришло из ADMIN_TRUSTED_PROXIES (сети балансировщиков,
+// в том же формате) — самый правый адрес X-Forwarded-For вне этих сетей: левые записи присылает сам
+// клиент, прокси дописывают адреса справа. ACCESS_LOG_TRUST_PROXY на проверку не влияет. Отказы пишутся
+// в журнал аудита администрирования (adminaudit.go) с исходом denied. Служебные маршруты и gRPC
+// (админских методов в нём нет) не ограничиваются.
+
+var errIPNotAllowed = errors.New("client address is not allowed for admin operations")
+
+type adminAllowlist struct {
+	prefixes []netip.Prefix
+	proxies  []netip.Prefix // доверенные прокси, которым верим X-Forwarded-For
+}
+
+// adminIPs — ограничение адресов; nil — выключено.
+var adminIPs *adminAllowlist
+
+// parseAllowedCIDRs разбирает список сетей переменной name; адрес без маски — сеть из одного адреса.
+func parseAllowedCIDRs(name, v string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, item := range splitList(v) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid address %q: expected CIDR or IP", name, item)
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid network %q: expected CIDR or IP", name, item)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// openAdminAllowlist читает ADMIN_ALLOWED_CIDRS и ADMIN_TRUSTED_PROXIES; без первой — nil.
+func openAdminAllowlist() (*adminAllowlist, error) {
+	prefixes, err := parseAllowedCIDRs("ADMIN_ALLOWED_CIDRS", getenv("ADMIN_ALLOWED_CIDRS", ""))
+	if err != nil || len(prefixes) == 0 {
+		return nil, err
+	}
+	proxies, err := parseAllowedCIDRs("ADMIN_TRUSTED_PROXIES", getenv("ADMIN_TRUSTED_PROXIES", ""))
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("admin: addresses restricted", "networks", len(prefixes), "trusted_proxies", len(proxies))
+	return &adminAllowlist{prefixes: prefixes, proxies: proxies}, nil
+}
+
+// containsIP — входит ли адрес ip в одну из сетей; нечитаемый адрес не входит.
+func containsIP(prefixes []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed — входит ли адрес ip в разрешённые сети.
+func (a *adminAllowlist) allowed(ip string) bool {
+	return containsIP(a.prefixes, ip)
+}
+
+// clientIP — адрес клиента для проверки: адрес соединения, а за доверенным прокси — самый правый
+// адрес X-Forwarded-For вне ADMIN_TRUSTED_PROXIES.
+func (a *adminAllowlist) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !containsIP(a.proxies, ip) {
+		return ip
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if !containsIP(a.proxies, hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip // вся цепочка — доверенные прокси
+}
+
+// restricted — действие маршрута name, если он ограничен по адресу; "" — не ограничен.
+func restricted(name, route, method string) string {
+	switch {
+	case adminActions[name] != "":
+		return adminActions[name]
+	case strings.HasPrefix(route, apiVersionPrefix+"/admin/"), method == http.MethodDelete:
+		return "admin.access"
+	}
+	return ""
+}
+
+// middleware — звено mux перед аутентификацией.
+func (a *adminAllowlist) middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr := mux.CurrentRoute(r)
+		if cr == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, err := cr.GetPathTemplate()
+		if err != nil || probeRoutes[route] {
+			next.ServeHTTP(w, r) // без шаблона — прослойка registerLegacyAPI: проверится переписанный запрос
+			return
+		}
+		action := restricted(cr.GetName(), route, r.Method)
+		ip := a.clientIP(r)
+		if action == "" || a.allowed(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		slog.WarnContext(r.Context(), "admin: address not allowed", "client_ip", ip, "method", r.Method, "route", route)
+		adminAudit.add(adminRecord{
+			Action: action, Actor: r.Header.Get("X-User-ID"), // заголовок ещё не проверен аутентификацией
+			Target:  map[string]string{"method": r.Method, "route": route, "client_ip": ip},
+			Outcome: auditDenied, StatusCode: http.StatusForbidden, RequestID: requestIDFrom(r.Context()), RemoteAddr: r.RemoteAddr,
+		})
+		writeError(w, errIPNotAllowed, http.StatusForbidden)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAdminAllowlistClientIP(t *testing.T) {
+	mustParse := func(name, v string) []netip.Prefix {
+		p, err := parseAllowedCIDRs(name, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	a := &adminAllowlist{
+		prefixes: mustParse("ADMIN_ALLOWED_CIDRS", "10.0.0.0/8"),
+		proxies:  mustParse("ADMIN_TRUSTED_PROXIES", "192.0.2.0/24"),
+	}
+	r := mux.NewRouter()
+	r.Use(a.middleware)
+	r.HandleFunc(apiVersionPrefix+"/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cases := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   int
+	}{
+		{"direct from allowed range", "10.1.2.3:4000", nil, http.StatusOK},
+		{"direct from outside", "203.0.113.9:4000", nil, http.StatusForbidden},
+		{"spoofed header without trusted proxy", "203.0.113.9:4000", []string{"10.0.0.5"}, http.StatusForbidden},
+		{"spoofed leftmost entry via trusted proxy", "192.0.2.10:4000", []string{"10.0.0.5, 203.0.113.9"}, http.StatusForbidden},
+		{"allowed range via trusted proxy", "192.0.2.10:4000", []string{"203.0.113.9, 10.0.0.5"}, http.StatusOK},
+		{"allowed range via proxy chain", "192.0.2.10:4000", []string{"10.0.0.5", "192.0.2.11"}, http.StatusOK},
+		{"trusted proxy without header", "192.0.2.10:4000", nil, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, apiVersionPrefix+"/admin/stats", nil)
+			req.RemoteAddr = c.remote
+			for _, v := range c.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != c.want {
+				t.Errorf("status = %d, want %d", rec.Code, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- Admin audit trail ---
+// Действия операторов и фоновые операции над журналом пишутся в отдельный журнал аудита, не смешиваясь
+// ни с событиями заказов, ни с аудитом команд: перестройка проекций, массовая отмена, работа с dead letters,
+// подписки webhooks, удаление персональных данных, а также усечение журнала архивом и компакция (с actor
+// "system"). Запросы к маршрутам из adminActions записываются middleware после ответа, с кодом ответа;
+// тела не сохраняются — в них бывают секреты. Отказы по адресу клиента (adminacl.go) — с исходом denied. С ADMIN_AUDIT_LOG_PATH записи дописываются в JSONL-файл
+// и читаются из него при запуске. GET /admin/audit отдаёт их страницами с фильтрами.
+
+// systemActor — автор фоновых операций.
+const systemActor = "system"
+
+// adminActions — маршруты, запросы к которым попадают в журнал: имя маршрута -> действие.
+var adminActions = map[string]string{
+	"rebuildProjection": "projection.rebuild",
+	"bulkCancelOrders":  "orders.bulk_cancel",
+	"retryDeadLetter":   "dead_letter.retry",
+	"deleteDeadLetter":  "dead_letter.delete",
+	"createWebhook":     "webhook.create",
+	"deleteWebhook":     "webhook.delete",
+	"eraseCustomerData": "customer.erase",
+	"createBackup":      "backup.create",
+	"reloadConfig":      "config.reload",
+	"verifyEvents":      "events.verify",
+	"createAPIKey":      "api_key.create",
+	"rotateAPIKey":      "api_key.rotate",
+	"deleteAPIKey":      "api_key.delete",
+}
+
+// auditDenied — запрос отклонён до аутентификации: адрес клиента не разрешён (adminacl.go).
+const auditDenied auditOutcome = "denied"
+
+// adminRecord — запись журнала аудита администрирования.
+type adminRecord struct {
+	Seq        int64             `json:"seq"`
+	Action     string            `json:"action"`
+	Actor      string            `json:"actor,omitempty"`
+	Target     map[string]string `json:"target,omitempty"` // параметры пути и запроса или детали фоновой операции
+	Outcome    auditOutcome      `json:"outcome"`
+	StatusCode int               `json:"status_code,omitempty"`
+	RequestID  string            `json:"request_id,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	At         time.Time         `json:"at"`
+}
+
+// adminAuditStore — журнал аудита администрирования (recordlog.go); opts.Path — ADMIN_AUDIT_LOG_PATH.
+type adminAuditStore struct {
+	recordLog[adminRecord]
+}
+
+var adminAudit = &adminAuditStore{recordLog[adminRecord]{
+	name: "admin audit", seqOf: func(r *adminRecord) *int64 { return &r.Seq }, opts: auditOptions{Max: 10000},
+}}
+
+func (a *adminAuditStore) add(rec adminRecord) {
+	if rec.At.IsZero() {
+		rec.At = time.Now()
+	}
+	a.append(rec)
+}
+
+// system записывает фоновую операцию.
+func (a *adminAuditStore) system(action string, target map[string]string) {
+	a.add(adminRecord{Action: action, Actor: systemActor, Target: target, Outcome: auditSucceeded})
+}
+
+// auditAdmin — middleware mux, которое пишет запросы к маршрутам adminActions в журнал.
+func auditAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var action string
+		if cr := mux.CurrentRoute(r); cr != nil {
+			action = adminActions[cr.GetName()]
+		}
+		if action == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		target := map[string]string{}
+		for k, v := range mux.Vars(r) {
+			target[k] = v
+		}
+		for k := range r.URL.Query() {
+			target[k] = r.URL.Query().Get(k)
+		}
+		outcome := auditSucceeded
+		if rec.status >= 400 {
+			outcome = auditFailed
+		}
+		adminAudit.add(adminRecord{
+			Action: action, Actor: r.Header.Get("X-User-ID"), Target: target, Outcome: outcome, StatusCode: rec.status,
+			RequestID: requestIDFrom(r.Context()), RemoteAddr: r.RemoteAddr,
+		})
+	})
+}
+
+// adminQuery — фильтр GET /admin/audit; пустые поля не фильтруют.
+type adminQuery struct {
+	After        int64
+	Limit        int
+	Action       string
+	Actor        string
+	Since, Until time.Time
+}
+
+func (q adminQuery) match(rec adminRecord) bool {
+	return rec.Seq > q.After &&
+		(q.Action == "" || rec.Action == q.Action) &&
+		(q.Actor == "" || rec.Actor == q.Actor) &&
+		(q.Since.IsZero() || !rec.At.Before(q.Since)) &&
+		(q.Until.IsZero() || rec.At.Before(q.Until))
+}
+
+func (a *adminAuditStore) query(q adminQuery) []adminRecord {
+	return a.find(q.match, q.Limit)
+}
+
+// getAdminAudit отдаёт журнал аудита администрирования страницами: ?after=<seq>, ?limit=<n> и фильтры
+// ?action, ?actor, ?since/?until (RFC 3339). Полная страница — со ссылкой Link rel="next".
+func getAdminAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	aq := adminQuery{Limit: eventsPageSize, Action: q.Get("action"), Actor: q.Get("actor")}
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			httpError(w, fmt.Sprintf("invalid after %q: expected audit seq", v), http.StatusBadRequest)
+			return
+		}
+		aq.After = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > eventsPageSizeMax {
+			httpError(w, fmt.Sprintf("invalid limit %q: expected 1..%d", v, eventsPageSizeMax), http.StatusBadRequest)
+			return
+		}
+		aq.Limit = n
+	}
+	for name, t := range map[string]*time.Time{"since": &aq.Since, "until": &aq.Until} {
+		if v := q.Get(name); v != "" {
+			ts, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				httpError(w, fmt.Sprintf("invalid %s %q: expected RFC 3339 time", name, v), http.StatusBadRequest)
+				return
+			}
+			*t = ts
+		}
+	}
+	records := adminAudit.query(aq)
+	if len(records) == aq.Limit {
+		next := url.Values{}
+		for k, v := range q {
+			next[k] = v
+		}
+		next.Set("after", strconv.FormatInt(records[len(records)-1].Seq, 10))
+		next.Set("limit", strconv.Itoa(aq.Limit))
+		w.Header().Add("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	writeBody(w, r, http.StatusOK, records)
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// --- API keys ---
+// Сервисам, у которых нет OIDC, вместо JWT выдаются ключи: заголовок X-API-Key (x-api-key в gRPC).
+// У ключа есть области: queries — чтение, commands — команды, admin — маршруты /admin, pii — персональные
+// поля в ответах открытым текстом. Ключи создаются,
+// ротируются и отзываются через /admin/api-keys и хранятся в API_KEYS_PATH; в файле только sha256
+// ключа, сам ключ отдаётся один раз — в ответе на создание или ротацию. После ротации прежний ключ
+// действует ещё API_KEY_ROTATION_GRACE, чтобы клиенты успели перейти. Статические ключи задаются
+// в API_KEYS (name=scope+scope:key,...) и через API их не поменять — так выдаётся первый ключ admin.
+// Присланный ключ проверяется всегда: неизвестный — 401, без нужной маршруту области — 403 (rbac.go);
+// автор команды — apikey:<name> вместо X-User-ID. Запросы без ключа проверяет JWT (jwt.go), а с API_KEYS_REQUIRED и без
+// JWT они отклоняются, кроме служебных маршрутов.
+
+const (
+	scopeQueries  = "queries"
+	scopeCommands = "commands"
+	scopeAdmin    = "admin"
+	scopePII      = "pii" // расшифрованные персональные поля в ответах (pii.go)
+)
+
+var apiKeyScopes = []string{scopeQueries, scopeCommands, scopeAdmin, scopePII}
+
+var (
+	errAPIKeyNotFound = errors.New("api key not found")
+	errAPIKeyExists   = errors.New("api key with this name already exists")
+	errAPIKeyStatic   = errors.New("static api keys are configured in API_KEYS and cannot be changed")
+	errInvalidAPIKey  = errors.New("invalid api key")
+)
+
+type apiKey struct {
+	ID             string     `json:"id"`
+	Name           string     `json:"name"`
+	Scopes         []string   `json:"scopes"`
+	Tenant         string     `json:"tenant,omitempty"`         // арендатор, к которому привязан ключ (tenancy.go)
+	Hash           string     `json:"hash,omitempty"`           // sha256 ключа, hex
+	PreviousHash   string     `json:"previous_hash,omitempty"`  // прежний ключ после ротации
+	PreviousUntil  *time.Time `json:"previous_until,omitempty"` // до этого времени прежний ключ действует
+	CreatedAt      time.Time  `json:"created_at"`
+	RotatedAt      *time.Time `json:"rotated_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	CommandsPerDay int64      `json:"commands_per_day,omitempty"` // квота команд в сутки (quotas.go); 0 — общая
+	Static         bool       `json:"static,omitempty"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"` // с запуска сервиса, в файл не пишется
+	Key            string     `json:"key,omitempty"`          // только в ответе на создание и ротацию
+}
+
+// public — ключ без хешей, для ответов.
+func (k apiKey) public() apiKey {
+	k.Hash, k.PreviousHash = "", ""
+	k.Scopes = slices.Clone(k.Scopes)
+	return k
+}
+
+func (k *apiKey) matches(hash string, now time.Time) bool {
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+		return true
+	}
+	return k.PreviousHash != "" && k.PreviousUntil != nil && now.Before(*k.PreviousUntil) &&
+		subtle.ConstantTimeCompare([]byte(k.PreviousHash), []byte(hash)) == 1
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKeySecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "tsck_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type apiKeyOptions struct {
+	Path     string
+	Static   string // API_KEYS
+	Grace    time.Duration
+	Required bool
+}
+
+type apiKeyRegistry struct {
+	opts apiKeyOptions
+
+	mu   sync.Mutex
+	keys map[string]*apiKey // id -> ключ
+}
+
+var apiKeys *apiKeyRegistry
+
+func openAPIKeys(opts apiKeyOptions) (*apiKeyRegistry, error) {
+	reg := &apiKeyRegistry{opts: opts, keys: map[string]*apiKey{}}
+	body, err := os.ReadFile(opts.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("api keys: read %s: %w", opts.Path, err)
+	}
+	var stored []*apiKey
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &stored); err != nil {
+			return nil, fmt.Errorf("api keys: decode %s: %w", opts.Path, err)
+		}
+	}
+	for _, k := range stored {
+		reg.keys[k.ID] = k
+	}
+	for _, spec := range splitList(opts.Static) {
+		k, err := parseStaticAPIKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		if reg.byName(k.Name) != nil {
+			return nil, fmt.Errorf("api keys: API_KEYS: %w: %s", errAPIKeyExists, k.Name)
+		}
+		reg.keys[k.ID] = k
+	}
+	if len(reg.keys) > 0 || opts.Required {
+		slog.Info("api keys: enabled", "keys", len(reg.keys), "required", opts.Required)
+	}
+	return reg, nil
+}
+
+// parseStaticAPIKey разбирает name=scope+scope:key из API_KEYS.
+func parseStaticAPIKey(spec string) (*apiKey, error) {
+	name, rest, ok1 := strings.Cut(spec, "=")
+	scopes, key, ok2 := strings.Cut(rest, ":")
+	if !ok1 || !ok2 || name == "" || key == "" {
+		return nil, fmt.Errorf("api keys: API_KEYS: expected name=scope+scope:key, got %q", spec)
+	}
+	k := &apiKey{ID: "static-" + name, Name: name, Scopes: strings.Split(scopes, "+"), Hash: hashAPIKey(key), Static: true, CreatedAt: time.Now().UTC()}
+	if err := checkAPIKeyScopes(k.Scopes); err != nil {
+		return nil, fmt.Errorf("api keys: API_KEYS: %s: %w", name, err)
+	}
+	return k, nil
+}
+
+func checkAPIKeyScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, s := range scopes {
+		if !slices.Contains(apiKeyScopes, s) {
+			return fmt.Errorf("unknown scope %q: expected %s", s, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// byName — ключ с именем name. Вызывается под reg.mu или до начала работы.
+func (reg *apiKeyRegistry) byName(name string) *apiKey {
+	for _, k := range reg.keys {
+		if k.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+// save переписывает файл ключей без статических. Вызывается под reg.mu.
+func (reg *apiKeyRegistry) save() error {
+	keys := make([]apiKey, 0, len(reg.keys))
+	for _, k := range reg.keys {
+		if !k.Static {
+			stored := *k
+			stored.LastUsedAt = nil
+			keys = append(keys, stored)
+		}
+	}
+	slices.SortFunc(keys, func(a, b apiKey) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	body, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(reg.opts.Path, body); err != nil {
+		return fmt.Errorf("api keys: save %s: %w", reg.opts.Path, err)
+	}
+	return nil
+}
+
+// authenticate — ключ, которому соответствует key; nil — такого нет, отозван или истёк.
+func (reg *apiKeyRegistry) authenticate(key string) *apiKey {
+	hash := hashAPIKey(key)
+	now := time.Now()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, k := range reg.keys {
+		if k.matches(hash, now) {
+			k.LastUsedAt = &now
+			found := k.public()
+			return &found
+		}
+	}
+	return nil
+}
+
+func (reg *apiKeyRegistry) create(name string, scopes []string, tenant string, expiresAt *time.Time, commandsPerDay int64) (apiKey, error) {
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		return apiKey{}, err
+	}
+	k := &apiKey{ID: uuid.NewString(), Name: name, Scopes: scopes, Tenant: tenant, Hash: hashAPIKey(secret), CreatedAt: time.Now().UTC(), ExpiresAt: expiresAt,
+		CommandsPerDay: commandsPerDay}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.byName(name) != nil {
+		return apiKey{}, errAPIKeyExists
+	}
+	reg.keys[k.ID] = k
+	if err := reg.save(); err != nil {
+		delete(reg.keys, k.ID)
+		return apiKey{}, err
+	}
+	created := k.public()
+	created.Key = secret
+	return created, nil
+}
+
+// rotate выдаёт ключу новое значение; прежнее действует ещё grace.
+func (reg *apiKeyRegistry) rotate(id string, grace time.Duration) (apiKey, error) {
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		return apiKey{}, err
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	k, ok := reg.keys[id]
+	switch {
+	case !ok:
+		return apiKey{}, errAPIKeyNotFound
+	case k.Static:
+		return apiKey{}, errAPIKeyStatic
+	}
+	before := *k
+	now := time.Now().UTC()
+	until := now.Add(grace)
+	k.PreviousHash, k.PreviousUntil = k.Hash, &until
+	k.Hash, k.RotatedAt = hashAPIKey(secret), &now
+	if err := reg.save(); err != nil {
+		*k = before
+		return apiKey{}, err
+	}
+	rotated := k.public()
+	rotated.Key = secret
+	return rotated, nil
+}
+
+func (reg *apiKeyRegistry) remove(id string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	k, ok := reg.keys[id]
+	switch {
+	case !ok:
+		return errAPIKeyNotFound
+	case k.Static:
+		return errAPIKeyStatic
+	}
+	delete(reg.keys, id)
+	if err := reg.save(); err != nil {
+		reg.keys[id] = k
+		return err
+	}
+	return nil
+}
+
+func (reg *apiKeyRegistry) list() []apiKey {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	keys := make([]apiKey, 0, len(reg.keys))
+	for _, k := range reg.keys {
+		keys = append(keys, k.public())
+	}
+	slices.SortFunc(keys, func(a, b apiKey) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return keys
+}
+
+// commandsPerDay — квота команд в сутки ключа name; 0 — ключа нет или квота общая.
+func (reg *apiKeyRegistry) commandsPerDay(name string) int64 {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if k := reg.byName(name); k != nil {
+		return k.CommandsPerDay
+	}
+	return 0
+}
+
+type apiKeyCtxKey struct{}
+
+// apiKeyFrom — ключ, которым аутентифицирован запрос; nil — без ключа.
+func apiKeyFrom(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyCtxKey{}).(*apiKey)
+	return k
+}
+
+// apiKeyActor — автор команд, отданных с ключом.
+func apiKeyActor(k *apiKey) string { return "apikey:" + k.Name }
+
+// middleware — звено mux перед JWT: запрос с ключом JWT уже не проверяет.
+func (reg *apiKeyRegistry) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr := mux.CurrentRoute(r)
+		if cr == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, err := cr.GetPathTemplate()
+		if err != nil || probeRoutes[route] || publicRoutes[route] {
+			next.ServeHTTP(w, r) // прослойка registerLegacyAPI: ключ проверит переписанный запрос
+			return
+		}
+		if clientCertFrom(r.Context()) != "" {
+			next.ServeHTTP(w, r) // аутентифицирован сертификатом (mtls.go)
+			return
+		}
+		secret := r.Header.Get("X-API-Key")
+		if secret == "" {
+			if reg.opts.Required && auth == nil {
+				writeError(w, fmt.Errorf("%w: X-API-Key is required", errInvalidAPIKey), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		k := reg.authenticate(secret)
+		if k == nil {
+			slog.InfoContext(r.Context(), "api keys: key rejected", "path", r.URL.Path)
+			writeError(w, fmt.Errorf("%w: unknown, revoked or expired X-API-Key", errInvalidAPIKey), http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set("X-User-ID", apiKeyActor(k)) // как у JWT: видят и внешние звенья
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, k)))
+	})
+}
+
+// grpcAPIKey проверяет x-api-key вызова; ok — ключа нет, решает JWT.
+func grpcAPIKey(ctx context.Context, method string) (context.Context, bool, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get("x-api-key")
+	if apiKeys == nil || len(v) == 0 {
+		if apiKeys != nil && apiKeys.opts.Required && auth == nil && !strings.HasPrefix(method, "/grpc.reflection.") {
+			return nil, false, status.Error(codes.Unauthenticated, "x-api-key is required")
+		}
+		return ctx, true, nil
+	}
+	k := apiKeys.authenticate(v[0])
+	if k == nil {
+		return nil, false, status.Error(codes.Unauthenticated, "unknown, revoked or expired x-api-key")
+	}
+	md = md.Copy()
+	md.Set("x-user-id", apiKeyActor(k))
+	ctx = metadata.NewIncomingContext(ctx, md)
+	return context.WithValue(ctx, apiKeyCtxKey{}, k), false, nil
+}
+
+// --- API key Handlers ---
+
+// createAPIKeyBody — тело POST /admin/api-keys.
+type createAPIKeyBody struct {
+	Name           string     `json:"name"`
+	Scopes         []string   `json:"scopes"`
+	Tenant         string     `json:"tenant,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	CommandsPerDay int64      `json:"commands_per_day,omitempty"`
+}
+
+func apiKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errAPIKeyNotFound):
+		writeError(w, err, http.StatusNotFound)
+	case errors.Is(err, errAPIKeyExists), errors.Is(err, errAPIKeyStatic):
+		writeError(w, err, http.StatusConflict)
+	default:
+		writeError(w, err, http.StatusInternalServerError)
+	}
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyBody
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || strings.ContainsAny(req.Name, "=:,") {
+		httpError(w, "name is required and must not contain '=', ':' or ','", http.StatusBadRequest)
+		return
+	}
+	if err := checkAPIKeyScopes(req.Scopes); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		httpError(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+	if req.CommandsPerDay < 0 {
+		httpError(w, "commands_per_day must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Tenant != "" && !tenantPattern.MatchString(req.Tenant) {
+		writeError(w, fmt.Errorf("%w %q: expected %s", errInvalidTenant, req.Tenant, tenantPattern), http.StatusBadRequest)
+		return
+	}
+	k, err := apiKeys.create(req.Name, req.Scopes, req.Tenant, req.ExpiresAt, req.CommandsPerDay)
+	if err != nil {
+		apiKeyError(w, err)
+		return
+	}
+	w.Header().Set("Location", apiVersionPrefix+"/admin/api-keys/"+k.ID)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(k)
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(apiKeys.list())
+}
+
+func rotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	k, err := apiKeys.rotate(mux.Vars(r)["id"], apiKeys.opts.Grace)
+	if err != nil {
+		apiKeyError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(k)
+}
+
+func deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := apiKeys.remove(mux.Vars(r)["id"]); err != nil {
+		apiKeyError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// --- Cold storage (S3) ---
+// Старые события выгружаются из горячего хранилища в gzip-сегменты (JSONL) в S3.
+// manifest.json перечисляет сегменты по порядку; Load склеивает архив и горячий журнал.
+
+// prefixTrimmer — горячие хранилища, умеющие удалить первые n событий журнала.
+type prefixTrimmer interface {
+	TrimPrefix(ctx context.Context, n int) error
+}
+
+type archiveSegment struct {
+	Key     string    `json:"key"`
+	Count   int       `json:"count"`
+	Bytes   int64     `json:"bytes"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Head    string    `json:"head"`         // eventKey первого события сегмента
+	Trimmed bool      `json:"trimmed"`      // события уже удалены из горячего хранилища
+	To      int64     `json:"to,omitempty"` // позиция последнего события; 0 у сегментов до появления позиций
+}
+
+type archiveManifest struct {
+	Segments []archiveSegment `json:"segments"`
+}
+
+type archiveOptions struct {
+	Bucket   string
+	Prefix   string
+	Endpoint string // MinIO и прочие S3-совместимые хранилища
+	Region   string
+	After    time.Duration // возраст, после которого событие уходит в архив
+	Interval time.Duration
+	Batch    int // максимум событий в одном сегменте
+}
+
+type archiveStore struct {
+	hot  EventStore
+	trim prefixTrimmer
+	s3   *s3.Client
+	opts archiveOptions
+
+	mu sync.Mutex // чтения и архивация видят согласованные manifest и горячий журнал
+}
+
+func newArchiveStore(ctx context.Context, hot EventStore, opts archiveOptions) (*archiveStore, error) {
+	trim, ok := hot.(prefixTrimmer)
+	if !ok {
+		return nil, fmt.Errorf("archive: %T does not support trimming", hot)
+	}
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(opts.Region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("archive: load aws config: %w", err)
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	a := &archiveStore{hot: hot, trim: trim, s3: client, opts: opts}
+	if _, err := a.manifest(ctx); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func eventKey(e Event) string {
+	return string(e.Type) + "|" + e.OrderID + "|" + e.Timestamp.UTC().Format(time.RFC3339Nano)
+}
+
+func (a *archiveStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	return a.hot.Append(ctx, e, expected)
+}
+
+func (a *archiveStore) Subscribe(fn func(Event)) func() {
+	return a.hot.Subscribe(fn)
+}
+
+func (a *archiveStore) Load(ctx context.Context) ([]Event, error) {
+	return a.load(ctx, eventQuery{}, func(Event) bool { return true }, a.hot.Load)
+}
+
+func (a *archiveStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	events, err := a.load(ctx, eventQuery{After: after, Limit: limit},
+		func(e Event) bool { return e.Position > after },
+		func(ctx context.Context) ([]Event, error) { return a.hot.LoadAfter(ctx, after, limit) })
+	return limitEvents(events, limit), err
+}
+
+func (a *archiveStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	events, err := a.load(ctx, q, q.matches,
+		func(ctx context.Context) ([]Event, error) { return a.hot.QueryEvents(ctx, q) })
+	return limitEvents(events, q.Limit), err
+}
+
+func (a *archiveStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return a.load(ctx, eventQuery{},
+		func(e Event) bool { return e.OrderID == orderID },
+		func(ctx context.Context) ([]Event, error) { return a.hot.LoadByOrder(ctx, orderID) })
+}
+
+func (a *archiveStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	return a.load(ctx, eventQuery{},
+		func(e Event) bool { return e.OrderID == orderID && e.Version > after },
+		func(ctx context.Context) ([]Event, error) { return a.hot.LoadByOrderAfter(ctx, orderID, after) })
+}
+
+// load склеивает подходящие под match события архива и горячего журнала;
+// сегменты, целиком лежащие до позиции q.After или вне интервала [q.Since, q.Until), не читаются.
+// Набрав q.Limit событий из архива (q.Limit > 0), load не идёт дальше; обрезать результат до
+// q.Limit — забота вызывающего.
+func (a *archiveStore) load(ctx context.Context, q eventQuery, match func(Event) bool, hot func(context.Context) ([]Event, error)) ([]Event, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m, err := a.manifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []Event
+	for _, seg := range m.Segments {
+		if seg.Count == 0 || (seg.To != 0 && seg.To <= q.After) ||
+			(!q.Since.IsZero() && seg.Last.Before(q.Since)) || (!q.Until.IsZero() && !seg.First.Before(q.Until)) {
+			continue
+		}
+		events, err := a.readSegment(ctx, seg.Key)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			if match(e) {
+				out = append(out, e)
+			}
+		}
+		if q.Limit > 0 && len(out) >= q.Limit {
+			return out, nil
+		}
+	}
+
+	if n := len(m.Segments); n == 0 || m.Segments[n-1].Trimmed {
+		rest, err := hot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return append(out, rest...), nil
+	}
+	// последняя выгрузка не завершена: нужен полный горячий журнал, чтобы отбросить дубликаты
+	full, err := a.hot.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range full[a.pendingTrim(m, full):] {
+		if match(e) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// pendingTrim возвращает число событий в начале горячего журнала, которые уже лежат
+// в последнем сегменте, но ещё не удалены (процесс упал между выгрузкой и trim).
+func (a *archiveStore) pendingTrim(m archiveManifest, hot []Event) int {
+	if len(m.Segments) == 0 {
+		return 0
+	}
+	last := m.Segments[len(m.Segments)-1]
+	if last.Trimmed || len(hot) < last.Count || eventKey(hot[0]) != last.Head {
+		return 0
+	}
+	return last.Count
+}
+
+func (a *archiveStore) manifestKey() string {
+	return a.opts.Prefix + "manifest.json"
+}
+
+func (a *archiveStore) manifest(ctx context.Context) (archiveManifest, error) {
+	var m archiveManifest
+	out, err := a.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: &a.opts.Bucket, Key: aws.String(a.manifestKey())})
+	var noKey *types.NoSuchKey
+	if errors.As(err, &noKey) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("archive: get manifest: %w", err)
+	}
+	defer out.Body.Close()
+	if err := json.NewDecoder(out.Body).Decode(&m); err != nil {
+		return m, fmt.Errorf("archive: decode manifest: %w", err)
+	}
+	return m, nil
+}
+
+func (a *archiveStore) saveManifest(ctx context.Context, m archiveManifest) error {
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = a.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &a.opts.Bucket,
+		Key:         aws.String(a.manifestKey()),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("archive: put manifest: %w", err)
+	}
+	return nil
+}
+
+func (a *archiveStore) readSegment(ctx context.Context, key string) ([]Event, error) {
+	out, err := a.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: &a.opts.Bucket, Key: &key})
+	if err != nil {
+		return nil, fmt.Errorf("archive: get segment %s: %w", key, err)
+	}
+	defer out.Body.Close()
+	zr, err := gzip.NewReader(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("archive: segment %s: %w", key, err)
+	}
+	defer zr.Close()
+
+	var events []Event
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("archive: segment %s: %w", key, err)
+		}
+		events = append(events, e)
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("archive: segment %s: %w", key, err)
+	}
+	return events, nil
+}
+
+// finishTrim доводит до конца выгрузку, прерванную между сохранением manifest и trim,
+// и возвращает manifest и горячий журнал без дубликатов архива. Вызывается под a.mu.
+func (a *archiveStore) finishTrim(ctx context.Context) (archiveManifest, []Event, error) {
+	m, err := a.manifest(ctx)
+	if err != nil {
+		return m, nil, err
+	}
+	hot, err := a.hot.Load(ctx)
+	if err != nil {
+		return m, nil, err
+	}
+	if n := a.pendingTrim(m, hot); n > 0 {
+		slog.WarnContext(ctx, "archive: finishing interrupted trim", "events", n)
+		if err := a.trim.TrimPrefix(ctx, n); err != nil {
+			return m, nil, fmt.Errorf("archive: trim: %w", err)
+		}
+		hot = hot[n:]
+	}
+	if len(m.Segments) > 0 && !m.Segments[len(m.Segments)-1].Trimmed {
+		m.Segments[len(m.Segments)-1].Trimmed = true
+		if err := a.saveManifest(ctx, m); err != nil {
+			return m, nil, err
+		}
+	}
+	return m, hot, nil
+}
+
+// archiveOnce выгружает один сегмент из событий старше opts.After.
+// Возвращает число заархивированных событий.
+func (a *archiveStore) archiveOnce(ctx context.Context) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m, hot, err := a.finishTrim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-a.opts.After)
+	n := 0
+	for n < len(hot) && n < a.opts.Batch && hot[n].Timestamp.Before(cutoff) {
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	batch := hot[:n]
+
+	seg := archiveSegment{Key: fmt.Sprintf("%ssegments/%06d.jsonl.gz", a.opts.Prefix, len(m.Segments))}
+	if err := a.writeSegment(ctx, &seg, batch); err != nil {
+		return 0, err
+	}
+
+	// сначала manifest, потом trim: после падения pendingTrim отбросит дубликаты
+	m.Segments = append(m.Segments, seg)
+	if err := a.saveManifest(ctx, m); err != nil {
+		return 0, err
+	}
+	if err := a.trim.TrimPrefix(ctx, n); err != nil {
+		return 0, fmt.Errorf("archive: trim: %w", err)
+	}
+	m.Segments[len(m.Segments)-1].Trimmed = true
+	if err := a.saveManifest(ctx, m); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeSegment сжимает events в сегмент seg.Key и обновляет счётчики и границы seg.
+func (a *archiveStore) writeSegment(ctx context.Context, seg *archiveSegment, events []Event) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("archive: encode: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("archive: compress: %w", err)
+	}
+	_, err := a.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:          &a.opts.Bucket,
+		Key:             &seg.Key,
+		Body:            bytes.NewReader(buf.Bytes()),
+		ContentType:     aws.String("application/x-ndjson"),
+		ContentEncoding: aws.String("gzip"),
+	})
+	if err != nil {
+		return fmt.Errorf("archive: put segment: %w", err)
+	}
+	seg.Count, seg.Bytes = len(events), int64(buf.Len())
+	if n := len(events); n > 0 {
+		seg.First, seg.Last = events[0].Timestamp, events[n-1].Timestamp
+		seg.Head, seg.To = eventKey(events[0]), events[n-1].Position
+	}
+	return nil
+}
+
+// DeleteStreams переписывает сегменты, где есть события заказов, и удаляет потоки из горячего хранилища.
+// Опустевшие сегменты остаются в manifest: по их числу нумеруются новые.
+func (a *archiveStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	del, ok := a.hot.(streamDeleter)
+	if !ok {
+		return fmt.Errorf("archive: %T does not support deleting streams", a.hot)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m, _, err := a.finishTrim(ctx)
+	if err != nil {
+		return err
+	}
+	drop := make(map[string]bool, len(orderIDs))
+	for _, id := range orderIDs {
+		drop[id] = true
+	}
+	for i := range m.Segments {
+		if m.Segments[i].Count == 0 {
+			continue
+		}
+		events, err := a.readSegment(ctx, m.Segments[i].Key)
+		if err != nil {
+			return err
+		}
+		kept := events[:0]
+		for _, e := range events {
+			if !drop[e.OrderID] {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(events) {
+			continue
+		}
+		if err := a.writeSegment(ctx, &m.Segments[i], kept); err != nil {
+			return err
+		}
+		if err := a.saveManifest(ctx, m); err != nil {
+			return err
+		}
+	}
+	return del.DeleteStreams(ctx, orderIDs)
+}
+
+func (a *archiveStore) run(ctx context.Context) {
+	t := time.NewTicker(a.opts.Interval)
+	defer t.Stop()
+	for {
+		for {
+			n, err := a.archiveOnce(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "archive: run failed", "error", err)
+				break
+			}
+			if n == 0 {
+				break
+			}
+			slog.InfoContext(ctx, "archive: moved events", "events", n, "bucket", a.opts.Bucket, "prefix", a.opts.Prefix)
+			adminAudit.system("log.trim", map[string]string{"events": strconv.Itoa(n), "bucket": a.opts.Bucket, "prefix": a.opts.Prefix})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
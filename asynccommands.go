@@ -0,0 +1,222 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// --- Asynchronous commands ---
+// Команда REST с заголовком Prefer: respond-async (RFC 7240) не выполняется в запросе: она ставится
+// в очередь, ответ — 202 Accepted с id команды и Location: /v1/commands/{id}. Пул исполнителей отправляет
+// команды из очереди в ту же шину, а GET /commands/{id} показывает состояние: pending, succeeded
+// (с версией и позицией события) или failed (с ошибкой и кодом, которым ответил бы синхронный запрос).
+// Очередь и состояния живут в памяти: после перезапуска невыполненные команды теряются, поэтому
+// клиенту, которому важна доставка, нужен Idempotency-Key, с которым команду безопасно отправить снова.
+
+type asyncCommandState string
+
+const (
+	asyncPending   asyncCommandState = "pending"
+	asyncSucceeded asyncCommandState = "succeeded"
+	asyncFailed    asyncCommandState = "failed"
+)
+
+// asyncCommand — состояние команды, принятой с respond-async.
+type asyncCommand struct {
+	ID          string            `json:"id"`
+	Command     string            `json:"command"`
+	State       asyncCommandState `json:"state"`
+	OrderID     string            `json:"order_id,omitempty"`
+	Version     int64             `json:"version,omitempty"`
+	Position    int64             `json:"position,omitempty"`
+	Replayed    bool              `json:"replayed,omitempty"`
+	StatusCode  int               `json:"status_code,omitempty"` // код ответа синхронного запроса
+	Error       string            `json:"error,omitempty"`
+	Code        string            `json:"code,omitempty"` // code ошибки, как в problem+json
+	SubmittedAt time.Time         `json:"submitted_at"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty"`
+
+	tenant string // арендатор команды (tenancy.go); чужая команда для запроса не существует
+}
+
+type asyncOptions struct {
+	Workers   int
+	QueueSize int
+	Retention time.Duration // сколько хранить состояние выполненной команды
+}
+
+var errQueueFull = errors.New("command queue is full")
+
+type queuedCommand struct {
+	id      string
+	ctx     context.Context
+	command Command
+	status  int // код успешного ответа синхронного запроса
+}
+
+type commandQueue struct {
+	opts  asyncOptions
+	queue chan queuedCommand
+
+	workers sync.WaitGroup
+
+	mu       sync.Mutex
+	closed   bool // остановка: новые команды не принимаются
+	statuses map[string]*asyncCommand
+}
+
+func newCommandQueue(opts asyncOptions) *commandQueue {
+	return &commandQueue{opts: opts, queue: make(chan queuedCommand, opts.QueueSize), statuses: map[string]*asyncCommand{}}
+}
+
+var asyncCommands *commandQueue
+
+// start запускает исполнителей очереди до отмены ctx.
+func (q *commandQueue) start(ctx context.Context) {
+	for range q.opts.Workers {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case qc, ok := <-q.queue:
+					if !ok {
+						return
+					}
+					q.run(qc)
+				}
+			}
+		}()
+	}
+}
+
+// stop перестаёт принимать команды и дожидается, пока исполнители выполнят очередь.
+func (q *commandQueue) stop(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d commands not run: %w", len(q.queue), ctx.Err())
+	}
+}
+
+// submit ставит команду в очередь; status — код, которым ответил бы синхронный запрос при успехе.
+// Контекст запроса не отменяет команду после ответа 202, но его значения (трассировка и т. п.) сохраняются.
+func (q *commandQueue) submit(ctx context.Context, c Command, status int) (asyncCommand, error) {
+	now := time.Now()
+	t := c.Target()
+	ac := &asyncCommand{ID: uuid.New().String(), Command: c.CommandName(), State: asyncPending, OrderID: t.OrderID, SubmittedAt: now,
+		tenant: cmp.Or(t.Metadata.Tenant, orderTenant(t.OrderID))}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return asyncCommand{}, errShuttingDown
+	}
+	q.prune(now)
+	select {
+	case q.queue <- queuedCommand{id: ac.ID, ctx: context.WithoutCancel(ctx), command: c, status: status}:
+	default:
+		q.mu.Unlock()
+		return asyncCommand{}, errQueueFull
+	}
+	q.statuses[ac.ID] = ac
+	out := *ac
+	q.mu.Unlock()
+	return out, nil
+}
+
+func (q *commandQueue) run(qc queuedCommand) {
+	stored, replayed, err := bus.Dispatch(qc.ctx, qc.command)
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ac, ok := q.statuses[qc.id]
+	if !ok {
+		return
+	}
+	ac.CompletedAt = &now
+	if err != nil {
+		ac.State, ac.Error, ac.StatusCode = asyncFailed, err.Error(), commandErrorStatus(err)
+		ac.Code = errorCode(err, ac.StatusCode)
+		return
+	}
+	ac.State, ac.StatusCode, ac.Replayed = asyncSucceeded, qc.status, replayed
+	ac.OrderID, ac.Version, ac.Position = stored.OrderID, stored.Version, stored.Position
+}
+
+// prune забывает выполненные команды старше opts.Retention; вызывается под q.mu.
+func (q *commandQueue) prune(now time.Time) {
+	for id, ac := range q.statuses {
+		if ac.CompletedAt != nil && now.Sub(*ac.CompletedAt) > q.opts.Retention {
+			delete(q.statuses, id)
+		}
+	}
+}
+
+func (q *commandQueue) get(id string) (asyncCommand, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ac, ok := q.statuses[id]
+	if !ok {
+		return asyncCommand{}, false
+	}
+	return *ac, true
+}
+
+// prefersAsync — клиент попросил асинхронное выполнение (Prefer: respond-async).
+func prefersAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(p), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// submitCommand ставит команду в очередь и отвечает 202 с её состоянием; переполненная очередь
+// или остановка сервиса — 503.
+func submitCommand(w http.ResponseWriter, r *http.Request, c Command, status int) {
+	ac, err := asyncCommands.submit(r.Context(), c, status)
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Location", apiVersionPrefix+"/commands/"+ac.ID)
+	w.Header().Set("Preference-Applied", "respond-async")
+	writeBody(w, r, http.StatusAccepted, ac)
+}
+
+// getCommandStatus отдаёт состояние асинхронной команды; неизвестная или уже забытая команда — 404.
+func getCommandStatus(w http.ResponseWriter, r *http.Request) {
+	ac, ok := asyncCommands.get(mux.Vars(r)["id"])
+	if !ok || !tenantSees(r.Context(), ac.tenant) {
+		httpError(w, "command not found", http.StatusNotFound)
+		return
+	}
+	writeBody(w, r, http.StatusOK, ac)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// --- Command audit trail ---
+// Каждая команда, пришедшая в шину, попадает в журнал аудита: кто (actor), когда, хеш содержимого
+// команды, итог и код, которым ответил бы REST. Журнал отделён от журнала событий: в нём есть и
+// отклонённые команды, которые событий не пишут, а содержимого команды нет — только SHA-256 его JSON
+// без метаданных, так что одинаковые команды дают одинаковый хеш, а персональные данные не копируются.
+// С AUDIT_LOG_PATH записи дописываются в JSONL-файл и читаются из него при запуске; в памяти
+// держатся последние AUDIT_MAX (recordlog.go). GET /admin/commands отдаёт их страницами с фильтрами.
+
+type auditOutcome string
+
+const (
+	auditSucceeded auditOutcome = "succeeded"
+	auditReplayed  auditOutcome = "replayed"
+	auditFailed    auditOutcome = "failed"
+)
+
+// auditRecord — запись журнала аудита об одной команде.
+type auditRecord struct {
+	Seq            int64        `json:"seq"` // номер записи, курсор ?after
+	Command        string       `json:"command"`
+	OrderID        string       `json:"order_id,omitempty"`
+	Actor          string       `json:"actor,omitempty"`
+	CorrelationID  string       `json:"correlation_id,omitempty"`
+	IdempotencyKey string       `json:"idempotency_key,omitempty"`
+	PayloadHash    string       `json:"payload_hash"` // sha256 JSON команды без metadata
+	Outcome        auditOutcome `json:"outcome"`
+	StatusCode     int          `json:"status_code,omitempty"` // код ответа REST для неудачной команды
+	Error          string       `json:"error,omitempty"`
+	Version        int64        `json:"version,omitempty"`
+	ReceivedAt     time.Time    `json:"received_at"`
+	DurationMs     float64      `json:"duration_ms"`
+}
+
+// auditStore — журнал аудита команд (recordlog.go); opts.Path — AUDIT_LOG_PATH.
+type auditStore struct {
+	recordLog[auditRecord]
+}
+
+var audit = &auditStore{recordLog[auditRecord]{
+	name: "audit", seqOf: func(r *auditRecord) *int64 { return &r.Seq }, opts: auditOptions{Max: 10000},
+}}
+
+// payloadHash — SHA-256 JSON команды без metadata: correlation id и автор от повтора к повтору меняются.
+func payloadHash(c Command) string {
+	var fields map[string]json.RawMessage
+	data, _ := json.Marshal(c)
+	if json.Unmarshal(data, &fields) == nil {
+		delete(fields, "metadata")
+		data, _ = json.Marshal(fields) // ключи map сериализуются по порядку
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// record — звено шины, которое пишет каждую команду и её итог в журнал аудита.
+func (a *auditStore) record(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		start := time.Now()
+		stored, replayed, err := next(ctx, c)
+		t := c.Target()
+		rec := auditRecord{
+			Command: c.CommandName(), OrderID: t.OrderID, Actor: t.Metadata.Actor, CorrelationID: t.Metadata.CorrelationID,
+			IdempotencyKey: t.Key, PayloadHash: payloadHash(c), Outcome: auditSucceeded,
+			ReceivedAt: start, DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		switch {
+		case err != nil:
+			rec.Outcome, rec.Error, rec.StatusCode = auditFailed, err.Error(), commandErrorStatus(err)
+		case replayed:
+			rec.Outcome = auditReplayed
+		}
+		if err == nil {
+			rec.OrderID, rec.Version = stored.OrderID, stored.Version
+		}
+		a.append(rec)
+		return stored, replayed, err
+	}
+}
+
+// auditQuery — фильтр GET /admin/commands; пустые поля не фильтруют.
+type auditQuery struct {
+	After        int64
+	Limit        int
+	Command      string
+	OrderID      string
+	Actor        string
+	Outcome      auditOutcome
+	Since, Until time.Time
+}
+
+func (q auditQuery) match(rec auditRecord) bool {
+	return rec.Seq > q.After &&
+		(q.Command == "" || rec.Command == q.Command) &&
+		(q.OrderID == "" || rec.OrderID == q.OrderID) &&
+		(q.Actor == "" || rec.Actor == q.Actor) &&
+		(q.Outcome == "" || rec.Outcome == q.Outcome) &&
+		(q.Since.IsZero() || !rec.ReceivedAt.Before(q.Since)) &&
+		(q.Until.IsZero() || rec.ReceivedAt.Before(q.Until))
+}
+
+func (a *auditStore) query(q auditQuery) []auditRecord {
+	return a.find(q.match, q.Limit)
+}
+
+// getAuditCommands отдаёт журнал аудита страницами в порядке поступления: ?after=<seq>, ?limit=<n> и фильтры
+// ?command, ?order_id, ?actor, ?outcome, ?since/?until (RFC 3339). Полная страница — со ссылкой Link rel="next".
+func getAuditCommands(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	aq := auditQuery{
+		Limit: eventsPageSize, Command: q.Get("command"), OrderID: q.Get("order_id"),
+		Actor: q.Get("actor"), Outcome: auditOutcome(q.Get("outcome")),
+	}
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			httpError(w, fmt.Sprintf("invalid after %q: expected audit seq", v), http.StatusBadRequest)
+			return
+		}
+		aq.After = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > eventsPageSizeMax {
+			httpError(w, fmt.Sprintf("invalid limit %q: expected 1..%d", v, eventsPageSizeMax), http.StatusBadRequest)
+			return
+		}
+		aq.Limit = n
+	}
+	switch aq.Outcome {
+	case "", auditSucceeded, auditReplayed, auditFailed:
+	default:
+		httpError(w, fmt.Sprintf("invalid outcome %q: expected succeeded, replayed or failed", aq.Outcome), http.StatusBadRequest)
+		return
+	}
+	for name, t := range map[string]*time.Time{"since": &aq.Since, "until": &aq.Until} {
+		if v := q.Get(name); v != "" {
+			ts, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				httpError(w, fmt.Sprintf("invalid %s %q: expected RFC 3339 time", name, v), http.StatusBadRequest)
+				return
+			}
+			*t = ts
+		}
+	}
+	records := audit.query(aq)
+	if len(records) == aq.Limit {
+		next := url.Values{}
+		for k, v := range q {
+			next[k] = v
+		}
+		next.Set("after", strconv.FormatInt(records[len(records)-1].Seq, 10))
+		next.Set("limit", strconv.Itoa(aq.Limit))
+		w.Header().Add("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	writeBody(w, r, http.StatusOK, records)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Backup and restore ---
+// Резервная копия — весь журнал в JSONL, по записи на строку: заголовок, события по порядку позиций и
+// завершающая запись. У каждого события — sha256 его JSON, у завершающей записи — число событий и sha256
+// всех событий подряд, так что обрыв, порча и перестановка строк видны при проверке. События пишутся
+// в том виде, в каком их читает сервис: расшифрованными и приведёнными к текущей схеме, поэтому копию
+// можно восстановить в любой backend с другими ключами шифрования — и хранить её нужно как персональные
+// данные. Стёртые покупатели в копии остаются стёртыми.
+//
+// POST /admin/backup отдаёт копию потоком до последнего события на момент запроса; ошибка посреди
+// потока видна клиенту по отсутствию завершающей записи. Те же операции — подкомандами:
+//
+//	tsc-p7-cqrs backup [-server URL] [FILE]  — копия в FILE (по умолчанию stdout): из хранилища или с сервера
+//	tsc-p7-cqrs verify FILE                  — проверить копию
+//	tsc-p7-cqrs restore FILE                 — проверить копию и записать её в пустое хранилище
+//
+// Restore пишет события с теми же версиями потоков и временем, позиции назначает новое хранилище.
+// Сервис при запуске на нём строит проекции заново, а релеи outbox начинают с конца журнала
+// и не публикуют восстановленные события повторно.
+
+const (
+	backupFormat  = "tsc-p7-cqrs-backup"
+	backupVersion = 1
+	backupPage    = 1000
+)
+
+type backupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Source    string    `json:"source"`         // EVENT_STORE, из которого снята копия
+	Until     int64     `json:"until_position"` // позиция последнего события на момент начала
+}
+
+type backupTrailer struct {
+	Events       int64  `json:"events"`
+	LastPosition int64  `json:"last_position"`
+	SHA256       string `json:"sha256"` // всех строк event подряд
+}
+
+// backupRecord — строка копии; заполнено ровно одно из Header, Event, Trailer.
+type backupRecord struct {
+	Header  *backupHeader   `json:"header,omitempty"`
+	Event   json.RawMessage `json:"event,omitempty"`
+	SHA256  string          `json:"sha256,omitempty"` // события
+	Trailer *backupTrailer  `json:"trailer,omitempty"`
+}
+
+// writeBackup пишет копию журнала es до последнего события на момент вызова.
+func writeBackup(ctx context.Context, es EventStore, source string, w io.Writer) (backupTrailer, error) {
+	until, err := lastStorePosition(ctx, es)
+	if err != nil {
+		return backupTrailer{}, err
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(backupRecord{Header: &backupHeader{
+		Format: backupFormat, Version: backupVersion, CreatedAt: time.Now().UTC(), Source: source, Until: until,
+	}}); err != nil {
+		return backupTrailer{}, err
+	}
+	total := sha256.New()
+	var tr backupTrailer
+	for after := int64(0); after < until; {
+		page, err := es.LoadAfter(ctx, after, backupPage)
+		if err != nil {
+			return tr, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, e := range page {
+			if e.Position > until {
+				break
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return tr, err
+			}
+			sum := sha256.Sum256(data)
+			total.Write(data)
+			if err := enc.Encode(backupRecord{Event: data, SHA256: hex.EncodeToString(sum[:])}); err != nil {
+				return tr, err
+			}
+			tr.Events++
+			tr.LastPosition = e.Position
+		}
+		after = page[len(page)-1].Position
+	}
+	tr.SHA256 = hex.EncodeToString(total.Sum(nil))
+	return tr, enc.Encode(backupRecord{Trailer: &tr})
+}
+
+// lastStorePosition — позиция последнего события журнала es.
+func lastStorePosition(ctx context.Context, es EventStore) (int64, error) {
+	var position int64
+	for {
+		page, err := es.LoadAfter(ctx, position, backupPage)
+		if err != nil || len(page) == 0 {
+			return position, err
+		}
+		position = page[len(page)-1].Position
+	}
+}
+
+// createBackup отдаёт POST /admin/backup.
+func createBackup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="backup-%s.jsonl"`, time.Now().UTC().Format("20060102T150405Z")))
+	w.Header().Set("Cache-Control", "no-store")
+	bw := bufio.NewWriterSize(w, 64<<10)
+	tr, err := writeBackup(r.Context(), store, getenv("EVENT_STORE", "memory"), bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// заголовок уже отправлен: клиент узнает об ошибке по отсутствию завершающей записи
+		slog.ErrorContext(r.Context(), "backup: failed", "events", tr.Events, "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "backup: written", "events", tr.Events, "last_position", tr.LastPosition)
+}
+
+// readBackup проверяет копию из r и передаёт её события fn по порядку; ошибка fn прерывает чтение.
+// Копия без завершающей записи или с неверной суммой — ошибка, но fn к этому моменту уже видел события:
+// перед записью копию нужно проверить отдельным проходом.
+func readBackup(r io.Reader, fn func(Event) error) (backupHeader, backupTrailer, error) {
+	var hdr backupHeader
+	var tr *backupTrailer
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	total := sha256.New()
+	var events, last int64
+	versions := map[string]int64{}
+	for line := 1; sc.Scan(); line++ {
+		var rec backupRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return hdr, backupTrailer{}, fmt.Errorf("backup: line %d: %w", line, err)
+		}
+		switch {
+		case line == 1:
+			if rec.Header == nil || rec.Header.Format != backupFormat {
+				return hdr, backupTrailer{}, errors.New("backup: not a backup file: first line has no header")
+			}
+			if rec.Header.Version != backupVersion {
+				return hdr, backupTrailer{}, fmt.Errorf("backup: unsupported version %d", rec.Header.Version)
+			}
+			hdr = *rec.Header
+			continue
+		case tr != nil:
+			return hdr, backupTrailer{}, fmt.Errorf("backup: line %d: data after the trailer", line)
+		case rec.Trailer != nil:
+			tr = rec.Trailer
+			continue
+		case rec.Event == nil:
+			return hdr, backupTrailer{}, fmt.Errorf("backup: line %d: empty record", line)
+		}
+		sum := sha256.Sum256(rec.Event)
+		if hex.EncodeToString(sum[:]) != rec.SHA256 {
+			return hdr, backupTrailer{}, fmt.Errorf("backup: line %d: checksum mismatch", line)
+		}
+		var e Event
+		if err := json.Unmarshal(rec.Event, &e); err != nil {
+			return hdr, backupTrailer{}, fmt.Errorf("backup: line %d: %w", line, err)
+		}
+		if e.Position <= last {
+			return hdr, backupTrailer{}, fmt.Errorf("backup: line %d: position %d after %d", line, e.Position, last)
+		}
+		if e.Version != versions[e.StreamID]+1 {
+			return hdr, backupTrailer{}, fmt.Errorf("backup: line %d: %s version %d after %d", line, e.StreamID, e.Version, versions[e.StreamID])
+		}
+		total.Write(rec.Event)
+		events, last, versions[e.StreamID] = events+1, e.Position, e.Version
+		if err := fn(e); err != nil {
+			return hdr, backupTrailer{}, fmt.Errorf("backup: line %d: %w", line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return hdr, backupTrailer{}, fmt.Errorf("backup: %w", err)
+	}
+	switch {
+	case tr == nil:
+		return hdr, backupTrailer{}, errors.New("backup: no trailer: the file is truncated")
+	case tr.Events != events || tr.LastPosition != last:
+		return hdr, *tr, fmt.Errorf("backup: trailer expects %d events up to position %d, file has %d up to %d", tr.Events, tr.LastPosition, events, last)
+	case tr.SHA256 != hex.EncodeToString(total.Sum(nil)):
+		return hdr, *tr, errors.New("backup: checksum of the events does not match the trailer")
+	}
+	return hdr, *tr, nil
+}
+
+// restoreBackup проверяет копию path и записывает её события в пустое хранилище es.
+func restoreBackup(ctx context.Context, es EventStore, path string) (backupTrailer, error) {
+	verify := func() (backupHeader, backupTrailer, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return backupHeader{}, backupTrailer{}, err
+		}
+		defer f.Close()
+		return readBackup(f, func(Event) error { return nil })
+	}
+	hdr, tr, err := verify()
+	if err != nil {
+		return tr, err
+	}
+	existing, err := es.LoadAfter(ctx, 0, 1)
+	if err != nil {
+		return tr, err
+	}
+	if len(existing) > 0 {
+		return tr, errors.New("restore: the event store is not empty")
+	}
+	slog.Info("restore: backup verified", "events", tr.Events, "source", hdr.Source, "created_at", hdr.CreatedAt)
+	f, err := os.Open(path)
+	if err != nil {
+		return tr, err
+	}
+	defer f.Close()
+	var written int64
+	_, _, err = readBackup(f, func(e Event) error {
+		e.Position = 0
+		if _, err := es.Append(ctx, e, e.Version-1); err != nil {
+			return err
+		}
+		if written++; written%10000 == 0 {
+			slog.Info("restore: progress", "events", written, "total", tr.Events)
+		}
+		return nil
+	})
+	if err != nil {
+		return tr, fmt.Errorf("restore: stopped after %d events: %w", written, err)
+	}
+	return tr, nil
+}
+
+// runTool выполняет подкоманду args[0] вместо запуска сервиса.
+func runTool(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: cqrsctl [flags] backup|verify|restore|replay ...")
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "replay":
+		return runReplay(ctx, args[1:])
+	case "backup":
+		server := fs.String("server", "", "take the backup from a running service at this base URL instead of the event store")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return runBackup(ctx, *server, fs.Arg(0))
+	case "verify", "restore":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: %s FILE", args[0])
+		}
+		if args[0] == "verify" {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			hdr, tr, err := readBackup(f, func(Event) error { return nil })
+			if err != nil {
+				return err
+			}
+			slog.Info("verify: backup is intact", "events", tr.Events, "last_position", tr.LastPosition, "source", hdr.Source, "created_at", hdr.CreatedAt)
+			return nil
+		}
+		stores, err := openEventStore(ctx)
+		if err != nil {
+			return err
+		}
+		tr, err := restoreBackup(ctx, stores.events, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		slog.Info("restore: done", "events", tr.Events, "store", getenv("EVENT_STORE", "memory"))
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q: expected backup, verify, restore or replay", args[0])
+	}
+}
+
+// runBackup пишет копию в path ("" или "-" — stdout).
+func runBackup(ctx context.Context, server, path string) error {
+	out := io.Writer(os.Stdout)
+	if path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriterSize(out, 64<<10)
+	if server != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(server, "/")+apiVersionPrefix+"/admin/backup", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			return fmt.Errorf("backup: %s: %s", resp.Status, body)
+		}
+		// копия проверяется по пути: обрыв ответа не должен выглядеть успехом
+		_, tr, err := readBackup(io.TeeReader(resp.Body, bw), func(Event) error { return nil })
+		if err != nil {
+			return err
+		}
+		slog.Info("backup: written", "events", tr.Events, "last_position", tr.LastPosition, "server", server)
+		return bw.Flush()
+	}
+	stores, err := openEventStore(ctx)
+	if err != nil {
+		return err
+	}
+	tr, err := writeBackup(ctx, stores.events, getenv("EVENT_STORE", "memory"), bw)
+	if err != nil {
+		return err
+	}
+	slog.Info("backup: written", "events", tr.Events, "last_position", tr.LastPosition)
+	return bw.Flush()
+}
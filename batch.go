@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// --- Batch commands ---
+// POST /orders/batch принимает массив команд и выполняет их по очереди, каждую отдельно:
+// ошибка одной команды не отменяет остальные. Результат по каждой команде — в том же порядке,
+// со статусом, который вернул бы одиночный запрос. Заголовки метаданных общие для всего пакета.
+
+const batchMaxCommands = 1000
+
+type batchCommandType string
+
+const (
+	batchCreate  batchCommandType = "create"
+	batchPay     batchCommandType = "pay"
+	batchCancel  batchCommandType = "cancel"
+	batchRefund  batchCommandType = "refund"
+	batchShip    batchCommandType = "ship"
+	batchDeliver batchCommandType = "deliver"
+	batchCoupon  batchCommandType = "apply-coupon"
+)
+
+// batchCommands собирает команду шины из элемента пакета с уже проверенным адресом t.
+var batchCommands = map[batchCommandType]func(bc batchCommand, t CommandTarget) Command{
+	batchCreate: func(bc batchCommand, t CommandTarget) Command {
+		return CreateOrder{t, orderCreatedData{CustomerID: bc.CustomerID, Customer: bc.Customer, Items: bc.Items, Currency: bc.Currency}}
+	},
+	batchPay: func(bc batchCommand, t CommandTarget) Command {
+		return PayOrder{t, paymentRequest{Amount: bc.Amount, Currency: bc.Currency, PaymentMethod: bc.PaymentMethod}}
+	},
+	batchCancel: func(bc batchCommand, t CommandTarget) Command { return CancelOrder{CommandTarget: t} },
+	batchRefund: func(bc batchCommand, t CommandTarget) Command {
+		return RefundOrder{t, refundRequest{Amount: bc.Amount, Currency: bc.Currency, Reason: bc.Reason}}
+	},
+	batchShip: func(bc batchCommand, t CommandTarget) Command {
+		return ShipOrder{t, Shipment{Carrier: bc.Carrier, TrackingNumber: bc.TrackingNumber}}
+	},
+	batchDeliver: func(bc batchCommand, t CommandTarget) Command { return DeliverOrder{t} },
+	batchCoupon:  func(bc batchCommand, t CommandTarget) Command { return ApplyCoupon{t, bc.Coupon} },
+}
+
+type batchCommand struct {
+	Command         batchCommandType `json:"command"`
+	OrderID         string           `json:"order_id,omitempty"`         // все команды, кроме create
+	ExpectedVersion *int64           `json:"expected_version,omitempty"` // как If-Match; без него версия не проверяется
+	IdempotencyKey  string           `json:"idempotency_key,omitempty"`
+	CustomerID      string           `json:"customer_id,omitempty"`     // create
+	Customer        *Customer        `json:"customer,omitempty"`        // create
+	Items           []OrderItem      `json:"items,omitempty"`           // create
+	Currency        string           `json:"currency,omitempty"`        // create; у pay и refund сверяется с заказом
+	Amount          *int64           `json:"amount,omitempty"`          // pay и refund; без него — весь остаток к оплате (к возврату)
+	Reason          string           `json:"reason,omitempty"`          // refund
+	Carrier         string           `json:"carrier,omitempty"`         // ship
+	TrackingNumber  string           `json:"tracking_number,omitempty"` // ship
+	Coupon          string           `json:"coupon,omitempty"`          // apply-coupon
+	PaymentMethod   string           `json:"payment_method,omitempty"`  // pay, для платёжного шлюза
+}
+
+type batchResult struct {
+	Status         int    `json:"status"`
+	OrderID        string `json:"order_id,omitempty"`
+	Version        int64  `json:"version,omitempty"`
+	Position       int64  `json:"position,omitempty"`
+	Replayed       bool   `json:"replayed,omitempty"`
+	Error          string `json:"error,omitempty"`
+	Code           string `json:"code,omitempty"`            // code ошибки, как в problem+json
+	CurrentVersion *int64 `json:"current_version,omitempty"` // при конфликте версий
+}
+
+func executeBatch(w http.ResponseWriter, r *http.Request) {
+	var cmds []batchCommand
+	if err := readBody(r, &cmds); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(cmds) == 0 || len(cmds) > batchMaxCommands {
+		httpError(w, fmt.Sprintf("batch must contain 1..%d commands", batchMaxCommands), http.StatusBadRequest)
+		return
+	}
+	md := requestMetadata(w, r)
+	results := make([]batchResult, len(cmds))
+	for i, bc := range cmds {
+		c, err := bc.command(md)
+		if err != nil {
+			results[i] = batchResult{Status: http.StatusBadRequest, OrderID: bc.OrderID, Error: err.Error()}
+			continue
+		}
+		stored, replayed, err := bus.Dispatch(r.Context(), c)
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return // клиент ушёл, отвечать некому
+		}
+		results[i] = commandBatchResult(bc, stored, replayed, err)
+	}
+	writeBody(w, r, http.StatusOK, results)
+}
+
+// command проверяет адрес элемента пакета и собирает из него команду шины; содержимое команды проверяет её обработчик.
+func (bc batchCommand) command(md EventMetadata) (Command, error) {
+	build, ok := batchCommands[bc.Command]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q: expected %s, %s, %s, %s, %s, %s or %s", bc.Command,
+			batchCreate, batchPay, batchCancel, batchRefund, batchShip, batchDeliver, batchCoupon)
+	}
+	t := CommandTarget{OrderID: bc.OrderID, Expected: anyVersion, Key: bc.IdempotencyKey, Metadata: md}
+	if bc.Command == batchCreate {
+		if bc.OrderID != "" || bc.ExpectedVersion != nil {
+			return nil, errors.New("create does not take order_id or expected_version")
+		}
+		return build(bc, t), nil
+	}
+	switch {
+	case bc.OrderID == "":
+		return nil, errors.New("order_id is required")
+	case bc.ExpectedVersion == nil:
+	case *bc.ExpectedVersion < 0:
+		return nil, errors.New("expected_version must not be negative")
+	default:
+		t.Expected = *bc.ExpectedVersion
+	}
+	return build(bc, t), nil
+}
+
+// commandBatchResult переводит итог команды в элемент ответа, как writeCommandResult и writeCommandError — в ответ HTTP.
+func commandBatchResult(bc batchCommand, e Event, replayed bool, err error) batchResult {
+	var conflict *versionConflictError
+	switch {
+	case err == nil:
+		status := http.StatusOK
+		if bc.Command == batchCreate {
+			status = http.StatusCreated
+		}
+		return batchResult{Status: status, OrderID: e.OrderID, Version: e.Version, Position: e.Position, Replayed: replayed}
+	case errors.As(err, &conflict):
+		return batchResult{Status: http.StatusConflict, OrderID: bc.OrderID, Error: "version conflict", Code: "version_conflict", CurrentVersion: &conflict.Current}
+	default:
+		status := commandErrorStatus(err)
+		return batchResult{Status: status, OrderID: bc.OrderID, Error: err.Error(), Code: errorCode(err, status)}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// --- Bulk cancel ---
+// POST /admin/orders/cancel отменяет все заказы read model, подходящие под фильтр (по умолчанию — PENDING;
+// created_before/created_after — по времени создания). Каждый заказ отменяется отдельной командой CancelOrder
+// через шину, с версией заказа из read model в качестве ожидаемой: заказ, изменившийся после выборки, получает
+// 409 и не отменяется. У всех событий один correlation id — его можно передать в X-Correlation-ID или взять
+// из ответа. С Idempotency-Key ключ команды над заказом — <key>/<order id>, так что повтор запроса не отменяет
+// заказы дважды. dry_run только показывает, какие заказы подошли бы.
+
+// bulkCancelRequest — тело POST /admin/orders/cancel; пустые поля фильтра не фильтруют.
+type bulkCancelRequest struct {
+	Status        OrderStatus `json:"status,omitempty"` // по умолчанию PENDING
+	CustomerID    string      `json:"customer_id,omitempty"`
+	CreatedBefore *time.Time  `json:"created_before,omitempty"`
+	CreatedAfter  *time.Time  `json:"created_after,omitempty"`
+	Reason        string      `json:"reason,omitempty"`
+	Limit         int         `json:"limit,omitempty"` // 1..1000, по умолчанию 1000
+	DryRun        bool        `json:"dry_run,omitempty"`
+}
+
+// bulkCancelSummary — итог массовой отмены: результаты по заказам в порядке их id.
+type bulkCancelSummary struct {
+	CorrelationID string        `json:"correlation_id"`
+	DryRun        bool          `json:"dry_run,omitempty"`
+	Matched       int           `json:"matched"`             // сколько заказов подошло под фильтр
+	Truncated     bool          `json:"truncated,omitempty"` // подошло больше limit: обработаны первые limit
+	Canceled      int           `json:"canceled"`
+	Failed        int           `json:"failed"`
+	Results       []batchResult `json:"results"`
+}
+
+func (req bulkCancelRequest) validate() error {
+	if err := validStatus(req.Status); err != nil {
+		return err
+	}
+	if req.Limit < 0 || req.Limit > batchMaxCommands {
+		return fmt.Errorf("limit must be 1..%d", batchMaxCommands)
+	}
+	if req.CreatedBefore != nil && req.CreatedAfter != nil && !req.CreatedAfter.Before(*req.CreatedBefore) {
+		return errors.New("created_after must be before created_before")
+	}
+	return nil
+}
+
+// match — подходит ли заказ под фильтр по времени создания; статус и покупателя отбирает selectOrders.
+func (req bulkCancelRequest) match(o Order) bool {
+	return (req.CreatedBefore == nil || o.CreatedAt.Before(*req.CreatedBefore)) &&
+		(req.CreatedAfter == nil || !o.CreatedAt.Before(*req.CreatedAfter))
+}
+
+func bulkCancelOrders(w http.ResponseWriter, r *http.Request) {
+	var req bulkCancelRequest
+	if err := readBody(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if req.Status == "" {
+		req.Status = StatusPending
+	}
+	if req.Limit == 0 {
+		req.Limit = batchMaxCommands
+	}
+	candidates, _ := selectOrders(req.Status, req.CustomerID, tenantFrom(r.Context()), "", math.MaxInt)
+	var matched []Order
+	for _, o := range candidates {
+		if req.match(o) {
+			matched = append(matched, o)
+		}
+	}
+	md := requestMetadata(w, r)
+	sum := bulkCancelSummary{CorrelationID: md.CorrelationID, DryRun: req.DryRun, Matched: len(matched), Results: []batchResult{}}
+	if len(matched) > req.Limit {
+		matched, sum.Truncated = matched[:req.Limit], true
+	}
+	key := r.Header.Get("Idempotency-Key")
+	for _, o := range matched {
+		if req.DryRun {
+			sum.Results = append(sum.Results, batchResult{Status: http.StatusOK, OrderID: o.ID, Version: o.Version})
+			continue
+		}
+		t := CommandTarget{OrderID: o.ID, Expected: o.Version, Metadata: md}
+		if key != "" {
+			t.Key = key + "/" + o.ID
+		}
+		stored, replayed, err := bus.Dispatch(r.Context(), CancelOrder{t, req.Reason})
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return // клиент ушёл, отвечать некому
+		}
+		res := commandBatchResult(batchCommand{Command: batchCancel, OrderID: o.ID}, stored, replayed, err)
+		if err != nil {
+			sum.Failed++
+		} else {
+			sum.Canceled++
+		}
+		sum.Results = append(sum.Results, res)
+	}
+	writeBody(w, r, http.StatusOK, sum)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// --- Checkpoints ---
+// checkpointStore запоминает позицию журнала, до которой дошёл фоновый обработчик (например, релей outbox),
+// чтобы после перезапуска он продолжил с неё, а не с начала или с конца журнала.
+type checkpointStore interface {
+	// LoadCheckpoint возвращает false, если обработчик name ещё не сохранял позицию.
+	LoadCheckpoint(ctx context.Context, name string) (int64, bool, error)
+	SaveCheckpoint(ctx context.Context, name string, position int64) error
+}
+
+// openCheckpoints берёт позиции из хранилища событий, если оно умеет их хранить, иначе — из файла.
+func openCheckpoints(hot EventStore) (checkpointStore, error) {
+	if cps, ok := hot.(checkpointStore); ok {
+		return cps, nil
+	}
+	path := getenv("CHECKPOINTS_PATH", "checkpoints.json")
+	slog.Warn("checkpoints: event store cannot store checkpoints", "store", fmt.Sprintf("%T", hot), "path", path)
+	return newFileCheckpointStore(path)
+}
+
+// fileCheckpointStore — JSON-файл name -> позиция, переписываемый целиком при каждом сохранении.
+type fileCheckpointStore struct {
+	mu        sync.Mutex
+	path      string
+	positions map[string]int64
+}
+
+func newFileCheckpointStore(path string) (*fileCheckpointStore, error) {
+	s := &fileCheckpointStore{path: path, positions: map[string]int64{}}
+	body, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("checkpoints: read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(body, &s.positions); err != nil {
+		return nil, fmt.Errorf("checkpoints: decode %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *fileCheckpointStore) LoadCheckpoint(ctx context.Context, name string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	position, ok := s.positions[name]
+	return position, ok, nil
+}
+
+func (s *fileCheckpointStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, had := s.positions[name]
+	s.positions[name] = position
+	body, err := json.Marshal(s.positions)
+	if err == nil {
+		err = writeFileAtomic(s.path, body)
+	}
+	if err != nil {
+		if had {
+			s.positions[name] = old
+		} else {
+			delete(s.positions, name)
+		}
+		return fmt.Errorf("checkpoints: save %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- CloudEvents 1.0 ---
+// Событие журнала как CloudEvent: id = stream_id@version (уникален в пределах source), type = <prefix>.<Type>,
+// subject = order_id, data — Data события; позиция, поток и метаданные — атрибуты-расширения.
+// Структурный режим (application/cloudevents+json) кладёт всё в тело, бинарный — атрибуты в заголовки ce-*,
+// а в тело только data. Принимаются CloudEvents-команды (POST /cloudevents) в обоих режимах.
+
+const (
+	cloudEventsJSON      = "application/cloudevents+json"
+	cloudEventsBatchJSON = "application/cloudevents-batch+json"
+)
+
+type cloudEventsOptions struct {
+	Source     string // атрибут source исходящих событий
+	TypePrefix string // type = <prefix>.<Type>, команды — <prefix>.command.<create|pay|cancel>
+}
+
+var cloudEvents cloudEventsOptions
+
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            *time.Time      `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+
+	// расширения; имена — только строчные латинские буквы и цифры, как требует спецификация
+	StreamID      string `json:"streamid,omitempty"`
+	StreamVersion int64  `json:"streamversion,omitempty"`
+	Position      int64  `json:"position,omitempty"`
+	SchemaVersion int    `json:"schemaversion,omitempty"`
+	CorrelationID string `json:"correlationid,omitempty"`
+	CausationID   string `json:"causationid,omitempty"`
+	TraceParent   string `json:"traceparent,omitempty"` // расширение Distributed Tracing
+	Tenant        string `json:"tenant,omitempty"`
+}
+
+func toCloudEvent(e Event) cloudEvent {
+	ts := e.Timestamp.UTC()
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              e.StreamID + "@" + strconv.FormatInt(e.Version, 10),
+		Source:          cloudEvents.Source,
+		Type:            cloudEvents.TypePrefix + "." + string(e.Type),
+		Subject:         e.OrderID,
+		Time:            &ts,
+		DataContentType: "application/json",
+		Data:            e.Data,
+		StreamID:        e.StreamID,
+		StreamVersion:   e.Version,
+		Position:        e.Position,
+		SchemaVersion:   e.SchemaVersion,
+		CorrelationID:   e.Metadata.CorrelationID,
+		CausationID:     e.Metadata.CausationID,
+		TraceParent:     e.Metadata.TraceParent,
+		Tenant:          e.Metadata.Tenant,
+	}
+}
+
+// binaryHeaders раскладывает атрибуты CloudEvent по заголовкам бинарного режима.
+func (ce cloudEvent) binaryHeaders(h http.Header) {
+	h.Set("Content-Type", ce.DataContentType)
+	set := func(name, v string) {
+		if v != "" {
+			h.Set("ce-"+name, v)
+		}
+	}
+	set("specversion", ce.SpecVersion)
+	set("id", ce.ID)
+	set("source", ce.Source)
+	set("type", ce.Type)
+	set("subject", ce.Subject)
+	if ce.Time != nil {
+		set("time", ce.Time.Format(time.RFC3339Nano))
+	}
+	set("streamid", ce.StreamID)
+	set("streamversion", strconv.FormatInt(ce.StreamVersion, 10))
+	set("position", strconv.FormatInt(ce.Position, 10))
+	set("schemaversion", strconv.Itoa(ce.SchemaVersion))
+	set("correlationid", ce.CorrelationID)
+	set("causationid", ce.CausationID)
+	set("traceparent", ce.TraceParent)
+	set("tenant", ce.Tenant)
+}
+
+// wantsCloudEventsBatch — клиент запросил журнал в формате CloudEvents batch.
+func wantsCloudEventsBatch(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(part); err == nil && mt == cloudEventsBatchJSON {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCloudEventsBatch(w http.ResponseWriter, events []Event) {
+	batch := make([]cloudEvent, len(events))
+	for i, e := range events {
+		batch[i] = toCloudEvent(e)
+	}
+	w.Header().Set("Content-Type", cloudEventsBatchJSON)
+	json.NewEncoder(w).Encode(batch)
+}
+
+// readCloudEvent разбирает CloudEvent из запроса в структурном или бинарном режиме.
+func readCloudEvent(r *http.Request) (cloudEvent, error) {
+	var ce cloudEvent
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return ce, err
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mt == cloudEventsJSON:
+		if err := json.Unmarshal(body, &ce); err != nil {
+			return ce, fmt.Errorf("invalid structured CloudEvent: %w", err)
+		}
+	case r.Header.Get("ce-specversion") != "":
+		ce = cloudEvent{
+			SpecVersion:     r.Header.Get("ce-specversion"),
+			ID:              r.Header.Get("ce-id"),
+			Source:          r.Header.Get("ce-source"),
+			Type:            r.Header.Get("ce-type"),
+			Subject:         r.Header.Get("ce-subject"),
+			DataContentType: mt,
+			CorrelationID:   r.Header.Get("ce-correlationid"),
+			CausationID:     r.Header.Get("ce-causationid"),
+		}
+		if len(body) > 0 {
+			if mt != "" && mt != "application/json" {
+				return ce, fmt.Errorf("unsupported data content type %q", mt)
+			}
+			ce.Data = body
+		}
+	default:
+		return ce, errors.New("expected a CloudEvent: " + cloudEventsJSON + " body or ce-* headers")
+	}
+	if ce.SpecVersion != "1.0" {
+		return ce, fmt.Errorf("unsupported specversion %q", ce.SpecVersion)
+	}
+	if ce.ID == "" || ce.Source == "" || ce.Type == "" {
+		return ce, errors.New("id, source and type are required")
+	}
+	return ce, nil
+}
+
+// orderCommandHandlers — команды над существующим заказом по имени в типе CloudEvent.
+var orderCommandHandlers = map[string]http.HandlerFunc{
+	"pay":          payOrder,
+	"cancel":       cancelOrder,
+	"refund":       refundOrder,
+	"ship":         shipOrder,
+	"deliver":      deliverOrder,
+	"apply-coupon": applyCoupon,
+}
+
+// acceptCloudEvent выполняет команду, пришедшую как CloudEvent (например, из Knative trigger или EventBridge):
+// type <prefix>.command.create|pay|cancel|refund|ship|deliver|apply-coupon, subject — order_id для всех команд, кроме create, data — тело команды.
+// Пара source + id служит Idempotency-Key: повторная доставка не выполняет команду дважды.
+func acceptCloudEvent(w http.ResponseWriter, r *http.Request) {
+	ce, err := readCloudEvent(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	command, ok := strings.CutPrefix(ce.Type, cloudEvents.TypePrefix+".command.")
+	var handler http.HandlerFunc
+	path := apiVersionPrefix + "/orders"
+	switch {
+	case ok && command == "create":
+		handler = createOrder
+	case ok && orderCommandHandlers[command] != nil && ce.Subject != "":
+		handler = orderCommandHandlers[command]
+		path = apiVersionPrefix + "/orders/" + ce.Subject + "/" + command
+	default:
+		httpError(w, fmt.Sprintf("unsupported CloudEvent type %q (commands other than create need subject = order id)", ce.Type), http.StatusBadRequest)
+		return
+	}
+	cmd, err := http.NewRequestWithContext(r.Context(), http.MethodPost, path, bytes.NewReader(ce.Data))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	cmd.Header.Set("Content-Type", "application/json")
+	cmd.Header.Set("Idempotency-Key", ce.Source+"/"+ce.ID)
+	cmd.Header.Set("X-Correlation-ID", ce.CorrelationID)
+	// причина команды — сам входящий CloudEvent, если отправитель не указал свою
+	cmd.Header.Set("X-Causation-ID", ce.CausationID)
+	if ce.CausationID == "" {
+		cmd.Header.Set("X-Causation-ID", ce.ID)
+	}
+	for _, h := range []string{"If-Match", "X-User-ID"} {
+		cmd.Header.Set(h, r.Header.Get(h))
+	}
+	if ce.Subject != "" {
+		cmd = mux.SetURLVars(cmd, map[string]string{"id": ce.Subject})
+	}
+	handler(w, cmd)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Command bus ---
+// Точки входа (REST, gRPC, пакет команд, истечение срока) не пишут события сами: они собирают
+// типизированную команду и отправляют её в CommandBus. Шина находит обработчик по имени команды;
+// обработчик проверяет команду, решает, какое событие записать, и выполняет её через executeCommand.
+// Новая точка входа — ещё один адаптер к шине, логика команд не дублируется.
+
+// Command — типизированная команда над заказом; EventType — событие, которое она записывает.
+type Command interface {
+	CommandName() string
+	EventType() EventType
+	Target() CommandTarget
+}
+
+// CommandTarget — адрес и служебные поля команды, общие для всех её типов.
+type CommandTarget struct {
+	OrderID  string        `json:"order_id,omitempty"`        // пусто у CreateOrder: id выдаётся новый
+	Expected int64         `json:"expected_version"`          // ожидаемая версия потока; anyVersion — без проверки
+	Key      string        `json:"idempotency_key,omitempty"` // Idempotency-Key; пусто — без дедупликации
+	Metadata EventMetadata `json:"metadata"`
+}
+
+func (t CommandTarget) Target() CommandTarget { return t }
+
+// orderCommandFor — запись события команды c по её адресу.
+func orderCommandFor(c Command) orderCommand {
+	t := c.Target()
+	return orderCommand{Type: c.EventType(), OrderID: t.OrderID, Expected: t.Expected, Key: t.Key, Metadata: t.Metadata}
+}
+
+type (
+	CreateOrder struct {
+		CommandTarget
+		Order orderCreatedData `json:"order"`
+	}
+	PayOrder struct {
+		CommandTarget
+		Payment paymentRequest `json:"payment"`
+	}
+	CancelOrder struct {
+		CommandTarget
+		Reason string `json:"reason,omitempty"`
+	}
+	RefundOrder struct {
+		CommandTarget
+		Refund refundRequest `json:"refund"`
+	}
+	ShipOrder struct {
+		CommandTarget
+		Shipment Shipment `json:"shipment"`
+	}
+	DeliverOrder struct{ CommandTarget }
+	ApplyCoupon  struct {
+		CommandTarget
+		Code string `json:"code"`
+	}
+	ExpireOrder struct{ CommandTarget }
+)
+
+func (CreateOrder) CommandName() string  { return "CreateOrder" }
+func (PayOrder) CommandName() string     { return "PayOrder" }
+func (CancelOrder) CommandName() string  { return "CancelOrder" }
+func (RefundOrder) CommandName() string  { return "RefundOrder" }
+func (ShipOrder) CommandName() string    { return "ShipOrder" }
+func (DeliverOrder) CommandName() string { return "DeliverOrder" }
+func (ApplyCoupon) CommandName() string  { return "ApplyCoupon" }
+func (ExpireOrder) CommandName() string  { return "ExpireOrder" }
+
+func (CreateOrder) EventType() EventType  { return EventOrderCreated }
+func (PayOrder) EventType() EventType     { return EventOrderPaymentReceived }
+func (CancelOrder) EventType() EventType  { return EventOrderCanceled }
+func (RefundOrder) EventType() EventType  { return EventOrderRefunded }
+func (ShipOrder) EventType() EventType    { return EventOrderShipped }
+func (DeliverOrder) EventType() EventType { return EventOrderDelivered }
+func (ApplyCoupon) EventType() EventType  { return EventDiscountApplied }
+func (ExpireOrder) EventType() EventType  { return EventOrderExpired }
+
+// commandValidator — команда, которую можно проверить без состояния заказа; проверяет validateCommands.
+type commandValidator interface {
+	Validate() error
+}
+
+func (c CreateOrder) Validate() error {
+	if c.OrderID != "" {
+		return errors.New("create does not take order_id")
+	}
+	return c.Order.validate()
+}
+
+func (c PayOrder) Validate() error { return c.Payment.validate() }
+
+func (c ShipOrder) Validate() error { return c.Shipment.validate() }
+
+func (c ApplyCoupon) Validate() error {
+	if c.Code == "" {
+		return errors.New("code is required")
+	}
+	return nil
+}
+
+// invalidCommandError — команда не прошла проверку до обращения к заказу; REST отвечает 400, gRPC — INVALID_ARGUMENT.
+type invalidCommandError struct{ error }
+
+func invalidCommand(err error) error { return &invalidCommandError{err} }
+
+func (e *invalidCommandError) Unwrap() error { return e.error }
+
+// CommandHandler выполняет команду; replayed — команда с тем же Key уже была выполнена.
+type CommandHandler func(ctx context.Context, c Command) (stored Event, replayed bool, err error)
+
+// CommandMiddleware — звено конвейера вокруг обработчиков: логирование, метрики, проверки, идемпотентность.
+type CommandMiddleware func(next CommandHandler) CommandHandler
+
+type CommandBus struct {
+	handlers   map[string]CommandHandler
+	middleware []CommandMiddleware
+}
+
+func newCommandBus() *CommandBus {
+	return &CommandBus{handlers: map[string]CommandHandler{}}
+}
+
+// Use добавляет звенья конвейера; первое добавленное звено — внешнее.
+func (b *CommandBus) Use(mw ...CommandMiddleware) {
+	b.middleware = append(b.middleware, mw...)
+}
+
+// handleCommand регистрирует обработчик команд типа C; второй обработчик того же типа — ошибка программы.
+func handleCommand[C Command](b *CommandBus, h func(ctx context.Context, c C) (Event, error)) {
+	var zero C
+	name := zero.CommandName()
+	if _, dup := b.handlers[name]; dup {
+		panic("command bus: duplicate handler for " + name)
+	}
+	b.handlers[name] = func(ctx context.Context, c Command) (Event, bool, error) {
+		stored, err := h(ctx, c.(C))
+		return stored, false, err
+	}
+}
+
+// Dispatch проводит команду через конвейер к её обработчику.
+func (b *CommandBus) Dispatch(ctx context.Context, c Command) (stored Event, replayed bool, err error) {
+	h, ok := b.handlers[c.CommandName()]
+	if !ok {
+		return Event{}, false, fmt.Errorf("command bus: no handler for %s", c.CommandName())
+	}
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		h = b.middleware[i](h)
+	}
+	return h(ctx, c)
+}
+
+// bus — шина команд над заказами; обработчики регистрирует newOrderCommandBus, конвейер — main.
+var bus = newOrderCommandBus()
+
+func newOrderCommandBus() *CommandBus {
+	b := newCommandBus()
+	handleCommand(b, func(ctx context.Context, c CreateOrder) (Event, error) {
+		data, err := createdData(c.Order)
+		if err != nil {
+			return Event{}, invalidCommand(err)
+		}
+		cmd := orderCommandFor(c)
+		cmd.Expected = 0 // новый поток: версия 0 означает «поток ещё не существует»
+		cmd.Data = data
+		return executeCommand(ctx, cmd)
+	})
+	handleCommand(b, func(ctx context.Context, c PayOrder) (Event, error) {
+		cmd := orderCommandFor(c)
+		cmd.Decide = paidData(c.Payment)
+		cmd.Effect = chargePayment(c.Payment.PaymentMethod)
+		return executeCommand(ctx, cmd)
+	})
+	handleCommand(b, func(ctx context.Context, c CancelOrder) (Event, error) {
+		cmd := orderCommandFor(c)
+		cmd.Decide = canceledData(c.Reason)
+		return executeCommand(ctx, cmd)
+	})
+	handleCommand(b, func(ctx context.Context, c RefundOrder) (Event, error) {
+		cmd := orderCommandFor(c)
+		cmd.Decide = refundData(c.Refund)
+		return executeCommand(ctx, cmd)
+	})
+	handleCommand(b, func(ctx context.Context, c ShipOrder) (Event, error) {
+		cmd := orderCommandFor(c)
+		cmd.Decide = shipData(c.Shipment)
+		return executeCommand(ctx, cmd)
+	})
+	handleCommand(b, func(ctx context.Context, c DeliverOrder) (Event, error) {
+		cmd := orderCommandFor(c)
+		cmd.Decide = deliveredData
+		return executeCommand(ctx, cmd)
+	})
+	handleCommand(b, func(ctx context.Context, c ApplyCoupon) (Event, error) {
+		cmd := orderCommandFor(c)
+		cmd.Decide = discountData(c.Code)
+		return executeCommand(ctx, cmd)
+	})
+	handleCommand(b, func(ctx context.Context, c ExpireOrder) (Event, error) {
+		cmd := orderCommandFor(c)
+		cmd.Decide = expiredData
+		return executeCommand(ctx, cmd)
+	})
+	return b
+}
+
+// --- Command middleware ---
+
+// logCommands пишет в лог каждую команду: адрес, итог и время выполнения.
+func logCommands(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		start := time.Now()
+		stored, replayed, err := next(ctx, c)
+		t := c.Target()
+		switch {
+		case err != nil:
+			slog.ErrorContext(ctx, "command failed", "command", c.CommandName(), "order_id", t.OrderID, "actor", t.Metadata.Actor,
+				"duration", time.Since(start), "error", err)
+		case replayed:
+			slog.InfoContext(ctx, "command replayed", "command", c.CommandName(), "order_id", stored.OrderID, "actor", t.Metadata.Actor,
+				"event_type", stored.Type, "version", stored.Version, "duration", time.Since(start))
+		default:
+			slog.InfoContext(ctx, "command handled", "command", c.CommandName(), "order_id", stored.OrderID, "actor", t.Metadata.Actor,
+				"event_type", stored.Type, "version", stored.Version, "position", stored.Position, "duration", time.Since(start))
+		}
+		return stored, replayed, err
+	}
+}
+
+// commandStats — счётчики по имени команды с запуска процесса.
+type commandStats struct {
+	Total    int64   `json:"total"`
+	Failed   int64   `json:"failed"`
+	Replayed int64   `json:"replayed"`
+	Seconds  float64 `json:"seconds"` // суммарное время выполнения
+}
+
+type commandMetrics struct {
+	mu    sync.Mutex
+	stats map[string]*commandStats
+}
+
+var metrics = &commandMetrics{stats: map[string]*commandStats{}}
+
+// measure — звено шины, которое считает команды, ошибки, повторы и время выполнения.
+func (m *commandMetrics) measure(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		start := time.Now()
+		stored, replayed, err := next(ctx, c)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		s, ok := m.stats[c.CommandName()]
+		if !ok {
+			s = &commandStats{}
+			m.stats[c.CommandName()] = s
+		}
+		s.Total++
+		s.Seconds += time.Since(start).Seconds()
+		outcome := auditSucceeded
+		switch {
+		case err != nil:
+			s.Failed++
+			outcome = auditFailed
+		case replayed:
+			s.Replayed++
+			outcome = auditReplayed
+		}
+		recordCommand(c.CommandName(), outcome, time.Since(start))
+		return stored, replayed, err
+	}
+}
+
+func (m *commandMetrics) snapshot() map[string]commandStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]commandStats, len(m.stats))
+	for name, s := range m.stats {
+		out[name] = *s
+	}
+	return out
+}
+
+// getCommandMetrics отдаёт счётчики команд по имени команды.
+func getCommandMetrics(w http.ResponseWriter, r *http.Request) {
+	writeBody(w, r, http.StatusOK, metrics.snapshot())
+}
+
+var errUnauthenticated = errors.New("command requires an actor (X-User-ID)")
+
+// actorRequired — COMMANDS_REQUIRE_ACTOR; перезагрузка настроек меняет его на ходу.
+var actorRequired atomic.Bool
+
+// requireActor — звено шины, которое при actorRequired отклоняет команды без автора (Metadata.Actor).
+func requireActor(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		if actorRequired.Load() && c.Target().Metadata.Actor == "" {
+			return Event{}, false, errUnauthenticated
+		}
+		return next(ctx, c)
+	}
+}
+
+// validateCommands — звено шины, которое проверяет команды с Validate до обращения к заказу.
+func validateCommands(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		if v, ok := c.(commandValidator); ok {
+			if err := v.Validate(); err != nil {
+				return Event{}, false, invalidCommand(err)
+			}
+		}
+		return next(ctx, c)
+	}
+}
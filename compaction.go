@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// --- Compaction / retention ---
+// Потоки заказов в терминальном статусе удаляются целиком (вместе со снимками),
+// когда последнее событие потока старше opts.After.
+
+// streamDeleter — хранилища, умеющие удалить потоки заказов вместе с их снимками.
+type streamDeleter interface {
+	DeleteStreams(ctx context.Context, orderIDs []string) error
+}
+
+// terminalStatuses — статусы, после которых заказ больше не меняется.
+var terminalStatuses = map[OrderStatus]bool{
+	StatusCanceled:  true,
+	StatusRefunded:  true,
+	StatusDelivered: true,
+}
+
+type compactionOptions struct {
+	After    time.Duration // срок хранения заказа после перехода в терминальный статус
+	Interval time.Duration
+	Batch    int // максимум заказов за один проход
+}
+
+type compactor struct {
+	store EventStore
+	del   streamDeleter
+	opts  compactionOptions
+}
+
+// newCompactor читает события через s (расшифрованные, в текущей схеме), а удаляет потоки в raw.
+func newCompactor(s, raw EventStore, opts compactionOptions) (*compactor, error) {
+	del, ok := raw.(streamDeleter)
+	if !ok {
+		return nil, fmt.Errorf("compaction: %T does not support deleting streams", raw)
+	}
+	return &compactor{store: s, del: del, opts: opts}, nil
+}
+
+// compactOnce удаляет до opts.Batch заказов с истёкшим сроком хранения; возвращает их число.
+func (c *compactor) compactOnce(ctx context.Context) (int, error) {
+	events, err := c.store.Load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	type state struct {
+		order Order
+		last  time.Time
+	}
+	states := map[string]*state{}
+	var ids []string // порядок первого появления, чтобы сначала удалялись старые заказы
+	for _, e := range events {
+		st, ok := states[e.OrderID]
+		if !ok {
+			st = &state{}
+			states[e.OrderID] = st
+			ids = append(ids, e.OrderID)
+		}
+		st.order.apply(e)
+		st.last = e.Timestamp
+	}
+
+	cutoff := time.Now().Add(-c.opts.After)
+	var expired []string
+	for _, id := range ids {
+		st := states[id]
+		if terminalStatuses[st.order.Status] && st.last.Before(cutoff) {
+			expired = append(expired, id)
+			if len(expired) == c.opts.Batch {
+				break
+			}
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if err := c.del.DeleteStreams(ctx, expired); err != nil {
+		return 0, fmt.Errorf("compaction: delete: %w", err)
+	}
+	forgetOrders(expired)
+	return len(expired), nil
+}
+
+func (c *compactor) run(ctx context.Context) {
+	t := time.NewTicker(c.opts.Interval)
+	defer t.Stop()
+	for {
+		for {
+			n, err := c.compactOnce(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "compaction: run failed", "error", err)
+				break
+			}
+			if n > 0 {
+				slog.InfoContext(ctx, "compaction: removed expired orders", "orders", n)
+				adminAudit.system("log.compact", map[string]string{"orders": strconv.Itoa(n)})
+			}
+			if n < c.opts.Batch {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
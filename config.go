@@ -0,0 +1,241 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Configuration ---
+// Каждая настройка называется как переменная окружения (HTTP_ADDR, EVENT_STORE, KAFKA_BROKERS, ...) и берётся
+// из первого источника, где она задана: флаг командной строки, окружение, YAML-файл (-config или CONFIG_FILE),
+// значение по умолчанию в коде. В файле ключи — имена настроек в любом регистре; вложенные секции
+// склеиваются через "_", так что http: {addr: ":8080"} — это HTTP_ADDR. Флаг -set KEY=VALUE (можно
+// несколько раз) задаёт любую настройку, для частых есть короткие флаги (configFlags). Значения проверяются
+// при запуске: неверное число, длительность или флаг — отказ запуска с именем настройки; ключи из файла
+// и -set, которые никто не прочитал, перечисляются в предупреждении — обычно это опечатка.
+
+// configFlags — короткие флаги: имя флага -> настройка.
+var configFlags = []struct{ flag, key, usage string }{
+	{"http-addr", "HTTP_ADDR", "HTTP listen address (default :8080)"},
+	{"grpc-addr", "GRPC_ADDR", `gRPC listen address or "off" (default :9090)`},
+	{"store", "EVENT_STORE", "event store backend: memory, postgres, file, sqlite, bolt, redis, esdb, dynamodb, mongo"},
+	{"publisher", "EVENT_PUBLISHER", "event broker to publish to: kafka, nats, rabbitmq, pubsub, sns"},
+	{"read-model", "READ_MODEL", "read model backend: memory, postgres or redis"},
+	{"tls-cert", "TLS_CERT_FILE", "TLS certificate for HTTP and gRPC"},
+	{"tls-key", "TLS_KEY_FILE", "TLS private key for HTTP and gRPC"},
+	{"autocert", "TLS_AUTOCERT_DOMAINS", "comma-separated domains to obtain certificates for via ACME (Let's Encrypt)"},
+	{"log-level", "LOG_LEVEL", "debug, info, warn or error"},
+	{"log-format", "LOG_FORMAT", "text or json"},
+}
+
+type configSettings struct {
+	mu    sync.Mutex
+	path  string // YAML-файл; перечитывается при перезагрузке (reload.go)
+	flags map[string]string
+	file  map[string]string
+	used  map[string]bool
+}
+
+var settings = &configSettings{flags: map[string]string{}, file: map[string]string{}, used: map[string]bool{}}
+
+// loadConfig разбирает флаги args и читает YAML-файл настроек; возвращает аргументы после флагов — подкоманду.
+func loadConfig(args []string) ([]string, error) {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	path := fs.String("config", "", "YAML configuration file (or CONFIG_FILE)")
+	fs.Func("set", "set any setting: -set KEY=VALUE (repeatable)", func(v string) error {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("expected KEY=VALUE, got %q", v)
+		}
+		settings.flags[strings.ToUpper(key)] = value
+		return nil
+	})
+	for _, f := range configFlags {
+		fs.Func(f.flag, f.usage, func(v string) error {
+			settings.flags[f.key] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+	if *path == "" {
+		*path = os.Getenv("CONFIG_FILE")
+	}
+	if *path == "" {
+		return fs.Args(), nil
+	}
+	settings.path = *path
+	file, err := readConfigFile(*path)
+	if err != nil {
+		return nil, err
+	}
+	settings.file = file
+	return fs.Args(), nil
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	file := map[string]string{}
+	return file, flattenConfig(file, "", doc)
+}
+
+// flattenConfig раскладывает секции YAML в плоские имена настроек.
+func flattenConfig(out map[string]string, prefix string, doc map[string]any) error {
+	for k, v := range doc {
+		key := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			if err := flattenConfig(out, key, v); err != nil {
+				return err
+			}
+		case []any:
+			// списки (брокеры, адреса) — через запятую, как в окружении
+			items := make([]string, len(v))
+			for i, it := range v {
+				items[i] = fmt.Sprint(it)
+			}
+			out[key] = strings.Join(items, ",")
+		case nil:
+		default:
+			out[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+func (s *configSettings) lookup(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used[key] = true
+	if v, ok := s.flags[key]; ok {
+		return v, true
+	}
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v, true
+	}
+	v, ok := s.file[key]
+	return v, ok && v != ""
+}
+
+// overridden — задана ли настройка флагом или окружением: тогда значение из файла не действует.
+func (s *configSettings) overridden(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, flag := s.flags[key]
+	return flag || os.Getenv(key) != ""
+}
+
+// replaceFile подменяет настройки из файла; возвращает прежние и ключи, значение которых изменилось.
+func (s *configSettings) replaceFile(file map[string]string) (map[string]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var changed []string
+	for k, v := range file {
+		if old, ok := s.file[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range s.file {
+		if _, ok := file[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	previous := s.file
+	s.file = file
+	return previous, changed
+}
+
+// warnUnused предупреждает о настройках из файла и флагов, которые не были прочитаны.
+func (s *configSettings) warnUnused() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unused []string
+	for _, m := range []map[string]string{s.flags, s.file} {
+		for k := range m {
+			if !s.used[k] {
+				unused = append(unused, k)
+			}
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		slog.Warn("config: settings not used by this configuration", "keys", strings.Join(unused, ","))
+	}
+}
+
+// --- Env helpers ---
+func getenv(key, def string) string {
+	if v, ok := settings.lookup(key); ok {
+		return v
+	}
+	return def
+}
+
+// getenvInt и остальные завершают процесс при неверном значении; settingInt и остальные возвращают
+// ошибку — для настроек, которые перечитываются на ходу.
+func getenvInt(key string, def int) int { return mustSetting(settingInt(key, def)) }
+
+func getenvFloat(key string, def float64) float64 { return mustSetting(settingFloat(key, def)) }
+
+func getenvDuration(key string, def time.Duration) time.Duration {
+	return mustSetting(settingDuration(key, def))
+}
+
+func getenvBool(key string, def bool) bool { return mustSetting(settingBool(key, def)) }
+
+func mustSetting[T any](v T, err error) T {
+	if err != nil {
+		log.Fatal(err)
+	}
+	return v
+}
+
+func settingInt(key string, def int) (int, error) {
+	return parseSetting(key, def, strconv.Atoi, "invalid integer %q")
+}
+
+func settingFloat(key string, def float64) (float64, error) {
+	return parseSetting(key, def, func(v string) (float64, error) { return strconv.ParseFloat(v, 64) }, "invalid number %q")
+}
+
+func settingDuration(key string, def time.Duration) (time.Duration, error) {
+	return parseSetting(key, def, time.ParseDuration, "invalid duration %q")
+}
+
+func settingBool(key string, def bool) (bool, error) {
+	return parseSetting(key, def, strconv.ParseBool, "invalid boolean %q: expected true or false")
+}
+
+func parseSetting[T any](key string, def T, parse func(string) (T, error), format string) (T, error) {
+	v := getenv(key, "")
+	if v == "" {
+		return def, nil
+	}
+	x, err := parse(v)
+	if err != nil {
+		return def, fmt.Errorf("%s: "+format, key, v)
+	}
+	return x, nil
+}
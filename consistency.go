@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Read-your-writes ---
+// Ответ команды несёт версию заказа и глобальную позицию её события (тело, ETag и X-Position). Запросы
+// к read model принимают их обратно: ?min_position=<позиция> ждёт, пока проекция, из которой читают заказы
+// (orderViewsProjection), не применит событие с этой позицией, а GET /orders/{id}?min_version=<версия> —
+// пока заказ в read model не дойдёт до этой версии. Ожидание ограничено consistencyTimeout
+// (CONSISTENCY_TIMEOUT); не дождались — 503 с Retry-After, а не устаревший ответ.
+
+var (
+	// orderViewsProjection — проекция, которая наполняет orderViews.
+	orderViewsProjection = "orders"
+	consistencyTimeout   = 5 * time.Second
+)
+
+var errReadModelBehind = errors.New("read model has not caught up")
+
+// parseMinimum читает неотрицательный параметр запроса name; нет параметра — 0.
+func parseMinimum(r *http.Request, name string) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected non-negative integer", name, v)
+	}
+	return n, nil
+}
+
+// awaitReadModel ждёт, пока done не вернёт true, но не дольше consistencyTimeout.
+func awaitReadModel(ctx context.Context, done func(p *projectionRunner) (bool, error)) error {
+	p := projections.byName[orderViewsProjection]
+	ctx, cancel := context.WithTimeout(ctx, consistencyTimeout)
+	defer cancel()
+	err := p.await(ctx, func() (bool, error) { return done(p) })
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errReadModelBehind
+	}
+	return err
+}
+
+// awaitPosition обрабатывает ?min_position; false — ответ уже отправлен.
+func awaitPosition(w http.ResponseWriter, r *http.Request) bool {
+	position, err := parseMinimum(r, "min_position")
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return false
+	}
+	if position == 0 {
+		return true
+	}
+	err = awaitReadModel(r.Context(), func(p *projectionRunner) (bool, error) {
+		return p.status().Position >= position, nil
+	})
+	return consistencyOK(w, err, fmt.Sprintf("position %d", position))
+}
+
+// consistencyOK отвечает на ошибку ожидания read model; false — ответ отправлен.
+func consistencyOK(w http.ResponseWriter, err error, target string) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errReadModelBehind):
+		w.Header().Set("Retry-After", "1")
+		httpError(w, fmt.Sprintf("%v to %s within %s", err, target, consistencyTimeout), http.StatusServiceUnavailable)
+	case errors.Is(err, context.Canceled):
+		// клиент ушёл
+	default:
+		writeError(w, err, http.StatusInternalServerError)
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// --- CORS ---
+// Браузерные дашборды ходят в API напрямую с другого origin. С CORS_ORIGINS ответы получают заголовки
+// Access-Control-*, а preflight-запросы OPTIONS отвечаются 204 до маршрутизации (у маршрутов mux нет
+// OPTIONS). Origin — точное значение, "*" (любой) или шаблон с одной звёздочкой: https://*.example.com.
+// По умолчанию разрешено только чтение (CORS_METHODS=GET,HEAD); команды из браузера нужно разрешить явно.
+// С CORS_CREDENTIALS (cookies, Authorization) вместо "*" возвращается сам origin запроса: так требует
+// спецификация. Запрос с неразрешённого origin обрабатывается как обычно, просто без заголовков CORS.
+// Настройки CORS_* меняются без перезапуска (reload.go).
+
+type corsOptions struct {
+	Origins       []string
+	Methods       []string
+	Headers       []string // разрешённые заголовки запроса
+	ExposeHeaders []string // заголовки ответа, видимые скрипту
+	Credentials   bool
+	MaxAge        time.Duration // сколько браузер помнит ответ на preflight
+}
+
+// allowOrigin — значение Access-Control-Allow-Origin для origin; пусто — origin не разрешён.
+func (o corsOptions) allowOrigin(origin string) string {
+	for _, pattern := range o.Origins {
+		prefix, suffix, wildcard := strings.Cut(pattern, "*")
+		switch {
+		case pattern == "*" && !o.Credentials:
+			return "*"
+		case !wildcard && strings.EqualFold(origin, pattern),
+			wildcard && len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix):
+			return origin
+		}
+	}
+	return ""
+}
+
+// corsPolicy — настройки с готовыми значениями заголовков.
+type corsPolicy struct {
+	corsOptions
+	methods, headers, expose, maxAge string
+}
+
+// corsHandler оборачивает весь роутер: preflight должен отвечаться и для путей без OPTIONS.
+type corsHandler struct {
+	next   http.Handler
+	policy atomic.Pointer[corsPolicy]
+}
+
+var cors *corsHandler
+
+func newCORSHandler(opts corsOptions, next http.Handler) *corsHandler {
+	c := &corsHandler{next: next}
+	c.update(opts)
+	return c
+}
+
+// update меняет настройки для следующих запросов.
+func (c *corsHandler) update(opts corsOptions) {
+	c.policy.Store(&corsPolicy{
+		corsOptions: opts,
+		methods:     strings.Join(opts.Methods, ", "),
+		headers:     strings.Join(opts.Headers, ", "),
+		expose:      strings.Join(opts.ExposeHeaders, ", "),
+		maxAge:      strconv.Itoa(int(opts.MaxAge.Seconds())),
+	})
+}
+
+func (c *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := c.policy.Load()
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(p.Origins) == 0 {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	allow := p.allowOrigin(origin)
+	if allow == "" {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", allow)
+	if p.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	method := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != http.MethodOptions || method == "" {
+		if p.expose != "" {
+			h.Set("Access-Control-Expose-Headers", p.expose)
+		}
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	// preflight: браузер сам сверит метод и заголовки с разрешёнными
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	if slices.Contains(p.Methods, method) {
+		h.Set("Access-Control-Allow-Methods", p.methods)
+		if p.headers != "" {
+			h.Set("Access-Control-Allow-Headers", p.headers)
+		}
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
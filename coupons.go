@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- Coupons ---
+// Купоны задаются переменной COUPONS: "SAVE10=10%,WELCOME=500" — скидка в процентах от суммы позиций
+// или в минимальных единицах валюты заказа. В событие DiscountApplied пишется уже посчитанная скидка,
+// так что изменение COUPONS не меняет сумму заказов, к которым купон применён раньше.
+
+// coupon — скидка по коду: либо Percent, либо Amount.
+type coupon struct {
+	Code    string
+	Percent int64
+	Amount  int64
+}
+
+var (
+	coupons           = map[string]coupon{} // по коду в верхнем регистре
+	errCouponRejected = errors.New("coupon rejected")
+)
+
+// discountAppliedData — Data события DiscountApplied.
+type discountAppliedData struct {
+	Code   string `json:"code"`
+	Amount int64  `json:"amount"` // скидка в минимальных единицах валюты
+}
+
+// couponRequest — тело команды применения купона.
+type couponRequest struct {
+	Code string `json:"code"`
+}
+
+// parseCoupons разбирает значение COUPONS.
+func parseCoupons(spec string) (map[string]coupon, error) {
+	out := map[string]coupon{}
+	for _, part := range splitList(spec) {
+		code, value, ok := strings.Cut(part, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !ok || code == "" {
+			return nil, fmt.Errorf("coupons: %q: expected CODE=<percent>%% or CODE=<amount>", part)
+		}
+		c := coupon{Code: code}
+		pct, isPercent := strings.CutSuffix(value, "%")
+		n, err := strconv.ParseInt(pct, 10, 64)
+		switch {
+		case err != nil || n <= 0:
+			return nil, fmt.Errorf("coupons: %s: invalid discount %q", code, value)
+		case isPercent && n > 100:
+			return nil, fmt.Errorf("coupons: %s: percent must be at most 100", code)
+		case isPercent:
+			c.Percent = n
+		default:
+			c.Amount = n
+		}
+		out[code] = c
+	}
+	return out, nil
+}
+
+// discount считает скидку купона для суммы позиций total; скидка не больше самой суммы.
+func (c coupon) discount(total int64) int64 {
+	if c.Percent > 0 {
+		return total/100*c.Percent + total%100*c.Percent/100
+	}
+	return min(c.Amount, total)
+}
+
+// discountData проверяет купон по состоянию заказа и собирает Data события DiscountApplied. Купон
+// применяется к заказу в PENDING (иначе — errInvalidTransition), до первой оплаты и только один раз.
+func discountData(code string) func(o Order) (json.RawMessage, error) {
+	return func(o Order) (json.RawMessage, error) {
+		if err := checkTransition(o, EventDiscountApplied); err != nil {
+			return nil, err
+		}
+		c, ok := coupons[strings.ToUpper(code)]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%w: unknown coupon %q", errCouponRejected, code)
+		case o.Coupon != "":
+			return nil, fmt.Errorf("%w: coupon %s is already applied", errCouponRejected, o.Coupon)
+		case o.AmountPaid > 0:
+			return nil, fmt.Errorf("%w: order already has payments", errCouponRejected)
+		}
+		return json.Marshal(discountAppliedData{Code: c.Code, Amount: c.discount(o.Total)})
+	}
+}
+
+// applyCoupon применяет купон к неоплаченному заказу; тело {"code": ...}.
+func applyCoupon(w http.ResponseWriter, r *http.Request) {
+	t, err := commandTarget(w, r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	var req couponRequest
+	if err := readBody(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	dispatchCommand(w, r, ApplyCoupon{t, req.Code}, http.StatusOK)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// --- Command retries and dead letters ---
+// Команда, упавшая на транзиентной ошибке (хранилище недоступно, таймаут платёжного шлюза — всё, на что
+// запрос ответил бы 5xx, и конфликт версий у команды без If-Match), повторяется с экспоненциальной
+// паузой. Если попытки кончились, команда попадает в список dead letters: GET /admin/dead-letters
+// показывает их с последней ошибкой, POST /admin/dead-letters/{id}/retry отправляет команду в шину
+// заново, DELETE — удаляет. Ошибки бизнес-правил (4xx) не повторяются и в список не попадают.
+// Список живёт в памяти процесса и ограничен opts.Max: старые записи вытесняются новыми.
+
+type retryOptions struct {
+	Attempts   int // всего попыток, включая первую
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	Max        int // предел списка dead letters
+}
+
+// deadLetter — команда, которая не выполнилась за все попытки.
+type deadLetter struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"command"`
+	Command  Command   `json:"payload"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+type deadLetterStore struct {
+	opts retryOptions
+
+	mu      sync.Mutex
+	letters []deadLetter // в порядке поступления
+}
+
+var deadLetters = &deadLetterStore{opts: retryOptions{Attempts: 1, Max: 1000}}
+
+// transientCommandError — ошибка, после которой команду имеет смысл повторить.
+func transientCommandError(c Command, err error) bool {
+	var conflict *versionConflictError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &conflict):
+		// без If-Match версию выбирала сама команда: повтор перечитает заказ
+		return c.Target().Expected == anyVersion
+	}
+	return commandErrorStatus(err) >= http.StatusInternalServerError
+}
+
+// retry — звено шины: повторяет команду при транзиентной ошибке, после последней попытки кладёт её в dead letters.
+func (d *deadLetterStore) retry(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		backoff := d.opts.BackoffMin
+		for attempt := 1; ; attempt++ {
+			stored, replayed, err := next(ctx, c)
+			if err == nil || !transientCommandError(c, err) {
+				return stored, replayed, err
+			}
+			if attempt >= d.opts.Attempts {
+				d.park(c, err, attempt)
+				return Event{}, false, err
+			}
+			select {
+			case <-ctx.Done():
+				return Event{}, false, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, d.opts.BackoffMax)
+		}
+	}
+}
+
+func (d *deadLetterStore) park(c Command, err error, attempts int) {
+	dl := deadLetter{ID: uuid.New().String(), Name: c.CommandName(), Command: c, Error: err.Error(), Attempts: attempts, FailedAt: time.Now()}
+	slog.Error("dead letter", "dead_letter_id", dl.ID, "command", dl.Name, "order_id", c.Target().OrderID, "attempts", attempts, "error", err)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.letters = append(d.letters, dl)
+	if over := len(d.letters) - d.opts.Max; over > 0 {
+		d.letters = append(d.letters[:0:0], d.letters[over:]...)
+	}
+}
+
+func (d *deadLetterStore) list() []deadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]deadLetter{}, d.letters...)
+}
+
+// take убирает запись из списка и возвращает её.
+func (d *deadLetterStore) take(id string) (deadLetter, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, dl := range d.letters {
+		if dl.ID == id {
+			d.letters = append(d.letters[:i], d.letters[i+1:]...)
+			return dl, true
+		}
+	}
+	return deadLetter{}, false
+}
+
+// --- Dead letters API ---
+
+func listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeBody(w, r, http.StatusOK, deadLetters.list())
+}
+
+// retryDeadLetter отправляет команду в шину заново; если она снова не выполнится, в список попадёт новая запись.
+func retryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	dl, ok := deadLetters.take(mux.Vars(r)["id"])
+	if !ok {
+		httpError(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	if dl.Command.EventType() == EventOrderCreated {
+		status = http.StatusCreated
+	}
+	dispatchCommand(w, r, dl.Command, status)
+}
+
+func deleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if _, ok := deadLetters.take(mux.Vars(r)["id"]); !ok {
+		httpError(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// --- Runtime diagnostics ---
+// С DEBUG_ADDR (по умолчанию off) на отдельном адресе поднимаются профили net/http/pprof
+// (/debug/pprof/..., в том числе goroutine?debug=2 и heap) и GET /debug/runtime — снимок рантайма в JSON:
+// горутины, куча, GC. Отдельный адрес не виден снаружи, пока его не опубликовать; с DEBUG_TOKEN каждый
+// запрос ещё и требует Authorization: Bearer <токен>.
+
+var processStarted = time.Now()
+
+// runtimeSnapshot — ответ GET /debug/runtime.
+type runtimeSnapshot struct {
+	GoVersion      string     `json:"go_version"`
+	StartedAt      time.Time  `json:"started_at"`
+	UptimeSeconds  float64    `json:"uptime_seconds"`
+	CPUs           int        `json:"cpus"`
+	GOMAXPROCS     int        `json:"gomaxprocs"`
+	Goroutines     int        `json:"goroutines"`
+	HeapAllocBytes uint64     `json:"heap_alloc_bytes"` // занято живыми и ещё не собранными объектами
+	HeapInuseBytes uint64     `json:"heap_inuse_bytes"`
+	HeapSysBytes   uint64     `json:"heap_sys_bytes"` // получено от ОС под кучу
+	HeapObjects    uint64     `json:"heap_objects"`
+	StackBytes     uint64     `json:"stack_inuse_bytes"`
+	SysBytes       uint64     `json:"sys_bytes"`
+	TotalAlloc     uint64     `json:"total_alloc_bytes"` // выделено с запуска
+	GCRuns         uint32     `json:"gc_runs"`
+	GCPauseTotal   float64    `json:"gc_pause_total_seconds"`
+	LastGC         *time.Time `json:"last_gc,omitempty"`
+	NextGCBytes    uint64     `json:"next_gc_bytes"`
+}
+
+func getRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("gc") == "true" {
+		runtime.GC() // чтобы куча в снимке была без мусора
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	snap := runtimeSnapshot{
+		GoVersion:      runtime.Version(),
+		StartedAt:      processStarted,
+		UptimeSeconds:  time.Since(processStarted).Seconds(),
+		CPUs:           runtime.NumCPU(),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: ms.HeapAlloc,
+		HeapInuseBytes: ms.HeapInuse,
+		HeapSysBytes:   ms.HeapSys,
+		HeapObjects:    ms.HeapObjects,
+		StackBytes:     ms.StackInuse,
+		SysBytes:       ms.Sys,
+		TotalAlloc:     ms.TotalAlloc,
+		GCRuns:         ms.NumGC,
+		GCPauseTotal:   time.Duration(ms.PauseTotalNs).Seconds(),
+		NextGCBytes:    ms.NextGC,
+	}
+	if ms.LastGC > 0 {
+		t := time.Unix(0, int64(ms.LastGC))
+		snap.LastGC = &t
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+// requireToken пропускает запросы с Authorization: Bearer token; пустой token — все запросы.
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="debug"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startDebug поднимает pprof и /debug/runtime на addr; "off" — не поднимать.
+func startDebug(addr, token string) error {
+	if addr == "off" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("debug: listen %s: %w", addr, err)
+	}
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.HandleFunc("GET /debug/runtime", getRuntime)
+	go func() {
+		// без WriteTimeout: профиль и trace пишутся столько секунд, сколько запрошено
+		srv := &http.Server{Handler: requireToken(token, m), ReadHeaderTimeout: 10 * time.Second}
+		if err := srv.Serve(lis); err != nil {
+			slog.Error("debug: serve", "error", err)
+		}
+	}()
+	slog.Info("debug: listening", "addr", addr, "token", token != "")
+	return nil
+}
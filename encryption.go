@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// --- Encryption at rest ---
+// Event.Data и состояние снимков шифруются AES-GCM до записи в хранилище.
+// Шифротекст хранится JSON-строкой "enc:v1:<kid>:<base64(nonce|ciphertext)>", поэтому
+// его принимают и JSONB-колонки; kid — префикс SHA-256 ключа, по нему выбирается ключ при чтении.
+// Незашифрованные данные (записанные до включения шифрования) читаются как есть.
+const encryptedPrefix = "enc:v1:"
+
+type dataCipher struct {
+	current string                 // kid ключа для новых записей
+	keys    map[string]cipher.AEAD // kid -> ключ; старые ключи только для чтения
+}
+
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newDataCipher(current []byte, old ...[]byte) (*dataCipher, error) {
+	c := &dataCipher{current: keyID(current), keys: map[string]cipher.AEAD{}}
+	for _, key := range append([][]byte{current}, old...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+		c.keys[keyID(key)] = aead
+	}
+	return c, nil
+}
+
+// seal шифрует plain; aad привязывает шифротекст к потоку, чтобы его нельзя было подставить в чужое событие.
+func (c *dataCipher) seal(plain []byte, aad string) (json.RawMessage, error) {
+	aead := c.keys[c.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("encryption: nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte(aad))
+	return json.Marshal(encryptedPrefix + c.current + ":" + base64.RawStdEncoding.EncodeToString(sealed))
+}
+
+// open расшифровывает данные, записанные seal; прочие данные возвращает без изменений.
+func (c *dataCipher) open(data json.RawMessage, aad string) (json.RawMessage, error) {
+	if len(data) == 0 || data[0] != '"' {
+		return data, nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil || !strings.HasPrefix(s, encryptedPrefix) {
+		return data, nil
+	}
+	kid, body, ok := strings.Cut(strings.TrimPrefix(s, encryptedPrefix), ":")
+	if !ok {
+		return nil, errors.New("encryption: malformed ciphertext")
+	}
+	aead, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("encryption: unknown key %s", kid)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(body)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encryption: malformed ciphertext")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return nil, fmt.Errorf("encryption: decrypt: %w", err)
+	}
+	return plain, nil
+}
+
+// openDataCipher читает ключи из окружения. ENCRYPTION_KEY — ключ AES (16, 24 или 32 байта, base64);
+// ENCRYPTION_KMS_DATA_KEY — тот же ключ, зашифрованный AWS KMS (CiphertextBlob из GenerateDataKey),
+// он расшифровывается при старте. ENCRYPTION_OLD_KEYS — прежние ключи через запятую, только для чтения.
+// Без ключа шифрование выключено (nil).
+func openDataCipher(ctx context.Context) (*dataCipher, error) {
+	var key []byte
+	if v := getenv("ENCRYPTION_KEY", ""); v != "" {
+		k, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: ENCRYPTION_KEY: %w", err)
+		}
+		key = k
+	} else if v := getenv("ENCRYPTION_KMS_DATA_KEY", ""); v != "" {
+		k, err := kmsDataKey(ctx, v)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	} else {
+		return nil, nil
+	}
+	var old [][]byte
+	for _, v := range strings.Split(getenv("ENCRYPTION_OLD_KEYS", ""), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		k, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: ENCRYPTION_OLD_KEYS: %w", err)
+		}
+		old = append(old, k)
+	}
+	c, err := newDataCipher(key, old...)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("encryption: event data encrypted", "key_id", c.current)
+	return c, nil
+}
+
+// kmsDataKey расшифровывает ключ данных через AWS KMS.
+func kmsDataKey(ctx context.Context, blob string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: ENCRYPTION_KMS_DATA_KEY: %w", err)
+	}
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if region := getenv("AWS_REGION", ""); region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: load aws config: %w", err)
+	}
+	client := kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if endpoint := getenv("KMS_ENDPOINT", ""); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	in := &kms.DecryptInput{CiphertextBlob: ciphertext}
+	if id := getenv("ENCRYPTION_KMS_KEY_ID", ""); id != "" {
+		in.KeyId = aws.String(id)
+	}
+	out, err := client.Decrypt(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: kms decrypt: %w", err)
+	}
+	return out.Plaintext, nil
+}
+
+// encryptingStore шифрует Data событий при записи и расшифровывает при чтении.
+type encryptingStore struct {
+	EventStore
+	c *dataCipher
+}
+
+func (s encryptingStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	plain := e.Data
+	sealed, err := s.c.seal(plain, e.StreamID)
+	if err != nil {
+		return Event{}, err
+	}
+	e.Data = sealed
+	stored, err := s.EventStore.Append(ctx, e, expected)
+	if err != nil {
+		return Event{}, err
+	}
+	stored.Data = plain
+	return stored, nil
+}
+
+func (s encryptingStore) decrypt(e Event) (Event, error) {
+	data, err := s.c.open(e.Data, e.StreamID)
+	if err != nil {
+		return Event{}, fmt.Errorf("%s@%d: %w", e.StreamID, e.Version, err)
+	}
+	e.Data = data
+	return e, nil
+}
+
+func (s encryptingStore) decryptAll(events []Event, err error) ([]Event, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range events {
+		if events[i], err = s.decrypt(e); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (s encryptingStore) Load(ctx context.Context) ([]Event, error) {
+	return s.decryptAll(s.EventStore.Load(ctx))
+}
+
+func (s encryptingStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	return s.decryptAll(s.EventStore.LoadAfter(ctx, after, limit))
+}
+
+func (s encryptingStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	return s.decryptAll(s.EventStore.QueryEvents(ctx, q))
+}
+
+func (s encryptingStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.decryptAll(s.EventStore.LoadByOrder(ctx, orderID))
+}
+
+func (s encryptingStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	return s.decryptAll(s.EventStore.LoadByOrderAfter(ctx, orderID, after))
+}
+
+func (s encryptingStore) Subscribe(fn func(Event)) func() {
+	return s.EventStore.Subscribe(func(e Event) {
+		plain, err := s.decrypt(e)
+		if err != nil {
+			slog.Error("encryption: decrypt event", "stream_id", e.StreamID, "version", e.Version, "error", err)
+			return
+		}
+		fn(plain)
+	})
+}
+
+// encryptingSnapshots шифрует состояние снимков: в нём те же данные заказа, что и в событиях.
+type encryptingSnapshots struct {
+	SnapshotStore
+	c *dataCipher
+}
+
+func (s encryptingSnapshots) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	state, err := s.c.seal(snap.State, snap.StreamID)
+	if err != nil {
+		return err
+	}
+	snap.State = state
+	return s.SnapshotStore.SaveSnapshot(ctx, snap)
+}
+
+func (s encryptingSnapshots) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	snap, ok, err := s.SnapshotStore.LoadSnapshot(ctx, streamID)
+	if err != nil || !ok {
+		return snap, ok, err
+	}
+	if snap.State, err = s.c.open(snap.State, streamID); err != nil {
+		return Snapshot{}, false, fmt.Errorf("snapshot %s: %w", streamID, err)
+	}
+	return snap, true, nil
+}
@@ -0,0 +1,147 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: events.proto
+
+// Подписка на журнал событий заказов. Код Go в этом каталоге сгенерирован из этого файла
+// (protoc-gen-go, protoc-gen-go-grpc); клиенты на других языках генерируют свой из него же.
+
+package eventspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	EventStream_SubscribeEvents_FullMethodName = "/orders.events.v1.EventStream/SubscribeEvents"
+)
+
+// EventStreamClient is the client API for EventStream service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type EventStreamClient interface {
+	// SubscribeEvents отдаёт события после from_position, подходящие под фильтр:
+	// сначала из журнала, затем новые по мере записи. Поток не завершается сам;
+	// клиент, отставший от записи, получает RESOURCE_EXHAUSTED и переподключается
+	// с позиции последнего полученного события.
+	SubscribeEvents(ctx context.Context, in *SubscribeEventsRequest, opts ...grpc.CallOption) (EventStream_SubscribeEventsClient, error)
+}
+
+type eventStreamClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEventStreamClient(cc grpc.ClientConnInterface) EventStreamClient {
+	return &eventStreamClient{cc}
+}
+
+func (c *eventStreamClient) SubscribeEvents(ctx context.Context, in *SubscribeEventsRequest, opts ...grpc.CallOption) (EventStream_SubscribeEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &EventStream_ServiceDesc.Streams[0], EventStream_SubscribeEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &eventStreamSubscribeEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type EventStream_SubscribeEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type eventStreamSubscribeEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *eventStreamSubscribeEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EventStreamServer is the server API for EventStream service.
+// All implementations must embed UnimplementedEventStreamServer
+// for forward compatibility
+type EventStreamServer interface {
+	// SubscribeEvents отдаёт события после from_position, подходящие под фильтр:
+	// сначала из журнала, затем новые по мере записи. Поток не завершается сам;
+	// клиент, отставший от записи, получает RESOURCE_EXHAUSTED и переподключается
+	// с позиции последнего полученного события.
+	SubscribeEvents(*SubscribeEventsRequest, EventStream_SubscribeEventsServer) error
+	mustEmbedUnimplementedEventStreamServer()
+}
+
+// UnimplementedEventStreamServer must be embedded to have forward compatible implementations.
+type UnimplementedEventStreamServer struct {
+}
+
+func (UnimplementedEventStreamServer) SubscribeEvents(*SubscribeEventsRequest, EventStream_SubscribeEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeEvents not implemented")
+}
+func (UnimplementedEventStreamServer) mustEmbedUnimplementedEventStreamServer() {}
+
+// UnsafeEventStreamServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EventStreamServer will
+// result in compilation errors.
+type UnsafeEventStreamServer interface {
+	mustEmbedUnimplementedEventStreamServer()
+}
+
+func RegisterEventStreamServer(s grpc.ServiceRegistrar, srv EventStreamServer) {
+	s.RegisterService(&EventStream_ServiceDesc, srv)
+}
+
+func _EventStream_SubscribeEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EventStreamServer).SubscribeEvents(m, &eventStreamSubscribeEventsServer{stream})
+}
+
+type EventStream_SubscribeEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type eventStreamSubscribeEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *eventStreamSubscribeEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// EventStream_ServiceDesc is the grpc.ServiceDesc for EventStream service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var EventStream_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "orders.events.v1.EventStream",
+	HandlerType: (*EventStreamServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubscribeEvents",
+			Handler:       _EventStream_SubscribeEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "events.proto",
+}
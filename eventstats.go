@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Event store statistics ---
+// Проекция "event-stats" считает по всему журналу (и по типам событий, не только заказов) число событий,
+// объём Data, время первого и последнего события и рост по дням (UTC) — по Timestamp событий. Темп записи
+// за последние окна (1m, 5m, 15m, 1h, 24h) считается по корзинам в минуту за сутки. GET /admin/event-stats
+// отдаёт сводку вместе с местом, которое журнал занимает в backend (если тот умеет его сообщить).
+// События заказов, удалённых компакцией, остаются в счёте до перестройки проекции.
+
+// eventRateWindows — окна темпа записи.
+var eventRateWindows = []struct {
+	Name string
+	D    time.Duration
+}{{"1m", time.Minute}, {"5m", 5 * time.Minute}, {"15m", 15 * time.Minute}, {"1h", time.Hour}, {"24h", 24 * time.Hour}}
+
+type eventTypeStats struct {
+	Type      EventType `json:"type"`
+	Events    int64     `json:"events"`
+	DataBytes int64     `json:"data_bytes"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+}
+
+type eventDayStats struct {
+	Date      string `json:"date"`
+	Events    int64  `json:"events"`
+	DataBytes int64  `json:"data_bytes"`
+}
+
+type eventRate struct {
+	Window    string  `json:"window"`
+	Events    int64   `json:"events"`
+	PerSecond float64 `json:"per_second"`
+}
+
+// eventStoreStats — ответ GET /admin/event-stats.
+type eventStoreStats struct {
+	Events       int64            `json:"events"`
+	DataBytes    int64            `json:"data_bytes"`           // сумма длин Data
+	SizeBytes    *int64           `json:"size_bytes,omitempty"` // место в backend, если тот его сообщает
+	LastPosition int64            `json:"last_position"`
+	Oldest       *time.Time       `json:"oldest,omitempty"`
+	Newest       *time.Time       `json:"newest,omitempty"`
+	ByType       []eventTypeStats `json:"by_type"`
+	PerDay       []eventDayStats  `json:"per_day"`
+	AppendRate   []eventRate      `json:"append_rate"`
+}
+
+type eventStatistics struct {
+	mu       sync.Mutex
+	byType   map[EventType]*eventTypeStats
+	perDay   map[string]*eventDayStats
+	perMin   map[int64]int64 // минута Unix -> событий, за последние сутки
+	events   int64
+	bytes    int64
+	position int64
+}
+
+var eventStats = newEventStatistics()
+
+func newEventStatistics() *eventStatistics {
+	return &eventStatistics{byType: map[EventType]*eventTypeStats{}, perDay: map[string]*eventDayStats{}, perMin: map[int64]int64{}}
+}
+
+func (s *eventStatistics) apply(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.Position > 0 && e.Position <= s.position {
+		return // повторная доставка
+	}
+	size := int64(len(e.Data))
+	t, ok := s.byType[e.Type]
+	if !ok {
+		t = &eventTypeStats{Type: e.Type, First: e.Timestamp}
+		s.byType[e.Type] = t
+	}
+	t.Events++
+	t.DataBytes += size
+	if e.Timestamp.Before(t.First) {
+		t.First = e.Timestamp
+	}
+	if e.Timestamp.After(t.Last) {
+		t.Last = e.Timestamp
+	}
+	date := e.Timestamp.UTC().Format(time.DateOnly)
+	d, ok := s.perDay[date]
+	if !ok {
+		d = &eventDayStats{Date: date}
+		s.perDay[date] = d
+	}
+	d.Events++
+	d.DataBytes += size
+	if minute := e.Timestamp.Unix() / 60; minute > time.Now().Add(-24*time.Hour).Unix()/60 {
+		s.perMin[minute]++
+	}
+	s.events++
+	s.bytes += size
+	s.position = max(s.position, e.Position)
+}
+
+func (s *eventStatistics) reset() {
+	fresh := newEventStatistics()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byType, s.perDay, s.perMin, s.events, s.bytes, s.position = fresh.byType, fresh.perDay, fresh.perMin, 0, 0, 0
+}
+
+func (s *eventStatistics) snapshot(now time.Time) eventStoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := eventStoreStats{Events: s.events, DataBytes: s.bytes, LastPosition: s.position, ByType: []eventTypeStats{}, PerDay: []eventDayStats{}}
+	for _, t := range s.byType {
+		out.ByType = append(out.ByType, *t)
+		if out.Oldest == nil || t.First.Before(*out.Oldest) {
+			first := t.First
+			out.Oldest = &first
+		}
+		if out.Newest == nil || t.Last.After(*out.Newest) {
+			last := t.Last
+			out.Newest = &last
+		}
+	}
+	sort.Slice(out.ByType, func(i, j int) bool { return out.ByType[i].Type < out.ByType[j].Type })
+	for _, d := range s.perDay {
+		out.PerDay = append(out.PerDay, *d)
+	}
+	sort.Slice(out.PerDay, func(i, j int) bool { return out.PerDay[i].Date < out.PerDay[j].Date })
+	current := now.Unix() / 60
+	for minute := range s.perMin {
+		if minute <= current-24*60 {
+			delete(s.perMin, minute) // старше самого длинного окна
+		}
+	}
+	for _, w := range eventRateWindows {
+		r := eventRate{Window: w.Name}
+		since := now.Add(-w.D).Unix() / 60
+		for minute, n := range s.perMin {
+			if minute > since {
+				r.Events += n
+			}
+		}
+		r.PerSecond = float64(r.Events) / w.D.Seconds()
+		out.AppendRate = append(out.AppendRate, r)
+	}
+	return out
+}
+
+// getEventStats отдаёт GET /admin/event-stats.
+func getEventStats(w http.ResponseWriter, r *http.Request) {
+	st := eventStats.snapshot(time.Now())
+	if sz, ok := storeBackend.(storeSizer); ok {
+		n, err := sz.SizeBytes(r.Context())
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		st.SizeBytes = &n
+	}
+	writeBody(w, r, http.StatusOK, st)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// --- Expiration of unpaid orders ---
+// Заказ, который дольше opts.TTL остаётся в PENDING, получает OrderExpired и становится CANCELED.
+// Срок отсчитывается от Timestamp события OrderCreated, а не от времени запуска процесса, поэтому
+// после перезапуска и повторного чтения журнала просроченными считаются те же заказы.
+
+type expiryOptions struct {
+	TTL      time.Duration // сколько заказ может ждать оплаты
+	Interval time.Duration
+	Batch    int // максимум заказов за один проход
+}
+
+type expirer struct {
+	opts expiryOptions
+}
+
+// expireOnce отменяет до opts.Batch просроченных заказов, начиная с самых старых; возвращает их число.
+// Событие пишется в версию заказа из read model: если заказ успели оплатить или отменить, команда
+// получает конфликт версий или недопустимый переход, и заказ пропускается.
+func (x *expirer) expireOnce(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-x.opts.TTL)
+	mutex.Lock()
+	var due []Order
+	for _, o := range orders {
+		if o.Status == StatusPending && !o.CreatedAt.IsZero() && o.CreatedAt.Before(cutoff) {
+			due = append(due, o)
+		}
+	}
+	mutex.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].CreatedAt.Before(due[j].CreatedAt) })
+	if len(due) > x.opts.Batch {
+		due = due[:x.opts.Batch]
+	}
+	n := 0
+	for _, o := range due {
+		_, _, err := bus.Dispatch(ctx, ExpireOrder{CommandTarget{
+			OrderID:  o.ID,
+			Expected: o.Version,
+			Metadata: commandMetadata("", "", "expiry"),
+		}})
+		var conflict *versionConflictError
+		switch {
+		case errors.As(err, &conflict), errors.Is(err, errInvalidTransition):
+			continue
+		case err != nil:
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (x *expirer) run(ctx context.Context) {
+	t := time.NewTicker(x.opts.Interval)
+	defer t.Stop()
+	for {
+		for {
+			n, err := x.expireOnce(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "expiry: run failed", "error", err)
+				break
+			}
+			if n > 0 {
+				slog.InfoContext(ctx, "expiry: canceled unpaid orders", "orders", n, "ttl", x.opts.TTL)
+			}
+			if n < x.opts.Batch {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+)
+
+// --- GraphQL queries ---
+// POST /graphql отдаёт заказы из read model и события журнала; у заказа есть вложенная история событий,
+// так что фронтенд получает заказ с историей за один запрос. Только чтение: команды остаются в REST и gRPC.
+
+const graphqlSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	# заказ по id; null, если заказа нет
+	order(id: ID!): Order
+	# заказы, упорядоченные по id; after — id последнего заказа предыдущей страницы
+	orders(status: OrderStatus, customerId: String, after: ID, first: Int = 100): [Order!]!
+	# события журнала после позиции after
+	events(after: Int = 0, types: [String!], orderId: ID, first: Int = 100): [Event!]!
+}
+
+enum OrderStatus {
+	PENDING
+	PAID
+	SHIPPED
+	DELIVERED
+	CANCELED
+	REFUNDED
+}
+
+type Order {
+	id: ID!
+	status: OrderStatus!
+	version: Int!
+	customerId: String
+	customer: Customer
+	customerErased: Boolean!
+	items: [OrderItem!]!
+	# к оплате: сумма позиций за вычетом скидки, в минимальных единицах валюты;
+	# суммы — Float, потому что Int в GraphQL 32-битный
+	total: Float!
+	discount: Float!
+	coupon: String
+	# ISO 4217
+	currency: String
+	amountPaid: Float!
+	amountRefunded: Float!
+	# остаток к оплате; у заказа не в PENDING — 0
+	outstanding: Float!
+	# причина последнего отказа платёжного шлюза
+	paymentError: String
+	# RFC 3339; время события OrderCreated
+	createdAt: String!
+	shipment: Shipment
+	# история заказа из журнала, по версиям
+	events(types: [String!]): [Event!]!
+}
+
+type OrderItem {
+	sku: String!
+	quantity: Int!
+	unitPrice: Float!
+}
+
+type Shipment {
+	carrier: String!
+	trackingNumber: String!
+}
+
+type Customer {
+	name: String
+	email: String
+	phone: String
+	address: String
+}
+
+type Event {
+	type: String!
+	orderId: ID!
+	streamId: String!
+	version: Int!
+	position: Int!
+	schemaVersion: Int!
+	# RFC 3339
+	timestamp: String!
+	metadata: EventMetadata!
+	# данные события в JSON, как в REST API
+	data: String!
+}
+
+type EventMetadata {
+	correlationId: String
+	causationId: String
+	actor: String
+	commandId: String
+}
+`
+
+const (
+	graphqlMaxFirst = 1000
+	graphqlMaxDepth = 8
+)
+
+func graphqlHandler() *relay.Handler {
+	schema := graphql.MustParseSchema(graphqlSchema, &graphqlResolver{}, graphql.MaxDepth(graphqlMaxDepth))
+	return &relay.Handler{Schema: schema}
+}
+
+type graphqlResolver struct{}
+
+func (*graphqlResolver) Order(ctx context.Context, args struct{ ID graphql.ID }) *orderResolver {
+	mutex.Lock()
+	o, ok := orders[string(args.ID)]
+	mutex.Unlock()
+	if !ok || !tenantOwns(ctx, o.ID) {
+		return nil
+	}
+	return &orderResolver{sensitive.order(ctx, o)}
+}
+
+func (*graphqlResolver) Orders(ctx context.Context, args struct {
+	Status     *string
+	CustomerID *string
+	After      *graphql.ID
+	First      int32
+}) ([]*orderResolver, error) {
+	if err := checkFirst(args.First); err != nil {
+		return nil, err
+	}
+	var status OrderStatus
+	if args.Status != nil {
+		status = OrderStatus(*args.Status)
+	}
+	var customerID, after string
+	if args.CustomerID != nil {
+		customerID = *args.CustomerID
+	}
+	if args.After != nil {
+		after = string(*args.After)
+	}
+	list, _ := selectOrders(status, customerID, tenantFrom(ctx), after, int(args.First))
+	out := make([]*orderResolver, len(list))
+	for i, o := range list {
+		out[i] = &orderResolver{sensitive.order(ctx, o)}
+	}
+	return out, nil
+}
+
+func (*graphqlResolver) Events(ctx context.Context, args struct {
+	After   int32
+	Types   *[]string
+	OrderID *graphql.ID
+	First   int32
+}) ([]*eventResolver, error) {
+	if err := checkFirst(args.First); err != nil {
+		return nil, err
+	}
+	if args.After < 0 {
+		return nil, errors.New("after must not be negative")
+	}
+	if args.First == 0 {
+		return []*eventResolver{}, nil
+	}
+	q := eventQuery{After: int64(args.After), Limit: int(args.First)}
+	if args.Types != nil {
+		for _, t := range *args.Types {
+			q.Types = append(q.Types, EventType(t))
+		}
+	}
+	if args.OrderID != nil {
+		q.OrderID = string(*args.OrderID)
+	}
+	events, err := store.QueryEvents(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*eventResolver, len(events))
+	for i, e := range events {
+		out[i] = &eventResolver{e}
+	}
+	return out, nil
+}
+
+func checkFirst(first int32) error {
+	if first < 0 || first > graphqlMaxFirst {
+		return errors.New("first must be between 0 and 1000")
+	}
+	return nil
+}
+
+func matchesTypes(e Event, types *[]string) bool {
+	return types == nil || len(*types) == 0 || slices.Contains(*types, string(e.Type))
+}
+
+type orderResolver struct{ o Order }
+
+func (r *orderResolver) ID() graphql.ID      { return graphql.ID(r.o.ID) }
+func (r *orderResolver) Status() string      { return string(r.o.Status) }
+func (r *orderResolver) Version() int32      { return int32(r.o.Version) }
+func (r *orderResolver) CustomerID() *string { return optionalString(r.o.CustomerID) }
+func (r *orderResolver) Customer() *customerResolver {
+	if r.o.Customer == nil {
+		return nil
+	}
+	return &customerResolver{*r.o.Customer}
+}
+func (r *orderResolver) Shipment() *shipmentResolver {
+	if r.o.Shipment == nil {
+		return nil
+	}
+	return &shipmentResolver{*r.o.Shipment}
+}
+func (r *orderResolver) CustomerErased() bool    { return r.o.CustomerErased }
+func (r *orderResolver) Total() float64          { return float64(r.o.Total) }
+func (r *orderResolver) Discount() float64       { return float64(r.o.Discount) }
+func (r *orderResolver) Coupon() *string         { return optionalString(r.o.Coupon) }
+func (r *orderResolver) Currency() *string       { return optionalString(r.o.Currency) }
+func (r *orderResolver) AmountPaid() float64     { return float64(r.o.AmountPaid) }
+func (r *orderResolver) AmountRefunded() float64 { return float64(r.o.AmountRefunded) }
+func (r *orderResolver) Outstanding() float64    { return float64(r.o.Outstanding) }
+func (r *orderResolver) PaymentError() *string   { return optionalString(r.o.PaymentError) }
+func (r *orderResolver) CreatedAt() string       { return r.o.CreatedAt.UTC().Format(time.RFC3339Nano) }
+
+func (r *orderResolver) Items() []*orderItemResolver {
+	out := make([]*orderItemResolver, len(r.o.Items))
+	for i, it := range r.o.Items {
+		out[i] = &orderItemResolver{it}
+	}
+	return out
+}
+
+func (r *orderResolver) Events(ctx context.Context, args struct{ Types *[]string }) ([]*eventResolver, error) {
+	events, err := store.LoadByOrderAfter(ctx, r.o.ID, 0)
+	if err != nil {
+		return nil, err
+	}
+	var out []*eventResolver
+	for _, e := range events {
+		if matchesTypes(e, args.Types) {
+			out = append(out, &eventResolver{e})
+		}
+	}
+	return out, nil
+}
+
+type orderItemResolver struct{ it OrderItem }
+
+func (r *orderItemResolver) SKU() string        { return r.it.SKU }
+func (r *orderItemResolver) Quantity() int32    { return int32(r.it.Quantity) }
+func (r *orderItemResolver) UnitPrice() float64 { return float64(r.it.UnitPrice) }
+
+type shipmentResolver struct{ s Shipment }
+
+func (r *shipmentResolver) Carrier() string        { return r.s.Carrier }
+func (r *shipmentResolver) TrackingNumber() string { return r.s.TrackingNumber }
+
+type customerResolver struct{ c Customer }
+
+func (r *customerResolver) Name() *string    { return optionalString(r.c.Name) }
+func (r *customerResolver) Email() *string   { return optionalString(r.c.Email) }
+func (r *customerResolver) Phone() *string   { return optionalString(r.c.Phone) }
+func (r *customerResolver) Address() *string { return optionalString(r.c.Address) }
+
+type eventResolver struct{ e Event }
+
+func (r *eventResolver) Type() string                { return string(r.e.Type) }
+func (r *eventResolver) OrderID() graphql.ID         { return graphql.ID(r.e.OrderID) }
+func (r *eventResolver) StreamID() string            { return r.e.StreamID }
+func (r *eventResolver) Version() int32              { return int32(r.e.Version) }
+func (r *eventResolver) Position() int32             { return int32(r.e.Position) }
+func (r *eventResolver) SchemaVersion() int32        { return int32(r.e.SchemaVersion) }
+func (r *eventResolver) Timestamp() string           { return r.e.Timestamp.UTC().Format(time.RFC3339Nano) }
+func (r *eventResolver) Metadata() *metadataResolver { return &metadataResolver{r.e.Metadata} }
+func (r *eventResolver) Data() string                { return string(r.e.Data) }
+
+type metadataResolver struct{ md EventMetadata }
+
+func (r *metadataResolver) CorrelationID() *string { return optionalString(r.md.CorrelationID) }
+func (r *metadataResolver) CausationID() *string   { return optionalString(r.md.CausationID) }
+func (r *metadataResolver) Actor() *string         { return optionalString(r.md.Actor) }
+func (r *metadataResolver) CommandID() *string     { return optionalString(r.md.CommandID) }
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"tsc-p7-cqrs/eventspb"
+	"tsc-p7-cqrs/orderspb"
+)
+
+// --- gRPC subscription API ---
+// Сервис EventStream (eventspb/events.proto) на GRPC_ADDR отдаёт журнал потоком SubscribeEvents;
+// догонка и фильтры те же, что у WebSocket. Там же работает сервис Orders (см. grpc_orders.go).
+// Reflection включён, чтобы grpcurl работал без .proto.
+type eventStreamServer struct {
+	eventspb.UnimplementedEventStreamServer
+}
+
+// startGRPC слушает addr в фоне; GRPC_ADDR=off выключает gRPC (пустое значение — адрес по умолчанию), тогда сервер nil.
+// С tlsConfig соединения шифруются тем же TLS, что и HTTP.
+func startGRPC(addr string, tlsConfig *tls.Config) (*grpc.Server, error) {
+	if addr == "off" {
+		return nil, nil
+	}
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(recoverUnary, authUnary),
+		grpc.ChainStreamInterceptor(recoverStream, authStream),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("grpc: listen %s: %w", addr, err)
+	}
+	srv := grpc.NewServer(opts...)
+	eventspb.RegisterEventStreamServer(srv, eventStreamServer{})
+	orderspb.RegisterOrdersServer(srv, ordersServer{})
+	reflection.Register(srv)
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			slog.Error("grpc: serve", "error", err)
+		}
+	}()
+	slog.Info("grpc: listening", "addr", addr)
+	return srv, nil
+}
+
+func (eventStreamServer) SubscribeEvents(req *eventspb.SubscribeEventsRequest, stream eventspb.EventStream_SubscribeEventsServer) error {
+	if req.FromPosition < 0 {
+		return status.Error(codes.InvalidArgument, "from_position must not be negative")
+	}
+	f := followEvents(stream.Context(), req.FromPosition)
+	for e := range f.C {
+		if len(req.Types) > 0 && !slices.Contains(req.Types, string(e.Type)) {
+			continue
+		}
+		if len(req.OrderIds) > 0 && !slices.Contains(req.OrderIds, e.OrderID) {
+			continue
+		}
+		if err := stream.Send(eventProto(e)); err != nil {
+			return err
+		}
+	}
+	err := f.Err()
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, errSlowConsumer):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
+
+func eventProto(e Event) *eventspb.Event {
+	return &eventspb.Event{
+		Type:          string(e.Type),
+		OrderId:       e.OrderID,
+		StreamId:      e.StreamID,
+		Version:       e.Version,
+		Position:      e.Position,
+		SchemaVersion: int32(e.SchemaVersion),
+		Timestamp:     timestamppb.New(e.Timestamp),
+		Metadata: &eventspb.EventMetadata{
+			CorrelationId: e.Metadata.CorrelationID,
+			CausationId:   e.Metadata.CausationID,
+			Actor:         e.Metadata.Actor,
+			CommandId:     e.Metadata.CommandID,
+		},
+		Data: e.Data,
+	}
+}
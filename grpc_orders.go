@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"tsc-p7-cqrs/eventspb"
+	"tsc-p7-cqrs/orderspb"
+)
+
+// --- gRPC command and query API ---
+// Сервис Orders (orderspb/orders.proto) повторяет REST API для внутренних сервисов: команды идут
+// через шину команд, запросы читают ту же read model и журнал. Заголовки REST становятся
+// метаданными вызова (x-correlation-id, x-causation-id, x-user-id), If-Match — полем expected_version.
+type ordersServer struct {
+	orderspb.UnimplementedOrdersServer
+}
+
+func (ordersServer) CreateOrder(ctx context.Context, req *orderspb.CreateOrderRequest) (*orderspb.CommandResult, error) {
+	t := CommandTarget{Key: req.IdempotencyKey, Metadata: grpcMetadata(ctx)}
+	return runGRPCCommand(ctx, CreateOrder{t, createRequestData(req)})
+}
+
+func (ordersServer) PayOrder(ctx context.Context, req *orderspb.PayOrderRequest) (*orderspb.CommandResult, error) {
+	t, err := grpcCommandTarget(ctx, req.OrderId, req.ExpectedVersion, req.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	return runGRPCCommand(ctx, PayOrder{t, paymentRequest{Amount: req.Amount, Currency: req.Currency, PaymentMethod: req.PaymentMethod}})
+}
+
+func (ordersServer) CancelOrder(ctx context.Context, req *orderspb.CancelOrderRequest) (*orderspb.CommandResult, error) {
+	t, err := grpcCommandTarget(ctx, req.OrderId, req.ExpectedVersion, req.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	return runGRPCCommand(ctx, CancelOrder{CommandTarget: t})
+}
+
+func (ordersServer) RefundOrder(ctx context.Context, req *orderspb.RefundOrderRequest) (*orderspb.CommandResult, error) {
+	t, err := grpcCommandTarget(ctx, req.OrderId, req.ExpectedVersion, req.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	return runGRPCCommand(ctx, RefundOrder{t, refundRequest{Amount: req.Amount, Currency: req.Currency, Reason: req.Reason}})
+}
+
+func (ordersServer) ShipOrder(ctx context.Context, req *orderspb.ShipOrderRequest) (*orderspb.CommandResult, error) {
+	t, err := grpcCommandTarget(ctx, req.OrderId, req.ExpectedVersion, req.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	return runGRPCCommand(ctx, ShipOrder{t, Shipment{Carrier: req.Carrier, TrackingNumber: req.TrackingNumber}})
+}
+
+func (ordersServer) DeliverOrder(ctx context.Context, req *orderspb.DeliverOrderRequest) (*orderspb.CommandResult, error) {
+	t, err := grpcCommandTarget(ctx, req.OrderId, req.ExpectedVersion, req.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	return runGRPCCommand(ctx, DeliverOrder{t})
+}
+
+func (ordersServer) ApplyCoupon(ctx context.Context, req *orderspb.ApplyCouponRequest) (*orderspb.CommandResult, error) {
+	t, err := grpcCommandTarget(ctx, req.OrderId, req.ExpectedVersion, req.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	return runGRPCCommand(ctx, ApplyCoupon{t, req.Code})
+}
+
+func (ordersServer) GetOrder(ctx context.Context, req *orderspb.GetOrderRequest) (*orderspb.Order, error) {
+	mutex.Lock()
+	o, ok := orders[req.OrderId]
+	mutex.Unlock()
+	if !ok || !tenantOwns(ctx, req.OrderId) {
+		return nil, status.Errorf(codes.NotFound, "order %q not found", req.OrderId)
+	}
+	return orderProto(sensitive.order(ctx, o)), nil
+}
+
+func (ordersServer) ListEvents(ctx context.Context, req *orderspb.ListEventsRequest) (*orderspb.ListEventsResponse, error) {
+	switch {
+	case req.AfterPosition < 0:
+		return nil, status.Error(codes.InvalidArgument, "after_position must not be negative")
+	case req.PageSize < 0:
+		return nil, status.Error(codes.InvalidArgument, "page_size must not be negative")
+	}
+	limit := eventsPageSize
+	if req.PageSize > 0 {
+		limit = min(int(req.PageSize), eventsPageSizeMax)
+	}
+	events, err := store.LoadAfter(ctx, req.AfterPosition, limit)
+	if err != nil {
+		return nil, commandStatus(ctx, err)
+	}
+	resp := &orderspb.ListEventsResponse{Events: make([]*eventspb.Event, len(events))}
+	for i, e := range events {
+		resp.Events[i] = eventProto(e)
+	}
+	if len(events) == limit {
+		resp.NextPosition = events[len(events)-1].Position // как Link rel="next" в GET /events
+	}
+	return resp, nil
+}
+
+// runGRPCCommand отправляет команду в шину и возвращает correlation id цепочки в заголовке ответа.
+func runGRPCCommand(ctx context.Context, c Command) (*orderspb.CommandResult, error) {
+	stored, replayed, err := bus.Dispatch(ctx, c)
+	if err != nil {
+		return nil, commandStatus(ctx, err)
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-correlation-id", stored.Metadata.CorrelationID))
+	return &orderspb.CommandResult{
+		OrderId:  stored.OrderID,
+		Version:  stored.Version,
+		Position: stored.Position,
+		Replayed: replayed,
+	}, nil
+}
+
+// grpcMetadata берёт метаданные события из метаданных вызова.
+func grpcMetadata(ctx context.Context) EventMetadata {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	m := commandMetadata(get("x-correlation-id"), get("x-causation-id"), get("x-user-id"))
+	m.Tenant = tenantFrom(ctx)
+	return m
+}
+
+// grpcCommandTarget проверяет адрес команды над существующим заказом; без expected_version версия не проверяется.
+func grpcCommandTarget(ctx context.Context, orderID string, v *int64, key string) (CommandTarget, error) {
+	t := CommandTarget{OrderID: orderID, Expected: anyVersion, Key: key}
+	if orderID == "" {
+		return t, status.Error(codes.InvalidArgument, "order_id is required")
+	}
+	if v != nil {
+		if *v < 0 {
+			return t, status.Error(codes.InvalidArgument, "expected_version must not be negative")
+		}
+		t.Expected = *v
+	}
+	t.Metadata = grpcMetadata(ctx)
+	return t, nil
+}
+
+// commandStatus переводит ошибку команды в статус gRPC, как writeCommandError — в код HTTP.
+func commandStatus(ctx context.Context, err error) error {
+	var conflict *versionConflictError
+	var invalid *invalidCommandError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.As(err, &invalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, errOrderNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errKeyReused), errors.Is(err, errPaymentMismatch), errors.Is(err, errRefundRejected), errors.Is(err, errCouponRejected):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errPaymentDeclined):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errPaymentGateway):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, errCommandQuota), errors.Is(err, errEventQuota):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.As(err, &conflict):
+		grpc.SetTrailer(ctx, metadata.Pairs("current-version", strconv.FormatInt(conflict.Current, 10)))
+		return status.Errorf(codes.Aborted, "version conflict: current version %d", conflict.Current)
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func orderProto(o Order) *orderspb.Order {
+	return &orderspb.Order{
+		Id:             o.ID,
+		Status:         string(o.Status),
+		Version:        o.Version,
+		CustomerId:     o.CustomerID,
+		Customer:       customerProto(o.Customer),
+		CustomerErased: o.CustomerErased,
+		Items:          itemsProto(o.Items),
+		Total:          o.Total,
+		Currency:       o.Currency,
+		AmountPaid:     o.AmountPaid,
+		AmountRefunded: o.AmountRefunded,
+		Outstanding:    o.Outstanding,
+		CreatedAt:      timestamppb.New(o.CreatedAt),
+		Shipment:       shipmentProto(o.Shipment),
+		Discount:       o.Discount,
+		Coupon:         o.Coupon,
+		PaymentError:   o.PaymentError,
+	}
+}
+
+// createRequestData переводит CreateOrderRequest в тело команды создания, как его разбирает REST API.
+func createRequestData(req *orderspb.CreateOrderRequest) orderCreatedData {
+	d := orderCreatedData{CustomerID: req.CustomerId, Customer: customerFromProto(req.Customer), Currency: req.Currency}
+	for _, it := range req.Items {
+		d.Items = append(d.Items, OrderItem{SKU: it.Sku, Quantity: it.Quantity, UnitPrice: it.UnitPrice})
+	}
+	return d
+}
+
+func itemsProto(items []OrderItem) []*orderspb.OrderItem {
+	out := make([]*orderspb.OrderItem, len(items))
+	for i, it := range items {
+		out[i] = &orderspb.OrderItem{Sku: it.SKU, Quantity: it.Quantity, UnitPrice: it.UnitPrice}
+	}
+	return out
+}
+
+func shipmentProto(s *Shipment) *orderspb.Shipment {
+	if s == nil {
+		return nil
+	}
+	return &orderspb.Shipment{Carrier: s.Carrier, TrackingNumber: s.TrackingNumber}
+}
+
+func customerFromProto(c *orderspb.Customer) *Customer {
+	if c == nil {
+		return nil
+	}
+	return &Customer{Name: c.Name, Email: c.Email, Phone: c.Phone, Address: c.Address}
+}
+
+func customerProto(c *Customer) *orderspb.Customer {
+	if c == nil {
+		return nil
+	}
+	return &orderspb.Customer{Name: c.Name, Email: c.Email, Phone: c.Phone, Address: c.Address}
+}
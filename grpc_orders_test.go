@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tsc-p7-cqrs/orderspb"
+)
+
+func TestListEventsPages(t *testing.T) {
+	h := openTenantService(t)
+	after := projections.head.Load()
+	for range 3 {
+		createTenantOrder(t, h, "paging", nil)
+	}
+	ctx := withTenant(context.Background(), "paging")
+	var srv ordersServer
+
+	var got []int64
+	req := &orderspb.ListEventsRequest{AfterPosition: after, PageSize: 2}
+	for pages := 0; ; pages++ {
+		if pages > 2 {
+			t.Fatalf("too many pages: %v", got)
+		}
+		res, err := srv.ListEvents(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Events) > 2 {
+			t.Fatalf("page of %d events, want at most 2", len(res.Events))
+		}
+		for _, e := range res.Events {
+			got = append(got, e.Position)
+		}
+		if res.NextPosition == 0 {
+			break
+		}
+		if res.NextPosition != got[len(got)-1] {
+			t.Fatalf("next_position %d, want last position %d", res.NextPosition, got[len(got)-1])
+		}
+		req.AfterPosition = res.NextPosition
+	}
+	if len(got) != 3 {
+		t.Errorf("positions %v, want 3 events", got)
+	}
+
+	for _, req := range []*orderspb.ListEventsRequest{{AfterPosition: -1}, {PageSize: -1}} {
+		if _, err := srv.ListEvents(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListEvents(%v): %v, want InvalidArgument", req, err)
+		}
+	}
+}
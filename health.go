@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// --- Health checks ---
+// GET /healthz — liveness: процесс жив и обслуживает HTTP; зависимости не проверяются, чтобы сбой базы
+// не приводил к перезапуску всех инстансов. GET /readyz — readiness: журнал событий (и read model
+// в Postgres или Redis, если заказы отдаются оттуда) отвечает за healthTimeout, ни одна проекция не
+// перестраивается и не отстаёт от головы журнала больше чем на readyMaxLag событий. Не готов — 503 и список
+// проверок, так что балансировщик снимает трафик с инстанса. HTTP поднимается только после догоняния
+// проекций при запуске, поэтому до него обе проверки просто не отвечают.
+
+var (
+	healthTimeout = 2 * time.Second
+	readyMaxLag   = int64(1000)
+)
+
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, code int, rep healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rep)
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthReport{Status: "ok"})
+}
+
+// probe выполняет проверку name с таймаутом healthTimeout.
+func probe(ctx context.Context, name string, fn func(ctx context.Context) error) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	if err := fn(ctx); err != nil {
+		return healthCheck{Name: name, Error: err.Error()}
+	}
+	return healthCheck{Name: name, OK: true}
+}
+
+// readinessChecks — проверки зависимостей и проекций.
+func readinessChecks(ctx context.Context) []healthCheck {
+	checks := []healthCheck{probe(ctx, "event_store", func(ctx context.Context) error {
+		// чтение с головы журнала: дёшево, но проходит через все обёртки хранилища до backend
+		_, err := store.LoadAfter(ctx, projections.head.Load(), 1)
+		return err
+	})}
+	if pgOrders != nil {
+		checks = append(checks, probe(ctx, "read_model_postgres", func(ctx context.Context) error {
+			return pgOrders.pool.Ping(ctx)
+		}))
+	}
+	if redisViews != nil {
+		checks = append(checks, probe(ctx, "read_model_redis", func(ctx context.Context) error {
+			return redisViews.rdb.Ping(ctx).Err()
+		}))
+	}
+	for _, st := range projections.statuses() {
+		c := healthCheck{Name: "projection " + st.Name, OK: true}
+		switch {
+		case st.Rebuild != nil && st.Rebuild.State == rebuildRunning:
+			c.OK, c.Error = false, fmt.Sprintf("rebuilding: %d of %d events", st.Rebuild.Processed, st.Rebuild.Total)
+		case st.Lag > readyMaxLag:
+			c.OK, c.Error = false, fmt.Sprintf("lagging %d events behind the log (max %d)", st.Lag, readyMaxLag)
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	checks := readinessChecks(r.Context())
+	for _, c := range checks {
+		if !c.OK {
+			writeHealth(w, http.StatusServiceUnavailable, healthReport{Status: "not ready", Checks: checks})
+			return
+		}
+	}
+	writeHealth(w, http.StatusOK, healthReport{Status: "ready", Checks: checks})
+}
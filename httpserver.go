@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- HTTP server limits ---
+// Без таймаутов медленный клиент держит соединение и горутину сколько угодно: заголовки по байту,
+// тело без конца, непрочитанный ответ. Сервер ограничивает чтение заголовков и тела, запись ответа,
+// простой keep-alive и размер заголовков (HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT,
+// HTTP_IDLE_TIMEOUT, HTTP_MAX_HEADER_BYTES). Контекст каждого запроса получает срок HTTP_REQUEST_TIMEOUT:
+// запросы к хранилищу и ожидания отменяются, а если обработчик так ничего и не ответил — 503. Срок
+// должен быть короче HTTP_WRITE_TIMEOUT и дольше long-poll (wait до 60 с), иначе ответ не успеет уйти.
+// Потоки (SSE, WebSocket, резервная копия) живут дольше любого срока: для них таймауты соединения
+// снимаются, а срок запроса не ставится — их ограничивает сам клиент и остановка сервиса.
+
+type httpServerOptions struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	RequestTimeout    time.Duration // 0 — без срока
+}
+
+// streamingRoutes — маршруты, ответ которых не ограничен по времени.
+var streamingRoutes = map[string]bool{"streamEvents": true, "subscribeEventsWS": true, "createBackup": true}
+
+func (o httpServerOptions) validate() error {
+	if o.RequestTimeout > 0 && o.WriteTimeout > 0 && o.RequestTimeout >= o.WriteTimeout {
+		return fmt.Errorf("HTTP_REQUEST_TIMEOUT (%s) must be shorter than HTTP_WRITE_TIMEOUT (%s)", o.RequestTimeout, o.WriteTimeout)
+	}
+	return nil
+}
+
+// server — http.Server с ограничениями o.
+func (o httpServerOptions) server(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: o.ReadHeaderTimeout,
+		ReadTimeout:       o.ReadTimeout,
+		WriteTimeout:      o.WriteTimeout,
+		IdleTimeout:       o.IdleTimeout,
+		MaxHeaderBytes:    o.MaxHeaderBytes,
+	}
+}
+
+// middleware — звено mux: срок запроса или снятие таймаутов соединения для потоков.
+func (o httpServerOptions) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr := mux.CurrentRoute(r)
+		if cr == nil || cr.GetName() == "" {
+			next.ServeHTTP(w, r) // служебные маршруты и прослойка registerLegacyAPI
+			return
+		}
+		if streamingRoutes[cr.GetName()] {
+			rc := http.NewResponseController(w)
+			_ = rc.SetReadDeadline(time.Time{}) // WebSocket читает из того же соединения
+			_ = rc.SetWriteDeadline(time.Time{})
+			next.ServeHTTP(w, r)
+			return
+		}
+		if o.RequestTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), o.RequestTimeout)
+		defer cancel()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) && r.Context().Err() == nil {
+			// обработчик принял отмену за уход клиента и промолчал
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusServiceUnavailable, "request_timeout", fmt.Sprintf("request did not complete within %s", o.RequestTimeout))
+		}
+	})
+}
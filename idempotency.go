@@ -0,0 +1,136 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// --- Idempotency ---
+// Idempotency-Key команды сохраняется в метаданных события (command_id), поэтому
+// обработанные ключи восстанавливаются из журнала вместе с read model. Ключ помнится ttl
+// (IDEMPOTENCY_TTL) с момента записи события: позже команда с тем же ключом выполняется как новая.
+// Ключи арендаторов (tenancy.go) не пересекаются: один и тот же ключ у двух арендаторов — две команды.
+type dedupStore struct {
+	ttl time.Duration // 0 — ключи не забываются
+
+	mu       sync.Mutex
+	done     map[string]Event         // dedupKey -> событие, записанное командой
+	inflight map[string]chan struct{} // команды, которые выполняются прямо сейчас
+}
+
+func newDedupStore() *dedupStore {
+	return &dedupStore{done: map[string]Event{}, inflight: map[string]chan struct{}{}}
+}
+
+var commands = newDedupStore()
+
+var errKeyReused = errors.New("Idempotency-Key was already used for a different request")
+
+// dedupCommands — звено шины: команда, уже выполненная с тем же Key, не повторяется — возвращается
+// её событие и replayed = true. Ключ другой команды или другого заказа — errKeyReused.
+func dedupCommands(d *dedupStore) CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, c Command) (Event, bool, error) {
+			t := c.Target()
+			if t.Key == "" {
+				return next(ctx, c)
+			}
+			tenant := cmp.Or(t.Metadata.Tenant, orderTenant(t.OrderID))
+			prev, done, release, err := d.claim(ctx, dedupKey(tenant, t.Key))
+			if err != nil {
+				return Event{}, false, err // клиент ушёл, пока ждали первую попытку
+			}
+			defer release()
+			if done {
+				if prev.Type != c.EventType() || (t.OrderID != "" && prev.OrderID != t.OrderID) {
+					return Event{}, false, errKeyReused
+				}
+				return prev, true, nil
+			}
+			stored, replayed, err := next(ctx, c)
+			if err == nil {
+				d.record(stored)
+			}
+			return stored, replayed, err
+		}
+	}
+}
+
+// dedupKey — ключ команды key арендатора tenant в dedupStore.
+func dedupKey(tenant, key string) string {
+	return tenantOrderID(tenant, key)
+}
+
+// record запоминает событие, записанное командой с Idempotency-Key.
+func (d *dedupStore) record(e Event) {
+	if e.Metadata.CommandID == "" || d.expired(e, time.Now()) {
+		return
+	}
+	e.Data = nil // для повтора ответа данные не нужны, а персональные данные незачем держать в памяти
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dedupKey(orderTenant(e.OrderID), e.Metadata.CommandID)
+	if _, ok := d.done[key]; !ok {
+		d.done[key] = e
+	}
+}
+
+// claim возвращает событие уже обработанной команды с ключом key либо резервирует ключ.
+// Параллельный повтор ждёт завершения первой попытки. release нужно вызвать в любом случае.
+func (d *dedupStore) claim(ctx context.Context, key string) (prev Event, done bool, release func(), err error) {
+	for {
+		d.mu.Lock()
+		if e, ok := d.done[key]; ok {
+			if !d.expired(e, time.Now()) {
+				d.mu.Unlock()
+				return e, true, func() {}, nil
+			}
+			delete(d.done, key)
+		}
+		ch, busy := d.inflight[key]
+		if !busy {
+			ch = make(chan struct{})
+			d.inflight[key] = ch
+			d.mu.Unlock()
+			return Event{}, false, func() {
+				d.mu.Lock()
+				delete(d.inflight, key)
+				d.mu.Unlock()
+				close(ch)
+			}, nil
+		}
+		d.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return Event{}, false, func() {}, ctx.Err()
+		}
+	}
+}
+
+func (d *dedupStore) expired(e Event, now time.Time) bool {
+	return d.ttl > 0 && now.Sub(e.Timestamp) > d.ttl
+}
+
+// sweep периодически забывает ключи старше ttl, чтобы память не росла с журналом.
+func (d *dedupStore) sweep(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			d.mu.Lock()
+			for key, e := range d.done {
+				if d.expired(e, now) {
+					delete(d.done, key)
+				}
+			}
+			d.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- Inventory ---
+// Склад — отдельный агрегат на каждый SKU: поток inventory-<sku> в том же журнале, что и заказы.
+// OrderID у событий склада — id агрегата (совпадает с именем потока): backend ведут версии потоков по нему.
+// Остаток меняется только событиями: StockAdded пополняет склад, StockReserved резервирует товар
+// под заказ, StockCommitted списывает резерв оплаченного заказа, StockReleased снимает резерв.
+//
+// Сага (INVENTORY_SAGA=true) читает журнал релеем outbox: на OrderCreated резервирует позиции заказа,
+// на оплату списывает резерв, на OrderCanceled и OrderExpired снимает его. Если какой-то позиции
+// не хватает, уже сделанные резервы снимаются и заказ отменяется (компенсация). Доставка at-least-once,
+// поэтому каждый шаг проверяет состояние агрегата: повторный резерв или снятие того же заказа — no-op.
+
+const (
+	EventStockAdded     EventType = "StockAdded"
+	EventStockReserved  EventType = "StockReserved"
+	EventStockCommitted EventType = "StockCommitted"
+	EventStockReleased  EventType = "StockReleased"
+)
+
+const inventoryStreamPrefix = "inventory-"
+
+func inventoryStream(sku string) string {
+	return inventoryStreamPrefix + sku
+}
+
+// stockData — Data событий склада; OrderID пуст у StockAdded.
+type stockData struct {
+	SKU      string `json:"sku"`
+	OrderID  string `json:"order_id,omitempty"`
+	Quantity int64  `json:"quantity"`
+}
+
+// Stock — остаток SKU на складе.
+type Stock struct {
+	SKU       string `json:"sku"`
+	OnHand    int64  `json:"on_hand"`   // на складе, включая зарезервированное
+	Reserved  int64  `json:"reserved"`  // под неоплаченные заказы
+	Available int64  `json:"available"` // можно зарезервировать
+	Version   int64  `json:"version"`
+
+	reservations map[string]int64 // заказ -> зарезервированное количество
+}
+
+// apply переводит остаток в состояние после события e; общий шаг для проекции и агрегата.
+func (s *Stock) apply(e Event) {
+	var data stockData
+	json.Unmarshal(e.Data, &data)
+	if s.reservations == nil {
+		s.reservations = map[string]int64{}
+	}
+	s.SKU = data.SKU
+	switch e.Type {
+	case EventStockAdded:
+		s.OnHand += data.Quantity
+	case EventStockReserved:
+		s.Reserved += data.Quantity
+		s.reservations[data.OrderID] = data.Quantity
+	case EventStockCommitted:
+		s.OnHand -= s.reservations[data.OrderID]
+		s.Reserved -= s.reservations[data.OrderID]
+		delete(s.reservations, data.OrderID)
+	case EventStockReleased:
+		s.Reserved -= s.reservations[data.OrderID]
+		delete(s.reservations, data.OrderID)
+	}
+	s.Available = s.OnHand - s.Reserved
+	s.Version = e.Version
+}
+
+// stockLevels — проекция остатков по SKU (проекция "inventory").
+var (
+	stockMu     sync.Mutex
+	stockLevels = map[string]*Stock{}
+)
+
+// applyStockEvent обновляет проекцию остатков; остальные события пропускает.
+func applyStockEvent(e Event) {
+	if !isStockEvent(e.Type) {
+		return
+	}
+	stockMu.Lock()
+	defer stockMu.Unlock()
+	var data stockData
+	json.Unmarshal(e.Data, &data)
+	s, ok := stockLevels[data.SKU]
+	if !ok {
+		s = &Stock{}
+		stockLevels[data.SKU] = s
+	}
+	if e.Version > s.Version {
+		s.apply(e)
+	}
+}
+
+func resetStock() {
+	stockMu.Lock()
+	defer stockMu.Unlock()
+	stockLevels = map[string]*Stock{}
+}
+
+func isStockEvent(t EventType) bool {
+	switch t {
+	case EventStockAdded, EventStockReserved, EventStockCommitted, EventStockReleased:
+		return true
+	}
+	return false
+}
+
+// loadStock восстанавливает агрегат склада из его потока.
+func loadStock(ctx context.Context, sku string) (Stock, error) {
+	events, err := store.LoadByOrder(ctx, inventoryStream(sku))
+	if err != nil {
+		return Stock{}, err
+	}
+	s := Stock{SKU: sku, reservations: map[string]int64{}}
+	for _, e := range events {
+		s.apply(e)
+	}
+	return s, nil
+}
+
+var errOutOfStock = errors.New("out of stock")
+
+// changeStock добавляет событие заказа orderID (пусто у StockAdded) в поток SKU, если decide его возвращает;
+// при конфликте версий состояние перечитывается и решение принимается заново. decide без события (false) — no-op.
+func changeStock(ctx context.Context, sku, orderID string, md EventMetadata, decide func(s Stock) (EventType, int64, bool, error)) (Stock, error) {
+	for {
+		s, err := loadStock(ctx, sku)
+		if err != nil {
+			return Stock{}, err
+		}
+		t, qty, ok, err := decide(s)
+		if err != nil || !ok {
+			return s, err
+		}
+		data, err := json.Marshal(stockData{SKU: sku, OrderID: orderID, Quantity: qty})
+		if err != nil {
+			return Stock{}, err
+		}
+		stored, err := store.Append(ctx, Event{
+			Type:      t,
+			OrderID:   inventoryStream(sku),
+			StreamID:  inventoryStream(sku),
+			Timestamp: time.Now(),
+			Metadata:  md,
+			Data:      data,
+		}, s.Version)
+		var conflict *versionConflictError
+		if errors.As(err, &conflict) {
+			continue
+		}
+		if err != nil {
+			return Stock{}, err
+		}
+		s.apply(stored)
+		return s, nil
+	}
+}
+
+// --- Inventory saga ---
+
+type inventorySaga struct{}
+
+// sagaMetadata продолжает цепочку события заказа e; причина шага — само событие (поток@версия).
+func sagaMetadata(e Event) EventMetadata {
+	return commandMetadata(e.Metadata.CorrelationID, fmt.Sprintf("%s@%d", e.StreamID, e.Version), "inventory-saga")
+}
+
+// handle выполняет шаг саги для события заказа; ошибка — транзиентная, шаг нужно повторить.
+func (inventorySaga) handle(ctx context.Context, e Event) error {
+	switch e.Type {
+	case EventOrderCreated:
+		return reserveOrder(ctx, e)
+	case EventOrderPaid, EventOrderPaymentReceived:
+		o, err := loadOrder(ctx, e.OrderID)
+		if err != nil || o.Status != StatusPaid {
+			return err
+		}
+		return settleOrder(ctx, e, o, EventStockCommitted)
+	case EventOrderCanceled, EventOrderExpired:
+		o, err := loadOrder(ctx, e.OrderID)
+		if err != nil {
+			return err
+		}
+		return settleOrder(ctx, e, o, EventStockReleased)
+	}
+	return nil
+}
+
+// reserveOrder резервирует позиции нового заказа; если какой-то позиции не хватает, снимает
+// уже сделанные резервы и отменяет заказ.
+func reserveOrder(ctx context.Context, e Event) error {
+	var data orderCreatedData
+	json.Unmarshal(e.Data, &data)
+	items := itemsBySKU(data.Items)
+	md := sagaMetadata(e)
+	for i, it := range items {
+		_, err := changeStock(ctx, it.SKU, e.OrderID, md, func(s Stock) (EventType, int64, bool, error) {
+			if _, ok := s.reservations[e.OrderID]; ok {
+				return "", 0, false, nil // уже зарезервировано при прошлой доставке
+			}
+			if s.Available < it.Quantity {
+				return "", 0, false, fmt.Errorf("%w: %s: requested %d, available %d", errOutOfStock, it.SKU, it.Quantity, s.Available)
+			}
+			return EventStockReserved, it.Quantity, true, nil
+		})
+		if errors.Is(err, errOutOfStock) {
+			return compensate(ctx, e, items[:i], err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// itemsBySKU складывает позиции одного SKU: резерв заказа на SKU — один.
+func itemsBySKU(items []OrderItem) []OrderItem {
+	var out []OrderItem
+	index := map[string]int{}
+	for _, it := range items {
+		if i, ok := index[it.SKU]; ok {
+			out[i].Quantity += it.Quantity
+			continue
+		}
+		index[it.SKU] = len(out)
+		out = append(out, it)
+	}
+	return out
+}
+
+// compensate снимает резервы позиций reserved и отменяет заказ с причиной cause.
+func compensate(ctx context.Context, e Event, reserved []OrderItem, cause error) error {
+	md := sagaMetadata(e)
+	for _, it := range reserved {
+		if _, err := changeStock(ctx, it.SKU, e.OrderID, md, releaseDecision(e.OrderID, EventStockReleased)); err != nil {
+			return err
+		}
+	}
+	_, _, err := bus.Dispatch(ctx, CancelOrder{
+		CommandTarget: CommandTarget{
+			OrderID:  e.OrderID,
+			Expected: anyVersion,
+			Key:      "inventory-saga/cancel/" + e.OrderID,
+			Metadata: md,
+		},
+		Reason: cause.Error(),
+	})
+	if errors.Is(err, errInvalidTransition) {
+		slog.WarnContext(ctx, "inventory saga: not canceling", "order_id", e.OrderID, "cause", cause, "error", err)
+		return nil
+	}
+	if err == nil {
+		slog.InfoContext(ctx, "inventory saga: canceled order", "order_id", e.OrderID, "cause", cause)
+	}
+	return err
+}
+
+// settleOrder списывает (StockCommitted) или снимает (StockReleased) резервы заказа o.
+func settleOrder(ctx context.Context, e Event, o Order, t EventType) error {
+	md := sagaMetadata(e)
+	for _, it := range itemsBySKU(o.Items) {
+		if _, err := changeStock(ctx, it.SKU, o.ID, md, releaseDecision(o.ID, t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseDecision — шаг над резервом заказа; без резерва (уже снят или не делался) — no-op.
+func releaseDecision(orderID string, t EventType) func(s Stock) (EventType, int64, bool, error) {
+	return func(s Stock) (EventType, int64, bool, error) {
+		qty, ok := s.reservations[orderID]
+		return t, qty, ok, nil
+	}
+}
+
+// startInventorySaga запускает сагу релеем по журналу; транзиентные ошибки шага повторяются.
+func startInventorySaga(ctx context.Context, s EventStore, cps checkpointStore) error {
+	var saga inventorySaga
+	return newOutboxRelay("inventory-saga", s, cps, func(ctx context.Context, e Event) {
+		backoff := publishBackoffMin
+		for attempt := 1; ctx.Err() == nil; attempt++ {
+			err := saga.handle(ctx, e)
+			if err == nil {
+				return
+			}
+			slog.WarnContext(ctx, "inventory saga: step failed", "stream_id", e.StreamID, "version", e.Version,
+				"event_type", e.Type, "attempt", attempt, "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, publishBackoffMax)
+		}
+	}).start(ctx)
+}
+
+// --- Inventory API ---
+
+type addStockRequest struct {
+	Quantity int64 `json:"quantity"`
+}
+
+// addStock пополняет склад SKU; тело {"quantity": n}.
+func addStock(w http.ResponseWriter, r *http.Request) {
+	var req addStockRequest
+	if err := readBody(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.Quantity <= 0 {
+		httpError(w, "quantity must be positive", http.StatusBadRequest)
+		return
+	}
+	sku := mux.Vars(r)["sku"]
+	md := requestMetadata(w, r)
+	s, err := changeStock(r.Context(), sku, "", md, func(Stock) (EventType, int64, bool, error) {
+		return EventStockAdded, req.Quantity, true, nil
+	})
+	if err != nil {
+		writeCommandError(w, err)
+		return
+	}
+	w.Header().Set("ETag", versionETag(s.Version))
+	writeBody(w, r, http.StatusOK, s)
+}
+
+// getStock отдаёт остаток SKU из проекции; SKU, которого не пополняли, — 404.
+func getStock(w http.ResponseWriter, r *http.Request) {
+	sku := mux.Vars(r)["sku"]
+	stockMu.Lock()
+	s, ok := stockLevels[sku]
+	var out Stock
+	if ok {
+		out = *s
+	}
+	stockMu.Unlock()
+	if !ok {
+		httpError(w, "SKU not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", versionETag(out.Version))
+	writeBody(w, r, http.StatusOK, out)
+}
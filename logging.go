@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// --- Logging ---
+// Лог пишется через log/slog: LOG_FORMAT=text (по умолчанию) или json для сборщиков логов, LOG_LEVEL —
+// debug, info (по умолчанию), warn или error. Записи с контекстом запроса получают request_id (из X-Request-ID
+// или новый; он же возвращается в ответе) и trace_id активного спана. Стандартный log после setupLogging
+// пишет в тот же обработчик, так что log.Fatal при запуске попадает в тот же формат. Строки о запросах
+// HTTP пишет отдельный журнал доступа (accesslog.go). LOG_LEVEL меняется без перезапуска (reload.go).
+
+type requestIDKey struct{}
+
+// logLevel — уровень обработчика по умолчанию; перезагрузка настроек меняет его на ходу.
+var logLevel = new(slog.LevelVar)
+
+// requestIDFrom — id запроса из контекста; пусто вне запроса HTTP.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler добавляет к записи request_id и trace_id из контекста.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogging ставит slog-логгер по умолчанию.
+func setupLogging(format, level string) error {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	logLevel.Set(lv)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("LOG_FORMAT: unknown format %q (text or json)", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	log.SetFlags(0)                         // время пишет сам slog
+	slog.SetLogLoggerLevel(slog.LevelError) // через log идут только log.Fatal при запуске
+	return nil
+}
+
+// requestIDs — middleware mux: id запроса из X-Request-ID или новый, в контексте и в ответе.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestIDFrom(r.Context()) != "" {
+			next.ServeHTTP(w, r) // путь без версии, переписанный registerLegacyAPI
+			return
+		}
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
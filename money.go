@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// --- Money ---
+// Суммы хранятся целыми числами в минимальных единицах валюты (копейках, центах, иенах) вместе
+// с кодом ISO 4217; float64 нигде не участвует. Число знаков после запятой нужно только для текста.
+
+// currencyExponents — валюты, у которых минимальная единица не сотая часть; у остальных — 2 знака.
+var currencyExponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+var (
+	errPaymentMismatch = errors.New("payment rejected")
+	errRefundRejected  = errors.New("refund rejected")
+)
+
+// normalizeCurrency приводит код валюты к верхнему регистру и проверяет, что это три латинские буквы.
+func normalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(code)
+	if len(code) != 3 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", fmt.Errorf("invalid currency %q: expected ISO 4217 code", code)
+	}
+	return code, nil
+}
+
+// formatMoney печатает сумму в основных единицах: 259900 RUB -> "2599.00 RUB".
+func formatMoney(amount int64, currency string) string {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		exp = 2
+	}
+	sign, abs := "", strconv.FormatUint(uint64(amount), 10)
+	if amount < 0 {
+		sign, abs = "-", strconv.FormatUint(uint64(-amount), 10)
+	}
+	if exp > 0 {
+		if len(abs) <= exp {
+			abs = strings.Repeat("0", exp-len(abs)+1) + abs
+		}
+		abs = abs[:len(abs)-exp] + "." + abs[len(abs)-exp:]
+	}
+	return strings.TrimSpace(sign + abs + " " + currency)
+}
+
+// itemsTotal складывает позиции заказа; ok = false при переполнении int64.
+func itemsTotal(items []OrderItem) (total int64, ok bool) {
+	for _, it := range items {
+		if it.Quantity != 0 && it.UnitPrice > math.MaxInt64/it.Quantity {
+			return 0, false
+		}
+		sum := it.Quantity * it.UnitPrice
+		if total > math.MaxInt64-sum {
+			return 0, false
+		}
+		total += sum
+	}
+	return total, true
+}
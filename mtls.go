@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// --- Client certificates (mTLS) ---
+// Внутренние сервисы аутентифицируются сертификатом клиента вместо токена или ключа API. MTLS_CLIENT_CA —
+// PEM-бандл УЦ, выпускающих сертификаты клиентов; работает только поверх TLS (tls.go), для HTTP и gRPC
+// сразу. MTLS_REQUIRED=false (по умолчанию): сертификат проверяется, если клиент его предъявил, остальные
+// входят с токеном или ключом, а без них не получают никаких прав (rbac.go); true — без действительного сертификата соединение не устанавливается,
+// и пробам Kubernetes тоже нужен сертификат. Отзыв: MTLS_CRL_FILE — списки отзыва УЦ из бандла (PEM или DER),
+// перечитываются каждые MTLS_CRL_REFRESH; MTLS_OCSP — спросить OCSP-ответчик из сертификата (ответ
+// кэшируется до NextUpdate); ответчик недоступен — отказ, если не MTLS_OCSP_FAIL_OPEN. MTLS_ALLOWED_CLIENTS
+// ограничивает имена клиентов. Имя — CN, без него первый DNS или URI SAN; автор команд — cert:<имя>,
+// права — роль MTLS_ROLE (operator, см. rbac.go), арендатора клиент выбирает заголовком (tenancy.go).
+
+type mtlsOptions struct {
+	CAFile         string
+	Required       bool
+	CRLFile        string
+	CRLRefresh     time.Duration
+	OCSP           bool
+	OCSPFailOpen   bool
+	OCSPTimeout    time.Duration
+	AllowedClients []string // пусто — любой клиент с сертификатом УЦ
+	Role           string
+}
+
+var errCertRevoked = errors.New("client certificate is revoked")
+
+// ocspStatus — кэшированный ответ OCSP.
+type ocspStatus struct {
+	revoked bool
+	until   time.Time
+}
+
+type clientCertAuth struct {
+	opts   mtlsOptions
+	cas    []*x509.Certificate
+	pool   *x509.CertPool
+	client *http.Client
+
+	mu      sync.RWMutex
+	revoked map[string]bool // издатель + серийный номер -> отозван по CRL
+	ocsp    map[string]ocspStatus
+}
+
+// clientCerts — проверка сертификатов клиентов; nil — mTLS выключен.
+var clientCerts *clientCertAuth
+
+// openClientCerts читает бандл УЦ и списки отзыва; без MTLS_CLIENT_CA — nil.
+func openClientCerts(ctx context.Context, opts mtlsOptions) (*clientCertAuth, error) {
+	if opts.CAFile == "" {
+		return nil, nil
+	}
+	if _, ok := roleScopes[opts.Role]; !ok {
+		return nil, fmt.Errorf("mtls: MTLS_ROLE: unknown role %q: expected reader, operator or admin", opts.Role)
+	}
+	data, err := os.ReadFile(opts.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("mtls: %w", err)
+	}
+	a := &clientCertAuth{opts: opts, pool: x509.NewCertPool(), client: &http.Client{Timeout: opts.OCSPTimeout},
+		revoked: map[string]bool{}, ocsp: map[string]ocspStatus{}}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("mtls: MTLS_CLIENT_CA: %w", err)
+		}
+		a.cas = append(a.cas, ca)
+		a.pool.AddCert(ca)
+	}
+	if len(a.cas) == 0 {
+		return nil, errors.New("mtls: MTLS_CLIENT_CA: no certificates")
+	}
+	if opts.CRLFile != "" {
+		if err := a.loadCRL(); err != nil {
+			return nil, err
+		}
+		if opts.CRLRefresh > 0 {
+			go a.refreshCRL(ctx)
+		}
+	}
+	slog.Info("mtls: client certificates", "cas", len(a.cas), "required", opts.Required, "crl", opts.CRLFile != "", "ocsp", opts.OCSP)
+	return a, nil
+}
+
+// configure включает проверку сертификатов клиентов в cfg.
+func (a *clientCertAuth) configure(cfg *tls.Config) error {
+	if cfg == nil {
+		return errors.New("mtls: MTLS_CLIENT_CA requires TLS (TLS_CERT_FILE/TLS_KEY_FILE or TLS_AUTOCERT_DOMAINS)")
+	}
+	cfg.ClientCAs = a.pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if a.opts.Required {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	cfg.VerifyConnection = a.verifyConnection
+	return nil
+}
+
+// loadCRL перечитывает MTLS_CRL_FILE; список без подписи УЦ из бандла — ошибка.
+func (a *clientCertAuth) loadCRL() error {
+	data, err := os.ReadFile(a.opts.CRLFile)
+	if err != nil {
+		return fmt.Errorf("mtls: %w", err)
+	}
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+	revoked := map[string]bool{}
+	for _, der := range ders {
+		rl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("mtls: MTLS_CRL_FILE: %w", err)
+		}
+		i := slices.IndexFunc(a.cas, func(ca *x509.Certificate) bool {
+			return bytes.Equal(ca.RawSubject, rl.RawIssuer) && rl.CheckSignatureFrom(ca) == nil
+		})
+		if i < 0 {
+			return errors.New("mtls: MTLS_CRL_FILE: list is not signed by a CA from MTLS_CLIENT_CA")
+		}
+		if !rl.NextUpdate.IsZero() && time.Now().After(rl.NextUpdate) {
+			slog.Warn("mtls: revocation list is out of date", "issuer", a.cas[i].Subject.String(), "next_update", rl.NextUpdate)
+		}
+		for _, entry := range rl.RevokedCertificateEntries {
+			revoked[string(rl.RawIssuer)+entry.SerialNumber.String()] = true
+		}
+	}
+	a.mu.Lock()
+	a.revoked = revoked
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *clientCertAuth) refreshCRL(ctx context.Context) {
+	t := time.NewTicker(a.opts.CRLRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := a.loadCRL(); err != nil {
+				slog.Error("mtls: reload revocation list, previous list stays in effect", "error", err)
+			}
+		}
+	}
+}
+
+// verifyConnection — проверка после цепочки: имя клиента, CRL и OCSP.
+func (a *clientCertAuth) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil // сертификата нет; MTLS_REQUIRED отклоняет такие соединения раньше
+	}
+	chain := cs.VerifiedChains[0]
+	leaf := chain[0]
+	issuer := leaf
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+	name := clientCertName(leaf)
+	if len(a.opts.AllowedClients) > 0 && !slices.Contains(a.opts.AllowedClients, name) {
+		slog.Info("mtls: client rejected", "client", name, "reason", "not in MTLS_ALLOWED_CLIENTS")
+		return fmt.Errorf("mtls: client %q is not allowed", name)
+	}
+	a.mu.RLock()
+	revoked := a.revoked[string(leaf.RawIssuer)+leaf.SerialNumber.String()]
+	a.mu.RUnlock()
+	if revoked {
+		slog.Info("mtls: client rejected", "client", name, "reason", "revoked (CRL)")
+		return errCertRevoked
+	}
+	if a.opts.OCSP {
+		if err := a.checkOCSP(leaf, issuer); err != nil {
+			slog.Info("mtls: client rejected", "client", name, "reason", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOCSP спрашивает ответчик из сертификата; сертификат без ответчика не проверяется.
+func (a *clientCertAuth) checkOCSP(leaf, issuer *x509.Certificate) error {
+	if len(leaf.OCSPServer) == 0 {
+		return nil
+	}
+	key := string(leaf.RawIssuer) + leaf.SerialNumber.String()
+	a.mu.RLock()
+	cached, ok := a.ocsp[key]
+	a.mu.RUnlock()
+	if ok && time.Now().Before(cached.until) {
+		if cached.revoked {
+			return errCertRevoked
+		}
+		return nil
+	}
+	st, err := a.queryOCSP(leaf, issuer)
+	if err != nil {
+		if a.opts.OCSPFailOpen {
+			slog.Warn("mtls: ocsp unavailable, accepting certificate", "responder", leaf.OCSPServer[0], "error", err)
+			return nil
+		}
+		return fmt.Errorf("mtls: ocsp: %w", err)
+	}
+	a.mu.Lock()
+	a.ocsp[key] = st
+	a.mu.Unlock()
+	if st.revoked {
+		return errCertRevoked
+	}
+	return nil
+}
+
+func (a *clientCertAuth) queryOCSP(leaf, issuer *x509.Certificate) (ocspStatus, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	resp, err := a.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ocspStatus{}, fmt.Errorf("responder: HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	r, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	switch r.Status {
+	case ocsp.Good, ocsp.Revoked:
+	default:
+		return ocspStatus{}, errors.New("responder does not know the certificate")
+	}
+	until := r.NextUpdate
+	if until.IsZero() {
+		until = time.Now().Add(time.Hour)
+	}
+	return ocspStatus{revoked: r.Status == ocsp.Revoked, until: until}, nil
+}
+
+// clientCertName — имя клиента по сертификату.
+func clientCertName(c *x509.Certificate) string {
+	switch {
+	case c.Subject.CommonName != "":
+		return c.Subject.CommonName
+	case len(c.DNSNames) > 0:
+		return c.DNSNames[0]
+	case len(c.URIs) > 0:
+		return c.URIs[0].String()
+	}
+	return c.SerialNumber.String()
+}
+
+type clientCertKey struct{}
+
+// clientCertFrom — имя клиента, предъявившего сертификат; "" — без сертификата.
+func clientCertFrom(ctx context.Context) string {
+	name, _ := ctx.Value(clientCertKey{}).(string)
+	return name
+}
+
+// clientCertActor — автор команд клиента с сертификатом.
+func clientCertActor(name string) string { return "cert:" + name }
+
+// middleware — звено mux перед ключами API: запрос с сертификатом ни ключ, ни токен уже не проверяют.
+func (a *clientCertAuth) middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := clientCertName(r.TLS.VerifiedChains[0][0])
+		r.Header.Set("X-User-ID", clientCertActor(name))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientCertKey{}, name)))
+	})
+}
+
+// grpcClientCert — клиент вызова gRPC по сертификату соединения; ok — сертификат есть.
+func grpcClientCert(ctx context.Context) (context.Context, bool) {
+	if clientCerts == nil {
+		return ctx, false
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ctx, false
+	}
+	name := clientCertName(info.State.VerifiedChains[0][0])
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+	md.Set("x-user-id", clientCertActor(name))
+	ctx = metadata.NewIncomingContext(ctx, md)
+	return context.WithValue(ctx, clientCertKey{}, name), true
+}
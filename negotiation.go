@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	"tsc-p7-cqrs/eventspb"
+	"tsc-p7-cqrs/orderspb"
+)
+
+// --- Content negotiation ---
+// Тела команд и результаты запросов передаются как JSON (по умолчанию), Protobuf (сообщения
+// orderspb и eventspb) или MessagePack (поля и имена — как в JSON, data событий — байты JSON).
+// Формат ответа выбирается по Accept, формат тела — по Content-Type; тело с любым другим Content-Type
+// читается как JSON, как и раньше. Ответы без сообщения Protobuf (пакет команд, ошибки)
+// при Accept: application/x-protobuf отдаются в JSON.
+
+const (
+	mediaJSON     = "application/json"
+	mediaProtobuf = "application/x-protobuf"
+	mediaMsgpack  = "application/msgpack"
+)
+
+// mediaTypes сводит распространённые названия форматов к каноническим.
+var mediaTypes = map[string]string{
+	"application/json":                mediaJSON,
+	"application/x-protobuf":          mediaProtobuf,
+	"application/protobuf":            mediaProtobuf,
+	"application/vnd.google.protobuf": mediaProtobuf,
+	"application/msgpack":             mediaMsgpack,
+	"application/x-msgpack":           mediaMsgpack,
+	"application/vnd.msgpack":         mediaMsgpack,
+}
+
+var errUnsupportedMediaType = errors.New("unsupported Content-Type: this command has no Protobuf message, use JSON or MessagePack")
+
+// responseMedia выбирает формат ответа из Accept по весу q; без подходящего формата — JSON.
+func responseMedia(r *http.Request, protobuf bool) string {
+	best, bestQ := mediaJSON, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		canonical, ok := mediaTypes[mt]
+		if !ok || (canonical == mediaProtobuf && !protobuf) {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = canonical, q
+		}
+	}
+	return best
+}
+
+// writeBody отвечает значением v в формате, выбранном по Accept.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, v any) {
+	msg := protoMessage(v)
+	mt := responseMedia(r, msg != nil)
+	var body []byte
+	var err error
+	switch mt {
+	case mediaProtobuf:
+		body, err = proto.Marshal(msg)
+	case mediaMsgpack:
+		body, err = marshalMsgpack(v)
+	default:
+		body, err = json.Marshal(v)
+		body = append(body, '\n')
+	}
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mt)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// readBody разбирает тело запроса в v по Content-Type. Пустое тело — io.EOF, как у json.Decoder.
+func readBody(r *http.Request, v any) error {
+	mt := mediaJSON
+	if parsed, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaTypes[parsed] != "" {
+		mt = mediaTypes[parsed]
+	}
+	if mt == mediaJSON {
+		return json.NewDecoder(r.Body).Decode(v)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return io.EOF
+	}
+	if mt == mediaMsgpack {
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	}
+	return unmarshalProto(data, v)
+}
+
+// writeBodyError отвечает на ошибку readBody.
+func writeBodyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedMediaType) {
+		writeError(w, err, http.StatusUnsupportedMediaType)
+		return
+	}
+	httpError(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+}
+
+func marshalMsgpack(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// protoMessage возвращает сообщение Protobuf для ответа v или nil, если у такого ответа его нет.
+func protoMessage(v any) proto.Message {
+	switch v := v.(type) {
+	case Order:
+		return orderProto(v)
+	case []Order:
+		list := &orderspb.OrderList{Orders: make([]*orderspb.Order, len(v))}
+		for i, o := range v {
+			list.Orders[i] = orderProto(o)
+		}
+		return list
+	case commandResult:
+		return &orderspb.CommandResult{OrderId: v.OrderID, Version: v.Version, Position: v.Position}
+	case []Event:
+		list := &orderspb.ListEventsResponse{Events: make([]*eventspb.Event, len(v))}
+		for i, e := range v {
+			list.Events[i] = eventProto(e)
+		}
+		return list
+	}
+	return nil
+}
+
+// unmarshalProto разбирает тело команды, у которой есть сообщение Protobuf.
+func unmarshalProto(data []byte, v any) error {
+	switch v := v.(type) {
+	case *orderCreatedData:
+		var req orderspb.CreateOrderRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		*v = createRequestData(&req)
+		return nil
+	case *paymentRequest:
+		var req orderspb.PayOrderRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		*v = paymentRequest{Amount: req.Amount, Currency: req.Currency}
+		return nil
+	case *refundRequest:
+		var req orderspb.RefundOrderRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		*v = refundRequest{Amount: req.Amount, Currency: req.Currency, Reason: req.Reason}
+		return nil
+	case *couponRequest:
+		var req orderspb.ApplyCouponRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		*v = couponRequest{Code: req.Code}
+		return nil
+	case *Shipment:
+		var req orderspb.ShipOrderRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		*v = Shipment{Carrier: req.Carrier, TrackingNumber: req.TrackingNumber}
+		return nil
+	}
+	return errUnsupportedMediaType
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- OIDC login (browser sessions) ---
+// Людям, которые открывают /docs (Swagger UI) и маршруты /admin и /events из браузера, токен руками не
+// подставить: с OIDC_ISSUER и OIDC_CLIENT_ID они входят через провайдера по authorization code с PKCE.
+// GET /auth/login?redirect=<путь> уводит к провайдеру, GET /auth/callback (OIDC_REDIRECT_URL) меняет код на
+// id_token, проверяет его ключами JWKS издателя (jwt.go) и nonce и ставит сессию — подписанную OIDC_SESSION_KEY
+// cookie на OIDC_SESSION_TTL. Роли сессии — группы из claim OIDC_GROUPS_CLAIM (groups), сопоставленные
+// OIDC_GROUP_ROLES (platform-admins=admin,support=reader); без подходящей группы — OIDC_DEFAULT_ROLE, а без
+// неё вход отклоняется (403). Дальше с сессией запрос — как с токеном этих ролей (rbac.go): автор —
+// claim OIDC_ACTOR_CLAIM (sub), арендатор — claim TENANT_CLAIM (tenancy.go). Команды с сессией требуют
+// X-CSRF-Token со значением cookie cqrs_csrf; Swagger UI подставляет его сам. Запросы с Authorization,
+// X-API-Key или сертификатом клиента cookie не читают. Браузер без сессии на GET вместо 401 уводится на вход.
+// GET /auth/logout удаляет сессию, GET /auth/session показывает её.
+
+const (
+	sessionCookie = "cqrs_session"
+	csrfCookie    = "cqrs_csrf"
+	stateCookie   = "cqrs_oidc"
+	loginTimeout  = 10 * time.Minute // от /auth/login до /auth/callback
+)
+
+var (
+	errLoginFailed = errors.New("login failed")
+	errCSRF        = errors.New("missing or invalid X-CSRF-Token")
+)
+
+// publicRoutes — маршруты входа: открыты без учётных данных и арендатора.
+var publicRoutes = map[string]bool{"/auth/login": true, "/auth/callback": true, "/auth/logout": true, "/auth/session": true}
+
+type oidcOptions struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // пусто — публичный клиент, только PKCE
+	RedirectURL  string
+	Scopes       []string
+	ActorClaim   string
+	GroupsClaim  string
+	GroupRoles   map[string]string // группа -> роль
+	DefaultRole  string            // пусто — без группы вход отклоняется
+	SessionTTL   time.Duration
+	SessionKey   string // base64, не короче 32 байт
+	Leeway       time.Duration
+	Refresh      time.Duration
+}
+
+// oidcProvider — нужные поля OpenID discovery.
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// browserSession — содержимое cookie сессии.
+type browserSession struct {
+	Actor   string   `json:"actor"`
+	Roles   []string `json:"roles"`
+	Tenant  string   `json:"tenant,omitempty"`
+	CSRF    string   `json:"csrf"`
+	Expires int64    `json:"exp"` // Unix
+}
+
+// loginState — cookie между /auth/login и /auth/callback.
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code_verifier
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+type oidcLogin struct {
+	opts     oidcOptions
+	verifier *jwtAuth // проверка id_token
+	key      []byte   // подпись cookie
+	secure   bool     // cookie только по HTTPS
+
+	mu       sync.Mutex
+	provider *oidcProvider
+}
+
+// sessions — вход через OIDC; nil — выключен.
+var sessions *oidcLogin
+
+// parseGroupRoles разбирает OIDC_GROUP_ROLES: group=role,...
+func parseGroupRoles(v string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, item := range splitList(v) {
+		group, role, ok := strings.Cut(item, "=")
+		if _, known := roleScopes[role]; !ok || group == "" || !known {
+			return nil, fmt.Errorf("OIDC_GROUP_ROLES: expected group=reader|operator|admin, got %q", item)
+		}
+		out[group] = role
+	}
+	return out, nil
+}
+
+// openOIDCLogin готовит вход; без OIDC_ISSUER — nil.
+func openOIDCLogin(ctx context.Context, opts oidcOptions) (*oidcLogin, error) {
+	if opts.Issuer == "" {
+		return nil, nil
+	}
+	if opts.ClientID == "" || opts.RedirectURL == "" {
+		return nil, errors.New("oidc: OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if _, ok := roleScopes[opts.DefaultRole]; opts.DefaultRole != "" && !ok {
+		return nil, fmt.Errorf("oidc: OIDC_DEFAULT_ROLE: unknown role %q: expected reader, operator or admin", opts.DefaultRole)
+	}
+	key, err := base64.StdEncoding.DecodeString(opts.SessionKey)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("oidc: OIDC_SESSION_KEY: %w", err)
+	case len(key) == 0:
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("oidc: generate session key: %w", err)
+		}
+		slog.Warn("oidc: OIDC_SESSION_KEY is not set, sessions end on restart and are not shared between instances")
+	case len(key) < 32:
+		return nil, errors.New("oidc: OIDC_SESSION_KEY must be at least 32 bytes")
+	}
+	verifier, err := openJWTAuth(ctx, jwtOptions{
+		Issuer: opts.Issuer, Audiences: []string{opts.ClientID}, ActorClaim: opts.ActorClaim,
+		Leeway: opts.Leeway, Refresh: opts.Refresh,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &oidcLogin{opts: opts, verifier: verifier, key: key, secure: strings.HasPrefix(opts.RedirectURL, "https://")}
+	slog.Info("oidc: browser login enabled", "issuer", opts.Issuer, "client_id", opts.ClientID, "groups", len(opts.GroupRoles))
+	return s, nil
+}
+
+// discover читает OpenID discovery издателя; удачный ответ запоминается.
+func (s *oidcLogin) discover(ctx context.Context) (*oidcProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.provider != nil {
+		return s.provider, nil
+	}
+	var p oidcProvider
+	if err := s.verifier.getJSON(ctx, strings.TrimSuffix(s.opts.Issuer, "/")+"/.well-known/openid-configuration", &p); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" {
+		return nil, errors.New("oidc: discovery: no authorization_endpoint or token_endpoint")
+	}
+	s.provider = &p
+	return &p, nil
+}
+
+// seal — v в виде подписанного значения cookie: base64url(json).base64url(hmac).
+func (s *oidcLogin) seal(v any) string {
+	body, _ := json.Marshal(v)
+	h := hmac.New(sha256.New, s.key)
+	h.Write(body)
+	b64 := base64.RawURLEncoding
+	return b64.EncodeToString(body) + "." + b64.EncodeToString(h.Sum(nil))
+}
+
+func (s *oidcLogin) open(value string, v any) error {
+	b64 := base64.RawURLEncoding
+	body, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return errors.New("malformed cookie")
+	}
+	raw, err := b64.DecodeString(body)
+	if err != nil {
+		return errors.New("malformed cookie")
+	}
+	want, err := b64.DecodeString(sig)
+	h := hmac.New(sha256.New, s.key)
+	h.Write(raw)
+	if err != nil || !hmac.Equal(want, h.Sum(nil)) {
+		return errors.New("cookie signature does not match")
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (s *oidcLogin) setCookie(w http.ResponseWriter, name, value, path string, ttl time.Duration, httpOnly bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name: name, Value: value, Path: path, MaxAge: int(ttl.Seconds()),
+		HttpOnly: httpOnly, Secure: s.secure, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *oidcLogin) clearCookie(w http.ResponseWriter, name, path string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: path, MaxAge: -1, Secure: s.secure, SameSite: http.SameSiteLaxMode})
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// roles — роли по группам владельца id_token.
+func (s *oidcLogin) roles(c jwtClaims) []string {
+	var groups []string
+	switch v := c[s.opts.GroupsClaim].(type) {
+	case string:
+		groups = strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []any:
+		for _, g := range v {
+			if g, ok := g.(string); ok {
+				groups = append(groups, g)
+			}
+		}
+	}
+	var roles []string
+	for _, g := range groups {
+		if r, ok := s.opts.GroupRoles[g]; ok && !slices.Contains(roles, r) {
+			roles = append(roles, r)
+		}
+	}
+	if len(roles) == 0 && s.opts.DefaultRole != "" {
+		roles = []string{s.opts.DefaultRole}
+	}
+	return roles
+}
+
+// localRedirect — путь возврата после входа; чужие адреса заменяются на /docs.
+func localRedirect(v string) string {
+	if !strings.HasPrefix(v, "/") || strings.HasPrefix(v, "//") || strings.HasPrefix(v, "/\\") {
+		return "/docs"
+	}
+	return v
+}
+
+// exchange меняет код авторизации на id_token.
+func (s *oidcLogin) exchange(ctx context.Context, p *oidcProvider, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.opts.RedirectURL},
+		"client_id":     {s.opts.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.opts.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(s.opts.ClientID), url.QueryEscape(s.opts.ClientSecret))
+	}
+	resp, err := s.verifier.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+	switch {
+	case body.Error != "":
+		return "", fmt.Errorf("token endpoint: %s: %s", body.Error, body.ErrorDescription)
+	case resp.StatusCode != http.StatusOK || body.IDToken == "":
+		return "", fmt.Errorf("token endpoint: %s: no id_token", resp.Status)
+	}
+	return body.IDToken, nil
+}
+
+type sessionKey struct{}
+
+// sessionFrom — сессия браузера запроса; nil — запрос без сессии.
+func sessionFrom(ctx context.Context) *browserSession {
+	s, _ := ctx.Value(sessionKey{}).(*browserSession)
+	return s
+}
+
+// middleware — звено mux после ключей API и до JWT: сессия из cookie становится claims токена.
+func (s *oidcLogin) middleware(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(sessionCookie)
+		if err != nil || r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" ||
+			apiKeyFrom(r.Context()) != nil || clientCertFrom(r.Context()) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var sess browserSession
+		if err := s.open(c.Value, &sess); err != nil || time.Now().Unix() >= sess.Expires {
+			next.ServeHTTP(w, r) // просроченная или чужая cookie — как без неё
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !hmac.Equal([]byte(r.Header.Get("X-CSRF-Token")), []byte(sess.CSRF)) {
+				writeError(w, errCSRF, http.StatusForbidden)
+				return
+			}
+		}
+		roles := make([]any, len(sess.Roles))
+		for i, role := range sess.Roles {
+			roles[i] = role
+		}
+		claims := jwtClaims{"sub": sess.Actor, rbac.RolesClaim: roles}
+		if tenancy != nil && sess.Tenant != "" {
+			claims[tenancy.Claim] = sess.Tenant
+		}
+		r.Header.Set("X-User-ID", sess.Actor)
+		ctx := context.WithValue(r.Context(), jwtClaimsKey{}, claims)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, sessionKey{}, &sess)))
+	})
+}
+
+// redirectToLogin уводит браузер без сессии на вход; false — запрос не из браузера.
+func (s *oidcLogin) redirectToLogin(w http.ResponseWriter, r *http.Request) bool {
+	if s == nil || r.Method != http.MethodGet || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	http.Redirect(w, r, "/auth/login?"+url.Values{"redirect": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+	return true
+}
+
+// register добавляет маршруты /auth.
+func (s *oidcLogin) register(r *mux.Router) {
+	if s == nil {
+		return
+	}
+	r.HandleFunc("/auth/login", s.login).Methods("GET").Name("oidcLogin")
+	r.HandleFunc("/auth/callback", s.callback).Methods("GET").Name("oidcCallback")
+	r.HandleFunc("/auth/logout", s.logout).Methods("GET").Name("oidcLogout")
+	r.HandleFunc("/auth/session", getSession).Methods("GET").Name("getSession")
+}
+
+// --- OIDC Handlers ---
+
+// login уводит браузер к провайдеру; ?redirect — куда вернуться после входа.
+func (s *oidcLogin) login(w http.ResponseWriter, r *http.Request) {
+	p, err := s.discover(r.Context())
+	if err != nil {
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	st := loginState{
+		State: randomToken(), Nonce: randomToken(), Verifier: randomToken(),
+		Redirect: localRedirect(r.URL.Query().Get("redirect")), Expires: time.Now().Add(loginTimeout).Unix(),
+	}
+	s.setCookie(w, stateCookie, s.seal(st), "/auth", loginTimeout, true)
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {s.opts.ClientID},
+		"redirect_uri":          {s.opts.RedirectURL},
+		"scope":                 {strings.Join(s.opts.Scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// callback завершает вход: код -> id_token -> сессия.
+func (s *oidcLogin) callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var st loginState
+	c, err := r.Cookie(stateCookie)
+	if err == nil {
+		err = s.open(c.Value, &st)
+	}
+	switch {
+	case err != nil || time.Now().Unix() >= st.Expires:
+		writeError(w, fmt.Errorf("%w: login expired, start again at /auth/login", errLoginFailed), http.StatusBadRequest)
+		return
+	case !hmac.Equal([]byte(q.Get("state")), []byte(st.State)):
+		writeError(w, fmt.Errorf("%w: state does not match", errLoginFailed), http.StatusBadRequest)
+		return
+	case q.Get("error") != "":
+		writeError(w, fmt.Errorf("%w: %s: %s", errLoginFailed, q.Get("error"), q.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+	s.clearCookie(w, stateCookie, "/auth")
+	p, err := s.discover(r.Context())
+	if err != nil {
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	idToken, err := s.exchange(r.Context(), p, q.Get("code"), st.Verifier)
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc: code exchange failed", "error", err)
+		writeError(w, fmt.Errorf("%w: %v", errLoginFailed, err), http.StatusUnauthorized)
+		return
+	}
+	claims, err := s.verifier.verify(r.Context(), idToken)
+	if err == nil && !hmac.Equal([]byte(claims.string("nonce")), []byte(st.Nonce)) {
+		err = errors.New("nonce does not match")
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc: id_token rejected", "error", err)
+		writeError(w, fmt.Errorf("%w: id_token: %v", errLoginFailed, err), http.StatusUnauthorized)
+		return
+	}
+	actor := claims.string(s.opts.ActorClaim)
+	roles := s.roles(claims)
+	if len(roles) == 0 {
+		slog.InfoContext(r.Context(), "oidc: login refused", "actor", actor, "reason", "no group in OIDC_GROUP_ROLES")
+		writeError(w, fmt.Errorf("%w: none of your groups grants a role", errForbidden), http.StatusForbidden)
+		return
+	}
+	sess := browserSession{Actor: actor, Roles: roles, CSRF: randomToken(), Expires: time.Now().Add(s.opts.SessionTTL).Unix()}
+	if tenancy != nil {
+		sess.Tenant = claims.string(tenancy.Claim)
+	}
+	s.setCookie(w, sessionCookie, s.seal(sess), "/", s.opts.SessionTTL, true)
+	s.setCookie(w, csrfCookie, sess.CSRF, "/", s.opts.SessionTTL, false)
+	slog.InfoContext(r.Context(), "oidc: login", "actor", actor, "roles", roles, "tenant", sess.Tenant)
+	http.Redirect(w, r, st.Redirect, http.StatusSeeOther)
+}
+
+// logout удаляет сессию и, если провайдер умеет, завершает сессию и у него.
+func (s *oidcLogin) logout(w http.ResponseWriter, r *http.Request) {
+	s.clearCookie(w, sessionCookie, "/")
+	s.clearCookie(w, csrfCookie, "/")
+	if p, err := s.discover(r.Context()); err == nil && p.EndSessionEndpoint != "" {
+		http.Redirect(w, r, p.EndSessionEndpoint+"?"+url.Values{"client_id": {s.opts.ClientID}}.Encode(), http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionView — ответ GET /auth/session.
+type sessionView struct {
+	Actor     string    `json:"actor"`
+	Roles     []string  `json:"roles"`
+	Tenant    string    `json:"tenant,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func getSession(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFrom(r.Context())
+	if sess == nil {
+		writeError(w, fmt.Errorf("%w: no session, sign in at /auth/login", errInvalidToken), http.StatusUnauthorized)
+		return
+	}
+	writeBody(w, r, http.StatusOK, sessionView{Actor: sess.Actor, Roles: sess.Roles, Tenant: sess.Tenant, ExpiresAt: time.Unix(sess.Expires, 0).UTC()})
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	swaggerFiles "github.com/swaggo/files"
+	"google.golang.org/protobuf/proto"
+
+	"tsc-p7-cqrs/orderspb"
+)
+
+// --- OpenAPI ---
+// Документ OpenAPI 3 собирается при старте из маршрутов mux: путь, методы и параметры пути берутся
+// из маршрута, описание операции — из apiDocs по имени маршрута (оно же operationId), схемы тел —
+// из Go-типов по json-тегам. Маршрут без описания всё равно попадает в документ, только без тел.
+// GET /docs — Swagger UI, GET /docs/openapi.json — сам документ.
+
+type apiOperation struct {
+	Summary      string
+	Tag          string
+	Params       []apiParam
+	Body         any    // значение типа тела запроса; nil — без тела
+	BodyType     string // по умолчанию application/json
+	Status       int    // код успешного ответа
+	Response     any    // значение типа тела ответа; nil — без тела
+	ResponseType string // по умолчанию application/json
+	Negotiated   bool   // тела также в MessagePack и, где есть сообщение, в Protobuf (negotiation.go)
+	Async        bool   // с Prefer: respond-async — 202 и состояние команды (asynccommands.go)
+	Errors       []int
+}
+
+type apiParam struct {
+	In          string // query или header
+	Name        string
+	Description string
+	Integer     bool
+}
+
+var (
+	paramIdempotencyKey = apiParam{In: "header", Name: "Idempotency-Key", Description: "повтор с тем же ключом возвращает результат первой попытки"}
+	paramIfMatch        = apiParam{In: "header", Name: "If-Match", Description: "ожидаемая версия заказа (ETag)"}
+	paramCorrelationID  = apiParam{In: "header", Name: "X-Correlation-ID", Description: "id цепочки сообщений; без него начинается новая"}
+	paramCausationID    = apiParam{In: "header", Name: "X-Causation-ID", Description: "id сообщения, вызвавшего команду"}
+	paramUserID         = apiParam{In: "header", Name: "X-User-ID", Description: "пользователь или сервис, отдавший команду"}
+	paramTenant         = apiParam{In: "header", Name: "X-Tenant-ID", Description: "арендатор при MULTI_TENANT, если учётные данные к нему не привязаны"}
+	paramPrefer         = apiParam{In: "header", Name: "Prefer", Description: "respond-async — поставить команду в очередь и ответить 202"}
+	paramAfter          = apiParam{In: "query", Name: "after", Description: "позиция последнего уже обработанного события", Integer: true}
+	paramMinPosition    = apiParam{In: "query", Name: "min_position", Description: "ждать, пока read model не применит событие с этой позицией (position ответа команды)", Integer: true}
+
+	commandParams = []apiParam{paramCorrelationID, paramCausationID, paramUserID, paramTenant}
+)
+
+// createOrderBody — тело POST /orders для документа; customer_erased выставляет только сервер.
+type createOrderBody struct {
+	CustomerID string      `json:"customer_id,omitempty"`
+	Customer   *Customer   `json:"customer,omitempty"`
+	Items      []OrderItem `json:"items,omitempty"`
+	Currency   string      `json:"currency,omitempty"`
+}
+
+// createWebhookBody — тело POST /webhooks; без secret сервер генерирует его сам.
+type createWebhookBody struct {
+	URL        string      `json:"url"`
+	EventTypes []EventType `json:"event_types,omitempty"`
+	Format     string      `json:"format,omitempty"`
+	Secret     string      `json:"secret,omitempty"`
+}
+
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+var apiDocs = map[string]apiOperation{
+	"createOrder": {
+		Summary: "Создать заказ", Tag: "commands",
+		Params: append([]apiParam{paramIdempotencyKey}, commandParams...),
+		Body:   createOrderBody{}, Status: http.StatusCreated, Negotiated: true, Async: true, Response: commandResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusUnprocessableEntity},
+	},
+	"executeBatch": {
+		Summary: "Пакет команд (до 1000), каждая выполняется отдельно; результаты в порядке команд", Tag: "commands",
+		Params: commandParams,
+		Body:   []batchCommand{}, Status: http.StatusOK, Negotiated: true, Response: []batchResult{},
+		Errors: []int{http.StatusBadRequest},
+	},
+	"payOrder": {
+		Summary: "Внести оплату заказа в PENDING (без amount — весь остаток); заказ становится PAID, когда оплаты покрывают сумму. С PAYMENT_PROVIDER сумма списывается через шлюз", Tag: "commands",
+		Params: append([]apiParam{paramIfMatch, paramIdempotencyKey}, commandParams...),
+		Body:   paymentRequest{}, Status: http.StatusOK, Negotiated: true, Async: true, Response: commandResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusPaymentRequired, http.StatusConflict, http.StatusUnprocessableEntity, http.StatusBadGateway},
+	},
+	"cancelOrder": {
+		Summary: "Отменить неоплаченный заказ (только из PENDING)", Tag: "commands",
+		Params: append([]apiParam{paramIfMatch, paramIdempotencyKey}, commandParams...),
+		Status: http.StatusOK, Negotiated: true, Async: true, Response: commandResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+	},
+	"refundOrder": {
+		Summary: "Вернуть оплату целиком или частично (только из PAID); после возврата всей оплаты — REFUNDED", Tag: "commands",
+		Params: append([]apiParam{paramIfMatch, paramIdempotencyKey}, commandParams...),
+		Body:   refundRequest{}, Status: http.StatusOK, Negotiated: true, Async: true, Response: commandResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+	},
+	"shipOrder": {
+		Summary: "Отправить заказ (только из PAID): перевозчик и трек-номер", Tag: "commands",
+		Params: append([]apiParam{paramIfMatch, paramIdempotencyKey}, commandParams...),
+		Body:   Shipment{}, Status: http.StatusOK, Negotiated: true, Async: true, Response: commandResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+	},
+	"deliverOrder": {
+		Summary: "Отметить отправленный заказ доставленным (только из SHIPPED)", Tag: "commands",
+		Params: append([]apiParam{paramIfMatch, paramIdempotencyKey}, commandParams...),
+		Status: http.StatusOK, Negotiated: true, Async: true, Response: commandResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+	},
+	"applyCoupon": {
+		Summary: "Применить купон к заказу в PENDING до первой оплаты; скидка уменьшает total", Tag: "commands",
+		Params: append([]apiParam{paramIfMatch, paramIdempotencyKey}, commandParams...),
+		Body:   couponRequest{}, Status: http.StatusOK, Negotiated: true, Async: true, Response: commandResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+	},
+	"eraseCustomerData": {
+		Summary: "Удалить персональные данные покупателя (crypto-shredding)", Tag: "commands",
+		Status: http.StatusNoContent,
+	},
+	"acceptCloudEvent": {
+		Summary: "Выполнить команду из CloudEvent (<prefix>.command.create|pay|cancel|refund|ship|deliver|apply-coupon); create отвечает 201", Tag: "commands",
+		Body: cloudEvent{}, BodyType: cloudEventsJSON, Status: http.StatusOK, Response: commandResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity},
+	},
+	"createSchedule": {
+		Summary: "Отложить команду над заказом до run_at или на delay; команда — как элемент пакета, кроме create", Tag: "commands",
+		Params: commandParams,
+		Body:   scheduleRequest{}, Status: http.StatusCreated, Negotiated: true, Response: ScheduledCommand{},
+		Errors: []int{http.StatusBadRequest},
+	},
+	"cancelSchedule": {
+		Summary: "Отменить отложенную команду, пока она не начала выполняться", Tag: "commands",
+		Params: commandParams,
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound, http.StatusConflict},
+	},
+	"listSchedules": {
+		Summary: "Отложенные команды по времени выполнения", Tag: "queries",
+		Params: []apiParam{
+			{In: "query", Name: "order_id", Description: "только команды над заказом"},
+			{In: "query", Name: "state", Description: "scheduled, running, succeeded, failed или canceled"},
+		},
+		Status: http.StatusOK, Negotiated: true, Response: []ScheduledCommand{},
+	},
+	"getSchedule": {
+		Summary: "Отложенная команда и её итог", Tag: "queries",
+		Status: http.StatusOK, Negotiated: true, Response: ScheduledCommand{}, Errors: []int{http.StatusNotFound},
+	},
+	"addStock": {
+		Summary: "Пополнить склад SKU; ответ — остаток после пополнения", Tag: "inventory",
+		Params: commandParams,
+		Body:   addStockRequest{}, Status: http.StatusOK, Negotiated: true, Response: Stock{},
+		Errors: []int{http.StatusBadRequest},
+	},
+	"getStock": {
+		Summary: "Остаток SKU: на складе, в резерве и доступно", Tag: "inventory",
+		Status: http.StatusOK, Negotiated: true, Response: Stock{}, Errors: []int{http.StatusNotFound},
+	},
+	"createWebhook": {
+		Summary: "Подписать URL на события; secret отдаётся только в этом ответе", Tag: "webhooks",
+		Body: createWebhookBody{}, Status: http.StatusCreated, Response: webhookSubscription{},
+		Errors: []int{http.StatusBadRequest},
+	},
+	"deleteWebhook": {
+		Summary: "Удалить подписку", Tag: "webhooks",
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound},
+	},
+	"bulkCancelOrders": {
+		Summary: "Отменить все заказы, подходящие под фильтр (по умолчанию PENDING), отдельными командами с общим correlation id", Tag: "admin",
+		Params: append([]apiParam{paramIdempotencyKey}, commandParams...),
+		Body:   bulkCancelRequest{}, Status: http.StatusOK, Negotiated: true, Response: bulkCancelSummary{},
+		Errors: []int{http.StatusBadRequest},
+	},
+	"retryDeadLetter": {
+		Summary: "Отправить команду из dead letters в шину заново; запись удаляется, при новой неудаче появится другая", Tag: "admin",
+		Status: http.StatusOK, Negotiated: true, Async: true, Response: commandResult{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+	},
+	"deleteDeadLetter": {
+		Summary: "Удалить запись из dead letters", Tag: "admin",
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound},
+	},
+	"listDeadLetters": {
+		Summary: "Команды, не выполненные после всех повторов (COMMAND_RETRY_ATTEMPTS), с последней ошибкой", Tag: "admin",
+		Status: http.StatusOK, Negotiated: true, Response: []deadLetter{},
+	},
+	"getAdminAudit": {
+		Summary: "Журнал действий администрирования страницами (Link rel=next): перестройки, массовая отмена, dead letters, webhooks, удаление данных, усечение и компакция журнала", Tag: "admin",
+		Params: []apiParam{
+			{In: "query", Name: "after", Description: "seq записи, после которой начинать", Integer: true},
+			{In: "query", Name: "limit", Description: "размер страницы, 1..1000, по умолчанию 100", Integer: true},
+			{In: "query", Name: "action", Description: "действие, например projection.rebuild"},
+			{In: "query", Name: "actor", Description: "автор (X-User-ID); фоновые операции — system"},
+			{In: "query", Name: "since", Description: "записи не раньше этого времени (RFC 3339)"},
+			{In: "query", Name: "until", Description: "записи раньше этого времени (RFC 3339)"},
+		},
+		Status: http.StatusOK, Negotiated: true, Response: []adminRecord{}, Errors: []int{http.StatusBadRequest},
+	},
+	"getAuditCommands": {
+		Summary: "Журнал аудита команд страницами (Link rel=next): автор, время, хеш содержимого, итог", Tag: "admin",
+		Params: []apiParam{
+			{In: "query", Name: "after", Description: "seq записи, после которой начинать", Integer: true},
+			{In: "query", Name: "limit", Description: "размер страницы, 1..1000, по умолчанию 100", Integer: true},
+			{In: "query", Name: "command", Description: "имя команды, например PayOrder"},
+			{In: "query", Name: "order_id", Description: "команды над заказом"},
+			{In: "query", Name: "actor", Description: "автор команды (X-User-ID)"},
+			{In: "query", Name: "outcome", Description: "succeeded, replayed или failed"},
+			{In: "query", Name: "since", Description: "команды не раньше этого времени (RFC 3339)"},
+			{In: "query", Name: "until", Description: "команды раньше этого времени (RFC 3339)"},
+		},
+		Status: http.StatusOK, Negotiated: true, Response: []auditRecord{}, Errors: []int{http.StatusBadRequest},
+	},
+	"listProjections": {
+		Summary: "Проекции read model: позиция последнего применённого события, число событий с запуска, очередь и отставание от журнала", Tag: "admin",
+		Status: http.StatusOK, Negotiated: true, Response: []projectionStatus{},
+	},
+	"getEventStats": {
+		Summary: "Статистика журнала: события и объём Data по типам, первое и последнее событие, рост по дням, темп записи за 1m..24h, место в backend", Tag: "admin",
+		Status: http.StatusOK, Negotiated: true, Response: eventStoreStats{}, Errors: []int{http.StatusInternalServerError},
+	},
+	"createBackup": {
+		Summary: "Резервная копия журнала потоком JSONL: заголовок, события с sha256 и завершающая запись с числом событий и общей суммой", Tag: "admin",
+		Status: http.StatusOK, Response: backupRecord{}, ResponseType: "application/x-ndjson",
+	},
+	"reloadConfig": {
+		Summary: "Перечитать файл настроек и подписки webhooks без перезапуска: что изменилось, что применено, что требует перезапуска", Tag: "admin",
+		Status: http.StatusOK, Negotiated: true, Response: configReload{}, Errors: []int{http.StatusUnprocessableEntity},
+	},
+	"oidcLogin": {
+		Summary: "Войти через OIDC-провайдера: редирект на его страницу входа", Tag: "auth",
+		Params: []apiParam{{In: "query", Name: "redirect", Description: "локальный путь, куда вернуться после входа; по умолчанию /docs"}},
+		Status: http.StatusFound,
+	},
+	"oidcCallback": {
+		Summary: "Завершить вход: код авторизации меняется на сессию (OIDC_REDIRECT_URL)", Tag: "auth",
+		Status: http.StatusSeeOther, Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusBadGateway},
+	},
+	"oidcLogout": {Summary: "Выйти: удалить сессию браузера", Tag: "auth", Status: http.StatusNoContent},
+	"getSession": {
+		Summary: "Текущая сессия браузера: автор, роли, арендатор", Tag: "auth",
+		Response: sessionView{}, Errors: []int{http.StatusUnauthorized},
+	},
+	"verifyEvents": {
+		Summary: "Проверить HMAC-подписи журнала (EVENT_SIGNING_KEY): сколько событий верны, не подписаны и подделаны", Tag: "admin",
+		Params: []apiParam{
+			{In: "query", Name: "from", Description: "первая позиция, включительно", Integer: true},
+			{In: "query", Name: "to", Description: "последняя позиция, включительно; без неё — до конца журнала", Integer: true},
+		},
+		Status: http.StatusOK, Negotiated: true, Response: signatureReport{},
+		Errors: []int{http.StatusBadRequest, http.StatusServiceUnavailable},
+	},
+	"createAPIKey": {
+		Summary: "Выдать ключ API с областями queries, commands, admin; ключ отдаётся только в этом ответе", Tag: "admin",
+		Body: createAPIKeyBody{}, Status: http.StatusCreated, Response: apiKey{},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict},
+	},
+	"rotateAPIKey": {
+		Summary: "Выдать ключу новое значение; прежнее действует ещё API_KEY_ROTATION_GRACE", Tag: "admin",
+		Status: http.StatusOK, Response: apiKey{}, Errors: []int{http.StatusNotFound, http.StatusConflict},
+	},
+	"deleteAPIKey": {
+		Summary: "Отозвать ключ API", Tag: "admin",
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound, http.StatusConflict},
+	},
+	"listAPIKeys": {
+		Summary: "Ключи API без значений: области, срок, ротация, последнее использование", Tag: "admin",
+		Status: http.StatusOK, Response: []apiKey{},
+	},
+	"listUsage": {
+		Summary: "Расход квот всех арендаторов и ключей API (QUOTA_*)", Tag: "admin",
+		Status: http.StatusOK, Negotiated: true, Response: usageReport{},
+	},
+	"getAdminStatus": {
+		Summary: "Состояние журнала и проекций: последняя позиция, размер хранилища, по каждой проекции — checkpoint и отставание в событиях и секундах", Tag: "admin",
+		Status: http.StatusOK, Negotiated: true, Response: adminStatus{}, Errors: []int{http.StatusInternalServerError},
+	},
+	"getProjection": {
+		Summary: "Проекция и ход её последней перестройки", Tag: "admin",
+		Status: http.StatusOK, Negotiated: true, Response: projectionStatus{}, Errors: []int{http.StatusNotFound},
+	},
+	"rebuildProjection": {
+		Summary: "Очистить проекцию и перестроить её из журнала в фоне; ход — в GET /admin/projections/{name}", Tag: "admin",
+		Status: http.StatusAccepted, Negotiated: true, Response: projectionStatus{}, Errors: []int{http.StatusNotFound, http.StatusConflict},
+	},
+	"listOrders": {
+		Summary: "Заказы из read model страницами в порядке id (Link rel=next, X-Total-Count)", Tag: "queries",
+		Params: []apiParam{
+			{In: "query", Name: "status", Description: "статус заказа: PENDING, PAID, SHIPPED, DELIVERED, CANCELED или REFUNDED"},
+			{In: "query", Name: "limit", Description: "размер страницы, 1..1000, по умолчанию 100", Integer: true},
+			{In: "query", Name: "cursor", Description: "id последнего заказа предыдущей страницы"},
+			paramMinPosition,
+		},
+		Status: http.StatusOK, Negotiated: true, Response: []Order{}, Errors: []int{http.StatusBadRequest, http.StatusServiceUnavailable},
+	},
+	"searchOrders": {
+		Summary: "Полнотекстовый поиск заказов с фасетами (SEARCH_URL: Elasticsearch/OpenSearch)", Tag: "queries",
+		Params: []apiParam{
+			{In: "query", Name: "q", Description: "текст: покупатель, SKU, купон, id (синтаксис simple_query_string)"},
+			{In: "query", Name: "status", Description: "фильтр по статусу"},
+			{In: "query", Name: "customer_id", Description: "фильтр по покупателю"},
+			{In: "query", Name: "sku", Description: "заказы с позицией SKU"},
+			{In: "query", Name: "currency", Description: "фильтр по валюте"},
+			{In: "query", Name: "limit", Description: "размер страницы, 1..100, по умолчанию 20", Integer: true},
+			{In: "query", Name: "offset", Description: "сколько результатов пропустить", Integer: true},
+		},
+		Status: http.StatusOK, Negotiated: true, Response: searchResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusBadGateway, http.StatusServiceUnavailable},
+	},
+	"getOrder": {
+		Summary: "Заказ из read model; с ?as_of — состояние заказа на момент в прошлом, восстановленное из журнала", Tag: "queries",
+		Params: []apiParam{
+			{In: "query", Name: "as_of", Description: "позиция журнала (включительно) или время RFC 3339"},
+			{In: "query", Name: "min_version", Description: "ждать, пока заказ в read model не дойдёт до этой версии (version ответа команды)", Integer: true},
+			paramMinPosition,
+		},
+		Status: http.StatusOK, Negotiated: true, Response: Order{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusServiceUnavailable},
+	},
+	"getOrderEvents": {
+		Summary: "История заказа в порядке версий; с Accept: application/cloudevents-batch+json — как CloudEvents", Tag: "queries",
+		Params: []apiParam{{In: "query", Name: "after", Description: "версия, после которой начинать", Integer: true}},
+		Status: http.StatusOK, Negotiated: true, Response: []Event{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	"listCustomerOrders": {
+		Summary: "Заказы покупателя в порядке создания", Tag: "queries",
+		Params: []apiParam{paramMinPosition},
+		Status: http.StatusOK, Negotiated: true, Response: []Order{}, Errors: []int{http.StatusBadRequest, http.StatusServiceUnavailable},
+	},
+	"getCommandStatus": {
+		Summary: "Состояние команды, принятой с Prefer: respond-async: pending, succeeded или failed", Tag: "queries",
+		Status: http.StatusOK, Negotiated: true, Response: asyncCommand{}, Errors: []int{http.StatusNotFound},
+	},
+	"getCommandMetrics": {
+		Summary: "Счётчики команд с запуска процесса по имени команды: всего, ошибок, повторов, суммарное время", Tag: "queries",
+		Status: http.StatusOK, Negotiated: true, Response: map[string]commandStats{},
+	},
+	"getStats": {
+		Summary: "Сводка по заказам из проекции stats: по статусам, созданные по дням, доля оплаченных, среднее время до оплаты", Tag: "queries",
+		Status: http.StatusOK, Negotiated: true, Response: orderStats{},
+	},
+	"getUsage": {
+		Summary: "Расход квот арендатора запроса и его ключа API: команд за сутки UTC, событий в журнале, лимиты", Tag: "queries",
+		Status: http.StatusOK, Negotiated: true, Response: usageReport{},
+	},
+	"getAllEvents": {
+		Summary: "Журнал событий страницами (Link rel=next, X-Total-Count, X-Last-Position); с ?wait — long-poll для внешних проекторов; с Accept: application/cloudevents-batch+json — как CloudEvents", Tag: "queries",
+		Params: []apiParam{
+			paramAfter,
+			{In: "query", Name: "from", Description: "позиция, с которой начинать (включительно); вместо after", Integer: true},
+			{In: "query", Name: "wait", Description: "секунд ждать новых событий, если их нет (long-poll), 0..60", Integer: true},
+			{In: "query", Name: "limit", Description: "размер страницы, 1..1000, по умолчанию 100", Integer: true},
+			{In: "query", Name: "type", Description: "типы событий; параметр можно повторять или перечислять через запятую"},
+			{In: "query", Name: "order_id", Description: "события одного заказа"},
+			{In: "query", Name: "since", Description: "события не раньше этого времени (RFC 3339)"},
+			{In: "query", Name: "until", Description: "события раньше этого времени (RFC 3339)"},
+		},
+		Status: http.StatusOK, Negotiated: true, Response: []Event{}, Errors: []int{http.StatusBadRequest},
+	},
+	"streamEvents": {
+		Summary: "События журнала потоком Server-Sent Events", Tag: "queries",
+		Params: []apiParam{paramAfter, {In: "header", Name: "Last-Event-ID", Description: "позиция последнего полученного события при переподключении", Integer: true}},
+		Status: http.StatusOK, Response: Event{}, ResponseType: "text/event-stream", Errors: []int{http.StatusBadRequest},
+	},
+	"subscribeEventsWS": {
+		Summary: "Подписка на события по WebSocket", Tag: "queries",
+		Params: []apiParam{
+			{In: "query", Name: "types", Description: "типы событий через запятую"},
+			{In: "query", Name: "order_ids", Description: "id заказов через запятую"},
+			paramAfter,
+		},
+		Status: http.StatusSwitchingProtocols, Errors: []int{http.StatusBadRequest, http.StatusForbidden},
+	},
+	"graphql": {
+		Summary: "GraphQL-запрос к заказам и журналу", Tag: "queries",
+		Body: graphqlRequest{}, Status: http.StatusOK, Response: map[string]any{},
+	},
+	"listWebhooks": {
+		Summary: "Подписки на события", Tag: "webhooks",
+		Status: http.StatusOK, Response: []webhookSubscription{},
+	},
+	"getWebhookDeliveries": {
+		Summary: "Позиция подписки и последние доставки", Tag: "webhooks",
+		Status: http.StatusOK, Response: webhookDeliveries{}, Errors: []int{http.StatusNotFound},
+	},
+}
+
+// enumValues — допустимые значения строковых типов домена.
+var enumValues = map[reflect.Type][]string{
+	reflect.TypeOf(OrderStatus("")): statusStrings(orderStatuses),
+	reflect.TypeOf(EventType("")): {string(EventOrderCreated), string(EventOrderPaid), string(EventOrderCanceled), string(EventOrderRefunded), string(EventOrderExpired),
+		string(EventOrderShipped), string(EventOrderDelivered), string(EventOrderPaymentReceived), string(EventDiscountApplied),
+		string(EventPaymentAuthorized), string(EventPaymentFailed),
+		string(EventStockAdded), string(EventStockReserved), string(EventStockCommitted), string(EventStockReleased),
+		string(EventCommandScheduled), string(EventScheduledCommandStarted), string(EventScheduledCommandCompleted), string(EventScheduledCommandCanceled)},
+	reflect.TypeOf(scheduleState("")):    {string(scheduleScheduled), string(scheduleRunning), string(scheduleSucceeded), string(scheduleFailed), string(scheduleCanceled)},
+	reflect.TypeOf(rebuildState("")):     {string(rebuildRunning), string(rebuildSucceeded), string(rebuildFailed)},
+	reflect.TypeOf(auditOutcome("")):     {string(auditSucceeded), string(auditReplayed), string(auditFailed)},
+	reflect.TypeOf(batchCommandType("")): {string(batchCreate), string(batchPay), string(batchCancel), string(batchRefund), string(batchShip), string(batchDeliver), string(batchCoupon)},
+}
+
+var pathVarPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// openAPIDocument описывает все маршруты r, кроме самой документации.
+func openAPIDocument(r *mux.Router) ([]byte, error) {
+	schemas := schemaSet{}
+	paths := map[string]map[string]any{}
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || strings.HasPrefix(tpl, "/docs") {
+			return nil // маршрут без пути (PathPrefix-подроутер) или сама документация
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := pathVarPattern.ReplaceAllString(tpl, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		for _, m := range methods {
+			paths[path][strings.ToLower(m)] = schemas.operation(route.GetName(), tpl)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("openapi: walk routes: %w", err)
+	}
+	return json.MarshalIndent(map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "tsc-p7-cqrs orders API",
+			"version": "1.0",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}, "", "  ")
+}
+
+// schemaSet — components.schemas документа; схемы структур попадают сюда по первому упоминанию.
+type schemaSet map[string]any
+
+func (s schemaSet) operation(name, tpl string) map[string]any {
+	doc := apiDocs[name]
+	op := map[string]any{}
+	if name != "" {
+		op["operationId"] = name
+	}
+	if doc.Summary != "" {
+		op["summary"] = doc.Summary
+	}
+	if doc.Tag != "" {
+		op["tags"] = []string{doc.Tag}
+	}
+	var params []map[string]any
+	for _, m := range pathVarPattern.FindAllStringSubmatch(tpl, -1) {
+		params = append(params, map[string]any{
+			"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, p := range doc.Params {
+		typ := "string"
+		if p.Integer {
+			typ = "integer"
+		}
+		params = append(params, map[string]any{
+			"name": p.Name, "in": p.In, "description": p.Description, "schema": map[string]any{"type": typ},
+		})
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if doc.Body != nil {
+		content := s.content(doc.Body, doc.BodyType)
+		if doc.Negotiated {
+			negotiatedContent(content, protoBodies[reflect.TypeOf(doc.Body)])
+		}
+		op["requestBody"] = map[string]any{"content": content}
+	}
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := map[string]any{"description": http.StatusText(status)}
+	if doc.Response != nil {
+		content := s.content(doc.Response, doc.ResponseType)
+		if doc.Negotiated {
+			negotiatedContent(content, protoMessage(doc.Response))
+		}
+		resp["content"] = content
+	}
+	responses := map[string]any{strconv.Itoa(status): resp}
+	if doc.Async {
+		op["parameters"] = append(params, map[string]any{
+			"name": paramPrefer.Name, "in": paramPrefer.In, "description": paramPrefer.Description, "schema": map[string]any{"type": "string"},
+		})
+		responses[strconv.Itoa(http.StatusAccepted)] = map[string]any{
+			"description": http.StatusText(http.StatusAccepted), "content": s.content(asyncCommand{}, ""),
+		}
+		responses[strconv.Itoa(http.StatusServiceUnavailable)] = map[string]any{"description": "command queue is full"}
+	}
+	for _, code := range doc.Errors {
+		responses[strconv.Itoa(code)] = map[string]any{"description": http.StatusText(code), "content": s.content(problemDetails{}, mediaProblem)}
+	}
+	op["responses"] = responses
+	return op
+}
+
+func (s schemaSet) content(v any, mediaType string) map[string]any {
+	if mediaType == "" {
+		mediaType = "application/json"
+	}
+	return map[string]any{mediaType: map[string]any{"schema": s.schema(reflect.TypeOf(v))}}
+}
+
+// protoBodies — сообщения Protobuf тел команд (см. unmarshalProto) по типу тела в документе.
+var protoBodies = map[reflect.Type]proto.Message{
+	reflect.TypeOf(createOrderBody{}): (*orderspb.CreateOrderRequest)(nil),
+	reflect.TypeOf(paymentRequest{}):  (*orderspb.PayOrderRequest)(nil),
+	reflect.TypeOf(refundRequest{}):   (*orderspb.RefundOrderRequest)(nil),
+	reflect.TypeOf(Shipment{}):        (*orderspb.ShipOrderRequest)(nil),
+	reflect.TypeOf(couponRequest{}):   (*orderspb.ApplyCouponRequest)(nil),
+}
+
+// negotiatedContent дополняет content JSON форматами MessagePack (та же схема) и Protobuf, если есть сообщение msg.
+func negotiatedContent(content map[string]any, msg proto.Message) {
+	content[mediaMsgpack] = content[mediaJSON]
+	if msg != nil {
+		content[mediaProtobuf] = map[string]any{"schema": map[string]any{
+			"type": "string", "format": "binary", "description": string(msg.ProtoReflect().Descriptor().FullName()),
+		}}
+	}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+func (s schemaSet) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]any{} // любое значение JSON
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.schema(t.Elem())
+	case reflect.String:
+		if values, ok := enumValues[t]; ok {
+			return map[string]any{"type": "string", "enum": values}
+		}
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := s[name]; !ok {
+			s[name] = nil // рекурсивные типы ссылаются на ещё не достроенную схему
+			s[name] = s.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (s schemaSet) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	obj := map[string]any{"type": "object", "properties": props}
+	if required != nil {
+		sort.Strings(required)
+		obj["required"] = required
+	}
+	return obj
+}
+
+// schemaName — имя схемы по имени Go-типа с заглавной буквы: commandResult -> CommandResult.
+func schemaName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>tsc-p7-cqrs API</title>
+  <link rel="stylesheet" href="/docs/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="/docs/swagger-ui-bundle.js"></script>
+  <script src="/docs/swagger-ui-standalone-preset.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({
+      url: "/docs/openapi.json",
+      dom_id: "#swagger-ui",
+      presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+      layout: "StandaloneLayout",
+      // сессия входа через OIDC: команды требуют X-CSRF-Token из cookie cqrs_csrf
+      requestInterceptor: (req) => {
+        const m = document.cookie.match(/(?:^|; )cqrs_csrf=([^;]*)/);
+        if (m) req.headers["X-CSRF-Token"] = decodeURIComponent(m[1]);
+        return req;
+      }
+    });
+  </script>
+</body>
+</html>
+`
+
+// registerDocs добавляет /docs после всех остальных маршрутов: документ описывает то, что уже зарегистрировано.
+func registerDocs(r *mux.Router) error {
+	spec, err := openAPIDocument(r)
+	if err != nil {
+		return err
+	}
+	r.HandleFunc("/docs/openapi.json", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}).Methods("GET")
+	page := func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(swaggerUIPage))
+	}
+	r.HandleFunc("/docs", page).Methods("GET")
+	r.HandleFunc("/docs/", page).Methods("GET")
+	// статика Swagger UI встроена в бинарник (github.com/swaggo/files)
+	r.PathPrefix("/docs/").Handler(http.StripPrefix("/docs", http.FileServer(swaggerFiles.HTTP))).Methods("GET")
+	return nil
+}
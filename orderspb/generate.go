@@ -0,0 +1,4 @@
+// Package orderspb — сгенерированный код gRPC API команд и запросов к заказам (orders.proto).
+package orderspb
+
+//go:generate protoc -I . -I ../eventspb --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative orders.proto
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// --- Transactional outbox ---
+// Outbox — сам журнал: событие и запись о том, что его нужно опубликовать, — одна и та же строка,
+// сохранённая одним Append, поэтому сбой между записью и публикацией ничего не теряет.
+// Релей читает журнал после сохранённой позиции (checkpointStore), публикует события по порядку
+// и сдвигает позицию после каждого подтверждённого брокером события. Доставка at-least-once:
+// после сбоя последнее событие может уйти повторно (NATS отбрасывает такие дубли по Nats-Msg-Id).
+// Позиции в mongo и dynamodb выдаются до записи события, и при нескольких писателях событие
+// с меньшей позицией может появиться в журнале позже — релей его не увидит; там пишите одним инстансом.
+type outboxRelay struct {
+	events      EventStore
+	checkpoints checkpointStore
+	name        string
+	interval    time.Duration
+	// deliver возвращается, когда событие доставлено или получатель от него отказался
+	deliver func(context.Context, Event)
+
+	position int64         // последнее доставленное событие
+	wake     chan struct{} // локальный Append: не ждать interval
+	stopping chan struct{} // остановка сервиса: дочитать журнал и выйти
+	done     chan struct{} // закрывается, когда run вернулся
+}
+
+// outboxRelays — запущенные релеи; при остановке сервиса каждый доставляет всё записанное.
+type outboxRelays struct {
+	mu  sync.Mutex
+	set map[*outboxRelay]struct{}
+}
+
+var relays = &outboxRelays{set: map[*outboxRelay]struct{}{}}
+
+// stop останавливает все релеи разом и ждёт, пока они дочитают журнал.
+func (rs *outboxRelays) stop(ctx context.Context) error {
+	rs.mu.Lock()
+	running := make([]*outboxRelay, 0, len(rs.set))
+	for r := range rs.set {
+		close(r.stopping)
+		running = append(running, r)
+	}
+	clear(rs.set)
+	rs.mu.Unlock()
+	for _, r := range running {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", r.name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+func newOutboxRelay(name string, s EventStore, cps checkpointStore, deliver func(context.Context, Event)) *outboxRelay {
+	return &outboxRelay{
+		events:      s,
+		checkpoints: cps,
+		name:        name,
+		interval:    getenvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+		deliver:     deliver,
+		wake:        make(chan struct{}, 1),
+		stopping:    make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// startOutbox запускает релей публикации в брокер p.
+func startOutbox(ctx context.Context, s EventStore, cps checkpointStore, p publisher) error {
+	name := getenv("OUTBOX_NAME", "outbox-"+getenv("EVENT_PUBLISHER", ""))
+	return newOutboxRelay(name, s, cps, func(ctx context.Context, e Event) { publishWithRetry(ctx, p, e) }).start(ctx)
+}
+
+// start запускает релей в фоне до отмены ctx или остановки сервиса. Без сохранённой позиции он начинает с конца журнала:
+// до появления outbox события публиковались сразу после записи. Конец ищется от позиции, известной
+// проекциям (они запускаются раньше), — дочитывается только хвост, а не весь журнал. Если позицию сохранить
+// не удалось, возвращается ошибка, чтобы не начать незаметно с конца при следующем запуске.
+func (r *outboxRelay) start(ctx context.Context) error {
+	position, ok, err := r.checkpoints.LoadCheckpoint(ctx, r.name)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if !ok {
+		if position, err = lastPosition(ctx, r.events); err != nil {
+			return fmt.Errorf("outbox: %w", err)
+		}
+		if err := r.checkpoints.SaveCheckpoint(ctx, r.name, position); err != nil {
+			return fmt.Errorf("outbox: %w", err)
+		}
+		slog.InfoContext(ctx, "outbox: no checkpoint, starting at the head", "relay", r.name, "position", position)
+	}
+	r.position = position
+	unsubscribe := r.events.Subscribe(func(Event) {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	})
+	relays.mu.Lock()
+	relays.set[r] = struct{}{}
+	relays.mu.Unlock()
+	go func() {
+		defer close(r.done)
+		defer unsubscribe()
+		r.run(ctx)
+	}()
+	return nil
+}
+
+func (r *outboxRelay) run(ctx context.Context) {
+	defer func() {
+		relays.mu.Lock()
+		delete(relays.set, r)
+		relays.mu.Unlock()
+	}()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for stopping := false; ; {
+		if err := r.drain(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "outbox: drain failed", "relay", r.name, "error", err)
+		}
+		if stopping {
+			return // последний проход после остановки: новых записей уже не будет
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.stopping:
+			stopping = true
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain доставляет все события после r.position; недоступный получатель задерживает релей, но не журнал.
+func (r *outboxRelay) drain(ctx context.Context) error {
+	events, err := r.events.LoadAfter(ctx, r.position, 0)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		r.deliver(ctx, e)
+		if ctx.Err() != nil {
+			return ctx.Err() // релей остановлен посреди доставки: событие уйдёт при следующем запуске
+		}
+		r.position = e.Position
+		if err := r.checkpoints.SaveCheckpoint(ctx, r.name, e.Position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Payment providers ---
+// Команда оплаты списывает деньги через PaymentProvider (PAYMENT_PROVIDER): сначала авторизация,
+// затем списание. В поток заказа пишутся PaymentAuthorized и, при отказе шлюза, PaymentFailed;
+// OrderPaymentReceived — только после успешного списания, с id авторизации. Без провайдера оплата,
+// как раньше, только записывается. PaymentFailed не несёт Idempotency-Key: повтор той же команды
+// после отказа снова идёт в шлюз, а повтор успешной — отдаёт записанный результат.
+
+const (
+	EventPaymentAuthorized EventType = "PaymentAuthorized"
+	EventPaymentFailed     EventType = "PaymentFailed"
+)
+
+var (
+	errPaymentDeclined = errors.New("payment declined")
+	errPaymentGateway  = errors.New("payment gateway error")
+)
+
+// PaymentProvider — платёжный шлюз.
+type PaymentProvider interface {
+	// Authorize резервирует сумму; отказ шлюза — ошибка errPaymentDeclined с причиной.
+	Authorize(ctx context.Context, p paymentIntent) (authorizationID string, err error)
+	// Capture списывает ранее авторизованную сумму.
+	Capture(ctx context.Context, authorizationID string, p paymentIntent) error
+}
+
+// paymentIntent — что списать: сумма в минимальных единицах валюты и способ оплаты клиента.
+type paymentIntent struct {
+	OrderID        string `json:"order_id"`
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency,omitempty"`
+	PaymentMethod  string `json:"payment_method,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// paymentAuthorizedData — Data события PaymentAuthorized.
+type paymentAuthorizedData struct {
+	AuthorizationID string `json:"authorization_id"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency,omitempty"`
+}
+
+// paymentFailedData — Data события PaymentFailed.
+type paymentFailedData struct {
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency,omitempty"`
+	AuthorizationID string `json:"authorization_id,omitempty"` // отказ при списании
+	Reason          string `json:"reason"`
+}
+
+var payments PaymentProvider // nil — оплата без шлюза
+
+// openPaymentProvider выбирает шлюз по PAYMENT_PROVIDER: none, sandbox или http.
+func openPaymentProvider() (PaymentProvider, error) {
+	switch kind := getenv("PAYMENT_PROVIDER", "none"); kind {
+	case "none":
+		return nil, nil
+	case "sandbox":
+		return sandboxProvider{}, nil
+	case "http":
+		url := getenv("PAYMENT_GATEWAY_URL", "")
+		if url == "" {
+			return nil, errors.New("payments: PAYMENT_GATEWAY_URL is required for PAYMENT_PROVIDER=http")
+		}
+		return &httpPaymentProvider{
+			url:    strings.TrimSuffix(url, "/"),
+			token:  getenv("PAYMENT_GATEWAY_TOKEN", ""),
+			client: &http.Client{Timeout: getenvDuration("PAYMENT_TIMEOUT", 10*time.Second)},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", kind)
+	}
+}
+
+// chargePayment — orderCommand.Effect команды оплаты: проводит платёж method через шлюз и
+// дополняет Data события OrderPaymentReceived id авторизации. Нулевая сумма в шлюз не идёт.
+func chargePayment(method string) func(ctx context.Context, c orderCommand) ([]Event, json.RawMessage, error) {
+	if payments == nil {
+		return nil
+	}
+	return func(ctx context.Context, c orderCommand) ([]Event, json.RawMessage, error) {
+		var paid orderPaidData
+		if err := json.Unmarshal(c.Data, &paid); err != nil {
+			return nil, nil, err
+		}
+		if paid.Amount == 0 {
+			return nil, c.Data, nil
+		}
+		p := paymentIntent{OrderID: c.OrderID, Amount: paid.Amount, Currency: paid.Currency, PaymentMethod: method, IdempotencyKey: c.Key}
+		failed := func(authID string, err error) ([]Event, json.RawMessage, error) {
+			e, merr := dataEvent(EventPaymentFailed, paymentFailedData{Amount: p.Amount, Currency: p.Currency, AuthorizationID: authID, Reason: err.Error()})
+			if merr != nil {
+				return nil, nil, merr
+			}
+			return []Event{e}, nil, err
+		}
+		authID, err := payments.Authorize(ctx, p)
+		if err != nil {
+			return failed("", err)
+		}
+		authorized, err := dataEvent(EventPaymentAuthorized, paymentAuthorizedData{AuthorizationID: authID, Amount: p.Amount, Currency: p.Currency})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := payments.Capture(ctx, authID, p); err != nil {
+			prior, _, err := failed(authID, err)
+			return append([]Event{authorized}, prior...), nil, err
+		}
+		paid.AuthorizationID = authID
+		data, err := json.Marshal(paid)
+		return []Event{authorized}, data, err
+	}
+}
+
+// dataEvent собирает промежуточное событие команды; поток, время и метаданные проставляет executeCommand.
+func dataEvent(t EventType, v any) (Event, error) {
+	data, err := json.Marshal(v)
+	return Event{Type: t, Data: data}, err
+}
+
+// sandboxProvider одобряет любой платёж, кроме способа оплаты "tok_decline" (отказ при авторизации)
+// и "tok_capture_fail" (отказ при списании); для разработки и тестов.
+type sandboxProvider struct{}
+
+func (sandboxProvider) Authorize(ctx context.Context, p paymentIntent) (string, error) {
+	if p.PaymentMethod == "tok_decline" {
+		return "", fmt.Errorf("%w: card declined", errPaymentDeclined)
+	}
+	return "sandbox-" + p.OrderID + "-" + fmt.Sprint(time.Now().UnixNano()), nil
+}
+
+func (sandboxProvider) Capture(ctx context.Context, authorizationID string, p paymentIntent) error {
+	if p.PaymentMethod == "tok_capture_fail" {
+		return fmt.Errorf("%w: capture rejected", errPaymentDeclined)
+	}
+	return nil
+}
+
+// httpPaymentProvider — шлюз с JSON API: POST /authorizations с paymentIntent отвечает
+// {"id": ..., "status": "authorized"|"declined", "reason": ...}, POST /authorizations/{id}/capture — 2xx.
+// Idempotency-Key запроса — ключ команды оплаты.
+type httpPaymentProvider struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type gatewayAuthorization struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (g *httpPaymentProvider) Authorize(ctx context.Context, p paymentIntent) (string, error) {
+	var auth gatewayAuthorization
+	if err := g.post(ctx, "/authorizations", p.IdempotencyKey, p, &auth); err != nil {
+		return "", err
+	}
+	switch auth.Status {
+	case "authorized":
+		return auth.ID, nil
+	case "declined":
+		return "", fmt.Errorf("%w: %s", errPaymentDeclined, auth.Reason)
+	default:
+		return "", fmt.Errorf("%w: unexpected authorization status %q", errPaymentGateway, auth.Status)
+	}
+}
+
+func (g *httpPaymentProvider) Capture(ctx context.Context, authorizationID string, p paymentIntent) error {
+	return g.post(ctx, "/authorizations/"+authorizationID+"/capture", p.IdempotencyKey, p, nil)
+}
+
+func (g *httpPaymentProvider) post(ctx context.Context, path, key string, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPaymentGateway, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPaymentRequired:
+		return fmt.Errorf("%w: gateway responded %s", errPaymentDeclined, resp.Status)
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%w: %s %s: %s", errPaymentGateway, req.Method, path, resp.Status)
+	case out != nil:
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("%w: decode response: %v", errPaymentGateway, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// --- Field-level PII encryption ---
+// С PII_KEY поля Data, перечисленные в PII_FIELDS (пути через точку от корня тела команды и Data события:
+// customer.name; массив на пути проходится поэлементно), шифруются по отдельности ключом PII_KEY до записи.
+// Шифруются только строки; шифротекст — строка "enc:v1:..." (encryption.go), привязанная к заказу, поэтому
+// проекции, read model, поиск, снимки, webhooks и брокеры видят и хранят только его. Полнотекстовый поиск
+// по таким полям не работает. Расшифровываются поля только в ответах на запросы чтения (область queries,
+// rbac.go) с областью pii: её дают роли из PII_ROLES (admin) и ключи API с этой областью; остальным вместо
+// значения отдаётся "***". Без аутентификации ограничений нет, как и для прочих областей. Ключи меняются так
+// же, как ENCRYPTION_KEY: прежние — в PII_OLD_KEYS. Поля, записанные до включения, читаются как есть.
+
+// piiRedacted — значение поля для запроса без области pii.
+const piiRedacted = "***"
+
+type piiPolicy struct {
+	fields [][]string // пути полей
+	c      *dataCipher
+}
+
+// sensitive — шифрование полей; nil — выключено.
+var sensitive *piiPolicy
+
+// openPIIPolicy читает PII_KEY, PII_OLD_KEYS и PII_FIELDS; без PII_KEY — nil.
+func openPIIPolicy() (*piiPolicy, error) {
+	v := getenv("PII_KEY", "")
+	if v == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("pii: PII_KEY: %w", err)
+	}
+	var old [][]byte
+	for _, v := range splitList(getenv("PII_OLD_KEYS", "")) {
+		k, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("pii: PII_OLD_KEYS: %w", err)
+		}
+		old = append(old, k)
+	}
+	c, err := newDataCipher(key, old...)
+	if err != nil {
+		return nil, err
+	}
+	p := &piiPolicy{c: c}
+	for _, f := range splitList(getenv("PII_FIELDS", "customer.name,customer.email,customer.phone,customer.address")) {
+		path := strings.Split(f, ".")
+		if slices.Contains(path, "") {
+			return nil, fmt.Errorf("pii: PII_FIELDS: invalid path %q", f)
+		}
+		p.fields = append(p.fields, path)
+	}
+	slog.Info("pii: fields encrypted", "fields", len(p.fields), "key_id", c.current)
+	return p, nil
+}
+
+// piiAAD — к чему привязан шифротекст поля события.
+func piiAAD(e Event) string {
+	if e.OrderID != "" {
+		return e.OrderID
+	}
+	return e.StreamID
+}
+
+// seal шифрует поля PII_FIELDS в data.
+func (p *piiPolicy) seal(data json.RawMessage, aad string) (json.RawMessage, error) {
+	var err error
+	for _, path := range p.fields {
+		if data, err = p.sealPath(data, path, aad); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (p *piiPolicy) sealPath(data json.RawMessage, path []string, aad string) (json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return data, nil
+	}
+	switch data[0] {
+	case '"':
+		var s string
+		if len(path) > 0 || json.Unmarshal(data, &s) != nil || strings.HasPrefix(s, encryptedPrefix) {
+			return data, nil // не лист пути, или уже зашифровано (восстановление из копии)
+		}
+		return p.c.seal(data, aad)
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return data, nil
+		}
+		for i := range items {
+			sealed, err := p.sealPath(items[i], path, aad)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = sealed
+		}
+		return json.Marshal(items)
+	case '{':
+		var fields map[string]json.RawMessage
+		if len(path) == 0 || json.Unmarshal(data, &fields) != nil {
+			return data, nil
+		}
+		v, ok := fields[path[0]]
+		if !ok {
+			return data, nil
+		}
+		sealed, err := p.sealPath(v, path[1:], aad)
+		if err != nil {
+			return nil, err
+		}
+		fields[path[0]] = sealed
+		return json.Marshal(fields)
+	}
+	return data, nil
+}
+
+type piiAccessKey struct{}
+
+// access помечает контекст запроса чтения: поля расшифровываются (область pii) или скрываются.
+// Без пометки — команды, проекции, фоновые чтения — поля остаются зашифрованными.
+func (p *piiPolicy) access(ctx context.Context, query bool) context.Context {
+	if p == nil || !query {
+		return ctx
+	}
+	scopes, _ := rbac.granted(ctx, true)
+	return context.WithValue(ctx, piiAccessKey{}, slices.Contains(scopes, scopePII))
+}
+
+// view — data для запроса с контекстом ctx.
+func (p *piiPolicy) view(ctx context.Context, data json.RawMessage, aad string) json.RawMessage {
+	reveal, marked := ctx.Value(piiAccessKey{}).(bool)
+	if p == nil || !marked || !bytes.Contains(data, []byte(encryptedPrefix)) {
+		return data
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return data
+	}
+	out, err := json.Marshal(p.walk(ctx, v, reveal, aad))
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+func (p *piiPolicy) walk(ctx context.Context, v any, reveal bool, aad string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			v[k] = p.walk(ctx, item, reveal, aad)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = p.walk(ctx, item, reveal, aad)
+		}
+	case string:
+		if !strings.HasPrefix(v, encryptedPrefix) {
+			return v
+		}
+		if !reveal {
+			return piiRedacted
+		}
+		raw, _ := json.Marshal(v)
+		plain, err := p.c.open(raw, aad)
+		var s string
+		if err == nil {
+			err = json.Unmarshal(plain, &s)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "pii: decrypt field", "aad", aad, "error", err)
+			return piiRedacted
+		}
+		return s
+	}
+	return v
+}
+
+// event — событие для запроса с контекстом ctx.
+func (p *piiPolicy) event(ctx context.Context, e Event) Event {
+	e.Data = p.view(ctx, e.Data, piiAAD(e))
+	return e
+}
+
+// order — заказ из read model для запроса с контекстом ctx; read model хранит поля зашифрованными.
+func (p *piiPolicy) order(ctx context.Context, o Order) Order {
+	if p == nil || ctx.Value(piiAccessKey{}) == nil {
+		return o
+	}
+	data, err := json.Marshal(o)
+	if err != nil || !bytes.Contains(data, []byte(encryptedPrefix)) {
+		return o
+	}
+	var out Order
+	if err := json.Unmarshal(p.view(ctx, data, o.ID), &out); err != nil {
+		return o
+	}
+	return out
+}
+
+func (p *piiPolicy) orders(ctx context.Context, list []Order) []Order {
+	if p == nil || ctx.Value(piiAccessKey{}) == nil {
+		return list
+	}
+	out := make([]Order, len(list))
+	for i, o := range list {
+		out[i] = p.order(ctx, o)
+	}
+	return out
+}
+
+// middleware — звено mux после RBAC: помечает запросы чтения.
+func (p *piiPolicy) middleware(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr := mux.CurrentRoute(r)
+		if cr == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, err := cr.GetPathTemplate()
+		if err != nil || probeRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		query := rbac.scope(cr.GetName(), route, r.Method) == scopeQueries
+		next.ServeHTTP(w, r.WithContext(p.access(r.Context(), query)))
+	})
+}
+
+// piiStore шифрует поля при записи; при чтении показывает их запросу так, как ему положено (access).
+type piiStore struct {
+	EventStore
+	p *piiPolicy
+}
+
+func (s piiStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	plain := e.Data
+	sealed, err := s.p.seal(e.Data, piiAAD(e))
+	if err != nil {
+		return Event{}, err
+	}
+	e.Data = sealed
+	stored, err := s.EventStore.Append(ctx, e, expected)
+	if err != nil {
+		return Event{}, err
+	}
+	stored.Data = plain
+	return stored, nil
+}
+
+func (s piiStore) viewAll(ctx context.Context, events []Event, err error) ([]Event, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range events {
+		events[i] = s.p.event(ctx, e)
+	}
+	return events, nil
+}
+
+func (s piiStore) Load(ctx context.Context) ([]Event, error) {
+	events, err := s.EventStore.Load(ctx)
+	return s.viewAll(ctx, events, err)
+}
+
+func (s piiStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	events, err := s.EventStore.LoadAfter(ctx, after, limit)
+	return s.viewAll(ctx, events, err)
+}
+
+func (s piiStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	events, err := s.EventStore.QueryEvents(ctx, q)
+	return s.viewAll(ctx, events, err)
+}
+
+func (s piiStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	events, err := s.EventStore.LoadByOrder(ctx, orderID)
+	return s.viewAll(ctx, events, err)
+}
+
+func (s piiStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	events, err := s.EventStore.LoadByOrderAfter(ctx, orderID, after)
+	return s.viewAll(ctx, events, err)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// --- Problem details (RFC 7807) ---
+// Ошибки API отдаются как application/problem+json: type, title, status, detail и машиночитаемый code,
+// по которому клиент выбирает реакцию. Известные ошибки домена получают свой code (order_not_found,
+// invalid_transition, version_conflict, ...), остальные — code по статусу (bad_request, not_found, ...).
+// type — URN вида urn:tsc-p7-cqrs:problem:<code>. Конфликт версий дополнительно несёт current_version.
+
+const mediaProblem = "application/problem+json"
+
+// problemDetails — тело ответа об ошибке.
+type problemDetails struct {
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	Status         int    `json:"status"`
+	Detail         string `json:"detail,omitempty"`
+	Code           string `json:"code"`
+	CurrentVersion *int64 `json:"current_version,omitempty"` // при version_conflict
+}
+
+// errorCodes — коды известных ошибок; проверяются по порядку через errors.Is.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{errOrderNotFound, "order_not_found"},
+	{errInvalidTransition, "invalid_transition"},
+	{errUnauthenticated, "unauthenticated"},
+	{errKeyReused, "idempotency_key_reused"},
+	{errPaymentMismatch, "payment_mismatch"},
+	{errRefundRejected, "refund_rejected"},
+	{errCouponRejected, "coupon_rejected"},
+	{errPaymentDeclined, "payment_declined"},
+	{errPaymentGateway, "payment_gateway_error"},
+	{errOutOfStock, "out_of_stock"},
+	{errQueueFull, "queue_full"},
+	{errShuttingDown, "shutting_down"},
+	{errReadModelBehind, "read_model_behind"},
+	{errUnknownProjection, "projection_not_found"},
+	{errRebuildRunning, "rebuild_running"},
+	{errRebuildNotSupported, "rebuild_not_supported"},
+	{errSearchDisabled, "search_disabled"},
+	{errSigningDisabled, "signing_disabled"},
+	{errUnsupportedMediaType, "unsupported_media_type"},
+	{context.DeadlineExceeded, "request_timeout"},
+	{errInvalidToken, "invalid_token"},
+	{errInvalidAPIKey, "invalid_api_key"},
+	{errForbidden, "forbidden"},
+	{errLoginFailed, "login_failed"},
+	{errCSRF, "csrf_token_invalid"},
+	{errIPNotAllowed, "ip_not_allowed"},
+	{errCommandQuota, "command_quota_exceeded"},
+	{errEventQuota, "event_quota_exceeded"},
+	{errTenantRequired, "tenant_required"},
+	{errInvalidTenant, "invalid_tenant"},
+	{errAPIKeyExists, "api_key_exists"},
+	{errAPIKeyStatic, "api_key_static"},
+	{errAPIKeyNotFound, "api_key_not_found"},
+}
+
+// statusCode — code по статусу HTTP: "Not Found" -> not_found.
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// errorCode — code ошибки err; неизвестная ошибка — code по status.
+func errorCode(err error, status int) string {
+	var conflict *versionConflictError
+	var invalid *invalidCommandError
+	switch {
+	case errors.As(err, &conflict):
+		return "version_conflict"
+	case errors.As(err, &invalid):
+		return "validation_failed"
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return statusCode(status)
+}
+
+func writeProblemDetails(w http.ResponseWriter, p problemDetails) {
+	p.Type = "urn:tsc-p7-cqrs:problem:" + p.Code
+	p.Title = http.StatusText(p.Status)
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", mediaProblem)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem отвечает ошибкой с явным code.
+func writeProblem(w http.ResponseWriter, status int, code, detail string) {
+	writeProblemDetails(w, problemDetails{Status: status, Code: code, Detail: detail})
+}
+
+// writeError отвечает ошибкой err; code выводится из неё. Истёкший срок запроса (httpserver.go) — 503, а не 500.
+func writeError(w http.ResponseWriter, err error, status int) {
+	if status == http.StatusInternalServerError && errors.Is(err, context.DeadlineExceeded) {
+		w.Header().Set("Retry-After", "1")
+		status = http.StatusServiceUnavailable
+	}
+	writeProblem(w, status, errorCode(err, status), err.Error())
+}
+
+// httpError — замена http.Error: detail без известной ошибки, code по статусу.
+func httpError(w http.ResponseWriter, detail string, status int) {
+	writeProblem(w, status, statusCode(status), detail)
+}
+
+// problemHandler — ответ mux на неизвестный путь или метод.
+func problemHandler(status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, r.Method+" "+r.URL.Path+": "+strings.ToLower(http.StatusText(status)), status)
+	})
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// --- Projections ---
+// Read model собирается из именованных проекций. Реестр питает их событиями хранилища: при запуске
+// проекции догоняют журнал, затем получают новые события из подписки (и из брокера, если он — projectionFeed).
+// Каждая проекция помнит позицию последнего применённого события. Проекция в памяти при запуске строится
+// с начала журнала; Durable-проекция (состояние живёт вне процесса) сохраняет позицию в checkpoints как
+// projection/<name> и догоняет журнал с неё. Повторную доставку проекция отсеивает сама — по версии потока,
+// как заказы: одно и то же событие может прийти из подписки и из брокера.
+//
+// Проекции независимы: у каждой своя очередь событий и своя горутина, так что медленная проекция (например,
+// индексация во внешний поиск) копит очередь, а остальные идут дальше. Проекция с After читает состояние
+// другой и применяет событие только после того, как его применила та. Отставание каждой проекции — событий
+// и секунд до головы журнала — видно в GET /admin/projections.
+//
+// POST /admin/projections/{name}/rebuild перестраивает проекцию без перезапуска: Reset очищает её, затем
+// журнал проигрывается заново в фоне, а прогресс виден в GET /admin/projections/{name}. Новые события на время
+// перестройки откладываются и применяются после неё, так что они не опережают старые; запросы к проекции
+// до конца перестройки видят неполное состояние. Проекция без Reset не перестраивается.
+
+// projection — именованная read model над журналом.
+type projection struct {
+	Name    string
+	Apply   func(Event)
+	Reset   func() // очищает проекцию перед перестройкой; nil — перестроить нельзя
+	Durable bool   // позиция сохраняется в checkpoints, после запуска журнал догоняется с неё
+	After   string // проекция, состояние которой читает Apply: событие применяется после неё
+}
+
+type rebuildState string
+
+const (
+	rebuildRunning   rebuildState = "running"
+	rebuildSucceeded rebuildState = "succeeded"
+	rebuildFailed    rebuildState = "failed"
+)
+
+// projectionRebuild — ход последней перестройки проекции.
+type projectionRebuild struct {
+	State      rebuildState `json:"state"`
+	Total      int          `json:"total"`     // событий в журнале на начало перестройки
+	Processed  int          `json:"processed"` // из них уже проиграно
+	Error      string       `json:"error,omitempty"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+}
+
+// projectionStatus — состояние проекции для GET /admin/projections.
+type projectionStatus struct {
+	Name       string             `json:"name"`
+	Durable    bool               `json:"durable,omitempty"`
+	Position   int64              `json:"position"`             // позиция последнего применённого события
+	Applied    int64              `json:"applied"`              // событий применено с запуска
+	Lag        int64              `json:"lag"`                  // позиций до последнего события журнала, полученного реестром
+	Queued     int                `json:"queued"`               // событий ждут в очереди проекции
+	LagSeconds float64            `json:"lag_seconds"`          // возраст самого старого неприменённого события; 0 — очередь пуста
+	Checkpoint *int64             `json:"checkpoint,omitempty"` // последняя сохранённая позиция; только у Durable
+	Rebuild    *projectionRebuild `json:"rebuild,omitempty"`
+}
+
+type projectionRunner struct {
+	projection
+	after *projectionRunner // по projection.After
+	head  *atomic.Int64     // projectionRegistry.head
+
+	applyMu sync.Mutex // упорядочивает Apply и Reset; mu при этом свободен для status
+
+	mu       sync.Mutex
+	position int64
+	applied  int64
+	saved    int64 // позиция последнего сохранённого checkpoint
+	rebuild  *projectionRebuild
+	pending  []Event       // события, пришедшие во время перестройки
+	changed  chan struct{} // закрывается при следующем применённом событии; nil — никто не ждёт
+	inbox    []Event       // очередь живых событий; inbox[0] применяется сейчас
+	wake     chan struct{} // сигнал горутине run о новых событиях в inbox
+}
+
+func (p *projectionRunner) apply(e Event) {
+	p.applyMu.Lock()
+	defer p.applyMu.Unlock()
+	p.mu.Lock()
+	if p.rebuild != nil && p.rebuild.State == rebuildRunning {
+		p.pending = append(p.pending, e)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	p.Apply(e)
+	p.mu.Lock()
+	p.advance(e)
+	p.mu.Unlock()
+}
+
+// handle применяет событие, дождавшись его в проекции After; ctx отменён — событие не применяется.
+func (p *projectionRunner) handle(ctx context.Context, e Event) {
+	if p.after != nil {
+		err := p.after.await(ctx, func() (bool, error) { return p.after.status().Position >= e.Position, nil })
+		if err != nil {
+			return
+		}
+	}
+	p.apply(e)
+}
+
+// enqueue ставит живое событие в очередь проекции.
+func (p *projectionRunner) enqueue(e Event) {
+	p.mu.Lock()
+	p.inbox = append(p.inbox, e)
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run применяет события из очереди по одному до отмены ctx.
+func (p *projectionRunner) run(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		if len(p.inbox) == 0 {
+			p.mu.Unlock()
+			select {
+			case <-p.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		e := p.inbox[0]
+		p.mu.Unlock()
+		_, span := tracer.Start(eventTraceContext(ctx, e), "projection "+p.Name, trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(attribute.String("event.type", string(e.Type)), attribute.Int64("event.position", e.Position)))
+		p.handle(ctx, e)
+		span.End()
+		p.mu.Lock()
+		p.inbox[0] = Event{}
+		p.inbox = p.inbox[1:]
+		p.mu.Unlock()
+	}
+}
+
+// advance учитывает применённое событие и будит ожидающих в await; вызывается под p.mu.
+func (p *projectionRunner) advance(e Event) {
+	p.applied++
+	p.position = max(p.position, e.Position)
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+// await ждёт, пока done не вернёт true; done проверяется сразу и после каждого применённого события.
+func (p *projectionRunner) await(ctx context.Context, done func() (bool, error)) error {
+	for {
+		p.mu.Lock()
+		if p.changed == nil {
+			p.changed = make(chan struct{})
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		if ok, err := done(); ok || err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *projectionRunner) status() projectionStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := projectionStatus{Name: p.Name, Durable: p.Durable, Position: p.position, Applied: p.applied, Queued: len(p.inbox)}
+	if p.rebuild != nil && p.rebuild.State == rebuildRunning {
+		st.Queued += len(p.pending)
+	}
+	st.Lag = max(p.head.Load()-p.position, 0)
+	if p.Durable {
+		saved := p.saved
+		st.Checkpoint = &saved
+	}
+	if len(p.inbox) > 0 {
+		st.LagSeconds = time.Since(p.inbox[0].Timestamp).Seconds()
+	}
+	if p.rebuild != nil {
+		rb := *p.rebuild
+		st.Rebuild = &rb
+	}
+	return st
+}
+
+var (
+	errUnknownProjection   = errors.New("projection not found")
+	errRebuildRunning      = errors.New("projection rebuild is already running")
+	errRebuildNotSupported = errors.New("projection cannot be rebuilt")
+)
+
+// startRebuild очищает проекцию и запускает проигрывание журнала в фоне.
+func (p *projectionRunner) startRebuild(ctx context.Context, es EventStore) error {
+	p.applyMu.Lock()
+	defer p.applyMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.Reset == nil:
+		return errRebuildNotSupported
+	case p.rebuild != nil && p.rebuild.State == rebuildRunning:
+		return errRebuildRunning
+	}
+	p.rebuild = &projectionRebuild{State: rebuildRunning, StartedAt: time.Now()}
+	p.Reset()
+	p.position, p.applied = 0, 0
+	go p.replay(ctx, es)
+	return nil
+}
+
+// replay проигрывает журнал в проекцию, затем применяет события, отложенные за время перестройки,
+// кроме тех, что уже попали в Load.
+func (p *projectionRunner) replay(ctx context.Context, es EventStore) {
+	events, err := es.Load(ctx)
+	p.mu.Lock()
+	p.rebuild.Total = len(events)
+	p.mu.Unlock()
+	for i, e := range events {
+		p.applyMu.Lock()
+		p.Apply(e)
+		p.applyMu.Unlock()
+		p.mu.Lock()
+		p.rebuild.Processed = i + 1
+		p.advance(e)
+		p.mu.Unlock()
+	}
+	p.applyMu.Lock()
+	defer p.applyMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.pending {
+		if e.Position > 0 && e.Position <= p.position {
+			continue // записано между Reset и Load: уже проиграно из журнала
+		}
+		p.Apply(e)
+		p.advance(e)
+	}
+	p.pending = nil
+	now := time.Now()
+	p.rebuild.State, p.rebuild.FinishedAt = rebuildSucceeded, &now
+	if err != nil {
+		p.rebuild.State, p.rebuild.Error = rebuildFailed, err.Error()
+		slog.Error("projections: rebuild failed", "projection", p.Name, "error", err)
+		return
+	}
+	slog.Info("projections: rebuilt", "projection", p.Name, "events", len(events), "duration", now.Sub(p.rebuild.StartedAt))
+}
+
+func (p *projectionRunner) checkpointName() string { return "projection/" + p.Name }
+
+type projectionRegistry struct {
+	list   []*projectionRunner // в порядке регистрации
+	byName map[string]*projectionRunner
+	head   atomic.Int64 // позиция последнего события, полученного реестром
+
+	ctx context.Context // из start: контекст фоновых перестроек
+	es  EventStore
+	cps checkpointStore
+}
+
+var projections = &projectionRegistry{byName: map[string]*projectionRunner{}}
+
+// projectionCheckpointInterval — как часто сохраняются позиции Durable-проекций.
+const projectionCheckpointInterval = time.Second
+
+// register добавляет проекции; вторая проекция с тем же именем — ошибка программы.
+func (r *projectionRegistry) register(ps ...projection) {
+	for _, p := range ps {
+		if _, dup := r.byName[p.Name]; dup {
+			panic("projections: duplicate projection " + p.Name)
+		}
+		pr := &projectionRunner{projection: p, head: &r.head, wake: make(chan struct{}, 1)}
+		r.list = append(r.list, pr)
+		r.byName[p.Name] = pr
+	}
+}
+
+// apply ставит событие в очереди всех проекций.
+func (r *projectionRegistry) apply(e Event) {
+	r.observe(e.Position)
+	for _, p := range r.list {
+		p.enqueue(e)
+	}
+}
+
+// observe сдвигает голову журнала, известную реестру.
+func (r *projectionRegistry) observe(position int64) {
+	for {
+		head := r.head.Load()
+		if position <= head || r.head.CompareAndSwap(head, position) {
+			return
+		}
+	}
+}
+
+// start догоняет журнал всеми проекциями параллельно и подписывает реестр на новые события; позиции
+// Durable-проекций сохраняются в cps до отмены ctx.
+func (r *projectionRegistry) start(ctx context.Context, es EventStore, cps checkpointStore) error {
+	r.ctx, r.es, r.cps = ctx, es, cps
+	durable := false
+	for _, p := range r.list {
+		if p.After != "" {
+			if p.after = r.byName[p.After]; p.after == nil {
+				panic("projections: " + p.Name + " after unknown projection " + p.After)
+			}
+		}
+		if !p.Durable {
+			continue
+		}
+		durable = true
+		position, _, err := cps.LoadCheckpoint(ctx, p.checkpointName())
+		if err != nil {
+			return fmt.Errorf("projections: %s: %w", p.Name, err)
+		}
+		p.position, p.saved = position, position
+	}
+	events, err := es.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if len(events) > 0 {
+		r.observe(events[len(events)-1].Position)
+	}
+	var wg sync.WaitGroup
+	for _, p := range r.list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, e := range events {
+				if !p.Durable || e.Position > p.position {
+					p.handle(ctx, e)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, p := range r.list {
+		go p.run(ctx)
+	}
+	es.Subscribe(r.apply)
+	if durable {
+		go r.saveCheckpoints(ctx)
+	}
+	return nil
+}
+
+// saveCheckpoints раз в projectionCheckpointInterval сохраняет позиции Durable-проекций, которые сдвинулись.
+func (r *projectionRegistry) saveCheckpoints(ctx context.Context) {
+	t := time.NewTicker(projectionCheckpointInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		r.save(ctx)
+	}
+}
+
+// save сохраняет сдвинувшиеся позиции Durable-проекций; возвращает первую ошибку.
+func (r *projectionRegistry) save(ctx context.Context) error {
+	var first error
+	for _, p := range r.list {
+		if !p.Durable {
+			continue
+		}
+		p.mu.Lock()
+		position, saved := p.position, p.saved
+		p.mu.Unlock()
+		if position == saved {
+			continue
+		}
+		if err := r.cps.SaveCheckpoint(ctx, p.checkpointName(), position); err != nil {
+			slog.ErrorContext(ctx, "projections: save checkpoint", "projection", p.Name, "error", err)
+			first = cmp.Or(first, err)
+			continue
+		}
+		p.mu.Lock()
+		p.saved = position
+		p.mu.Unlock()
+	}
+	return first
+}
+
+// flush при остановке дожидается, пока проекции применят всё полученное, и сохраняет checkpoint.
+func (r *projectionRegistry) flush(ctx context.Context) error {
+	if r.cps == nil {
+		return nil // реестр не запущен
+	}
+	head := r.head.Load()
+	for _, p := range r.list {
+		err := p.await(ctx, func() (bool, error) { return p.status().Position >= head, nil })
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Name, err)
+		}
+	}
+	return r.save(ctx)
+}
+
+func (r *projectionRegistry) statuses() []projectionStatus {
+	out := make([]projectionStatus, 0, len(r.list))
+	for _, p := range r.list {
+		out = append(out, p.status())
+	}
+	return out
+}
+
+// rebuild перестраивает проекцию name в фоне.
+func (r *projectionRegistry) rebuild(name string) (projectionStatus, error) {
+	p, ok := r.byName[name]
+	if !ok {
+		return projectionStatus{}, errUnknownProjection
+	}
+	if err := p.startRebuild(r.ctx, r.es); err != nil {
+		return projectionStatus{}, err
+	}
+	return p.status(), nil
+}
+
+// listProjections отдаёт проекции в порядке регистрации с их позициями.
+func listProjections(w http.ResponseWriter, r *http.Request) {
+	writeBody(w, r, http.StatusOK, projections.statuses())
+}
+
+// getProjection отдаёт проекцию с ходом последней перестройки.
+func getProjection(w http.ResponseWriter, r *http.Request) {
+	p, ok := projections.byName[mux.Vars(r)["name"]]
+	if !ok {
+		writeError(w, errUnknownProjection, http.StatusNotFound)
+		return
+	}
+	writeBody(w, r, http.StatusOK, p.status())
+}
+
+// rebuildProjection запускает перестройку и отвечает 202 со ссылкой на её ход; уже идущая перестройка
+// или проекция без Reset — 409.
+func rebuildProjection(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	st, err := projections.rebuild(name)
+	switch {
+	case errors.Is(err, errUnknownProjection):
+		writeError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		writeError(w, err, http.StatusConflict)
+		return
+	}
+	w.Header().Set("Location", apiVersionPrefix+"/admin/projections/"+name)
+	writeBody(w, r, http.StatusAccepted, st)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- Prometheus metrics ---
+// GET /metrics отдаёт метрики в текстовом формате Prometheus (0.0.4): команды по имени и итогу с временем
+// выполнения, записанные события по типу, время ответов HTTP по маршруту mux (шаблон пути, а не сам путь,
+// чтобы id не раздували число рядов), отставание проекций и размер журнала. Счётчики и гистограммы живут
+// в процессе и обнуляются при перезапуске; значения о проекциях и журнале снимаются в момент запроса.
+// Формат пишется вручную, без клиентской библиотеки: он простой.
+
+// promBuckets — верхние границы корзин гистограмм длительности, в секундах.
+var promBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// promVec — семейство рядов одной метрики с набором меток.
+type promVec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*promSeries // по значениям меток через \xff
+}
+
+type promSeries struct {
+	values []string
+	value  float64  // counter
+	counts []uint64 // histogram: по корзинам promBuckets, не накопительно
+	sum    float64
+	count  uint64
+}
+
+func newPromVec(kind, name, help string, labels ...string) *promVec {
+	return &promVec{name: name, help: help, kind: kind, labels: labels, series: map[string]*promSeries{}}
+}
+
+func (v *promVec) get(values []string) *promSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &promSeries{values: values}
+		if v.kind == "histogram" {
+			s.counts = make([]uint64, len(promBuckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// inc увеличивает счётчик.
+func (v *promVec) inc(values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).value++
+}
+
+// observe добавляет наблюдение в гистограмму.
+func (v *promVec) observe(d time.Duration, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, sec := v.get(values), d.Seconds()
+	if i := sort.SearchFloat64s(promBuckets, sec); i < len(promBuckets) {
+		s.counts[i]++
+	}
+	s.sum += sec
+	s.count++
+}
+
+func (v *promVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, promLabels(v.labels, s.values), promFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range promBuckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, promLabels(slices.Concat(v.labels, []string{"le"}), slices.Concat(s.values, []string{promFloat(le)})), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, promLabels(slices.Concat(v.labels, []string{"le"}), slices.Concat(s.values, []string{"+Inf"})), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, promLabels(v.labels, s.values), promFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, promLabels(v.labels, s.values), s.count)
+	}
+}
+
+func promLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func promFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	promCommands = newPromVec("counter", "orders_commands_total",
+		"Commands dispatched through the command bus by command name and outcome.", "command", "outcome")
+	promCommandDuration = newPromVec("histogram", "orders_command_duration_seconds",
+		"Command handling time through the command bus.", "command")
+	promEventsAppended = newPromVec("counter", "orders_events_appended_total",
+		"Events appended to the event store by this process, by event type.", "type")
+	promAppendDuration = newPromVec("histogram", "orders_event_store_append_duration_seconds",
+		"Event store Append latency.")
+	promHTTPDuration = newPromVec("histogram", "orders_http_request_duration_seconds",
+		"HTTP request latency by route template, method and status code.", "route", "method", "code")
+)
+
+// recordCommand учитывает команду шины; вызывается из commandMetrics.measure.
+func recordCommand(name string, outcome auditOutcome, d time.Duration) {
+	promCommands.inc(name, string(outcome))
+	promCommandDuration.observe(d, name)
+}
+
+// meteredStore считает записанные события и время Append.
+type meteredStore struct {
+	EventStore
+}
+
+func (s meteredStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	start := time.Now()
+	stored, err := s.EventStore.Append(ctx, e, expected)
+	promAppendDuration.observe(time.Since(start))
+	if err == nil {
+		promEventsAppended.inc(string(stored.Type))
+	}
+	return stored, err
+}
+
+// statusRecorder запоминает код ответа и размер тела для метрик и логов.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush нужен потоковым ответам (SSE, long-poll).
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack нужен апгрейду WebSocket; после него код ответа — 101.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// measureHTTP — middleware mux, которое пишет время ответа в orders_http_request_duration_seconds.
+func measureHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if t, err := cr.GetPathTemplate(); err == nil {
+				route = t
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		promHTTPDuration.observe(time.Since(start), route, r.Method, strconv.Itoa(rec.status))
+	})
+}
+
+// writeGauge пишет метрику-gauge с рядами, снятыми в момент запроса.
+func writeGauge(w io.Writer, name, help string, labels []string, rows map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(labels) > 0 {
+			values = []string{k}
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, promLabels(labels, values), promFloat(rows[k]))
+	}
+}
+
+// serveMetrics отдаёт GET /metrics.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, v := range []*promVec{promCommands, promCommandDuration, promEventsAppended, promAppendDuration, promHTTPDuration, promRateLimited, promPanics} {
+		v.write(w)
+	}
+	lag, lagSeconds, queued := map[string]float64{}, map[string]float64{}, map[string]float64{}
+	for _, st := range projections.statuses() {
+		lag[st.Name], lagSeconds[st.Name], queued[st.Name] = float64(st.Lag), st.LagSeconds, float64(st.Queued)
+	}
+	writeGauge(w, "orders_projection_lag_events", "Log positions between the head of the event log and the projection.", []string{"projection"}, lag)
+	writeGauge(w, "orders_projection_lag_seconds", "Age of the oldest event not yet applied by the projection.", []string{"projection"}, lagSeconds)
+	writeGauge(w, "orders_projection_queued_events", "Events waiting in the projection queue.", []string{"projection"}, queued)
+	mutex.Lock()
+	size, count := orderEvents, len(orders)
+	mutex.Unlock()
+	writeGauge(w, "orders_event_store_position", "Position of the last event in the log seen by the projections.", nil, map[string]float64{"": float64(projections.head.Load())})
+	writeGauge(w, "orders_event_store_order_events", "Order events in the log according to the read model.", nil, map[string]float64{"": float64(size)})
+	writeGauge(w, "orders_read_model_orders", "Orders in the in-memory read model.", nil, map[string]float64{"": float64(count)})
+}
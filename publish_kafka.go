@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// --- Kafka publisher ---
+// Ключ сообщения — order_id: события одного заказа попадают в одну партицию и читаются по порядку.
+// Тело — JSON события, тип и позиция дублируются в заголовках для фильтрации без разбора тела.
+type kafkaPublisher struct {
+	w *kafka.Writer
+}
+
+type kafkaOptions struct {
+	Brokers string // через запятую
+	Topic   string
+}
+
+func newKafkaPublisher(ctx context.Context, opts kafkaOptions) (*kafkaPublisher, error) {
+	var brokers []string
+	for _, b := range strings.Split(opts.Brokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("kafka: no brokers configured")
+	}
+	if err := kafkaCheckTopic(ctx, brokers, opts.Topic); err != nil {
+		return nil, err
+	}
+	return &kafkaPublisher{w: &kafka.Writer{
+		Addr:            kafka.TCP(brokers...),
+		Topic:           opts.Topic,
+		Balancer:        &kafka.Hash{},
+		RequiredAcks:    kafka.RequireAll,
+		MaxAttempts:     5,
+		WriteBackoffMin: publishBackoffMin,
+		WriteBackoffMax: time.Second,
+		BatchTimeout:    10 * time.Millisecond, // публикуем по одному событию, не ждём наполнения пачки
+	}}, nil
+}
+
+// kafkaCheckTopic проверяет при старте, что хотя бы один брокер доступен и топик существует.
+func kafkaCheckTopic(ctx context.Context, brokers []string, topic string) error {
+	var errs []error
+	for _, b := range brokers {
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		conn, err := kafka.DialContext(dialCtx, "tcp", b)
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		partitions, err := conn.ReadPartitions(topic)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("kafka: topic %s: %w", topic, err)
+		}
+		if len(partitions) == 0 {
+			return fmt.Errorf("kafka: topic %s has no partitions", topic)
+		}
+		return nil
+	}
+	return fmt.Errorf("kafka: no broker reachable: %w", errors.Join(errs...))
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("kafka: encode: %w", err)
+	}
+	err = p.w.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(e.OrderID),
+		Value: body,
+		Time:  e.Timestamp,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(e.Type)},
+			{Key: "position", Value: []byte(strconv.FormatInt(e.Position, 10))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("kafka: publish: %w", err)
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.w.Close()
+}
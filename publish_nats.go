@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// --- NATS JetStream publisher ---
+// События публикуются в subject <subject>.<type> потока JetStream (создаётся при старте);
+// Nats-Msg-Id = stream_id@version, так что повторная публикация после сбоя отбрасывается брокером.
+// С NATS_CONSUMER read model питается из durable consumer: каждый инстанс видит записи всех остальных,
+// доставка at-least-once (ack после применения события).
+type natsPublisher struct {
+	nc  *nats.Conn
+	js  jetstream.JetStream
+	cc  jetstream.ConsumeContext
+	opt natsOptions
+}
+
+type natsOptions struct {
+	URL      string
+	Stream   string
+	Subject  string // префикс subject'ов событий
+	Consumer string // имя durable consumer для read model; пусто — только публикация
+}
+
+func newNATSPublisher(ctx context.Context, opts natsOptions) (*natsPublisher, error) {
+	nc, err := nats.Connect(opts.URL, nats.Name("tsc-p7-cqrs"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("nats: connect %s: %w", opts.URL, err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: jetstream: %w", err)
+	}
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       opts.Stream,
+		Subjects:   []string{opts.Subject + ".>"},
+		Duplicates: 10 * time.Minute, // окно дедупликации по Nats-Msg-Id
+	})
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: stream %s: %w", opts.Stream, err)
+	}
+	return &natsPublisher{nc: nc, js: js, opt: opts}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("nats: encode: %w", err)
+	}
+	msg := nats.NewMsg(p.opt.Subject + "." + string(e.Type))
+	msg.Data = body
+	msg.Header.Set("Order-Id", e.OrderID)
+	msg.Header.Set("Position", strconv.FormatInt(e.Position, 10))
+	if _, err := p.js.PublishMsg(ctx, msg, jetstream.WithMsgID(e.StreamID+"@"+strconv.FormatInt(e.Version, 10))); err != nil {
+		return fmt.Errorf("nats: publish: %w", err)
+	}
+	return nil
+}
+
+// Consume подписывает fn на durable consumer NATS_CONSUMER; без него ничего не делает.
+// Новый consumer начинает с новых сообщений: всё более раннее read model прочитал из журнала.
+func (p *natsPublisher) Consume(ctx context.Context, fn func(Event)) error {
+	if p.opt.Consumer == "" {
+		return nil
+	}
+	cons, err := p.js.CreateOrUpdateConsumer(ctx, p.opt.Stream, jetstream.ConsumerConfig{
+		Durable:       p.opt.Consumer,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		FilterSubject: p.opt.Subject + ".>",
+	})
+	if err != nil {
+		return fmt.Errorf("nats: consumer %s: %w", p.opt.Consumer, err)
+	}
+	p.cc, err = cons.Consume(func(msg jetstream.Msg) {
+		var e Event
+		if err := json.Unmarshal(msg.Data(), &e); err != nil {
+			slog.Error("nats: bad event", "subject", msg.Subject(), "error", err)
+			msg.Term() // повторная доставка не поможет
+			return
+		}
+		fn(e)
+		if err := msg.Ack(); err != nil {
+			slog.Warn("nats: ack failed", "stream_id", e.StreamID, "version", e.Version, "error", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("nats: consume %s: %w", p.opt.Consumer, err)
+	}
+	return nil
+}
+
+func (p *natsPublisher) Close() error {
+	if p.cc != nil {
+		p.cc.Stop()
+	}
+	return p.nc.Drain()
+}
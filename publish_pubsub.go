@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+)
+
+// --- Google Cloud Pub/Sub publisher ---
+// Ordering key — order_id: подписка с включённым message ordering получает события заказа по порядку.
+// Тип, order_id и позиция — атрибуты сообщения, по которым подписки фильтруют события.
+// При неудачной публикации Pub/Sub приостанавливает ключ; следующая попытка возобновляет его.
+type pubsubPublisher struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+}
+
+type pubsubOptions struct {
+	Project  string
+	Topic    string
+	Endpoint string // для эмулятора удобнее PUBSUB_EMULATOR_HOST, его клиент читает сам
+}
+
+func newPubSubPublisher(ctx context.Context, opts pubsubOptions) (*pubsubPublisher, error) {
+	if opts.Project == "" {
+		return nil, errors.New("pubsub: PUBSUB_PROJECT is required")
+	}
+	var clientOpts []option.ClientOption
+	if opts.Endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(opts.Endpoint))
+	}
+	client, err := pubsub.NewClient(ctx, opts.Project, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: client: %w", err)
+	}
+	topic := client.Topic(opts.Topic)
+	ok, err := topic.Exists(ctx)
+	if err == nil && !ok {
+		err = errors.New("does not exist")
+	}
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("pubsub: topic %s: %w", opts.Topic, err)
+	}
+	topic.EnableMessageOrdering = true
+	return &pubsubPublisher{client: client, topic: topic}, nil
+}
+
+func (p *pubsubPublisher) Publish(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("pubsub: encode: %w", err)
+	}
+	res := p.topic.Publish(ctx, &pubsub.Message{
+		Data:        body,
+		OrderingKey: e.OrderID,
+		Attributes: map[string]string{
+			"type":     string(e.Type),
+			"order_id": e.OrderID,
+			"position": strconv.FormatInt(e.Position, 10),
+		},
+	})
+	if _, err := res.Get(ctx); err != nil {
+		p.topic.ResumePublish(e.OrderID)
+		return fmt.Errorf("pubsub: publish: %w", err)
+	}
+	return nil
+}
+
+func (p *pubsubPublisher) Close() error {
+	p.topic.Stop()
+	return p.client.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// --- RabbitMQ publisher ---
+// События публикуются в topic exchange с routing key по типу: OrderPaid -> order.paid,
+// так что потребитель подписывается на нужные типы (order.paid, order.*, #).
+// Каждая публикация ждёт publisher confirm; после разрыва соединение открывается заново при следующей попытке.
+type rabbitPublisher struct {
+	opts rabbitOptions
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+type rabbitOptions struct {
+	URL      string
+	Exchange string
+}
+
+func newRabbitPublisher(opts rabbitOptions) (*rabbitPublisher, error) {
+	p := &rabbitPublisher{opts: opts}
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// connect открывает соединение и канал в режиме confirm и объявляет exchange. Вызывается под p.mu.
+func (p *rabbitPublisher) connect() error {
+	conn, err := amqp.DialConfig(p.opts.URL, amqp.Config{Properties: amqp.Table{"connection_name": "tsc-p7-cqrs"}})
+	if err != nil {
+		return fmt.Errorf("rabbitmq: connect: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.ExchangeDeclare(p.opts.Exchange, amqp.ExchangeTopic, true, false, false, false, nil)
+	}
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("rabbitmq: exchange %s: %w", p.opts.Exchange, err)
+	}
+	p.conn, p.ch = conn, ch
+	return nil
+}
+
+// routingKey строит ключ из типа события: первое слово — сущность, остальные через "_" — действие
+// (OrderPaid -> order.paid, OrderItemAdded -> order.item_added).
+func routingKey(t EventType) string {
+	var words []string
+	start := 0
+	s := string(t)
+	for i, r := range s {
+		if i > 0 && unicode.IsUpper(r) {
+			words = append(words, strings.ToLower(s[start:i]))
+			start = i
+		}
+	}
+	words = append(words, strings.ToLower(s[start:]))
+	if len(words) == 1 {
+		return words[0]
+	}
+	return words[0] + "." + strings.Join(words[1:], "_")
+}
+
+func (p *rabbitPublisher) Publish(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("rabbitmq: encode: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch == nil || p.ch.IsClosed() {
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	conf, err := p.ch.PublishWithDeferredConfirmWithContext(ctx, p.opts.Exchange, routingKey(e.Type), false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     fmt.Sprintf("%s@%d", e.StreamID, e.Version),
+		CorrelationId: e.Metadata.CorrelationID,
+		Type:          string(e.Type),
+		Timestamp:     e.Timestamp,
+		Headers:       amqp.Table{"order_id": e.OrderID, "position": e.Position},
+		Body:          body,
+	})
+	if err != nil {
+		return fmt.Errorf("rabbitmq: publish: %w", err)
+	}
+	acked, err := conf.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("rabbitmq: confirm: %w", err)
+	}
+	if !acked {
+		return errors.New("rabbitmq: broker nacked the message")
+	}
+	return nil
+}
+
+func (p *rabbitPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// --- AWS SNS publisher ---
+// События публикуются в SNS topic, откуда расходятся по подписанным SQS-очередям (fan-out).
+// Тип, order_id и позиция уходят в message attributes, чтобы очереди фильтровали события filter policy.
+// FIFO topic (ARN на .fifo) сохраняет порядок событий заказа (MessageGroupId = order_id) и
+// отбрасывает повторы (MessageDeduplicationId = stream_id@version).
+// Очереди из SNS_SQS_QUEUES подписываются на topic при старте с raw delivery; политика очереди
+// должна разрешать sqs:SendMessage для этого topic.
+type snsPublisher struct {
+	sns   *sns.Client
+	topic string
+	fifo  bool
+}
+
+type snsOptions struct {
+	TopicARN string
+	Queues   string // URL SQS-очередей через запятую
+	Region   string
+	Endpoint string // для LocalStack
+}
+
+func newSNSPublisher(ctx context.Context, opts snsOptions) (*snsPublisher, error) {
+	if opts.TopicARN == "" {
+		return nil, errors.New("sns: SNS_TOPIC_ARN is required")
+	}
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(opts.Region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("sns: load aws config: %w", err)
+	}
+	p := &snsPublisher{
+		sns: sns.NewFromConfig(cfg, func(o *sns.Options) {
+			if opts.Endpoint != "" {
+				o.BaseEndpoint = aws.String(opts.Endpoint)
+			}
+		}),
+		topic: opts.TopicARN,
+		fifo:  strings.HasSuffix(opts.TopicARN, ".fifo"),
+	}
+	if _, err := p.sns.GetTopicAttributes(ctx, &sns.GetTopicAttributesInput{TopicArn: aws.String(p.topic)}); err != nil {
+		return nil, fmt.Errorf("sns: topic %s: %w", p.topic, err)
+	}
+	queues := splitList(opts.Queues)
+	if len(queues) == 0 {
+		return p, nil
+	}
+	q := sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+	})
+	for _, url := range queues {
+		if err := p.subscribeQueue(ctx, q, url); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// subscribeQueue подписывает очередь на topic; повторная подписка того же ARN возвращает существующую.
+func (p *snsPublisher) subscribeQueue(ctx context.Context, q *sqs.Client, url string) error {
+	attrs, err := q.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(url),
+		AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameQueueArn},
+	})
+	if err != nil {
+		return fmt.Errorf("sns: queue %s: %w", url, err)
+	}
+	_, err = p.sns.Subscribe(ctx, &sns.SubscribeInput{
+		TopicArn:              aws.String(p.topic),
+		Protocol:              aws.String("sqs"),
+		Endpoint:              aws.String(attrs.Attributes[string(sqstypes.QueueAttributeNameQueueArn)]),
+		Attributes:            map[string]string{"RawMessageDelivery": "true"},
+		ReturnSubscriptionArn: true,
+	})
+	if err != nil {
+		return fmt.Errorf("sns: subscribe %s: %w", url, err)
+	}
+	return nil
+}
+
+func (p *snsPublisher) Publish(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("sns: encode: %w", err)
+	}
+	in := &sns.PublishInput{
+		TopicArn: aws.String(p.topic),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"type":     {DataType: aws.String("String"), StringValue: aws.String(string(e.Type))},
+			"order_id": {DataType: aws.String("String"), StringValue: aws.String(e.OrderID)},
+			"position": {DataType: aws.String("Number"), StringValue: aws.String(strconv.FormatInt(e.Position, 10))},
+		},
+	}
+	if p.fifo {
+		in.MessageGroupId = aws.String(e.OrderID)
+		in.MessageDeduplicationId = aws.String(e.StreamID + "@" + strconv.FormatInt(e.Version, 10))
+	}
+	if _, err := p.sns.Publish(ctx, in); err != nil {
+		return fmt.Errorf("sns: publish: %w", err)
+	}
+	return nil
+}
+
+func (p *snsPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Quotas ---
+// Сверх темпа (ratelimit.go) у арендатора (tenancy.go) и у ключа API есть квоты: команд за сутки (UTC) —
+// QUOTA_TENANT_COMMANDS_PER_DAY и QUOTA_KEY_COMMANDS_PER_DAY, событий в журнале — QUOTA_TENANT_EVENTS;
+// 0 — без ограничения. Отдельным арендаторам квоты задаёт QUOTA_TENANTS (acme.commands=10000,acme.events=1000000),
+// отдельному ключу — поле commands_per_day при создании. Команда засчитывается по своему событию (не по
+// событиям платежа перед ним) арендатору, который её отдал (Metadata.QuotaTenant), и ключу-автору; команды
+// admin без арендатора, саг и планировщика в квоту арендатора не идут, отклонённые и повторы по Idempotency-Key
+// квоту не тратят. Счёт ведёт проекция "usage" по журналу, поэтому он переживает
+// перезапуск, а проверка мягкая: параллельные команды могут превысить квоту на несколько событий. Сверх квоты
+// команд — 429 с Retry-After до конца суток, сверх квоты событий — 403. Расход видно в GET /usage (свой)
+// и GET /admin/usage (все). События заказов, удалённых компакцией, остаются в счёте до перестройки проекции.
+// Квоты меняются без перезапуска (reload.go).
+
+var (
+	errCommandQuota = errors.New("daily command quota exceeded")
+	errEventQuota   = errors.New("stored event quota exceeded")
+)
+
+// tenantQuota — квоты одного арендатора; nil-поле — общая квота.
+type tenantQuota struct {
+	CommandsPerDay *int64
+	Events         *int64
+}
+
+type quotaOptions struct {
+	TenantCommandsPerDay int64
+	TenantEvents         int64
+	KeyCommandsPerDay    int64
+	Tenants              map[string]tenantQuota
+}
+
+// parseTenantQuotas разбирает QUOTA_TENANTS: tenant.commands=N,tenant.events=N.
+func parseTenantQuotas(v string) (map[string]tenantQuota, error) {
+	out := map[string]tenantQuota{}
+	for _, item := range splitList(v) {
+		name, value, ok := strings.Cut(item, "=")
+		tenant, kind, dotted := strings.Cut(name, ".")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !ok || !dotted || !tenantPattern.MatchString(tenant) || err != nil || n < 0 {
+			return nil, fmt.Errorf("QUOTA_TENANTS: expected tenant.commands=N or tenant.events=N, got %q", item)
+		}
+		q := out[tenant]
+		switch kind {
+		case "commands":
+			q.CommandsPerDay = &n
+		case "events":
+			q.Events = &n
+		default:
+			return nil, fmt.Errorf("QUOTA_TENANTS: unknown quota %q: expected commands or events", kind)
+		}
+		out[tenant] = q
+	}
+	return out, nil
+}
+
+// usageCounter — расход арендатора или ключа.
+type usageCounter struct {
+	day      string // сутки, за которые считается commands
+	commands int64
+	events   int64 // только у арендатора
+}
+
+type usageTracker struct {
+	mu      sync.Mutex
+	opts    quotaOptions
+	tenants map[string]*usageCounter
+	keys    map[string]*usageCounter // имя ключа API
+	last    int64                    // позиция последнего применённого события: повторная доставка не в счёт
+}
+
+var usage = &usageTracker{tenants: map[string]*usageCounter{}, keys: map[string]*usageCounter{}}
+
+func (u *usageTracker) update(opts quotaOptions) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.opts = opts
+}
+
+// counter — счётчик subject в m; nil при create = false, если его нет.
+func counter(m map[string]*usageCounter, subject string, create bool) *usageCounter {
+	c, ok := m[subject]
+	if !ok && create {
+		c = &usageCounter{}
+		m[subject] = c
+	}
+	return c
+}
+
+// countCommand добавляет команду дня day; старые сутки забываются.
+func (c *usageCounter) countCommand(day string) {
+	switch {
+	case day > c.day:
+		c.day, c.commands = day, 1
+	case day == c.day:
+		c.commands++
+	}
+}
+
+// commandsOn — команд за сутки day.
+func (c *usageCounter) commandsOn(day string) int64 {
+	if c == nil || c.day != day {
+		return 0
+	}
+	return c.commands
+}
+
+// quotaEvents — события, которые записывают команды клиентов (commandbus.go), по одному на команду.
+var quotaEvents = map[EventType]bool{
+	EventOrderCreated: true, EventOrderPaymentReceived: true, EventOrderCanceled: true, EventOrderRefunded: true,
+	EventOrderShipped: true, EventOrderDelivered: true, EventDiscountApplied: true,
+}
+
+// apiKeyName — имя ключа API автора команды; "" — автор не ключ.
+func apiKeyName(actor string) string {
+	name, ok := strings.CutPrefix(actor, "apikey:")
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+func (u *usageTracker) apply(e Event) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if e.Position > 0 && e.Position <= u.last {
+		return
+	}
+	u.last = max(u.last, e.Position)
+	day := e.Timestamp.UTC().Format(time.DateOnly)
+	if t := orderTenant(e.OrderID); t != "" {
+		counter(u.tenants, t, true).events++
+	}
+	if !quotaEvents[e.Type] {
+		return
+	}
+	if t := e.Metadata.QuotaTenant; t != "" {
+		counter(u.tenants, t, true).countCommand(day)
+	}
+	if name := apiKeyName(e.Metadata.Actor); name != "" {
+		counter(u.keys, name, true).countCommand(day)
+	}
+}
+
+func (u *usageTracker) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	clear(u.tenants)
+	clear(u.keys)
+	u.last = 0
+}
+
+// limits — квоты арендатора tenant: команд в сутки и событий; 0 — без ограничения.
+func (u *usageTracker) limits(tenant string) (commands, events int64) {
+	commands, events = u.opts.TenantCommandsPerDay, u.opts.TenantEvents
+	if q, ok := u.opts.Tenants[tenant]; ok {
+		if q.CommandsPerDay != nil {
+			commands = *q.CommandsPerDay
+		}
+		if q.Events != nil {
+			events = *q.Events
+		}
+	}
+	return commands, events
+}
+
+// keyQuota — собственная квота команд ключа name в сутки; 0 — общая. Вызывается до u.mu:
+// реестр ключей берёт свой мьютекс.
+func keyQuota(name string) int64 {
+	if apiKeys == nil || name == "" {
+		return 0
+	}
+	return apiKeys.commandsPerDay(name)
+}
+
+// keyLimit — квота команд ключа в сутки с собственной own. Вызывается под u.mu.
+func (u *usageTracker) keyLimit(own int64) int64 {
+	if own > 0 {
+		return own
+	}
+	return u.opts.KeyCommandsPerDay
+}
+
+// check — можно ли арендатору tenant и ключу key отдать ещё одну команду в момент now.
+func (u *usageTracker) check(tenant, key string, now time.Time) error {
+	day := now.UTC().Format(time.DateOnly)
+	own := keyQuota(key)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if tenant != "" {
+		commands, events := u.limits(tenant)
+		c := counter(u.tenants, tenant, false)
+		if events > 0 && c != nil && c.events >= events {
+			return fmt.Errorf("%w: tenant %s stores %d of %d events", errEventQuota, tenant, c.events, events)
+		}
+		if commands > 0 && c.commandsOn(day) >= commands {
+			return fmt.Errorf("%w: tenant %s used %d of %d commands today", errCommandQuota, tenant, c.commandsOn(day), commands)
+		}
+	}
+	if keyLimit := u.keyLimit(own); key != "" && keyLimit > 0 {
+		if used := counter(u.keys, key, false).commandsOn(day); used >= keyLimit {
+			return fmt.Errorf("%w: api key %s used %d of %d commands today", errCommandQuota, key, used, keyLimit)
+		}
+	}
+	return nil
+}
+
+// enforce — звено шины после дедупликации: повтор команды по Idempotency-Key квоту не проверяет.
+func (u *usageTracker) enforce(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		md := c.Target().Metadata
+		if err := u.check(md.Tenant, apiKeyName(md.Actor), time.Now()); err != nil {
+			return Event{}, false, err
+		}
+		return next(ctx, c)
+	}
+}
+
+// quotaReset — начало следующих суток UTC: тогда обнуляется квота команд.
+func quotaReset(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// usageView — расход и квоты арендатора или ключа.
+type usageView struct {
+	Subject        string    `json:"subject"`
+	Commands       int64     `json:"commands_today"`
+	CommandsPerDay int64     `json:"commands_per_day"` // 0 — без ограничения
+	Events         *int64    `json:"events,omitempty"` // у арендатора
+	EventsLimit    *int64    `json:"events_limit,omitempty"`
+	ResetsAt       time.Time `json:"resets_at"`
+}
+
+// usageReport — ответ GET /usage и GET /admin/usage.
+type usageReport struct {
+	Tenants []usageView `json:"tenants"`
+	APIKeys []usageView `json:"api_keys"`
+}
+
+func (u *usageTracker) tenantView(tenant string, now time.Time) usageView {
+	c := counter(u.tenants, tenant, false)
+	commands, limit := u.limits(tenant)
+	var events int64
+	if c != nil {
+		events = c.events
+	}
+	return usageView{Subject: tenant, Commands: c.commandsOn(now.UTC().Format(time.DateOnly)), CommandsPerDay: commands,
+		Events: &events, EventsLimit: &limit, ResetsAt: quotaReset(now)}
+}
+
+func (u *usageTracker) keyView(name string, limit int64, now time.Time) usageView {
+	return usageView{Subject: name, Commands: counter(u.keys, name, false).commandsOn(now.UTC().Format(time.DateOnly)),
+		CommandsPerDay: limit, ResetsAt: quotaReset(now)}
+}
+
+// report — расход арендаторов tenants и ключей keys; nil — всех известных.
+func (u *usageTracker) report(tenants, keys []string, now time.Time) usageReport {
+	own := map[string]int64{}
+	if keys == nil && apiKeys != nil {
+		for _, k := range apiKeys.list() {
+			keys = append(keys, k.Name)
+		}
+	}
+	for _, name := range keys {
+		own[name] = keyQuota(name)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if tenants == nil {
+		tenants = []string{}
+		for t := range u.tenants {
+			tenants = append(tenants, t)
+		}
+		for t := range u.opts.Tenants {
+			if _, ok := u.tenants[t]; !ok {
+				tenants = append(tenants, t)
+			}
+		}
+	}
+	rep := usageReport{Tenants: []usageView{}, APIKeys: []usageView{}}
+	for _, t := range tenants {
+		rep.Tenants = append(rep.Tenants, u.tenantView(t, now))
+	}
+	for _, name := range keys {
+		rep.APIKeys = append(rep.APIKeys, u.keyView(name, u.keyLimit(own[name]), now))
+	}
+	sort.Slice(rep.Tenants, func(i, j int) bool { return rep.Tenants[i].Subject < rep.Tenants[j].Subject })
+	sort.Slice(rep.APIKeys, func(i, j int) bool { return rep.APIKeys[i].Subject < rep.APIKeys[j].Subject })
+	return rep
+}
+
+// --- Quota Handlers ---
+
+// getUsage отдаёт расход арендатора запроса и его ключа API.
+func getUsage(w http.ResponseWriter, r *http.Request) {
+	tenants, keys := []string{}, []string{}
+	if t := tenantFrom(r.Context()); t != "" {
+		tenants = append(tenants, t)
+	}
+	if k := apiKeyFrom(r.Context()); k != nil {
+		keys = append(keys, k.Name)
+	}
+	writeBody(w, r, http.StatusOK, usage.report(tenants, keys, time.Now()))
+}
+
+// listUsage отдаёт расход всех арендаторов и ключей.
+func listUsage(w http.ResponseWriter, r *http.Request) {
+	writeBody(w, r, http.StatusOK, usage.report(nil, nil, time.Now()))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// --- Rate limiting ---
+// Журнал пишется одним писателем, поэтому один клиент не должен занимать его целиком. У каждого клиента
+// два ведра токенов: для команд (всё, кроме GET, HEAD и OPTIONS) и для запросов на чтение, со своими
+// темпом и запасом (RATE_LIMIT_COMMANDS, RATE_LIMIT_QUERIES — в секунду, 0 — без ограничения).
+// Клиент — значение заголовка RATE_LIMIT_KEY_HEADER (X-API-Key), без него — IP-адрес, с
+// ACCESS_LOG_TRUST_PROXY — из X-Forwarded-For. Ключ здесь не проверяется. Сверх лимита — 429
+// с Retry-After; служебные маршруты (/healthz, /readyz, /metrics) не ограничиваются. Вёдра клиентов,
+// которые не обращались дольше rateLimitIdle, забываются. Лимиты меняются без перезапуска (reload.go):
+// вёдра всех клиентов при этом создаются заново, полными.
+//
+// С мультиарендностью (tenancy.go) у каждого арендатора есть и общие на всех его клиентов вёдра:
+// RATE_LIMIT_TENANT_COMMANDS и RATE_LIMIT_TENANT_QUERIES (0 — без ограничения, по умолчанию). Они
+// проверяются после аутентификации, когда арендатор уже известен; классы в метрике — tenant_command
+// и tenant_query. Так же у каждого аутентифицированного автора — ключа API (apikey:<name>), сертификата
+// клиента, пользователя JWT или сессии — свои вёдра RATE_LIMIT_ACTOR_COMMANDS и RATE_LIMIT_ACTOR_QUERIES
+// (0 — без ограничения, по умолчанию), классы actor_command и actor_query: в отличие от вёдер по
+// RATE_LIMIT_KEY_HEADER, ключ в них уже проверен. Суточные квоты — в quotas.go.
+
+// rateLimitIdle — сколько помнить ведро молчащего клиента; за это время оно заведомо наполняется.
+const rateLimitIdle = 10 * time.Minute
+
+type rateLimitOptions struct {
+	CommandRate  float64 // запросов в секунду; 0 — без ограничения
+	CommandBurst int
+	QueryRate    float64
+	QueryBurst   int
+	KeyHeader    string
+}
+
+type clientBuckets struct {
+	command, query *rate.Limiter
+	seen           time.Time
+}
+
+type rateLimiter struct {
+	client func(*rateLimiter, *http.Request) string // ключ вёдер запроса; "" — не ограничивается
+	class  string                                   // приставка класса в метрике
+
+	mu      sync.Mutex
+	opts    rateLimitOptions
+	clients map[string]*clientBuckets
+}
+
+var limiter, tenantLimiter, actorLimiter *rateLimiter
+
+var promRateLimited = newPromVec("counter", "orders_http_rate_limited_total",
+	"HTTP requests rejected by the per-client rate limit, by route class.", "class")
+
+func newRateLimiter(opts rateLimitOptions, clientIP func(*http.Request) string) *rateLimiter {
+	client := func(l *rateLimiter, r *http.Request) string {
+		if v := r.Header.Get(l.keyHeader()); v != "" {
+			return "key:" + v
+		}
+		return "ip:" + clientIP(r)
+	}
+	return &rateLimiter{opts: opts, client: client, clients: map[string]*clientBuckets{}}
+}
+
+// newActorLimiter — лимиты аутентифицированных авторов; звено mux после аутентификации.
+func newActorLimiter(opts rateLimitOptions) *rateLimiter {
+	client := func(_ *rateLimiter, r *http.Request) string {
+		ctx := r.Context()
+		if apiKeyFrom(ctx) == nil && clientCertFrom(ctx) == "" && jwtClaimsFrom(ctx) == nil {
+			return "" // X-User-ID без учётных данных ничего не доказывает
+		}
+		return r.Header.Get("X-User-ID")
+	}
+	return &rateLimiter{opts: opts, client: client, class: "actor_", clients: map[string]*clientBuckets{}}
+}
+
+// newTenantLimiter — лимиты арендаторов; звено mux после tenancy.middleware.
+func newTenantLimiter(opts rateLimitOptions) *rateLimiter {
+	client := func(_ *rateLimiter, r *http.Request) string { return tenantFrom(r.Context()) }
+	return &rateLimiter{opts: opts, client: client, class: "tenant_", clients: map[string]*clientBuckets{}}
+}
+
+// update меняет лимиты; вёдра, созданные по прежним, забываются.
+func (l *rateLimiter) update(opts rateLimitOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.opts = opts
+	clear(l.clients)
+}
+
+func (l *rateLimiter) keyHeader() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.opts.KeyHeader
+}
+
+// bucket — ведро клиента key для класса маршрутов; nil — класс не ограничен.
+func (l *rateLimiter) bucket(key string, command bool, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if command && l.opts.CommandRate <= 0 || !command && l.opts.QueryRate <= 0 {
+		return nil
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientBuckets{}
+		if l.opts.CommandRate > 0 {
+			c.command = rate.NewLimiter(rate.Limit(l.opts.CommandRate), max(l.opts.CommandBurst, 1))
+		}
+		if l.opts.QueryRate > 0 {
+			c.query = rate.NewLimiter(rate.Limit(l.opts.QueryRate), max(l.opts.QueryBurst, 1))
+		}
+		l.clients[key] = c
+	}
+	c.seen = now
+	if command {
+		return c.command
+	}
+	return c.query
+}
+
+// sweep раз в every забывает клиентов, молчащих дольше rateLimitIdle.
+func (l *rateLimiter) sweep(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.mu.Lock()
+			for key, c := range l.clients {
+				if now.Sub(c.seen) > rateLimitIdle {
+					delete(l.clients, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cr := mux.CurrentRoute(r); cr != nil {
+			route, err := cr.GetPathTemplate()
+			if err != nil || probeRoutes[route] {
+				// без шаблона — прослойка registerLegacyAPI: лимит проверит переписанный запрос
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		key := l.client(l, r)
+		command, class := true, "command"
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			command, class = false, "query"
+		}
+		now := time.Now()
+		var b *rate.Limiter
+		if key != "" {
+			b = l.bucket(key, command, now)
+		}
+		if b == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if res := b.ReserveN(now, 1); res.OK() {
+			delay := res.DelayFrom(now)
+			if delay == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			res.CancelAt(now) // запрос отклонён: токен не тратится
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		}
+		promRateLimited.inc(l.class + class)
+		httpError(w, "rate limit exceeded for "+strings.ReplaceAll(l.class, "_", " ")+class+" requests", http.StatusTooManyRequests)
+	})
+}
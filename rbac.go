@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- Role-based access control ---
+// Каждый маршрут требует одну область: queries — чтение, commands — команды, admin — всё под /admin.
+// Роли — наборы областей: reader читает заказы и события, operator ещё и отдаёт команды, admin может
+// всё. Роли владельца JWT берутся из claim JWT_ROLES_CLAIM (roles: массив или строка через пробел или
+// запятую); токен без известной роли получает RBAC_DEFAULT_ROLE (operator — как до появления ролей).
+// Роли из PII_ROLES ещё и видят персональные поля открытым текстом (область pii, pii.go).
+// У ключа API (apikeys.go) вместо ролей сами области, у клиента с сертификатом (mtls.go) — роль MTLS_ROLE. RBAC_ROUTES переопределяет область отдельных
+// маршрутов по имени: refundOrder=admin,cancelOrder=admin; имена вызовов gRPC те же (RefundOrder ->
+// refundOrder). Сессия браузера (oidc.go) — как токен с ролями по группам. Без JWT, входа OIDC, mTLS и обязательных ключей аутентификации нет, и ограничений тоже; с ними запрос
+// без учётных данных может только то, что JWT оставляет открытым (чтение без JWT_PROTECT_QUERIES).
+
+var roleScopes = map[string][]string{
+	"reader":   {scopeQueries},
+	"operator": {scopeQueries, scopeCommands},
+	"admin":    {scopeQueries, scopeCommands, scopeAdmin},
+}
+
+// queryRoutes — маршруты чтения, которые принимают POST.
+var queryRoutes = map[string]string{"graphql": scopeQueries}
+
+var errForbidden = errors.New("access denied")
+
+type rbacPolicy struct {
+	RolesClaim  string
+	DefaultRole string
+	Routes      map[string]string // имя маршрута -> область
+}
+
+var rbac rbacPolicy
+
+// parseRBACRoutes разбирает RBAC_ROUTES: route=scope,... поверх queryRoutes.
+func parseRBACRoutes(v string) (map[string]string, error) {
+	routes := maps.Clone(queryRoutes)
+	for _, item := range splitList(v) {
+		name, scope, ok := strings.Cut(item, "=")
+		if !ok || name == "" || !slices.Contains(apiKeyScopes, scope) {
+			return nil, fmt.Errorf("RBAC_ROUTES: expected route=%s, got %q", strings.Join(apiKeyScopes, "|"), item)
+		}
+		routes[name] = scope
+	}
+	return routes, nil
+}
+
+// scope — область маршрута name (шаблон route) для метода.
+func (p rbacPolicy) scope(name, route, method string) string {
+	if s, ok := p.Routes[name]; ok {
+		return s
+	}
+	switch {
+	case strings.HasPrefix(route, apiVersionPrefix+"/admin/"):
+		return scopeAdmin
+	case method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions:
+		return scopeQueries
+	}
+	return scopeCommands
+}
+
+// roles — роли из claims токена.
+func (p rbacPolicy) roles(c jwtClaims) []string {
+	var raw []string
+	switch v := c[p.RolesClaim].(type) {
+	case string:
+		raw = strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []any:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				raw = append(raw, s)
+			}
+		}
+	}
+	var roles []string
+	for _, r := range raw {
+		if _, ok := roleScopes[r]; ok {
+			roles = append(roles, r)
+		}
+	}
+	if len(roles) == 0 {
+		roles = []string{p.DefaultRole}
+	}
+	return roles
+}
+
+// granted — области запроса с контекстом ctx; anonymous — учётных данных нет.
+func (p rbacPolicy) granted(ctx context.Context, query bool) (scopes []string, anonymous bool) {
+	if clientCertFrom(ctx) != "" {
+		return roleScopes[clientCerts.opts.Role], false
+	}
+	if k := apiKeyFrom(ctx); k != nil {
+		return k.Scopes, false
+	}
+	if c := jwtClaimsFrom(ctx); c != nil {
+		for _, r := range p.roles(c) {
+			scopes = append(scopes, roleScopes[r]...)
+		}
+		return scopes, false
+	}
+	switch {
+	case auth == nil && sessions == nil && clientCerts == nil && (apiKeys == nil || !apiKeys.opts.Required):
+		return apiKeyScopes, true // аутентификация не настроена
+	case auth != nil && !auth.opts.ProtectQueries && query:
+		return []string{scopeQueries}, true
+	}
+	return nil, true
+}
+
+// middleware — звено mux после ключей API и JWT.
+func (p rbacPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr := mux.CurrentRoute(r)
+		if cr == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, err := cr.GetPathTemplate()
+		if err != nil || probeRoutes[route] || publicRoutes[route] {
+			next.ServeHTTP(w, r) // прослойка registerLegacyAPI: права проверит переписанный запрос
+			return
+		}
+		need := p.scope(cr.GetName(), route, r.Method)
+		scopes, anonymous := p.granted(r.Context(), need == scopeQueries)
+		switch {
+		case slices.Contains(scopes, need):
+			next.ServeHTTP(w, r)
+		case anonymous && sessions.redirectToLogin(w, r):
+		case anonymous:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+jwtRealm+`"`)
+			writeError(w, fmt.Errorf("%w: route requires %q, send a bearer token or X-API-Key", errInvalidToken, need), http.StatusUnauthorized)
+		default:
+			writeError(w, fmt.Errorf("%w: route requires %q", errForbidden, need), http.StatusForbidden)
+		}
+	})
+}
+
+// grpcRouteName — имя маршрута HTTP для вызова gRPC: /orders.v1.Orders/RefundOrder -> refundOrder.
+func grpcRouteName(method string) string {
+	name := method[strings.LastIndex(method, "/")+1:]
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[size:]
+}
+
+// authorizeGRPC проверяет права на вызов method после grpcAuthenticate.
+func (p rbacPolicy) authorizeGRPC(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, "/grpc.reflection.") {
+		return nil
+	}
+	need := scopeCommands
+	if grpcQueryMethods[method] {
+		need = scopeQueries
+	}
+	if s, ok := p.Routes[grpcRouteName(method)]; ok {
+		need = s
+	}
+	scopes, anonymous := p.granted(ctx, need == scopeQueries)
+	switch {
+	case slices.Contains(scopes, need):
+		return nil
+	case anonymous:
+		return status.Errorf(codes.Unauthenticated, "method requires %q, send a bearer token or x-api-key", need)
+	}
+	return status.Errorf(codes.PermissionDenied, "%v: method requires %q", errForbidden, need)
+}
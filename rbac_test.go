@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withAuth подменяет глобальные настройки аутентификации на время теста.
+func withAuth(t *testing.T, a *jwtAuth, keys *apiKeyRegistry, certs *clientCertAuth) {
+	t.Helper()
+	prevAuth, prevKeys, prevCerts, prevSessions, prevRBAC := auth, apiKeys, clientCerts, sessions, rbac
+	t.Cleanup(func() {
+		auth, apiKeys, clientCerts, sessions, rbac = prevAuth, prevKeys, prevCerts, prevSessions, prevRBAC
+	})
+	auth, apiKeys, clientCerts, sessions = a, keys, certs, nil
+	rbac = rbacPolicy{RolesClaim: "roles", DefaultRole: "operator", Routes: queryRoutes}
+}
+
+func certContext(name string) context.Context {
+	return context.WithValue(context.Background(), clientCertKey{}, name)
+}
+
+func TestRBACClientCertificates(t *testing.T) {
+	withAuth(t, nil, nil, &clientCertAuth{opts: mtlsOptions{Role: "operator"}})
+	cases := []struct {
+		name          string
+		ctx           context.Context
+		want          []string
+		wantAnonymous bool
+	}{
+		{"without certificate", context.Background(), nil, true},
+		{"with certificate", certContext("billing"), roleScopes["operator"], false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, query := range []bool{false, true} {
+				scopes, anonymous := rbac.granted(c.ctx, query)
+				if !slices.Equal(scopes, c.want) || anonymous != c.wantAnonymous {
+					t.Errorf("granted(query=%v) = %v, anonymous %v; want %v, anonymous %v", query, scopes, anonymous, c.want, c.wantAnonymous)
+				}
+			}
+		})
+	}
+}
+
+func jwtContext(roles ...any) context.Context {
+	c := jwtClaims{"sub": "u1"}
+	if len(roles) > 0 {
+		c["roles"] = roles
+	}
+	return context.WithValue(context.Background(), jwtClaimsKey{}, c)
+}
+
+func keyContext(scopes ...string) context.Context {
+	return context.WithValue(context.Background(), apiKeyCtxKey{}, &apiKey{Name: "k1", Scopes: scopes})
+}
+
+// rbacRoutes — маршруты матрицы и соответствующие им вызовы gRPC ("" — вызова нет).
+var rbacRoutes = []struct {
+	name, method, path, template, grpc string
+}{
+	{"getOrder", http.MethodGet, "/orders/o1", "/orders/{id}", "/orders.v1.Orders/GetOrder"},
+	{"graphql", http.MethodPost, "/graphql", "/graphql", ""},
+	{"createOrder", http.MethodPost, "/orders", "/orders", "/orders.v1.Orders/CreateOrder"},
+	{"refundOrder", http.MethodPost, "/orders/o1/refund", "/orders/{id}/refund", "/orders.v1.Orders/RefundOrder"},
+	{"createBackup", http.MethodPost, "/admin/backup", "/admin/backup", ""},
+}
+
+func TestRBACMatrix(t *testing.T) {
+	const ok, unauth, denied = http.StatusOK, http.StatusUnauthorized, http.StatusForbidden
+	cases := []struct {
+		name           string
+		protectQueries bool
+		ctx            context.Context
+		want           [5]int // по rbacRoutes
+	}{
+		{"anonymous", false, context.Background(), [5]int{ok, ok, unauth, unauth, unauth}},
+		{"anonymous, protected queries", true, context.Background(), [5]int{unauth, unauth, unauth, unauth, unauth}},
+		{"jwt reader", true, jwtContext("reader"), [5]int{ok, ok, denied, denied, denied}},
+		{"jwt without roles", true, jwtContext(), [5]int{ok, ok, ok, denied, denied}},
+		{"jwt unknown role", true, jwtContext("guest"), [5]int{ok, ok, ok, denied, denied}},
+		{"jwt admin", true, jwtContext("admin"), [5]int{ok, ok, ok, ok, ok}},
+		{"jwt roles as string", true, context.WithValue(context.Background(), jwtClaimsKey{}, jwtClaims{"roles": "reader, admin"}), [5]int{ok, ok, ok, ok, ok}},
+		{"key with queries", true, keyContext(scopeQueries), [5]int{ok, ok, denied, denied, denied}},
+		{"key with commands", true, keyContext(scopeCommands), [5]int{denied, denied, ok, denied, denied}},
+		{"key with all scopes", true, keyContext(apiKeyScopes...), [5]int{ok, ok, ok, ok, ok}},
+		{"client certificate", true, certContext("billing"), [5]int{ok, ok, denied, denied, denied}},
+	}
+	grpcCodes := map[int]codes.Code{ok: codes.OK, unauth: codes.Unauthenticated, denied: codes.PermissionDenied}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			withAuth(t, &jwtAuth{opts: jwtOptions{ProtectQueries: c.protectQueries}}, &apiKeyRegistry{}, &clientCertAuth{opts: mtlsOptions{Role: "reader"}})
+			routes, err := parseRBACRoutes("refundOrder=admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rbac.Routes = routes
+			r := mux.NewRouter()
+			r.Use(rbac.middleware)
+			for _, rt := range rbacRoutes {
+				r.HandleFunc(apiVersionPrefix+rt.template, func(w http.ResponseWriter, r *http.Request) {}).Methods(rt.method).Name(rt.name)
+			}
+			for i, rt := range rbacRoutes {
+				req := httptest.NewRequest(rt.method, apiVersionPrefix+rt.path, nil).WithContext(c.ctx)
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				if rec.Code != c.want[i] {
+					t.Errorf("%s %s: status %d, want %d", rt.method, rt.path, rec.Code, c.want[i])
+				}
+				if rt.grpc == "" {
+					continue
+				}
+				if got := status.Code(rbac.authorizeGRPC(c.ctx, rt.grpc)); got != grpcCodes[c.want[i]] {
+					t.Errorf("%s: code %v, want %v", rt.grpc, got, grpcCodes[c.want[i]])
+				}
+			}
+		})
+	}
+}
+
+func TestRBACScope(t *testing.T) {
+	p := rbacPolicy{Routes: map[string]string{"graphql": scopeQueries, "cancelOrder": scopeAdmin}}
+	cases := []struct {
+		name, route, method, want string
+	}{
+		{"getOrder", apiVersionPrefix + "/orders/{id}", http.MethodGet, scopeQueries},
+		{"listOrders", apiVersionPrefix + "/orders", http.MethodHead, scopeQueries},
+		{"createOrder", apiVersionPrefix + "/orders", http.MethodPost, scopeCommands},
+		{"deleteWebhook", apiVersionPrefix + "/webhooks/{id}", http.MethodDelete, scopeCommands},
+		{"graphql", apiVersionPrefix + "/graphql", http.MethodPost, scopeQueries},
+		{"cancelOrder", apiVersionPrefix + "/orders/{id}/cancel", http.MethodPost, scopeAdmin},
+		{"getAdminStatus", apiVersionPrefix + "/admin/status", http.MethodGet, scopeAdmin},
+	}
+	for _, c := range cases {
+		if got := p.scope(c.name, c.route, c.method); got != c.want {
+			t.Errorf("scope(%s %s) = %q, want %q", c.method, c.route, got, c.want)
+		}
+	}
+}
+
+func TestRBACReflectionIsOpen(t *testing.T) {
+	withAuth(t, &jwtAuth{opts: jwtOptions{ProtectQueries: true}}, nil, nil)
+	if err := rbac.authorizeGRPC(context.Background(), "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"); err != nil {
+		t.Errorf("reflection: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// --- PostgreSQL read model ---
+// С READ_MODEL=postgres заказы read model лежат в таблице order_views базы READ_MODEL_URL (по умолчанию —
+// DATABASE_URL), и GET /orders, /orders/{id}, /customers/{id}/orders читают из неё. Таблицу обновляет
+// Durable-проекция "orders-postgres": после перезапуска она догоняет журнал со своего checkpoint, а не
+// с начала. Строка заказа обновляется, только если событие новее её версии, так что повторная доставка
+// и проигрывание после checkpoint безопасны. Ошибка записи пишется в лог; расхождение с журналом
+// исправляет POST /admin/projections/orders-postgres/rebuild.
+const postgresReadModelSchema = `
+CREATE TABLE IF NOT EXISTS order_views (
+	id          TEXT PRIMARY KEY,
+	status      TEXT        NOT NULL,
+	version     BIGINT      NOT NULL,
+	customer_id TEXT        NOT NULL DEFAULT '',
+	created_at  TIMESTAMPTZ NOT NULL,
+	body        JSONB       NOT NULL
+);
+CREATE INDEX IF NOT EXISTS order_views_status_idx ON order_views (status, id);
+CREATE INDEX IF NOT EXISTS order_views_customer_idx ON order_views (customer_id, created_at, id);
+`
+
+// postgresApplyTimeout — предел на применение одного события к таблице.
+const postgresApplyTimeout = 5 * time.Second
+
+type postgresOrders struct {
+	pool *pgxpool.Pool
+}
+
+// pgOrders — read model в Postgres, если READ_MODEL=postgres; удаление персональных данных и компакция
+// чистят и его.
+var pgOrders *postgresOrders
+
+func newPostgresOrders(ctx context.Context, dsn string) (*postgresOrders, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("read model: connect: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("read model: ping: %w", err)
+	}
+	if _, err := pool.Exec(ctx, postgresReadModelSchema); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("read model: bootstrap schema: %w", err)
+	}
+	return &postgresOrders{pool: pool}, nil
+}
+
+// apply применяет событие заказа к его строке; события других потоков до OrderCreated не доходят.
+func (p *postgresOrders) apply(e Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresApplyTimeout)
+	defer cancel()
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		var o Order
+		var body []byte
+		err := tx.QueryRow(ctx, `SELECT body FROM order_views WHERE id = $1 FOR UPDATE`, e.OrderID).Scan(&body)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			if e.Type != EventOrderCreated {
+				return nil
+			}
+		case err != nil:
+			return err
+		default:
+			if err := json.Unmarshal(body, &o); err != nil {
+				return err
+			}
+			if e.Version <= o.Version {
+				return nil // уже применено
+			}
+		}
+		o.apply(e)
+		if body, err = json.Marshal(o); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO order_views (id, status, version, customer_id, created_at, body)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (id) DO UPDATE SET status = EXCLUDED.status, version = EXCLUDED.version,
+				customer_id = EXCLUDED.customer_id, body = EXCLUDED.body`,
+			o.ID, string(o.Status), o.Version, o.CustomerID, o.CreatedAt, body)
+		return err
+	})
+	if err != nil {
+		slog.Error("read model: apply failed", "order_id", e.OrderID, "event_type", e.Type, "version", e.Version, "error", err)
+	}
+}
+
+func (p *postgresOrders) reset() {
+	if _, err := p.pool.Exec(context.Background(), `TRUNCATE order_views`); err != nil {
+		slog.Error("read model: reset failed", "error", err)
+	}
+}
+
+// forget удаляет строки заказов, удалённых при компакции журнала.
+func (p *postgresOrders) forget(ids []string) {
+	if _, err := p.pool.Exec(context.Background(), `DELETE FROM order_views WHERE id = ANY($1)`, ids); err != nil {
+		slog.Error("read model: forget failed", "orders", len(ids), "error", err)
+	}
+}
+
+// erase убирает персональные данные покупателя из его заказов после удаления ключа.
+func (p *postgresOrders) erase(customerID string) {
+	_, err := p.pool.Exec(context.Background(),
+		`UPDATE order_views SET body = (body - 'customer') || '{"customer_erased": true}' WHERE customer_id = $1`, customerID)
+	if err != nil {
+		slog.Error("read model: erase customer failed", "customer_id", customerID, "error", err)
+	}
+}
+
+func (p *postgresOrders) GetOrder(ctx context.Context, id string) (Order, bool, error) {
+	var body []byte
+	err := p.pool.QueryRow(ctx, `SELECT body FROM order_views WHERE id = $1`, id).Scan(&body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Order{}, false, nil
+	}
+	if err != nil {
+		return Order{}, false, err
+	}
+	var o Order
+	return o, true, json.Unmarshal(body, &o)
+}
+
+func (p *postgresOrders) ListOrders(ctx context.Context, status OrderStatus, tenant, after string, limit int) ([]Order, int, error) {
+	prefix := tenantOrderID(tenant, "") // id заказов арендатора начинаются с tenant:
+	var total int
+	err := p.pool.QueryRow(ctx, `SELECT count(*) FROM order_views WHERE ($1 = '' OR status = $1) AND left(id, length($2)) = $2`,
+		string(status), prefix).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, err := p.query(ctx,
+		`SELECT body FROM order_views WHERE ($1 = '' OR status = $1) AND left(id, length($2)) = $2 AND id > $3 ORDER BY id LIMIT $4`,
+		string(status), prefix, after, limit)
+	return list, total, err
+}
+
+func (p *postgresOrders) CustomerOrders(ctx context.Context, customerID string) ([]Order, error) {
+	return p.query(ctx, `SELECT body FROM order_views WHERE customer_id = $1 ORDER BY created_at, id`, customerID)
+}
+
+func (p *postgresOrders) query(ctx context.Context, sql string, args ...any) ([]Order, error) {
+	rows, err := p.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	list := []Order{}
+	for rows.Next() {
+		var body []byte
+		if err := rows.Scan(&body); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var o Order
+		if err := json.Unmarshal(body, &o); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, o)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Redis read model ---
+// С READ_MODEL=redis заказы read model лежат в Redis (READ_MODEL_REDIS_ADDR), общем для всех инстансов API:
+// <prefix>order:<id> — JSON заказа с TTL (READ_MODEL_TTL), sorted set'ы <prefix>orders и <prefix>status:<статус>
+// (id в лексикографическом порядке) — для страниц GET /orders, <prefix>customer:<id> (по времени создания) —
+// для заказов покупателя. Durable-проекция "orders-redis" применяет событие к закэшированному заказу
+// (или к заказу, восстановленному из журнала, если ключ истёк) и записывает его скриптом, который не
+// откатывает ключ к старой версии: инстансы, получившие одно событие, пишут одно и то же. Истёкший ключ
+// восстанавливается из журнала при чтении; индексы заказа при этом не истекают.
+
+type redisOrders struct {
+	rdb    *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// redisViews — read model в Redis, если READ_MODEL=redis; удаление персональных данных и компакция чистят и его.
+var redisViews *redisOrders
+
+type redisReadModelOptions struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	TTL      time.Duration
+}
+
+func newRedisOrders(ctx context.Context, opts redisReadModelOptions) (*redisOrders, error) {
+	rdb := redis.NewClient(&redis.Options{Addr: opts.Addr, Password: opts.Password, DB: opts.DB})
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("read model: redis ping %s: %w", opts.Addr, err)
+	}
+	return &redisOrders{rdb: rdb, prefix: opts.Prefix, ttl: opts.TTL}, nil
+}
+
+func (m *redisOrders) orderKey(id string) string { return m.prefix + "order:" + id }
+
+// redisPutOrderScript записывает заказ, если он новее закэшированного, и переносит id между индексами статусов.
+// KEYS: ключ заказа, индекс всех заказов, индекс нового статуса, индекс покупателя (или ""). ARGV: JSON,
+// версия, TTL в мс, id, префикс, статус, время создания (мс). Возвращает 1, если заказ записан.
+var redisPutOrderScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur then
+	local old = cjson.decode(cur)
+	if tonumber(old.version) >= tonumber(ARGV[2]) then
+		redis.call('PEXPIRE', KEYS[1], ARGV[3])
+		return 0
+	end
+	if old.status ~= ARGV[6] then
+		redis.call('ZREM', ARGV[5] .. 'status:' .. old.status, ARGV[4])
+	end
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+redis.call('ZADD', KEYS[2], 0, ARGV[4])
+redis.call('ZADD', KEYS[3], 0, ARGV[4])
+if KEYS[4] ~= '' then
+	redis.call('ZADD', KEYS[4], ARGV[7], ARGV[4])
+end
+return 1
+`)
+
+func (m *redisOrders) put(ctx context.Context, o Order) error {
+	body, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	customerKey := ""
+	if o.CustomerID != "" {
+		customerKey = m.prefix + "customer:" + o.CustomerID
+	}
+	keys := []string{m.orderKey(o.ID), m.prefix + "orders", m.prefix + "status:" + string(o.Status), customerKey}
+	return redisPutOrderScript.Run(ctx, m.rdb, keys,
+		body, o.Version, m.ttl.Milliseconds(), o.ID, m.prefix, string(o.Status), o.CreatedAt.UnixMilli()).Err()
+}
+
+// cached возвращает заказ из кэша; false — ключа нет или он истёк.
+func (m *redisOrders) cached(ctx context.Context, id string) (Order, bool, error) {
+	body, err := m.rdb.Get(ctx, m.orderKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Order{}, false, nil
+	}
+	if err != nil {
+		return Order{}, false, err
+	}
+	var o Order
+	return o, true, json.Unmarshal(body, &o)
+}
+
+// known сообщает, есть ли заказ в индексе: ключ заказа мог истечь, индекс — нет.
+func (m *redisOrders) known(ctx context.Context, id string) (bool, error) {
+	err := m.rdb.ZScore(ctx, m.prefix+"orders", id).Err()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// apply применяет событие заказа к закэшированному заказу; если ключ истёк или события пропущены, заказ
+// восстанавливается из журнала, где событие уже есть. События других потоков до OrderCreated не доходят.
+func (m *redisOrders) apply(e Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresApplyTimeout)
+	defer cancel()
+	err := func() error {
+		o, ok, err := m.cached(ctx, e.OrderID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ok && e.Version <= o.Version:
+			return nil // уже применено
+		case ok && e.Version == o.Version+1, !ok && e.Type == EventOrderCreated:
+			o.apply(e)
+		default:
+			if !ok {
+				if known, err := m.known(ctx, e.OrderID); err != nil || !known {
+					return err
+				}
+			}
+			if o, err = loadOrder(ctx, e.OrderID); err != nil || o.ID == "" {
+				return err
+			}
+		}
+		return m.put(ctx, o)
+	}()
+	if err != nil {
+		slog.Error("read model: redis apply failed", "order_id", e.OrderID, "event_type", e.Type, "version", e.Version, "error", err)
+	}
+}
+
+// reset удаляет все ключи read model с префиксом.
+func (m *redisOrders) reset() {
+	ctx := context.Background()
+	iter := m.rdb.Scan(ctx, 0, m.prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		m.rdb.Del(ctx, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("read model: redis reset failed", "error", err)
+	}
+}
+
+// forget удаляет заказы, удалённые при компакции журнала.
+func (m *redisOrders) forget(ids []string) {
+	ctx := context.Background()
+	for _, id := range ids {
+		o, ok, err := m.cached(ctx, id)
+		pipe := m.rdb.TxPipeline()
+		pipe.Del(ctx, m.orderKey(id))
+		pipe.ZRem(ctx, m.prefix+"orders", id)
+		if ok {
+			pipe.ZRem(ctx, m.prefix+"status:"+string(o.Status), id)
+			pipe.ZRem(ctx, m.prefix+"customer:"+o.CustomerID, id)
+		}
+		if _, perr := pipe.Exec(ctx); perr != nil || err != nil {
+			slog.Error("read model: redis forget failed", "order_id", id, "error", errors.Join(err, perr))
+		}
+	}
+}
+
+// erase перезаписывает заказы покупателя без персональных данных после удаления его ключа.
+func (m *redisOrders) erase(customerID string) {
+	ctx := context.Background()
+	ids, err := m.rdb.ZRange(ctx, m.prefix+"customer:"+customerID, 0, -1).Result()
+	if err != nil {
+		slog.Error("read model: redis erase customer failed", "customer_id", customerID, "error", err)
+		return
+	}
+	for _, id := range ids {
+		o, ok, err := m.cached(ctx, id)
+		if err != nil || !ok {
+			continue // истёкший ключ восстановится из журнала, где данных уже не прочесть
+		}
+		o.Customer, o.CustomerErased = nil, true
+		body, _ := json.Marshal(o)
+		if err := m.rdb.Set(ctx, m.orderKey(id), body, redis.KeepTTL).Err(); err != nil {
+			slog.Error("read model: redis erase customer failed", "customer_id", customerID, "error", err)
+		}
+	}
+}
+
+// load возвращает заказы ids по порядку: истёкшие ключи восстанавливаются из журнала и кэшируются заново.
+func (m *redisOrders) load(ctx context.Context, ids []string) ([]Order, error) {
+	list := make([]Order, 0, len(ids))
+	if len(ids) == 0 {
+		return list, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = m.orderKey(id)
+	}
+	bodies, err := m.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range bodies {
+		var o Order
+		if s, ok := v.(string); ok {
+			if err := json.Unmarshal([]byte(s), &o); err != nil {
+				return nil, err
+			}
+		} else {
+			if o, err = loadOrder(ctx, ids[i]); err != nil {
+				return nil, err
+			}
+			if o.ID == "" {
+				continue // заказ удалён из журнала
+			}
+			if err := m.put(ctx, o); err != nil {
+				return nil, err
+			}
+		}
+		list = append(list, o)
+	}
+	return list, nil
+}
+
+func (m *redisOrders) GetOrder(ctx context.Context, id string) (Order, bool, error) {
+	if o, ok, err := m.cached(ctx, id); ok || err != nil {
+		return o, ok, err
+	}
+	if known, err := m.known(ctx, id); err != nil || !known {
+		return Order{}, false, err // такого заказа нет: в журнал не идём
+	}
+	list, err := m.load(ctx, []string{id})
+	if err != nil || len(list) == 0 {
+		return Order{}, false, err
+	}
+	return list[0], true, nil
+}
+
+func (m *redisOrders) ListOrders(ctx context.Context, status OrderStatus, tenant, after string, limit int) ([]Order, int, error) {
+	index := m.prefix + "orders"
+	if status != "" {
+		index = m.prefix + "status:" + string(status)
+	}
+	// id заказов арендатора — непрерывный диапазон [tenant:, tenant;) индекса
+	min, max := "-", "+"
+	if tenant != "" {
+		min, max = "["+tenantOrderID(tenant, ""), "("+tenant+";"
+	}
+	total, err := m.rdb.ZLexCount(ctx, index, min, max).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	if after != "" && (tenant == "" || after >= min[1:]) {
+		min = "(" + after
+	}
+	ids, err := m.rdb.ZRangeByLex(ctx, index, &redis.ZRangeBy{Min: min, Max: max, Count: int64(limit)}).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	list, err := m.load(ctx, ids)
+	return list, int(total), err
+}
+
+func (m *redisOrders) CustomerOrders(ctx context.Context, customerID string) ([]Order, error) {
+	ids, err := m.rdb.ZRange(ctx, m.prefix+"customer:"+customerID, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return m.load(ctx, ids)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// --- Append-only record log ---
+// Общее хранилище журналов аудита (audit.go, adminaudit.go): записи получают возрастающий номер Seq,
+// в памяти держатся последние opts.Max, с opts.Path записи дописываются в JSONL-файл и читаются из него при запуске.
+
+type auditOptions struct {
+	Path string // путь JSONL-файла; пусто — только в памяти
+	Max  int    // сколько записей держать в памяти
+}
+
+type recordLog[R any] struct {
+	name  string          // префикс ошибок и логов
+	seqOf func(*R) *int64 // поле Seq записи
+	opts  auditOptions
+
+	mu      sync.Mutex
+	f       *os.File
+	seq     int64
+	records []R // в порядке Seq
+}
+
+// open читает записи из opts.Path и открывает файл на дозапись. Хвост без перевода строки — незавершённая
+// запись — отрезается, как в store_file.go, иначе следующая запись склеилась бы с ним в одну строку.
+func (l *recordLog[R]) open() error {
+	if l.opts.Path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(l.opts.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("%s: open %s: %w", l.name, l.opts.Path, err)
+	}
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				slog.Warn(l.name+": dropping incomplete trailing record", "path", l.opts.Path, "bytes", len(line))
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%s: read %s: %w", l.name, l.opts.Path, err)
+		}
+		good += int64(len(line))
+		var rec R
+		if json.Unmarshal(line, &rec) != nil {
+			continue // пустая или повреждённая строка
+		}
+		l.seq = *l.seqOf(&rec)
+		l.keep(rec)
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: truncate %s: %w", l.name, l.opts.Path, err)
+	}
+	l.f = f
+	return nil
+}
+
+// keep добавляет запись в память, вытесняя старые сверх opts.Max; вызывается под l.mu или до запуска.
+func (l *recordLog[R]) keep(rec R) {
+	l.records = append(l.records, rec)
+	if over := len(l.records) - l.opts.Max; over > l.opts.Max/10 {
+		l.records = append(l.records[:0:0], l.records[over:]...)
+	}
+}
+
+// append присваивает записи следующий Seq и сохраняет её.
+func (l *recordLog[R]) append(rec R) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	*l.seqOf(&rec) = l.seq
+	l.keep(rec)
+	if l.f != nil {
+		line, _ := json.Marshal(rec)
+		if _, err := l.f.Write(append(line, '\n')); err != nil {
+			slog.Error(l.name+": write failed", "path", l.opts.Path, "error", err)
+		}
+	}
+}
+
+// find — записи, для которых match истинна, в порядке Seq, не больше limit.
+func (l *recordLog[R]) find(match func(R) bool, limit int) []R {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []R{}
+	for _, rec := range l.records {
+		if match(rec) {
+			if out = append(out, rec); len(out) == limit {
+				break
+			}
+		}
+	}
+	return out
+}
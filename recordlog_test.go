@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testRecord struct {
+	Seq  int64  `json:"seq"`
+	Name string `json:"name"`
+}
+
+func openTestLog(t *testing.T, path string) *recordLog[testRecord] {
+	t.Helper()
+	l := &recordLog[testRecord]{name: "test log", seqOf: func(r *testRecord) *int64 { return &r.Seq }, opts: auditOptions{Path: path, Max: 100}}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.f.Close() })
+	return l
+}
+
+func TestRecordLogDropsIncompleteTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	body := `{"seq":1,"name":"a"}` + "\n" + `{"seq":2,"name":"b"}` + "\n" + `{"seq":3,"na`
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := openTestLog(t, path)
+	if len(l.records) != 2 || l.seq != 2 {
+		t.Fatalf("records %v, seq %d; want 2 records, seq 2", l.records, l.seq)
+	}
+	l.append(testRecord{Name: "c"})
+
+	reopened := openTestLog(t, path)
+	got := reopened.find(func(testRecord) bool { return true }, 0)
+	want := []testRecord{{1, "a"}, {2, "b"}, {3, "c"}}
+	if len(got) != len(want) {
+		t.Fatalf("records after reopen = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("record %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- Panic recovery ---
+// Паника в обработчике запроса не должна ронять процесс: read model и очереди живут в памяти и после
+// перезапуска строятся заново. Паника HTTP-обработчика и gRPC-вызова перехватывается, пишется в лог со
+// стеком и учитывается в orders_panics_total, клиент получает 500 (problem+json) или codes.Internal.
+// Если ответ уже начат, статус не поменять — соединение просто закрывается. http.ErrAbortHandler —
+// намеренный обрыв ответа, он не считается ошибкой.
+
+var promPanics = newPromVec("counter", "orders_panics_total",
+	"Panics recovered in request handlers, by transport.", "transport")
+
+// recoverPanics — middleware mux; стоит внутри access log и метрик, чтобы те увидели 500.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			promPanics.inc("http")
+			slog.ErrorContext(r.Context(), "http: panic", "method", r.Method, "path", r.URL.Path, "panic", v, "stack", string(debug.Stack()))
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler) // ответ уже начат: net/http закроет соединение без своего лога
+			}
+			httpError(w, "internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func recoverGRPC(ctx context.Context, method string, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	promPanics.inc("grpc")
+	slog.ErrorContext(ctx, "grpc: panic", "method", method, "panic", v, "stack", string(debug.Stack()))
+	*err = status.Error(codes.Internal, "internal server error")
+}
+
+func recoverUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer recoverGRPC(ctx, info.FullMethod, &err)
+	return handler(ctx, req)
+}
+
+func recoverStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recoverGRPC(ss.Context(), info.FullMethod, &err)
+	return handler(srv, ss)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Configuration reload ---
+// SIGHUP или POST /admin/config/reload перечитывают файл настроек (-config) и файл подписок webhooks
+// и применяют на ходу то, что меняется без перезапуска: LOG_LEVEL, лимиты RATE_LIMIT_*, CORS_*,
+// QUOTA_*, COMMANDS_REQUIRE_ACTOR и сами подписки. Соединения клиентов (SSE, WebSocket, gRPC) не рвутся.
+// Флаги и окружение процесса не меняются, поэтому заданная ими настройка по-прежнему сильнее файла.
+// Неверное значение — отказ целиком: действуют прежние настройки. Изменённые в файле настройки,
+// которые читаются только при запуске, перечисляются в ответе и в предупреждении.
+
+// hotSettings — настройки, которые применяются без перезапуска.
+type hotSettings struct {
+	LogLevel     slog.Level
+	RateLimits   rateLimitOptions
+	TenantLimits rateLimitOptions
+	ActorLimits  rateLimitOptions
+	Quotas       quotaOptions
+	CORS         corsOptions
+	RequireActor bool
+}
+
+// hotKeys — имена этих настроек.
+var hotKeys = []string{
+	"LOG_LEVEL", "COMMANDS_REQUIRE_ACTOR",
+	"RATE_LIMIT_COMMANDS", "RATE_LIMIT_COMMANDS_BURST", "RATE_LIMIT_QUERIES", "RATE_LIMIT_QUERIES_BURST", "RATE_LIMIT_KEY_HEADER",
+	"RATE_LIMIT_TENANT_COMMANDS", "RATE_LIMIT_TENANT_COMMANDS_BURST", "RATE_LIMIT_TENANT_QUERIES", "RATE_LIMIT_TENANT_QUERIES_BURST",
+	"RATE_LIMIT_ACTOR_COMMANDS", "RATE_LIMIT_ACTOR_COMMANDS_BURST", "RATE_LIMIT_ACTOR_QUERIES", "RATE_LIMIT_ACTOR_QUERIES_BURST",
+	"QUOTA_TENANT_COMMANDS_PER_DAY", "QUOTA_TENANT_EVENTS", "QUOTA_TENANTS", "QUOTA_KEY_COMMANDS_PER_DAY",
+	"CORS_ORIGINS", "CORS_METHODS", "CORS_HEADERS", "CORS_EXPOSE_HEADERS", "CORS_CREDENTIALS", "CORS_MAX_AGE",
+}
+
+// readHotSettings читает настройки, не завершая процесс при неверном значении.
+func readHotSettings() (hotSettings, error) {
+	var h hotSettings
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := h.LogLevel.UnmarshalText([]byte(getenv("LOG_LEVEL", "info"))); err != nil {
+		check(errors.New("LOG_LEVEL: " + err.Error()))
+	}
+	var err error
+	h.RequireActor, err = settingBool("COMMANDS_REQUIRE_ACTOR", false)
+	check(err)
+	h.RateLimits.CommandRate, err = settingFloat("RATE_LIMIT_COMMANDS", 50)
+	check(err)
+	h.RateLimits.CommandBurst, err = settingInt("RATE_LIMIT_COMMANDS_BURST", 100)
+	check(err)
+	h.RateLimits.QueryRate, err = settingFloat("RATE_LIMIT_QUERIES", 200)
+	check(err)
+	h.RateLimits.QueryBurst, err = settingInt("RATE_LIMIT_QUERIES_BURST", 400)
+	check(err)
+	h.RateLimits.KeyHeader = getenv("RATE_LIMIT_KEY_HEADER", "X-API-Key")
+	h.TenantLimits.CommandRate, err = settingFloat("RATE_LIMIT_TENANT_COMMANDS", 0)
+	check(err)
+	h.TenantLimits.CommandBurst, err = settingInt("RATE_LIMIT_TENANT_COMMANDS_BURST", 100)
+	check(err)
+	h.TenantLimits.QueryRate, err = settingFloat("RATE_LIMIT_TENANT_QUERIES", 0)
+	check(err)
+	h.TenantLimits.QueryBurst, err = settingInt("RATE_LIMIT_TENANT_QUERIES_BURST", 400)
+	check(err)
+	h.ActorLimits.CommandRate, err = settingFloat("RATE_LIMIT_ACTOR_COMMANDS", 0)
+	check(err)
+	h.ActorLimits.CommandBurst, err = settingInt("RATE_LIMIT_ACTOR_COMMANDS_BURST", 100)
+	check(err)
+	h.ActorLimits.QueryRate, err = settingFloat("RATE_LIMIT_ACTOR_QUERIES", 0)
+	check(err)
+	h.ActorLimits.QueryBurst, err = settingInt("RATE_LIMIT_ACTOR_QUERIES_BURST", 400)
+	check(err)
+	for key, p := range map[string]*int64{
+		"QUOTA_TENANT_COMMANDS_PER_DAY": &h.Quotas.TenantCommandsPerDay,
+		"QUOTA_TENANT_EVENTS":           &h.Quotas.TenantEvents,
+		"QUOTA_KEY_COMMANDS_PER_DAY":    &h.Quotas.KeyCommandsPerDay,
+	} {
+		n, err := settingInt(key, 0)
+		check(err)
+		if n < 0 {
+			check(errors.New(key + ": must not be negative"))
+		}
+		*p = int64(n)
+	}
+	h.Quotas.Tenants, err = parseTenantQuotas(getenv("QUOTA_TENANTS", ""))
+	check(err)
+	h.CORS = corsOptions{
+		Origins: splitList(getenv("CORS_ORIGINS", "")),
+		Methods: splitList(strings.ToUpper(getenv("CORS_METHODS", "GET,HEAD"))),
+		Headers: splitList(getenv("CORS_HEADERS",
+			"Accept,Authorization,Content-Type,If-Match,Idempotency-Key,Last-Event-ID,Prefer,X-API-Key,X-Request-ID,X-Correlation-ID,X-Causation-ID,X-User-ID,X-Tenant-ID,traceparent,tracestate")),
+		ExposeHeaders: splitList(getenv("CORS_EXPOSE_HEADERS",
+			"ETag,Location,Link,Retry-After,Deprecation,Idempotent-Replayed,Preference-Applied,X-Request-ID,X-Correlation-ID,X-Position,X-Last-Position,X-Total-Count")),
+	}
+	h.CORS.Credentials, err = settingBool("CORS_CREDENTIALS", false)
+	check(err)
+	h.CORS.MaxAge, err = settingDuration("CORS_MAX_AGE", 10*time.Minute)
+	check(err)
+	return h, errors.Join(errs...)
+}
+
+// apply ставит настройки работающему сервису.
+func (h hotSettings) apply() {
+	logLevel.Set(h.LogLevel)
+	actorRequired.Store(h.RequireActor)
+	if limiter != nil {
+		limiter.update(h.RateLimits)
+	}
+	if tenantLimiter != nil {
+		tenantLimiter.update(h.TenantLimits)
+	}
+	if actorLimiter != nil {
+		actorLimiter.update(h.ActorLimits)
+	}
+	usage.update(h.Quotas)
+	if cors != nil {
+		cors.update(h.CORS)
+	}
+}
+
+// configReload — ответ POST /admin/config/reload.
+type configReload struct {
+	Changed         []string      `json:"changed"`                    // настройки файла, значение которых изменилось
+	Applied         []string      `json:"applied"`                    // из них применены
+	Overridden      []string      `json:"overridden,omitempty"`       // заданы флагом или окружением: файл не действует
+	RestartRequired []string      `json:"restart_required,omitempty"` // читаются только при запуске
+	Webhooks        webhookReload `json:"webhooks"`
+}
+
+var reloadMu sync.Mutex
+
+// reloadSettings перечитывает файл настроек и подписки webhooks.
+func reloadSettings(ctx context.Context) (configReload, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	res := configReload{Changed: []string{}, Applied: []string{}}
+	if settings.path != "" {
+		file, err := readConfigFile(settings.path)
+		if err != nil {
+			return res, err
+		}
+		previous, changed := settings.replaceFile(file)
+		hot, err := readHotSettings()
+		if err != nil {
+			settings.replaceFile(previous)
+			return res, err
+		}
+		hot.apply()
+		for _, key := range changed {
+			res.Changed = append(res.Changed, key)
+			switch {
+			case settings.overridden(key):
+				res.Overridden = append(res.Overridden, key)
+			case slices.Contains(hotKeys, key):
+				res.Applied = append(res.Applied, key)
+			default:
+				res.RestartRequired = append(res.RestartRequired, key)
+			}
+		}
+	}
+	if webhooks != nil {
+		var err error
+		if res.Webhooks, err = webhooks.reload(); err != nil {
+			return res, err
+		}
+	}
+	slog.InfoContext(ctx, "config: reloaded", "applied", strings.Join(res.Applied, ","),
+		"webhooks_started", len(res.Webhooks.Started), "webhooks_stopped", len(res.Webhooks.Stopped), "webhooks_restarted", len(res.Webhooks.Restarted))
+	if len(res.RestartRequired) > 0 {
+		slog.WarnContext(ctx, "config: changed settings take effect after restart", "keys", strings.Join(res.RestartRequired, ","))
+	}
+	return res, nil
+}
+
+// reloadOnSignal перезагружает настройки по каждому SIGHUP до отмены ctx.
+func reloadOnSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if _, err := reloadSettings(ctx); err != nil {
+				slog.ErrorContext(ctx, "config: reload failed, previous settings stay in effect", "error", err)
+			}
+		}
+	}
+}
+
+// --- Reload Handlers ---
+func reloadConfig(w http.ResponseWriter, r *http.Request) {
+	res, err := reloadSettings(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "config: reload failed, previous settings stay in effect", "error", err)
+		writeError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	writeBody(w, r, http.StatusOK, res)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// --- Replay (cqrsctl) ---
+// cqrsctl — тот же бинарник под именем cqrsctl (в образе — ссылка на app); он выполняет подкоманды
+// обслуживания и без подкоманды сервис не запускает. cqrsctl replay проигрывает журнал — из хранилища
+// EVENT_STORE или из резервной копии (-backup FILE, см. backup.go) — в одну из целей:
+//
+//	replay validate                  — проверить журнал: позиции, версии потоков, JSON в Data, переходы заказов, подписи
+//	replay projections [-only a,b]   — перестроить Durable-проекции (внешние read model, поиск) и их checkpoint
+//	replay publish [-from N] [-to N] — заново опубликовать события в EVENT_PUBLISHER; checkpoint outbox не меняется
+//
+// Журнал проверяется при любой цели; -dry-run только проверяет и считает события, ничего не меняя.
+// -from/-to — позиции, включительно. Перестройка проекций рассчитана на остановленный сервис: работающему
+// нужен POST /admin/projections/{name}/rebuild. С -backup позиции берутся из копии, поэтому перестраивать
+// проекции по ней имеет смысл, только если копия снята с того же хранилища.
+
+// replayProblemsLogged — сколько нарушений validate пишет в лог; остальные только считаются.
+const replayProblemsLogged = 20
+
+type replayOptions struct {
+	Backup   string
+	From, To int64 // To = 0 — до конца журнала
+	Only     []string
+	DryRun   bool
+}
+
+func (o replayOptions) inRange(e Event) bool {
+	return e.Position >= o.From && (o.To == 0 || e.Position <= o.To)
+}
+
+// replayValidator проверяет журнал по порядку событий.
+type replayValidator struct {
+	last     int64
+	versions map[string]int64
+	orders   map[string]Order
+	problems int
+}
+
+func newReplayValidator() *replayValidator {
+	return &replayValidator{versions: map[string]int64{}, orders: map[string]Order{}}
+}
+
+// report учитывает нарушение problem в событии e.
+func (v *replayValidator) report(e Event, problem error) {
+	if v.problems++; v.problems <= replayProblemsLogged {
+		slog.Warn("replay: invalid event", "position", e.Position, "stream_id", e.StreamID, "version", e.Version, "event_type", e.Type, "error", problem)
+	}
+}
+
+func (v *replayValidator) check(e Event) {
+	var problem error
+	o, known := v.orders[e.OrderID]
+	switch {
+	case e.Position <= v.last:
+		problem = fmt.Errorf("position %d after %d", e.Position, v.last)
+	case e.Version != v.versions[e.StreamID]+1:
+		problem = fmt.Errorf("version %d after %d", e.Version, v.versions[e.StreamID])
+	case len(e.Data) > 0 && !json.Valid(e.Data):
+		problem = errors.New("data is not valid JSON")
+	case e.StreamID != orderStream(e.OrderID):
+	case !known && e.Type != EventOrderCreated:
+		problem = fmt.Errorf("%s before %s", e.Type, EventOrderCreated)
+	case known:
+		problem = checkTransition(o, e.Type)
+	}
+	v.last = max(v.last, e.Position)
+	v.versions[e.StreamID] = max(v.versions[e.StreamID], e.Version)
+	if e.StreamID == orderStream(e.OrderID) && (known || e.Type == EventOrderCreated) {
+		o.apply(e)
+		v.orders[e.OrderID] = o
+	}
+	if problem != nil {
+		v.report(e, problem)
+	}
+}
+
+// replayEvents передаёт fn все события журнала или копии по порядку, проверяя их v.
+func replayEvents(ctx context.Context, es EventStore, opts replayOptions, v *replayValidator, fn func(Event) error) error {
+	each := func(e Event) error {
+		v.check(e)
+		return fn(e)
+	}
+	if opts.Backup != "" {
+		// копия проверяется целиком до того, как её события куда-то уйдут
+		if !opts.DryRun {
+			if err := readBackupFile(opts.Backup, func(Event) error { return nil }); err != nil {
+				return err
+			}
+		}
+		return readBackupFile(opts.Backup, each)
+	}
+	for after := int64(0); ; {
+		page, err := es.LoadAfter(ctx, after, backupPage)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+		for _, e := range page {
+			if err := each(e); err != nil {
+				return err
+			}
+		}
+		after = page[len(page)-1].Position
+	}
+}
+
+func readBackupFile(path string, fn func(Event) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = readBackup(f, fn)
+	return err
+}
+
+// runReplay выполняет cqrsctl replay.
+func runReplay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	var opts replayOptions
+	fs.StringVar(&opts.Backup, "backup", "", "replay a backup file instead of the event store")
+	fs.Int64Var(&opts.From, "from", 0, "first position to replay (publish)")
+	fs.Int64Var(&opts.To, "to", 0, "last position to replay (publish); 0 — up to the end")
+	only := fs.String("only", "", "comma-separated Durable projections to rebuild (projections); default — all")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "validate and count events without changing anything")
+	if len(args) == 0 {
+		return errors.New("usage: replay validate|projections|publish [flags]")
+	}
+	target := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	opts.Only = splitList(*only)
+	stores, err := openEventStore(ctx)
+	if err != nil {
+		return err
+	}
+	v := newReplayValidator()
+	if stores.signing != nil && opts.Backup == "" {
+		rep, err := stores.signing.verify(ctx, opts.From, opts.To, v.report)
+		if err != nil {
+			return err
+		}
+		slog.Info("replay: signatures verified", "checked", rep.Checked, "valid", rep.Valid, "unsigned", rep.Unsigned, "invalid", rep.InvalidCount)
+	}
+	var replayed int64
+	progress := func() {
+		if replayed++; replayed%10000 == 0 {
+			slog.Info("replay: progress", "events", replayed)
+		}
+	}
+	switch target {
+	case "validate":
+		opts.DryRun = true
+		err = replayEvents(ctx, stores.events, opts, v, func(Event) error { progress(); return nil })
+	case "projections":
+		err = replayProjections(ctx, stores, opts, v, progress)
+	case "publish":
+		err = replayPublish(ctx, stores.events, opts, v, progress)
+	default:
+		return fmt.Errorf("unknown replay target %q: expected validate, projections or publish", target)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("replay: done", "target", target, "events", replayed, "last_position", v.last, "problems", v.problems, "dry_run", opts.DryRun)
+	if v.problems > 0 {
+		return fmt.Errorf("replay: %d invalid events", v.problems)
+	}
+	return nil
+}
+
+// replayProjections перестраивает Durable-проекции офлайн: Reset, весь журнал, checkpoint на его конце.
+// Проекции в памяти проигрываются вместе с ними: Durable-проекция с After читает их состояние.
+func replayProjections(ctx context.Context, stores openedStores, opts replayOptions, v *replayValidator, progress func()) error {
+	if opts.From != 0 || opts.To != 0 {
+		return errors.New("replay projections: -from and -to are not supported, projections are rebuilt from the start")
+	}
+	if err := registerProjections(ctx); err != nil {
+		return err
+	}
+	var targets []*projectionRunner
+	for _, p := range projections.list {
+		if p.Durable && (len(opts.Only) == 0 || slices.Contains(opts.Only, p.Name)) {
+			targets = append(targets, p)
+		}
+	}
+	for _, name := range opts.Only {
+		if p := projections.byName[name]; p == nil || !p.Durable {
+			return fmt.Errorf("replay projections: %q is not a Durable projection (READ_MODEL, SEARCH_URL)", name)
+		}
+	}
+	if len(targets) == 0 {
+		return errors.New("replay projections: no Durable projections configured (READ_MODEL, SEARCH_URL)")
+	}
+	if !opts.DryRun {
+		for _, p := range targets {
+			p.Reset()
+		}
+	}
+	err := replayEvents(ctx, stores.events, opts, v, func(e Event) error {
+		progress()
+		if opts.DryRun {
+			return nil
+		}
+		for _, p := range projections.list {
+			if !p.Durable || slices.Contains(targets, p) {
+				p.Apply(e)
+			}
+		}
+		return nil
+	})
+	if err != nil || opts.DryRun {
+		return err
+	}
+	for _, p := range targets {
+		if err := stores.checkpoints.SaveCheckpoint(ctx, p.checkpointName(), v.last); err != nil {
+			return fmt.Errorf("replay projections: %s: %w", p.Name, err)
+		}
+		slog.Info("replay: projection rebuilt", "projection", p.Name, "position", v.last)
+	}
+	return nil
+}
+
+// replayPublish публикует события диапазона в EVENT_PUBLISHER, повторяя неудачные попытки.
+func replayPublish(ctx context.Context, es EventStore, opts replayOptions, v *replayValidator, progress func()) error {
+	var pub publisher
+	if !opts.DryRun {
+		var err error
+		if pub, err = openPublisher(ctx); err != nil {
+			return err
+		}
+		if pub == nil {
+			return errors.New("replay publish: EVENT_PUBLISHER is not set")
+		}
+		defer pub.Close()
+	}
+	return replayEvents(ctx, es, opts, v, func(e Event) error {
+		if !opts.inRange(e) {
+			return nil
+		}
+		progress()
+		if pub != nil {
+			publishWithRetry(ctx, pub, e)
+		}
+		return ctx.Err()
+	})
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// --- Scheduled commands ---
+// POST /scheduled-commands откладывает команду над существующим заказом до run_at (или на delay):
+// «отменить заказ в 18:00, если он не оплачен» — это отложенный cancel, который в 18:00 либо отменит
+// заказ, либо завершится недопустимым переходом, если заказ уже оплачен. Команда задаётся как элемент
+// пакета (batchCommand), кроме create.
+//
+// Расписание — агрегат в журнале, поток schedule-<id>: CommandScheduled, ScheduledCommandStarted,
+// ScheduledCommandCompleted или ScheduledCommandCanceled, поэтому оно переживает перезапуск.
+// Планировщик сначала записывает Started в версию запланированной команды — запись может выиграть
+// только одна из конкурирующих попыток, как и отмена, — затем выполняет команду с Idempotency-Key
+// schedule/<id> и записывает Completed. Команда, прерванная перезапуском после Started, выполняется
+// снова при следующем запуске, и ключ не даёт ей сработать дважды.
+
+const (
+	EventCommandScheduled          EventType = "CommandScheduled"
+	EventScheduledCommandStarted   EventType = "ScheduledCommandStarted"
+	EventScheduledCommandCompleted EventType = "ScheduledCommandCompleted"
+	EventScheduledCommandCanceled  EventType = "ScheduledCommandCanceled"
+)
+
+const scheduleStreamPrefix = "schedule-"
+
+func scheduleStream(id string) string {
+	return scheduleStreamPrefix + id
+}
+
+type scheduleState string
+
+const (
+	scheduleScheduled scheduleState = "scheduled"
+	scheduleRunning   scheduleState = "running"
+	scheduleSucceeded scheduleState = "succeeded"
+	scheduleFailed    scheduleState = "failed"
+	scheduleCanceled  scheduleState = "canceled"
+)
+
+// commandScheduledData — Data события CommandScheduled.
+type commandScheduledData struct {
+	ID      string       `json:"id"`
+	Command batchCommand `json:"command"`
+	RunAt   time.Time    `json:"run_at"`
+}
+
+// ScheduledCommand — отложенная команда и её состояние.
+type ScheduledCommand struct {
+	ID        string        `json:"id"`
+	Command   batchCommand  `json:"command"`
+	RunAt     time.Time     `json:"run_at"`
+	State     scheduleState `json:"state"`
+	Result    *batchResult  `json:"result,omitempty"` // итог, как элемент ответа пакета; Data события Completed
+	CreatedAt time.Time     `json:"created_at"`
+	Version   int64         `json:"version"`
+
+	correlationID string // цепочка запроса, который запланировал команду
+}
+
+// apply переводит расписание в состояние после события e; общий шаг для проекции и агрегата.
+func (sc *ScheduledCommand) apply(e Event) {
+	switch e.Type {
+	case EventCommandScheduled:
+		var data commandScheduledData
+		json.Unmarshal(e.Data, &data)
+		*sc = ScheduledCommand{
+			ID:            data.ID,
+			Command:       data.Command,
+			RunAt:         data.RunAt,
+			State:         scheduleScheduled,
+			CreatedAt:     e.Timestamp,
+			correlationID: e.Metadata.CorrelationID,
+		}
+	case EventScheduledCommandStarted:
+		sc.State = scheduleRunning
+	case EventScheduledCommandCompleted:
+		var data batchResult
+		json.Unmarshal(e.Data, &data)
+		sc.State, sc.Result = scheduleSucceeded, &data
+		if data.Error != "" {
+			sc.State = scheduleFailed
+		}
+	case EventScheduledCommandCanceled:
+		sc.State = scheduleCanceled
+	}
+	sc.Version = e.Version
+}
+
+func isScheduleEvent(t EventType) bool {
+	switch t {
+	case EventCommandScheduled, EventScheduledCommandStarted, EventScheduledCommandCompleted, EventScheduledCommandCanceled:
+		return true
+	}
+	return false
+}
+
+// schedules — проекция отложенных команд по id (проекция "schedules").
+var (
+	scheduleMu sync.Mutex
+	schedules  = map[string]*ScheduledCommand{}
+)
+
+// applyScheduleEvent обновляет проекцию расписаний; события не из потоков расписаний пропускает.
+func applyScheduleEvent(e Event) {
+	if !isScheduleEvent(e.Type) {
+		return
+	}
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	id := e.StreamID[len(scheduleStreamPrefix):]
+	sc, ok := schedules[id]
+	if !ok {
+		if e.Type != EventCommandScheduled {
+			return
+		}
+		sc = &ScheduledCommand{}
+		schedules[id] = sc
+	}
+	if e.Version > sc.Version {
+		sc.apply(e)
+	}
+}
+
+func resetSchedules() {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	schedules = map[string]*ScheduledCommand{}
+}
+
+// loadSchedule восстанавливает расписание из его потока; неизвестное — с пустым ID.
+func loadSchedule(ctx context.Context, id string) (ScheduledCommand, error) {
+	events, err := store.LoadByOrder(ctx, scheduleStream(id))
+	if err != nil {
+		return ScheduledCommand{}, err
+	}
+	var sc ScheduledCommand
+	for _, e := range events {
+		sc.apply(e)
+	}
+	return sc, nil
+}
+
+// appendScheduleEvent добавляет событие в поток расписания id в версию expected.
+func appendScheduleEvent(ctx context.Context, id string, t EventType, data any, expected int64, md EventMetadata) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return store.Append(ctx, Event{
+		Type:      t,
+		OrderID:   scheduleStream(id),
+		StreamID:  scheduleStream(id),
+		Timestamp: time.Now(),
+		Metadata:  md,
+		Data:      raw,
+	}, expected)
+}
+
+// --- Scheduler ---
+
+type scheduler struct {
+	interval time.Duration
+}
+
+// fireDue выполняет команды, срок которых наступил; resume — также прерванные перезапуском (running).
+func (s *scheduler) fireDue(ctx context.Context, resume bool) {
+	now := time.Now()
+	scheduleMu.Lock()
+	var due []ScheduledCommand
+	for _, sc := range schedules {
+		if (sc.State == scheduleScheduled && !sc.RunAt.After(now)) || (resume && sc.State == scheduleRunning) {
+			due = append(due, *sc)
+		}
+	}
+	scheduleMu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].RunAt.Before(due[j].RunAt) })
+	for _, sc := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := s.fire(ctx, sc); err != nil {
+			slog.ErrorContext(ctx, "scheduler: fire failed", "schedule_id", sc.ID, "command", sc.Command.Command, "order_id", sc.Command.OrderID, "error", err)
+		}
+	}
+}
+
+// fire выполняет отложенную команду sc ровно один раз.
+func (s *scheduler) fire(ctx context.Context, sc ScheduledCommand) error {
+	md := commandMetadata(sc.correlationID, fmt.Sprintf("%s@%d", scheduleStream(sc.ID), sc.Version), "scheduler")
+	expected := sc.Version
+	if sc.State == scheduleScheduled {
+		started, err := appendScheduleEvent(ctx, sc.ID, EventScheduledCommandStarted, struct{}{}, expected, md)
+		var conflict *versionConflictError
+		if errors.As(err, &conflict) {
+			return nil // отменена или запущена другой попыткой
+		}
+		if err != nil {
+			return err
+		}
+		expected = started.Version
+	}
+	bc := sc.Command
+	bc.IdempotencyKey = "schedule/" + sc.ID
+	result := batchResult{Status: http.StatusBadRequest, OrderID: bc.OrderID}
+	c, err := bc.command(md)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		stored, replayed, err := bus.Dispatch(ctx, c)
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err // остаётся running и выполнится при следующем запуске
+		}
+		result = commandBatchResult(bc, stored, replayed, err)
+	}
+	_, err = appendScheduleEvent(ctx, sc.ID, EventScheduledCommandCompleted, result, expected, md)
+	return err
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	s.fireDue(ctx, true)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.fireDue(ctx, false)
+		}
+	}
+}
+
+// --- Scheduled commands API ---
+
+// scheduleRequest — тело POST /scheduled-commands: run_at (RFC 3339) или delay ("30m").
+type scheduleRequest struct {
+	Command batchCommand `json:"command"`
+	RunAt   *time.Time   `json:"run_at,omitempty"`
+	Delay   string       `json:"delay,omitempty"`
+}
+
+// createSchedule откладывает команду; команда проверяется сразу, состояние заказа — при выполнении.
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	var req scheduleRequest
+	if err := readBody(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	runAt, err := req.runAt(time.Now())
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if req.Command.Command == batchCreate {
+		httpError(w, "create cannot be scheduled", http.StatusBadRequest)
+		return
+	}
+	if !tenantOwns(r.Context(), req.Command.OrderID) {
+		writeError(w, fmt.Errorf("%w: %s", errOrderNotFound, req.Command.OrderID), http.StatusNotFound)
+		return
+	}
+	md := requestMetadata(w, r)
+	c, err := req.Command.command(md)
+	if err == nil {
+		if v, ok := c.(commandValidator); ok {
+			err = v.Validate()
+		}
+	}
+	if err != nil {
+		httpError(w, "command: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := uuid.New().String()
+	stored, err := appendScheduleEvent(r.Context(), id, EventCommandScheduled, commandScheduledData{ID: id, Command: req.Command, RunAt: runAt}, 0, md)
+	if err != nil {
+		writeCommandError(w, err)
+		return
+	}
+	var sc ScheduledCommand
+	sc.apply(stored)
+	w.Header().Set("Location", apiVersionPrefix+"/scheduled-commands/"+id)
+	writeBody(w, r, http.StatusCreated, sc)
+}
+
+func (req scheduleRequest) runAt(now time.Time) (time.Time, error) {
+	switch {
+	case req.RunAt != nil && req.Delay != "":
+		return time.Time{}, errors.New("run_at and delay are mutually exclusive")
+	case req.RunAt != nil:
+		return req.RunAt.UTC(), nil
+	case req.Delay != "":
+		d, err := time.ParseDuration(req.Delay)
+		if err != nil || d < 0 {
+			return time.Time{}, fmt.Errorf("invalid delay %q: expected a non-negative duration like 30m", req.Delay)
+		}
+		return now.Add(d).UTC(), nil
+	default:
+		return time.Time{}, errors.New("run_at or delay is required")
+	}
+}
+
+// listSchedules отдаёт отложенные команды по времени выполнения; фильтры order_id и state.
+func listSchedules(w http.ResponseWriter, r *http.Request) {
+	orderID, state := r.URL.Query().Get("order_id"), scheduleState(r.URL.Query().Get("state"))
+	scheduleMu.Lock()
+	out := []ScheduledCommand{}
+	for _, sc := range schedules {
+		if (orderID == "" || sc.Command.OrderID == orderID) && (state == "" || sc.State == state) && tenantOwns(r.Context(), sc.Command.OrderID) {
+			out = append(out, *sc)
+		}
+	}
+	scheduleMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].RunAt.Before(out[j].RunAt) })
+	writeBody(w, r, http.StatusOK, out)
+}
+
+func getSchedule(w http.ResponseWriter, r *http.Request) {
+	scheduleMu.Lock()
+	sc, ok := schedules[mux.Vars(r)["id"]]
+	var out ScheduledCommand
+	if ok {
+		out = *sc
+	}
+	scheduleMu.Unlock()
+	if !ok || !tenantOwns(r.Context(), out.Command.OrderID) {
+		httpError(w, "scheduled command not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", versionETag(out.Version))
+	writeBody(w, r, http.StatusOK, out)
+}
+
+// cancelSchedule отменяет команду, которая ещё не начала выполняться; начатую или завершённую — 409.
+func cancelSchedule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	sc, err := loadSchedule(r.Context(), id)
+	if err != nil {
+		writeCommandError(w, err)
+		return
+	}
+	if sc.ID == "" || !tenantOwns(r.Context(), sc.Command.OrderID) {
+		httpError(w, "scheduled command not found", http.StatusNotFound)
+		return
+	}
+	if sc.State != scheduleScheduled {
+		httpError(w, fmt.Sprintf("scheduled command is %s", sc.State), http.StatusConflict)
+		return
+	}
+	_, err = appendScheduleEvent(r.Context(), id, EventScheduledCommandCanceled, struct{}{}, sc.Version, requestMetadata(w, r))
+	var conflict *versionConflictError
+	if errors.As(err, &conflict) {
+		httpError(w, "scheduled command has already started", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeCommandError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
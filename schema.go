@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// --- Event schema versions ---
+// schemaVersions — текущая версия формы Data для каждого типа события; Append проставляет её новым событиям.
+// События без schema_version (записанные до появления версий) считаются версией 1.
+var schemaVersions = map[EventType]int{
+	EventOrderCreated:   2,
+	EventOrderPaid:      1,
+	EventOrderCanceled:  1,
+	EventOrderRefunded:  1,
+	EventOrderExpired:   1,
+	EventOrderShipped:   1,
+	EventOrderDelivered: 1,
+
+	EventOrderPaymentReceived: 1,
+	EventDiscountApplied:      1,
+	EventPaymentAuthorized:    1,
+	EventPaymentFailed:        1,
+
+	EventCommandScheduled:          1,
+	EventScheduledCommandStarted:   1,
+	EventScheduledCommandCompleted: 1,
+	EventScheduledCommandCanceled:  1,
+
+	EventStockAdded:     1,
+	EventStockReserved:  1,
+	EventStockCommitted: 1,
+	EventStockReleased:  1,
+}
+
+// upcaster переводит событие из версии схемы n в n+1.
+type upcaster func(Event) (Event, error)
+
+// upcasters[type][n] — шаг n -> n+1. При изменении формы события увеличьте schemaVersions
+// и зарегистрируйте шаг со старой версии, не трогая уже записанный журнал.
+var upcasters = map[EventType]map[int]upcaster{
+	EventOrderCreated: {1: upcastOrderCreatedItems},
+}
+
+// upcastOrderCreatedItems: в версии 2 OrderCreated несёт позиции заказа; заказы, созданные раньше, — без позиций.
+func upcastOrderCreatedItems(e Event) (Event, error) {
+	fields := map[string]json.RawMessage{}
+	if len(e.Data) > 0 {
+		if err := json.Unmarshal(e.Data, &fields); err != nil || fields == nil {
+			return Event{}, fmt.Errorf("data is not an object: %s", e.Data)
+		}
+	}
+	if _, ok := fields["items"]; !ok {
+		fields["items"] = json.RawMessage("[]")
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return Event{}, err
+	}
+	e.Data = data
+	return e, nil
+}
+
+// upcast доводит событие до текущей версии схемы. Типы без версии и события
+// из более новой схемы (при выкатке новой версии сервиса) проходят как есть.
+func upcast(e Event) (Event, error) {
+	if e.SchemaVersion == 0 {
+		e.SchemaVersion = 1
+	}
+	target, ok := schemaVersions[e.Type]
+	if !ok {
+		return e, nil
+	}
+	for e.SchemaVersion < target {
+		step, ok := upcasters[e.Type][e.SchemaVersion]
+		if !ok {
+			return Event{}, fmt.Errorf("upcast %s@%d: no upcaster for %s v%d", e.StreamID, e.Version, e.Type, e.SchemaVersion)
+		}
+		next, err := step(e)
+		if err != nil {
+			return Event{}, fmt.Errorf("upcast %s@%d: %s v%d: %w", e.StreamID, e.Version, e.Type, e.SchemaVersion, err)
+		}
+		next.SchemaVersion = e.SchemaVersion + 1
+		e = next
+	}
+	return e, nil
+}
+
+func upcastAll(events []Event) ([]Event, error) {
+	for i, e := range events {
+		up, err := upcast(e)
+		if err != nil {
+			return nil, err
+		}
+		events[i] = up
+	}
+	return events, nil
+}
+
+// upcastingStore отдаёт события из нижележащего хранилища в текущей схеме;
+// в самом журнале события остаются в той форме, в которой были записаны.
+type upcastingStore struct {
+	EventStore
+}
+
+func (s upcastingStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	if e.SchemaVersion == 0 {
+		e.SchemaVersion = schemaVersions[e.Type]
+	}
+	return s.EventStore.Append(ctx, e, expected)
+}
+
+func (s upcastingStore) Load(ctx context.Context) ([]Event, error) {
+	events, err := s.EventStore.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return upcastAll(events)
+}
+
+func (s upcastingStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	events, err := s.EventStore.LoadAfter(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return upcastAll(events)
+}
+
+func (s upcastingStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	events, err := s.EventStore.QueryEvents(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return upcastAll(events)
+}
+
+func (s upcastingStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	events, err := s.EventStore.LoadByOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	return upcastAll(events)
+}
+
+func (s upcastingStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	events, err := s.EventStore.LoadByOrderAfter(ctx, orderID, after)
+	if err != nil {
+		return nil, err
+	}
+	return upcastAll(events)
+}
+
+func (s upcastingStore) Subscribe(fn func(Event)) func() {
+	return s.EventStore.Subscribe(func(e Event) {
+		up, err := upcast(e)
+		if err != nil {
+			slog.Error("schema: upcast event", "stream_id", e.StreamID, "version", e.Version, "event_type", e.Type, "error", err)
+			return
+		}
+		fn(up)
+	})
+}
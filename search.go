@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// --- Search projection (Elasticsearch / OpenSearch) ---
+// С SEARCH_URL проекция "orders-search" индексирует заказы в индекс SEARCH_INDEX: на каждое событие заказа
+// документ заказа из read model перезаписывается целиком. Версия документа — версия заказа (version_type
+// external_gte), поэтому повторная или запоздавшая доставка не откатывает документ к старому состоянию.
+// Проекция Durable и идёт после "orders" (After): при запуске она догоняет журнал со своего checkpoint,
+// индексируя уже собранное состояние. GET /orders/search ищет по тексту (?q — покупатель, позиции, купон, id)
+// с фильтрами и фасетами по статусу, покупателю, SKU и валюте. REST-клиент — net/http по JSON API,
+// одинаковому у Elasticsearch 7+/8 и OpenSearch.
+
+type searchOptions struct {
+	URL      string
+	Index    string
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+type searchIndex struct {
+	opts   searchOptions
+	client *http.Client
+}
+
+// search — индекс заказов, если задан SEARCH_URL.
+var search *searchIndex
+
+var errSearchDisabled = errors.New("search is not configured (SEARCH_URL)")
+
+const searchMapping = `{
+  "mappings": {
+    "properties": {
+      "id":          {"type": "keyword"},
+      "tenant":      {"type": "keyword"},
+      "status":      {"type": "keyword"},
+      "customer_id": {"type": "keyword"},
+      "customer": {"properties": {
+        "name":    {"type": "text"},
+        "email":   {"type": "keyword"},
+        "phone":   {"type": "keyword"},
+        "address": {"type": "text"}
+      }},
+      "items":      {"properties": {"sku": {"type": "keyword"}}},
+      "currency":   {"type": "keyword"},
+      "coupon":     {"type": "keyword"},
+      "created_at": {"type": "date"}
+    }
+  }
+}`
+
+// searchFields — поля полнотекстового ?q.
+var searchFields = []string{"id", "customer_id", "customer.name", "customer.email", "customer.address", "items.sku", "coupon"}
+
+// searchFacets — фасет ответа -> поле индекса.
+var searchFacets = map[string]string{"status": "status", "customer_id": "customer_id", "sku": "items.sku", "currency": "currency"}
+
+// searchError — ответ поискового сервера с кодом не 2xx.
+type searchError struct {
+	Status int
+	Body   string
+}
+
+func (e *searchError) Error() string { return fmt.Sprintf("search: HTTP %d: %s", e.Status, e.Body) }
+
+func newSearchIndex(ctx context.Context, opts searchOptions) (*searchIndex, error) {
+	s := &searchIndex{opts: opts, client: &http.Client{Timeout: opts.Timeout}}
+	err := s.do(ctx, http.MethodPut, "/"+url.PathEscape(opts.Index), json.RawMessage(searchMapping), nil)
+	var se *searchError
+	if errors.As(err, &se) && se.Status == http.StatusBadRequest && bytes.Contains([]byte(se.Body), []byte("resource_already_exists_exception")) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("search: create index %s: %w", opts.Index, err)
+	}
+	return s, nil
+}
+
+func (s *searchIndex) do(ctx context.Context, method, path string, body, out any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.opts.URL+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.opts.Username != "" {
+		req.SetBasicAuth(s.opts.Username, s.opts.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &searchError{Status: resp.StatusCode, Body: string(msg)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *searchIndex) docPath(id string) string {
+	return "/" + url.PathEscape(s.opts.Index) + "/_doc/" + url.PathEscape(id)
+}
+
+// index перезаписывает документ заказа; более новая версия в индексе (409) — не ошибка.
+func (s *searchIndex) index(ctx context.Context, o Order) error {
+	path := s.docPath(o.ID) + "?version_type=external_gte&version=" + strconv.FormatInt(o.Version, 10)
+	err := s.do(ctx, http.MethodPut, path, o, nil)
+	var se *searchError
+	if errors.As(err, &se) && se.Status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// apply индексирует заказ события из read model; события других потоков пропускает.
+func (s *searchIndex) apply(e Event) {
+	mutex.Lock()
+	o, ok := orders[e.OrderID]
+	mutex.Unlock()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	if err := s.index(ctx, o); err != nil {
+		slog.ErrorContext(ctx, "search: index failed", "order_id", o.ID, "version", o.Version, "error", err)
+	}
+}
+
+func (s *searchIndex) deleteByQuery(ctx context.Context, query any) error {
+	return s.do(ctx, http.MethodPost, "/"+url.PathEscape(s.opts.Index)+"/_delete_by_query?conflicts=proceed", map[string]any{"query": query}, nil)
+}
+
+func (s *searchIndex) reset() {
+	if err := s.deleteByQuery(context.Background(), map[string]any{"match_all": map[string]any{}}); err != nil {
+		slog.Error("search: reset failed", "error", err)
+	}
+}
+
+// forget удаляет документы заказов, удалённых при компакции журнала.
+func (s *searchIndex) forget(ids []string) {
+	if err := s.deleteByQuery(context.Background(), map[string]any{"ids": map[string]any{"values": ids}}); err != nil {
+		slog.Error("search: forget failed", "orders", len(ids), "error", err)
+	}
+}
+
+// erase переиндексирует заказы покупателя после удаления его персональных данных из read model.
+func (s *searchIndex) erase(customerID string) {
+	list, _ := memoryOrders{}.CustomerOrders(context.Background(), customerID)
+	for _, o := range list {
+		if err := s.index(context.Background(), o); err != nil {
+			slog.Error("search: erase customer failed", "customer_id", customerID, "order_id", o.ID, "error", err)
+		}
+	}
+}
+
+// searchFacet — значение фасета и число заказов с ним.
+type searchFacet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// searchResult — ответ GET /orders/search.
+type searchResult struct {
+	Total  int                      `json:"total"`
+	Orders []Order                  `json:"orders"`
+	Facets map[string][]searchFacet `json:"facets"`
+}
+
+// searchQuery — запрос GET /orders/search; пустые поля не фильтруют.
+type searchQuery struct {
+	Text    string
+	Filters map[string]string // фасет -> значение
+	Tenant  string            // непустой — только заказы арендатора
+	Limit   int
+	Offset  int
+}
+
+func (s *searchIndex) search(ctx context.Context, q searchQuery) (searchResult, error) {
+	must := []any{}
+	if q.Text != "" {
+		must = append(must, map[string]any{"simple_query_string": map[string]any{
+			"query": q.Text, "fields": searchFields, "default_operator": "and", "lenient": true,
+		}})
+	}
+	filter := []any{}
+	for facet, value := range q.Filters {
+		filter = append(filter, map[string]any{"term": map[string]any{searchFacets[facet]: value}})
+	}
+	if q.Tenant != "" {
+		filter = append(filter, map[string]any{"term": map[string]any{"tenant": q.Tenant}})
+	}
+	aggs := map[string]any{}
+	for facet, field := range searchFacets {
+		aggs[facet] = map[string]any{"terms": map[string]any{"field": field, "size": 20}}
+	}
+	body := map[string]any{
+		"size": q.Limit, "from": q.Offset, "track_total_hits": true,
+		"query": map[string]any{"bool": map[string]any{"must": must, "filter": filter}},
+		"sort":  []any{"_score", map[string]any{"created_at": "desc"}},
+		"aggs":  aggs,
+	}
+	var resp struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Source Order `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+		Aggregations map[string]struct {
+			Buckets []struct {
+				Key      string `json:"key"`
+				DocCount int    `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"aggregations"`
+	}
+	if err := s.do(ctx, http.MethodPost, "/"+url.PathEscape(s.opts.Index)+"/_search", body, &resp); err != nil {
+		return searchResult{}, err
+	}
+	res := searchResult{Total: resp.Hits.Total.Value, Orders: []Order{}, Facets: map[string][]searchFacet{}}
+	for _, h := range resp.Hits.Hits {
+		res.Orders = append(res.Orders, h.Source)
+	}
+	for facet, agg := range resp.Aggregations {
+		values := []searchFacet{}
+		for _, b := range agg.Buckets {
+			values = append(values, searchFacet{Value: b.Key, Count: b.DocCount})
+		}
+		res.Facets[facet] = values
+	}
+	return res, nil
+}
+
+const (
+	searchPageSize    = 20
+	searchPageSizeMax = 100
+)
+
+// searchOrders ищет заказы: ?q — полнотекстовый запрос (синтаксис simple_query_string), ?status, ?customer_id,
+// ?sku, ?currency — фильтры по фасетам, ?limit и ?offset — страница. Без SEARCH_URL — 503.
+func searchOrders(w http.ResponseWriter, r *http.Request) {
+	if search == nil {
+		writeError(w, errSearchDisabled, http.StatusServiceUnavailable)
+		return
+	}
+	q := r.URL.Query()
+	sq := searchQuery{Text: q.Get("q"), Filters: map[string]string{}, Tenant: tenantFrom(r.Context()), Limit: searchPageSize}
+	for facet := range searchFacets {
+		if v := q.Get(facet); v != "" {
+			sq.Filters[facet] = v
+		}
+	}
+	if err := validStatus(OrderStatus(sq.Filters["status"])); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	for name, n := range map[string]*int{"limit": &sq.Limit, "offset": &sq.Offset} {
+		if v := q.Get(name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 || (name == "limit" && (i < 1 || i > searchPageSizeMax)) {
+				httpError(w, fmt.Sprintf("invalid %s %q", name, v), http.StatusBadRequest)
+				return
+			}
+			*n = i
+		}
+	}
+	res, err := search.search(r.Context(), sq)
+	if err != nil {
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	res.Orders = sensitive.orders(r.Context(), res.Orders)
+	writeBody(w, r, http.StatusOK, res)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// --- Crypto-shredding (GDPR) ---
+// Персональные данные покупателя (поле "customer" в Data) шифруются ключом этого покупателя
+// (поле "customer_id"). Удаление ключа делает их нечитаемыми, не трогая неизменяемый журнал:
+// при чтении такие события получают "customer_erased": true вместо "customer".
+
+// customerKeyStore хранит ключи данных покупателей отдельно от журнала, чтобы их можно было удалить.
+type customerKeyStore interface {
+	CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error)
+	// CreateCustomerKey сохраняет key, если ключа ещё нет, и возвращает ключ, который теперь хранится.
+	CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error)
+	DeleteCustomerKey(ctx context.Context, customerID string) error
+}
+
+// openCustomerKeys берёт ключи из хранилища событий, если оно умеет их хранить, иначе — из файла.
+// С включённым шифрованием ключи покупателей хранятся зашифрованными основным ключом.
+func openCustomerKeys(hot EventStore, enc *dataCipher) (customerKeyStore, error) {
+	keys, ok := hot.(customerKeyStore)
+	if !ok {
+		path := getenv("CUSTOMER_KEYS_PATH", "customer-keys.json")
+		slog.Warn("shredding: event store cannot store customer keys", "store", fmt.Sprintf("%T", hot), "path", path)
+		fk, err := newFileKeyStore(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = fk
+	}
+	if enc != nil {
+		keys = sealedKeyStore{keys, enc}
+	}
+	return keys, nil
+}
+
+// shreddingStore шифрует персональные данные событий ключами покупателей.
+type shreddingStore struct {
+	EventStore
+	keys customerKeyStore
+}
+
+func (s shreddingStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	plain := e.Data
+	sealed, err := s.seal(ctx, e.Data)
+	if err != nil {
+		return Event{}, err
+	}
+	e.Data = sealed
+	stored, err := s.EventStore.Append(ctx, e, expected)
+	if err != nil {
+		return Event{}, err
+	}
+	stored.Data = plain
+	return stored, nil
+}
+
+// piiFields разбирает Data с персональными данными; ok = false, если их нет.
+func piiFields(data json.RawMessage) (fields map[string]json.RawMessage, customerID string, ok bool) {
+	if len(data) == 0 || data[0] != '{' {
+		return nil, "", false
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, "", false
+	}
+	pii, has := fields["customer"]
+	if !has || string(pii) == "null" {
+		return nil, "", false
+	}
+	if err := json.Unmarshal(fields["customer_id"], &customerID); err != nil || customerID == "" {
+		return nil, "", false
+	}
+	return fields, customerID, true
+}
+
+func (s shreddingStore) seal(ctx context.Context, data json.RawMessage) (json.RawMessage, error) {
+	fields, customerID, ok := piiFields(data)
+	if !ok {
+		return data, nil
+	}
+	c, err := s.cipher(ctx, customerID, true)
+	if err != nil {
+		return nil, err
+	}
+	if fields["customer"], err = c.seal(fields["customer"], customerID); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// cipher возвращает шифр ключа покупателя; nil — ключ удалён (или ещё не создан при create = false).
+func (s shreddingStore) cipher(ctx context.Context, customerID string, create bool) (*dataCipher, error) {
+	key, ok, err := s.keys.CustomerKey(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("shredding: customer %s: %w", customerID, err)
+	}
+	if !ok && !create {
+		return nil, nil
+	}
+	if !ok {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("shredding: generate key: %w", err)
+		}
+		if key, err = s.keys.CreateCustomerKey(ctx, customerID, key); err != nil {
+			return nil, fmt.Errorf("shredding: customer %s: %w", customerID, err)
+		}
+	}
+	return newDataCipher(key)
+}
+
+// reveal расшифровывает персональные данные события; ciphers кэширует ключи в пределах одного чтения.
+func (s shreddingStore) reveal(ctx context.Context, e Event, ciphers map[string]*dataCipher) (Event, error) {
+	fields, customerID, ok := piiFields(e.Data)
+	if !ok {
+		return e, nil
+	}
+	c, cached := ciphers[customerID]
+	if !cached {
+		var err error
+		if c, err = s.cipher(ctx, customerID, false); err != nil {
+			return Event{}, err
+		}
+		ciphers[customerID] = c
+	}
+	if c == nil {
+		delete(fields, "customer")
+		fields["customer_erased"] = json.RawMessage("true")
+	} else {
+		pii, err := c.open(fields["customer"], customerID)
+		if err != nil {
+			return Event{}, fmt.Errorf("%s@%d: %w", e.StreamID, e.Version, err)
+		}
+		fields["customer"] = pii
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return Event{}, err
+	}
+	e.Data = data
+	return e, nil
+}
+
+func (s shreddingStore) revealAll(ctx context.Context, events []Event, err error) ([]Event, error) {
+	if err != nil {
+		return nil, err
+	}
+	ciphers := map[string]*dataCipher{}
+	for i, e := range events {
+		if events[i], err = s.reveal(ctx, e, ciphers); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (s shreddingStore) Load(ctx context.Context) ([]Event, error) {
+	events, err := s.EventStore.Load(ctx)
+	return s.revealAll(ctx, events, err)
+}
+
+func (s shreddingStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	events, err := s.EventStore.LoadAfter(ctx, after, limit)
+	return s.revealAll(ctx, events, err)
+}
+
+func (s shreddingStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	events, err := s.EventStore.QueryEvents(ctx, q)
+	return s.revealAll(ctx, events, err)
+}
+
+func (s shreddingStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	events, err := s.EventStore.LoadByOrder(ctx, orderID)
+	return s.revealAll(ctx, events, err)
+}
+
+func (s shreddingStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	events, err := s.EventStore.LoadByOrderAfter(ctx, orderID, after)
+	return s.revealAll(ctx, events, err)
+}
+
+func (s shreddingStore) Subscribe(fn func(Event)) func() {
+	return s.EventStore.Subscribe(func(e Event) {
+		plain, err := s.reveal(context.Background(), e, map[string]*dataCipher{})
+		if err != nil {
+			slog.Error("shredding: reveal event", "stream_id", e.StreamID, "version", e.Version, "error", err)
+			return
+		}
+		fn(plain)
+	})
+}
+
+// sealedKeyStore хранит ключи покупателей зашифрованными основным ключом (envelope encryption).
+type sealedKeyStore struct {
+	customerKeyStore
+	enc *dataCipher
+}
+
+func (s sealedKeyStore) CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error) {
+	sealed, ok, err := s.customerKeyStore.CustomerKey(ctx, customerID)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	key, err := s.open(sealed, customerID)
+	return key, err == nil, err
+}
+
+func (s sealedKeyStore) CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error) {
+	sealed, err := s.enc.seal(key, "customer-key:"+customerID)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.customerKeyStore.CreateCustomerKey(ctx, customerID, sealed)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(stored, customerID)
+}
+
+// open расшифровывает ключ; ключи, сохранённые до включения шифрования, возвращаются как есть.
+func (s sealedKeyStore) open(sealed []byte, customerID string) ([]byte, error) {
+	var str string
+	if json.Unmarshal(sealed, &str) != nil {
+		return sealed, nil
+	}
+	return s.enc.open(sealed, "customer-key:"+customerID)
+}
+
+// fileKeyStore — JSON-файл customer_id -> ключ; переписывается целиком через временный файл и rename,
+// так что удалённый ключ не остаётся в старых строках, как было бы в журнале с дозаписью.
+type fileKeyStore struct {
+	mu   sync.Mutex
+	path string
+	keys map[string][]byte
+}
+
+func newFileKeyStore(path string) (*fileKeyStore, error) {
+	s := &fileKeyStore{path: path, keys: map[string][]byte{}}
+	body, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("shredding: read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(body, &s.keys); err != nil {
+		return nil, fmt.Errorf("shredding: decode %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *fileKeyStore) CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[customerID]
+	return key, ok, nil
+}
+
+func (s *fileKeyStore) CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.keys[customerID]; ok {
+		return old, nil
+	}
+	s.keys[customerID] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, customerID)
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *fileKeyStore) DeleteCustomerKey(ctx context.Context, customerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[customerID]
+	if !ok {
+		return nil
+	}
+	delete(s.keys, customerID)
+	if err := s.save(); err != nil {
+		s.keys[customerID] = key
+		return err
+	}
+	return nil
+}
+
+func (s *fileKeyStore) save() error {
+	body, err := json.Marshal(s.keys)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, body); err != nil {
+		return fmt.Errorf("shredding: save keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// --- Graceful shutdown ---
+// По SIGTERM или SIGINT сервис останавливается по порядку: HTTP и gRPC перестают принимать соединения
+// и дожидаются запросов в работе (потоки событий SSE, WebSocket и gRPC закрываются сразу — клиент
+// переподключится к другому инстансу с последней позиции), очередь асинхронных команд выполняется
+// до конца, проекции применяют свои очереди и сохраняют checkpoint, релеи outbox (брокер, webhooks,
+// сага) дочитывают журнал до последнего записанного события, затем закрывается брокер. На всё —
+// SHUTDOWN_TIMEOUT; что не успело, догонится при следующем запуске с сохранённых позиций. Второй сигнал
+// завершает процесс сразу.
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// draining закрывается в начале остановки.
+var (
+	draining     = make(chan struct{})
+	drainingOnce sync.Once
+)
+
+// shutdownParts — то, что останавливается явно; остальное живёт до отмены корневого контекста.
+type shutdownParts struct {
+	HTTP      *http.Server
+	ACME      *http.Server // nil — без autocert
+	GRPC      *grpc.Server // nil — gRPC выключен
+	Publisher publisher    // nil — публикация выключена
+}
+
+// shutdown останавливает сервис за timeout; ошибки шагов пишутся в лог и не прерывают остальные шаги.
+func shutdown(timeout time.Duration, parts shutdownParts) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	drainingOnce.Do(func() { close(draining) })
+	step := func(name string, fn func(context.Context) error) {
+		t := time.Now()
+		if err := fn(ctx); err != nil {
+			slog.Warn("shutdown: "+name, "error", err, "duration", time.Since(t))
+			return
+		}
+		slog.Debug("shutdown: "+name, "duration", time.Since(t))
+	}
+	slog.Info("shutdown: started", "timeout", timeout)
+	step("http", parts.HTTP.Shutdown)
+	if parts.ACME != nil {
+		step("acme", parts.ACME.Shutdown)
+	}
+	if parts.GRPC != nil {
+		step("grpc", func(ctx context.Context) error { return stopGRPC(ctx, parts.GRPC) })
+	}
+	step("async commands", asyncCommands.stop)
+	step("projections", projections.flush)
+	step("outbox relays", relays.stop)
+	if parts.Publisher != nil {
+		step("publisher", func(context.Context) error { return parts.Publisher.Close() })
+	}
+	slog.Info("shutdown: finished", "duration", time.Since(start))
+}
+
+// stopGRPC дожидается вызовов в работе; не успели к отмене ctx — соединения рвутся.
+func stopGRPC(ctx context.Context, srv *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Event signatures ---
+// С EVENT_SIGNING_KEY каждое событие подписывается HMAC-SHA256 перед записью в backend: подпись
+// "v1:<kid>:<base64url>" лежит в Metadata.Signature и покрывает поток, заказ, тип, версию схемы, время
+// (с точностью до миллисекунды — столько хранят все backend), прочие метаданные и Data в том виде, в каком
+// они записаны: зашифрованными ключом хранилища и ключами покупателей. Поэтому подписи переживают стирание
+// покупателя и проверяются без ключей шифрования. Версию и позицию назначает backend, их подпись не
+// покрывает: пропуски и перестановки находит проверка версий потоков в cqrsctl replay.
+//
+// Ключ меняется так же, как ключ шифрования: новый — в EVENT_SIGNING_KEY, прежние — в EVENT_SIGNING_OLD_KEYS,
+// по ним проверяются старые подписи. Проверяют подписи cqrsctl replay (любая цель, кроме -backup:
+// в копии события расшифрованы) и POST /admin/events/verify. События без подписи, записанные до её
+// включения, допустимы; после первого подписанного события неподписанное — нарушение.
+const signaturePrefix = "v1:"
+
+// signatureProblemsMax — сколько нарушений перечисляет ответ проверки; остальные только считаются.
+const signatureProblemsMax = 100
+
+var (
+	errUnsigned         = errors.New("event is not signed")
+	errInvalidSignature = errors.New("event signature does not match")
+	errSigningDisabled  = errors.New("event signing is not configured (EVENT_SIGNING_KEY)")
+)
+
+type eventSigner struct {
+	current string            // kid ключа для новых подписей
+	keys    map[string][]byte // kid -> ключ; старые ключи только для проверки
+}
+
+func newEventSigner(current []byte, old ...[]byte) (*eventSigner, error) {
+	s := &eventSigner{current: keyID(current), keys: map[string][]byte{}}
+	for _, key := range append([][]byte{current}, old...) {
+		if len(key) < 32 {
+			return nil, errors.New("signing: key must be at least 32 bytes")
+		}
+		s.keys[keyID(key)] = key
+	}
+	return s, nil
+}
+
+// signedContent — подписываемая часть события.
+type signedContent struct {
+	StreamID      string          `json:"stream_id"`
+	OrderID       string          `json:"order_id"`
+	Type          EventType       `json:"type"`
+	SchemaVersion int             `json:"schema_version"`
+	Timestamp     int64           `json:"timestamp"` // Unix, мс
+	Metadata      EventMetadata   `json:"metadata"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// mac — HMAC события ключом key. Data приводится к каноническому JSON: JSONB и BSON не сохраняют
+// порядок ключей и пробелы.
+func mac(key []byte, e Event) []byte {
+	c := signedContent{
+		StreamID: e.StreamID, OrderID: e.OrderID, Type: e.Type, SchemaVersion: e.SchemaVersion,
+		Timestamp: e.Timestamp.UnixMilli(), Metadata: e.Metadata, Data: canonicalJSON(e.Data),
+	}
+	c.Metadata.Signature = ""
+	body, _ := json.Marshal(c)
+	h := hmac.New(sha256.New, key)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+func canonicalJSON(data json.RawMessage) json.RawMessage {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return data
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+func (s *eventSigner) sign(e Event) string {
+	return signaturePrefix + s.current + ":" + base64.RawURLEncoding.EncodeToString(mac(s.keys[s.current], e))
+}
+
+// verify проверяет подпись события; без подписи — errUnsigned.
+func (s *eventSigner) verify(e Event) error {
+	if e.Metadata.Signature == "" {
+		return errUnsigned
+	}
+	kid, sig, ok := strings.Cut(strings.TrimPrefix(e.Metadata.Signature, signaturePrefix), ":")
+	if !ok || !strings.HasPrefix(e.Metadata.Signature, signaturePrefix) {
+		return fmt.Errorf("%w: malformed signature", errInvalidSignature)
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return fmt.Errorf("%w: unknown key %s", errInvalidSignature, kid)
+	}
+	want, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(want, mac(key, e)) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// openEventSigner читает ключи из окружения: EVENT_SIGNING_KEY — base64, не короче 32 байт;
+// EVENT_SIGNING_OLD_KEYS — прежние ключи через запятую. Без ключа подпись выключена (nil).
+func openEventSigner() (*eventSigner, error) {
+	v := getenv("EVENT_SIGNING_KEY", "")
+	if v == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("signing: EVENT_SIGNING_KEY: %w", err)
+	}
+	var old [][]byte
+	for _, v := range splitList(getenv("EVENT_SIGNING_OLD_KEYS", "")) {
+		k, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("signing: EVENT_SIGNING_OLD_KEYS: %w", err)
+		}
+		old = append(old, k)
+	}
+	s, err := newEventSigner(key, old...)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("signing: events signed", "key_id", s.current)
+	return s, nil
+}
+
+// signingStore подписывает события при записи; читает без проверки — её делает verify.
+type signingStore struct {
+	EventStore
+	s *eventSigner
+}
+
+// eventSignatures — журнал под подписью, для POST /admin/events/verify; nil — подпись выключена.
+var eventSignatures *signingStore
+
+func (st *signingStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	e.Metadata.Signature = st.s.sign(e)
+	return st.EventStore.Append(ctx, e, expected)
+}
+
+// signatureProblem — событие, не прошедшее проверку.
+type signatureProblem struct {
+	Position int64  `json:"position"`
+	StreamID string `json:"stream_id"`
+	Version  int64  `json:"version"`
+	Error    string `json:"error"`
+}
+
+// signatureReport — итог проверки подписей.
+type signatureReport struct {
+	Checked      int64              `json:"checked"`
+	Valid        int64              `json:"valid"`
+	Unsigned     int64              `json:"unsigned"` // записаны до включения подписи
+	InvalidCount int64              `json:"invalid_count"`
+	Invalid      []signatureProblem `json:"invalid"` // первые signatureProblemsMax
+	LastPosition int64              `json:"last_position"`
+}
+
+// verify проверяет подписи событий с позициями from..to (to = 0 — до конца журнала); fn получает
+// каждое нарушение.
+func (st *signingStore) verify(ctx context.Context, from, to int64, fn func(Event, error)) (signatureReport, error) {
+	rep := signatureReport{Invalid: []signatureProblem{}}
+	signed := false
+	for after := max(from-1, 0); ; {
+		page, err := st.EventStore.LoadAfter(ctx, after, backupPage)
+		if err != nil {
+			return rep, err
+		}
+		for _, e := range page {
+			if to > 0 && e.Position > to {
+				return rep, nil
+			}
+			rep.Checked++
+			rep.LastPosition = e.Position
+			err := st.s.verify(e)
+			switch {
+			case err == nil:
+				rep.Valid++
+				signed = true
+				continue
+			case errors.Is(err, errUnsigned) && !signed:
+				rep.Unsigned++
+				continue
+			case errors.Is(err, errUnsigned):
+				err = errors.New("unsigned event after signed ones")
+			}
+			rep.InvalidCount++
+			if len(rep.Invalid) < signatureProblemsMax {
+				rep.Invalid = append(rep.Invalid, signatureProblem{Position: e.Position, StreamID: e.StreamID, Version: e.Version, Error: err.Error()})
+			}
+			if fn != nil {
+				fn(e, err)
+			}
+		}
+		if len(page) < backupPage {
+			return rep, nil
+		}
+		after = page[len(page)-1].Position
+	}
+}
+
+// --- Signature Handlers ---
+
+// verifyEvents проверяет подписи журнала: ?from=<position>, ?to=<position> — диапазон, включительно.
+// Большой журнал проверяет дольше HTTP_REQUEST_TIMEOUT — для него есть cqrsctl replay validate.
+func verifyEvents(w http.ResponseWriter, r *http.Request) {
+	if eventSignatures == nil {
+		writeError(w, errSigningDisabled, http.StatusServiceUnavailable)
+		return
+	}
+	var from, to int64
+	for name, p := range map[string]*int64{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				httpError(w, fmt.Sprintf("invalid %s %q: expected event position", name, v), http.StatusBadRequest)
+				return
+			}
+			*p = n
+		}
+	}
+	start := time.Now()
+	rep, err := eventSignatures.verify(r.Context(), from, to, nil)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	level := slog.LevelInfo
+	if rep.InvalidCount > 0 {
+		level = slog.LevelError
+	}
+	slog.Log(r.Context(), level, "signing: log verified", "checked", rep.Checked, "invalid", rep.InvalidCount,
+		"unsigned", rep.Unsigned, "duration", time.Since(start))
+	writeBody(w, r, http.StatusOK, rep)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// --- Order state machine ---
+// PENDING -> PAID -> SHIPPED -> DELIVERED; PENDING -> CANCELED (отмена или истечение срока оплаты);
+// PAID -> REFUNDED, когда возвращена вся оплата; оплата и скидка (DiscountApplied) — только в PENDING.
+// Команды над существующим заказом проверяются по текущему состоянию агрегата (orderCommand.Decide):
+// неизвестный заказ — errOrderNotFound (404), недопустимый переход — errInvalidTransition (409).
+
+// orderStatuses — все статусы заказа в порядке жизненного цикла.
+var orderStatuses = []OrderStatus{StatusPending, StatusPaid, StatusShipped, StatusDelivered, StatusCanceled, StatusRefunded}
+
+// transitionsFrom — статусы, из которых допустимо событие.
+var transitionsFrom = map[EventType][]OrderStatus{
+	EventOrderPaymentReceived: {StatusPending},
+	EventOrderCanceled:        {StatusPending},
+	EventOrderExpired:         {StatusPending},
+	EventOrderShipped:         {StatusPaid},
+	EventOrderDelivered:       {StatusShipped},
+	EventOrderRefunded:        {StatusPaid},
+	EventDiscountApplied:      {StatusPending},
+}
+
+var (
+	errInvalidTransition = errors.New("invalid order state transition")
+	errOrderNotFound     = errors.New("order not found")
+)
+
+// checkTransition проверяет, что событие t допустимо в состоянии o; иначе — errInvalidTransition.
+func checkTransition(o Order, t EventType) error {
+	from, ok := transitionsFrom[t]
+	switch {
+	case !ok:
+		return nil
+	case !slices.Contains(from, o.Status):
+		return fmt.Errorf("%w: order is %s, %s requires %s", errInvalidTransition, o.Status, t, joinStatuses(from, " or "))
+	}
+	return nil
+}
+
+func statusStrings(statuses []OrderStatus) []string {
+	s := make([]string, len(statuses))
+	for i, st := range statuses {
+		s[i] = string(st)
+	}
+	return s
+}
+
+func joinStatuses(statuses []OrderStatus, sep string) string {
+	return strings.Join(statusStrings(statuses), sep)
+}
+
+// validStatus проверяет фильтр по статусу; пустой статус допустим.
+func validStatus(status OrderStatus) error {
+	if status == "" || slices.Contains(orderStatuses, status) {
+		return nil
+	}
+	return fmt.Errorf("invalid status %q: expected one of %s", status, joinStatuses(orderStatuses, ", "))
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCheckTransition(t *testing.T) {
+	allowed := map[EventType][]OrderStatus{
+		EventOrderPaymentReceived: {StatusPending},
+		EventOrderCanceled:        {StatusPending},
+		EventOrderExpired:         {StatusPending},
+		EventDiscountApplied:      {StatusPending},
+		EventOrderShipped:         {StatusPaid},
+		EventOrderRefunded:        {StatusPaid},
+		EventOrderDelivered:       {StatusShipped},
+		EventPaymentFailed:        orderStatuses, // вне машины состояний
+	}
+	for typ, from := range allowed {
+		for _, st := range orderStatuses {
+			err := checkTransition(Order{Status: st}, typ)
+			if want := slices.Contains(from, st); (err == nil) != want {
+				t.Errorf("%s from %s: err = %v, want allowed %v", typ, st, err, want)
+			}
+			if err != nil && !errors.Is(err, errInvalidTransition) {
+				t.Errorf("%s from %s: err = %v, want errInvalidTransition", typ, st, err)
+			}
+		}
+	}
+}
+
+// orderEvent — событие заказа o1 с данными data.
+func orderEvent(typ EventType, data any) Event {
+	raw, _ := json.Marshal(data)
+	return Event{Type: typ, OrderID: "o1", Data: raw}
+}
+
+var lifecycleItems = []OrderItem{{SKU: "s1", Quantity: 2, UnitPrice: 1500}, {SKU: "s2", Quantity: 1, UnitPrice: 999}}
+
+func TestOrderLifecycle(t *testing.T) {
+	created := orderEvent(EventOrderCreated, orderCreatedData{CustomerID: "c1", Items: lifecycleItems, Currency: "USD"})
+	pay := func(amount int64) Event {
+		return orderEvent(EventOrderPaymentReceived, orderPaidData{Amount: amount, Currency: "USD"})
+	}
+	refund := func(amount int64) Event {
+		return orderEvent(EventOrderRefunded, orderRefundedData{Amount: amount, Currency: "USD"})
+	}
+	shipped := orderEvent(EventOrderShipped, Shipment{Carrier: "dhl", TrackingNumber: "t1"})
+
+	type want struct {
+		status                         OrderStatus
+		total, paid, refunded, balance int64
+	}
+	cases := []struct {
+		name   string
+		events []Event
+		want   want
+	}{
+		{"created", []Event{created}, want{StatusPending, 3999, 0, 0, 3999}},
+		{"partial payment", []Event{created, pay(1000)}, want{StatusPending, 3999, 1000, 0, 2999}},
+		{"payments cover total", []Event{created, pay(1000), pay(2999)}, want{StatusPaid, 3999, 3999, 0, 0}},
+		{"discount lowers total", []Event{created, orderEvent(EventDiscountApplied, discountAppliedData{Code: "SAVE", Amount: 399})}, want{StatusPending, 3600, 0, 0, 3600}},
+		{"discounted order paid", []Event{created, orderEvent(EventDiscountApplied, discountAppliedData{Code: "SAVE", Amount: 399}), pay(3600)}, want{StatusPaid, 3600, 3600, 0, 0}},
+		{"partial refund keeps paid", []Event{created, pay(3999), refund(1000)}, want{StatusPaid, 3999, 3999, 1000, 0}},
+		{"refunds cover payment", []Event{created, pay(3999), refund(1000), refund(2999)}, want{StatusRefunded, 3999, 3999, 3999, 0}},
+		{"shipped and delivered", []Event{created, pay(3999), shipped, orderEvent(EventOrderDelivered, struct{}{})}, want{StatusDelivered, 3999, 3999, 0, 0}},
+		{"canceled", []Event{created, orderEvent(EventOrderCanceled, orderCanceledData{})}, want{StatusCanceled, 3999, 0, 0, 0}},
+		{"expired", []Event{created, pay(500), orderEvent(EventOrderExpired, struct{}{})}, want{StatusCanceled, 3999, 500, 0, 0}},
+		{"legacy paid event", []Event{created, orderEvent(EventOrderPaid, struct{}{})}, want{StatusPaid, 3999, 0, 0, 0}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var o Order
+			for i, e := range c.events {
+				e.Version = int64(i + 1)
+				o.apply(e)
+			}
+			got := want{o.Status, o.Total, o.AmountPaid, o.AmountRefunded, o.Outstanding}
+			if got != c.want {
+				t.Errorf("order = %+v, want %+v", got, c.want)
+			}
+			if o.Version != int64(len(c.events)) {
+				t.Errorf("version = %d, want %d", o.Version, len(c.events))
+			}
+		})
+	}
+}
+
+func amount(n int64) *int64 { return &n }
+
+func TestPaidData(t *testing.T) {
+	pending := Order{Status: StatusPending, Total: 3999, AmountPaid: 1000, Outstanding: 2999, Currency: "USD"}
+	cases := []struct {
+		name    string
+		order   Order
+		req     paymentRequest
+		want    orderPaidData
+		wantErr error
+	}{
+		{"whole balance", pending, paymentRequest{}, orderPaidData{Amount: 2999, Currency: "USD"}, nil},
+		{"partial amount", pending, paymentRequest{Amount: amount(500)}, orderPaidData{Amount: 500, Currency: "USD"}, nil},
+		{"exact balance, lowercase currency", pending, paymentRequest{Amount: amount(2999), Currency: "usd"}, orderPaidData{Amount: 2999, Currency: "USD"}, nil},
+		{"more than balance", pending, paymentRequest{Amount: amount(3000)}, orderPaidData{}, errPaymentMismatch},
+		{"other currency", pending, paymentRequest{Currency: "EUR"}, orderPaidData{}, errPaymentMismatch},
+		{"order without currency", Order{Status: StatusPending, Outstanding: 100}, paymentRequest{Currency: "eur"}, orderPaidData{Amount: 100, Currency: "EUR"}, nil},
+		{"paid order", Order{Status: StatusPaid}, paymentRequest{}, orderPaidData{}, errInvalidTransition},
+		{"canceled order", Order{Status: StatusCanceled, Total: 3999}, paymentRequest{}, orderPaidData{}, errInvalidTransition},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw, err := paidData(c.req)(c.order)
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got orderPaidData
+			if err := json.Unmarshal(raw, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("data = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPaymentRequestValidate(t *testing.T) {
+	for _, req := range []paymentRequest{{Amount: amount(-1)}, {Currency: "US"}, {Currency: "U$D"}} {
+		if err := req.validate(); err == nil {
+			t.Errorf("validate(%+v) = nil, want error", req)
+		}
+	}
+	if err := (paymentRequest{Amount: amount(0), Currency: "jpy"}).validate(); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+}
+
+func TestRefundData(t *testing.T) {
+	paid := Order{Status: StatusPaid, Total: 3999, AmountPaid: 3999, AmountRefunded: 1000, Currency: "USD"}
+	cases := []struct {
+		name    string
+		order   Order
+		req     refundRequest
+		want    int64
+		wantErr error
+	}{
+		{"rest of payment", paid, refundRequest{}, 2999, nil},
+		{"partial amount", paid, refundRequest{Amount: amount(999), Currency: "usd"}, 999, nil},
+		{"exact refundable", paid, refundRequest{Amount: amount(2999)}, 2999, nil},
+		{"more than refundable", paid, refundRequest{Amount: amount(3000)}, 0, errRefundRejected},
+		{"zero amount", paid, refundRequest{Amount: amount(0)}, 0, errRefundRejected},
+		{"negative amount", paid, refundRequest{Amount: amount(-5)}, 0, errRefundRejected},
+		{"other currency", paid, refundRequest{Currency: "EUR"}, 0, errRefundRejected},
+		{"invalid currency", paid, refundRequest{Currency: "E"}, 0, errRefundRejected},
+		{"pending order", Order{Status: StatusPending, AmountPaid: 500}, refundRequest{}, 0, errInvalidTransition},
+		{"refunded order", Order{Status: StatusRefunded, AmountPaid: 100, AmountRefunded: 100}, refundRequest{}, 0, errInvalidTransition},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw, err := refundData(c.req)(c.order)
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got orderRefundedData
+			if err := json.Unmarshal(raw, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Amount != c.want || got.Currency != "USD" {
+				t.Errorf("data = %+v, want %d USD", got, c.want)
+			}
+		})
+	}
+}
+
+func TestItemsTotal(t *testing.T) {
+	cases := []struct {
+		name   string
+		items  []OrderItem
+		want   int64
+		wantOK bool
+	}{
+		{"empty", nil, 0, true},
+		{"lines", lifecycleItems, 3999, true},
+		{"free item", []OrderItem{{SKU: "s", Quantity: 3, UnitPrice: 0}}, 0, true},
+		{"line overflows", []OrderItem{{SKU: "s", Quantity: 2, UnitPrice: 1 << 62}}, 0, false},
+		{"sum overflows", []OrderItem{{SKU: "a", Quantity: 1, UnitPrice: 1 << 62}, {SKU: "b", Quantity: 1, UnitPrice: 1 << 62}}, 0, false},
+	}
+	for _, c := range cases {
+		if got, ok := itemsTotal(c.items); got != c.want || ok != c.wantOK {
+			t.Errorf("%s: itemsTotal = %d, %v; want %d, %v", c.name, got, ok, c.want, c.wantOK)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	cases := []struct {
+		amount   int64
+		currency string
+		want     string
+	}{
+		{259900, "RUB", "2599.00 RUB"},
+		{5, "USD", "0.05 USD"},
+		{-150, "EUR", "-1.50 EUR"},
+		{1500, "JPY", "1500 JPY"},
+		{1234, "KWD", "1.234 KWD"},
+		{7, "", "0.07"},
+	}
+	for _, c := range cases {
+		if got := formatMoney(c.amount, c.currency); got != c.want {
+			t.Errorf("formatMoney(%d, %q) = %q, want %q", c.amount, c.currency, got, c.want)
+		}
+	}
+}
+
+func TestCouponDiscount(t *testing.T) {
+	cases := []struct {
+		coupon coupon
+		total  int64
+		want   int64
+	}{
+		{coupon{Percent: 10}, 3999, 399},
+		{coupon{Percent: 15}, 199, 29},
+		{coupon{Percent: 100}, 3999, 3999},
+		{coupon{Amount: 500}, 3999, 500},
+		{coupon{Amount: 5000}, 3999, 3999}, // не больше суммы
+		{coupon{Percent: 50}, 1 << 62, 1 << 61},
+	}
+	for _, c := range cases {
+		if got := c.coupon.discount(c.total); got != c.want {
+			t.Errorf("%+v.discount(%d) = %d, want %d", c.coupon, c.total, got, c.want)
+		}
+	}
+}
+
+func TestParseCoupons(t *testing.T) {
+	got, err := parseCoupons("save10=10%, WELCOME=500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["SAVE10"] != (coupon{Code: "SAVE10", Percent: 10}) || got["WELCOME"] != (coupon{Code: "WELCOME", Amount: 500}) {
+		t.Errorf("parseCoupons = %+v", got)
+	}
+	for _, spec := range []string{"SAVE", "=10%", "SAVE=0", "SAVE=-5", "SAVE=101%", "SAVE=ten"} {
+		if _, err := parseCoupons(spec); err == nil {
+			t.Errorf("parseCoupons(%q) = nil error", spec)
+		}
+	}
+}
+
+func TestDiscountData(t *testing.T) {
+	prev := coupons
+	t.Cleanup(func() { coupons = prev })
+	coupons = map[string]coupon{"SAVE10": {Code: "SAVE10", Percent: 10}}
+	pending := Order{Status: StatusPending, Total: 3999}
+	cases := []struct {
+		name    string
+		order   Order
+		code    string
+		want    discountAppliedData
+		wantErr error
+	}{
+		{"applied", pending, "save10", discountAppliedData{Code: "SAVE10", Amount: 399}, nil},
+		{"unknown coupon", pending, "FREE", discountAppliedData{}, errCouponRejected},
+		{"second coupon", Order{Status: StatusPending, Total: 3600, Coupon: "SAVE10"}, "SAVE10", discountAppliedData{}, errCouponRejected},
+		{"after partial payment", Order{Status: StatusPending, Total: 3999, AmountPaid: 1}, "SAVE10", discountAppliedData{}, errCouponRejected},
+		{"paid order", Order{Status: StatusPaid, Total: 3999}, "SAVE10", discountAppliedData{}, errInvalidTransition},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw, err := discountData(c.code)(c.order)
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got discountAppliedData
+			if err := json.Unmarshal(raw, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("data = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestExpireUnpaidOrders(t *testing.T) {
+	h := openTenantService(t)
+	stale := createTenantOrder(t, h, "expiry", nil)
+	paid := createTenantOrder(t, h, "expiry", nil)
+	if code := tenantCall(t, h, "expiry", http.MethodPost, "/orders/"+paid+"/pay", map[string]any{}, nil, nil); code != http.StatusOK {
+		t.Fatalf("pay: status %d", code)
+	}
+	time.Sleep(200 * time.Millisecond)
+	fresh := createTenantOrder(t, h, "expiry", nil)
+
+	// срок истёк посередине между созданием stale и fresh
+	mutex.Lock()
+	cutoff := orders[stale].CreatedAt.Add(orders[fresh].CreatedAt.Sub(orders[stale].CreatedAt) / 2)
+	mutex.Unlock()
+	x := &expirer{opts: expiryOptions{TTL: time.Since(cutoff), Batch: 1000}}
+	if _, err := x.expireOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]OrderStatus{stale: StatusCanceled, paid: StatusPaid, fresh: StatusPending}
+	for id, st := range want {
+		err := awaitReadModel(context.Background(), func(*projectionRunner) (bool, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return orders[id].Status == st, nil
+		})
+		if err != nil {
+			mutex.Lock()
+			got := orders[id].Status
+			mutex.Unlock()
+			t.Errorf("order %s: status %s, want %s", id, got, st)
+		}
+	}
+}
+
+func TestOrderCommandRules(t *testing.T) {
+	h := openTenantService(t)
+	canceled := createTenantOrder(t, h, "rules", nil)
+	paid := createTenantOrder(t, h, "rules", nil)
+	steps := []struct {
+		name, orderID, action string
+		body                  map[string]any
+		want                  int
+	}{
+		{"pay unknown order", tenantOrderID("rules", "missing"), "pay", nil, http.StatusNotFound},
+		{"cancel unknown order", tenantOrderID("rules", "missing"), "cancel", nil, http.StatusNotFound},
+		{"cancel", canceled, "cancel", nil, http.StatusOK},
+		{"pay after cancel", canceled, "pay", nil, http.StatusConflict},
+		{"ship unpaid order", paid, "ship", map[string]any{"carrier": "dhl", "tracking_number": "t1"}, http.StatusConflict},
+		{"overpay", paid, "pay", map[string]any{"amount": 1001}, http.StatusUnprocessableEntity},
+		{"partial payment", paid, "pay", map[string]any{"amount": 400}, http.StatusOK},
+		{"refund pending order", paid, "refund", nil, http.StatusConflict},
+		{"pay the rest", paid, "pay", nil, http.StatusOK},
+		{"cancel after pay", paid, "cancel", nil, http.StatusConflict},
+		{"apply coupon after pay", paid, "apply-coupon", map[string]any{"code": "SAVE10"}, http.StatusConflict},
+		{"deliver before ship", paid, "deliver", nil, http.StatusConflict},
+		{"ship", paid, "ship", map[string]any{"carrier": "dhl", "tracking_number": "t1"}, http.StatusOK},
+		{"deliver", paid, "deliver", nil, http.StatusOK},
+	}
+	for _, s := range steps {
+		body := s.body
+		if body == nil {
+			body = map[string]any{}
+		}
+		if code := tenantCall(t, h, "rules", http.MethodPost, "/orders/"+s.orderID+"/"+s.action, body, nil, nil); code != s.want {
+			t.Errorf("%s: status %d, want %d", s.name, code, s.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Statistics projection ---
+// Проекция "stats" считает по журналу заказов сводку для GET /stats: заказы по статусам, созданные по дням (UTC),
+// долю оплаченных и среднее время от создания до оплаты. Оплаченным считается заказ, хоть раз перешедший
+// в PAID, — в том числе потом отправленный или возвращённый; время оплаты — Timestamp события этого перехода.
+// Статус считается тем же Order.apply, что и в read model; проекция хранит по заказу только то, что нужно
+// для статуса. Заказы, удалённые при компакции журнала, из сводки вычитаются — как при перестройке.
+
+type orderStatsEntry struct {
+	order  Order
+	paidAt time.Time // первый переход в PAID; нулевое — не оплачен
+}
+
+type orderStatistics struct {
+	mu       sync.Mutex
+	orders   map[string]*orderStatsEntry
+	byStatus map[OrderStatus]int
+	perDay   map[string]int // дата создания (UTC) -> заказов
+	paid     int
+	payTime  time.Duration // суммарное время до оплаты у paid заказов
+}
+
+var stats = newOrderStatistics()
+
+func newOrderStatistics() *orderStatistics {
+	return &orderStatistics{orders: map[string]*orderStatsEntry{}, byStatus: map[OrderStatus]int{}, perDay: map[string]int{}}
+}
+
+func (s *orderStatistics) apply(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	en, ok := s.orders[e.OrderID]
+	if !ok && e.Type != EventOrderCreated {
+		return
+	}
+	if ok && e.Version <= en.order.Version {
+		return
+	}
+	if !ok {
+		en = &orderStatsEntry{}
+		s.orders[e.OrderID] = en
+	} else {
+		decrement(s.byStatus, en.order.Status)
+	}
+	en.order.apply(e)
+	en.order.Customer, en.order.Items, en.order.Shipment = nil, nil, nil // для статуса не нужны
+	s.byStatus[en.order.Status]++
+	if !ok {
+		s.perDay[en.order.CreatedAt.UTC().Format(time.DateOnly)]++
+	}
+	if en.paidAt.IsZero() && en.order.Status == StatusPaid {
+		en.paidAt = e.Timestamp
+		s.paid++
+		s.payTime += en.paidAt.Sub(en.order.CreatedAt)
+	}
+}
+
+func (s *orderStatistics) reset() {
+	fresh := newOrderStatistics()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders, s.byStatus, s.perDay, s.paid, s.payTime = fresh.orders, fresh.byStatus, fresh.perDay, 0, 0
+}
+
+// forget вычитает заказы, удалённые при компакции журнала.
+func (s *orderStatistics) forget(ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		en, ok := s.orders[id]
+		if !ok {
+			continue
+		}
+		delete(s.orders, id)
+		decrement(s.byStatus, en.order.Status)
+		decrement(s.perDay, en.order.CreatedAt.UTC().Format(time.DateOnly))
+		if !en.paidAt.IsZero() {
+			s.paid--
+			s.payTime -= en.paidAt.Sub(en.order.CreatedAt)
+		}
+	}
+}
+
+// decrement уменьшает счётчик и убирает его, когда он дошёл до нуля.
+func decrement[K comparable](m map[K]int, k K) {
+	if m[k]--; m[k] <= 0 {
+		delete(m, k)
+	}
+}
+
+// dayCount — заказы, созданные за день.
+type dayCount struct {
+	Date   string `json:"date"` // YYYY-MM-DD, UTC
+	Orders int    `json:"orders"`
+}
+
+// orderStats — ответ GET /stats.
+type orderStats struct {
+	Orders              int                 `json:"orders"`
+	ByStatus            map[OrderStatus]int `json:"by_status"`
+	OrdersPerDay        []dayCount          `json:"orders_per_day"` // по возрастанию даты
+	Paid                int                 `json:"paid"`           // заказов, хоть раз перешедших в PAID
+	ConversionRate      float64             `json:"payment_conversion_rate"`
+	AvgTimeToPaySeconds float64             `json:"avg_time_to_pay_seconds"`
+}
+
+func (s *orderStatistics) snapshot() orderStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := orderStats{Orders: len(s.orders), ByStatus: map[OrderStatus]int{}, OrdersPerDay: []dayCount{}, Paid: s.paid}
+	for st, n := range s.byStatus {
+		out.ByStatus[st] = n
+	}
+	for day, n := range s.perDay {
+		out.OrdersPerDay = append(out.OrdersPerDay, dayCount{Date: day, Orders: n})
+	}
+	sort.Slice(out.OrdersPerDay, func(i, j int) bool { return out.OrdersPerDay[i].Date < out.OrdersPerDay[j].Date })
+	if out.Orders > 0 {
+		out.ConversionRate = float64(s.paid) / float64(out.Orders)
+	}
+	if s.paid > 0 {
+		out.AvgTimeToPaySeconds = (s.payTime / time.Duration(s.paid)).Seconds()
+	}
+	return out
+}
+
+// getStats отдаёт сводку проекции "stats".
+func getStats(w http.ResponseWriter, r *http.Request) {
+	writeBody(w, r, http.StatusOK, stats.snapshot())
+}
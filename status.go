@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// --- Admin status ---
+// GET /admin/status — сводка для разбора задержек согласованности: последняя позиция журнала (прочитанная
+// из хранилища, а не только полученная проекциями), размер хранилища и по каждой проекции позиция,
+// сохранённый checkpoint и отставание в событиях и секундах.
+
+// storeBackend — backend журнала под всеми обёртками; из него берётся размер хранилища.
+var storeBackend EventStore
+
+// storeSizer — backend, который знает, сколько места занимает журнал.
+type storeSizer interface {
+	SizeBytes(ctx context.Context) (int64, error)
+}
+
+type adminStoreStatus struct {
+	Backend      string `json:"backend"`
+	LastPosition int64  `json:"last_position"`        // позиция последнего записанного события
+	SeenPosition int64  `json:"seen_position"`        // последняя позиция, полученная проекциями
+	OrderEvents  int64  `json:"order_events"`         // событий заказов по read model
+	Orders       int    `json:"orders"`               // заказов в read model
+	SizeBytes    *int64 `json:"size_bytes,omitempty"` // только у backend с storeSizer
+}
+
+type adminStatus struct {
+	Store       adminStoreStatus   `json:"store"`
+	Projections []projectionStatus `json:"projections"`
+	MaxLag      int64              `json:"max_lag"` // наибольшее отставание проекции, в событиях
+}
+
+// lastPosition дочитывает журнал es от позиции, известной проекциям, до конца.
+func lastPosition(ctx context.Context, es EventStore) (int64, error) {
+	position := projections.head.Load()
+	tail, err := es.LoadAfter(ctx, position, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(tail) > 0 {
+		position = tail[len(tail)-1].Position
+	}
+	return position, nil
+}
+
+func getAdminStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	st := adminStatus{Store: adminStoreStatus{Backend: getenv("EVENT_STORE", "memory"), SeenPosition: projections.head.Load()}}
+	var err error
+	if st.Store.LastPosition, err = lastPosition(ctx, store); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if sz, ok := storeBackend.(storeSizer); ok {
+		n, err := sz.SizeBytes(ctx)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		st.Store.SizeBytes = &n
+	}
+	mutex.Lock()
+	st.Store.OrderEvents, st.Store.Orders = orderEvents, len(orders)
+	mutex.Unlock()
+	st.Projections = projections.statuses()
+	for i, p := range st.Projections {
+		// отставание считается от последней записанной позиции: подписка могла ещё не доставить хвост
+		p.Lag = max(st.Store.LastPosition-p.Position, 0)
+		st.Projections[i] = p
+		st.MaxLag = max(st.MaxLag, p.Lag)
+	}
+	writeBody(w, r, http.StatusOK, st)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// --- bbolt store ---
+// events: seq (big-endian uint64) -> JSON события; seq — глобальная позиция события
+// orders: order_id -> вложенный bucket с ключами seq (вторичный индекс)
+// streams: stream_id -> текущая версия потока (big-endian uint64)
+// snapshots: stream_id -> JSON последнего снимка
+// customer_keys: customer_id -> ключ данных покупателя
+// checkpoints: имя обработчика -> позиция (big-endian uint64)
+var (
+	boltEventsBucket       = []byte("events")
+	boltOrdersBucket       = []byte("orders")
+	boltStreamsBucket      = []byte("streams")
+	boltSnapshotsBucket    = []byte("snapshots")
+	boltCustomerKeysBucket = []byte("customer_keys")
+	boltCheckpointsBucket  = []byte("checkpoints")
+)
+
+type boltStore struct {
+	mu   sync.Mutex // порядок уведомлений совпадает с порядком seq
+	db   *bolt.DB
+	subs subscribers
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltEventsBucket, boltOrdersBucket, boltStreamsBucket, boltSnapshotsBucket, boltCustomerKeysBucket, boltCheckpointsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("bolt: init buckets: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func boltKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+func (s *boltStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		events := tx.Bucket(boltEventsBucket)
+		seq, err := events.NextSequence()
+		if err != nil {
+			return err
+		}
+		idx, err := tx.Bucket(boltOrdersBucket).CreateBucketIfNotExists([]byte(e.OrderID))
+		if err != nil {
+			return err
+		}
+		streams := tx.Bucket(boltStreamsBucket)
+		var current int64
+		if v := streams.Get([]byte(e.StreamID)); v != nil {
+			current = int64(binary.BigEndian.Uint64(v))
+		} else {
+			// поток, записанный до появления версий: версия равна числу его событий
+			current = int64(idx.Stats().KeyN)
+		}
+		if err := checkVersion(e.StreamID, expected, current); err != nil {
+			return err
+		}
+		e.Version = current + 1
+		e.Position = int64(seq)
+		if err := streams.Put([]byte(e.StreamID), boltKey(uint64(e.Version))); err != nil {
+			return err
+		}
+
+		val, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		key := boltKey(seq)
+		if err := events.Put(key, val); err != nil {
+			return err
+		}
+		return idx.Put(key, nil)
+	})
+	var conflict *versionConflictError
+	if errors.As(err, &conflict) {
+		return Event{}, err
+	}
+	if err != nil {
+		return Event{}, fmt.Errorf("bolt: append: %w", err)
+	}
+	s.subs.publish(e)
+	return e, nil
+}
+
+// boltEvent декодирует запись; позиция берётся из ключа, так что её получают
+// и события, записанные до появления позиций.
+func boltEvent(k, v []byte) (Event, error) {
+	var e Event
+	if err := json.Unmarshal(v, &e); err != nil {
+		return Event{}, err
+	}
+	e.Position = int64(binary.BigEndian.Uint64(k))
+	return e, nil
+}
+
+func (s *boltStore) Load(ctx context.Context) ([]Event, error) {
+	return s.LoadAfter(ctx, 0, 0)
+}
+
+func (s *boltStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	return s.QueryEvents(ctx, eventQuery{After: after, Limit: limit})
+}
+
+// QueryEvents с OrderID идёт по индексу заказа, иначе по журналу с позиции After;
+// индексов по типу и времени в bolt нет, эти условия проверяются на каждом событии.
+func (s *boltStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	var out []Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		events := tx.Bucket(boltEventsBucket)
+		keys := events
+		if q.OrderID != "" {
+			if keys = tx.Bucket(boltOrdersBucket).Bucket([]byte(q.OrderID)); keys == nil {
+				return nil
+			}
+		}
+		c := keys.Cursor()
+		for k, _ := c.Seek(boltKey(uint64(q.After) + 1)); k != nil && (q.Limit <= 0 || len(out) < q.Limit); k, _ = c.Next() {
+			e, err := boltEvent(k, events.Get(k))
+			if err != nil {
+				return err
+			}
+			if q.matches(e) {
+				out = append(out, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: load: %w", err)
+	}
+	return out, nil
+}
+
+func (s *boltStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.LoadByOrderAfter(ctx, orderID, 0)
+}
+
+func (s *boltStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	var out []Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		idx := tx.Bucket(boltOrdersBucket).Bucket([]byte(orderID))
+		if idx == nil {
+			return nil
+		}
+		events := tx.Bucket(boltEventsBucket)
+		return idx.ForEach(func(k, _ []byte) error {
+			e, err := boltEvent(k, events.Get(k))
+			if err != nil {
+				return err
+			}
+			if e.Version > after {
+				out = append(out, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: load order %s: %w", orderID, err)
+	}
+	return out, nil
+}
+
+func (s *boltStore) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	val, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("bolt: encode snapshot: %w", err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSnapshotsBucket)
+		if v := b.Get([]byte(snap.StreamID)); v != nil {
+			var old Snapshot
+			if err := json.Unmarshal(v, &old); err == nil && old.Version >= snap.Version {
+				return nil
+			}
+		}
+		return b.Put([]byte(snap.StreamID), val)
+	})
+	if err != nil {
+		return fmt.Errorf("bolt: save snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStore) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	var (
+		snap Snapshot
+		ok   bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltSnapshotsBucket).Get([]byte(streamID))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &snap)
+	})
+	if err != nil {
+		return Snapshot{}, false, fmt.Errorf("bolt: load snapshot: %w", err)
+	}
+	return snap, ok, nil
+}
+
+func (s *boltStore) CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error) {
+	var key []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltCustomerKeysBucket).Get([]byte(customerID)); v != nil {
+			key = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("bolt: load customer key: %w", err)
+	}
+	return key, key != nil, nil
+}
+
+func (s *boltStore) CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCustomerKeysBucket)
+		if v := b.Get([]byte(customerID)); v != nil {
+			key = append([]byte(nil), v...)
+			return nil
+		}
+		return b.Put([]byte(customerID), key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: save customer key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *boltStore) DeleteCustomerKey(ctx context.Context, customerID string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCustomerKeysBucket).Delete([]byte(customerID))
+	})
+	if err != nil {
+		return fmt.Errorf("bolt: delete customer key: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStore) LoadCheckpoint(ctx context.Context, name string) (int64, bool, error) {
+	var position int64
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltCheckpointsBucket).Get([]byte(name)); v != nil {
+			position, ok = int64(binary.BigEndian.Uint64(v)), true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("bolt: load checkpoint: %w", err)
+	}
+	return position, ok, nil
+}
+
+func (s *boltStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCheckpointsBucket).Put([]byte(name), boltKey(uint64(position)))
+	})
+	if err != nil {
+		return fmt.Errorf("bolt: save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStore) Subscribe(fn func(Event)) func() {
+	return s.subs.subscribe(fn)
+}
+
+func (s *boltStore) TrimPrefix(ctx context.Context, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		orders := tx.Bucket(boltOrdersBucket)
+		c := tx.Bucket(boltEventsBucket).Cursor()
+		for k, v := c.First(); k != nil && n > 0; k, v = c.First() {
+			var e Event
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if idx := orders.Bucket([]byte(e.OrderID)); idx != nil {
+				if err := idx.Delete(k); err != nil {
+					return err
+				}
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("bolt: trim: %w", err)
+	}
+	return nil
+}
+
+// DeleteStreams удаляет события заказов по вторичному индексу, сам индекс, версии потоков и снимки.
+func (s *boltStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		events := tx.Bucket(boltEventsBucket)
+		orders := tx.Bucket(boltOrdersBucket)
+		for _, id := range orderIDs {
+			if idx := orders.Bucket([]byte(id)); idx != nil {
+				var keys [][]byte
+				if err := idx.ForEach(func(k, _ []byte) error {
+					keys = append(keys, append([]byte(nil), k...))
+					return nil
+				}); err != nil {
+					return err
+				}
+				for _, k := range keys {
+					if err := events.Delete(k); err != nil {
+						return err
+					}
+				}
+				if err := orders.DeleteBucket([]byte(id)); err != nil {
+					return err
+				}
+			}
+			stream := []byte(orderStream(id))
+			if err := tx.Bucket(boltStreamsBucket).Delete(stream); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltSnapshotsBucket).Delete(stream); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("bolt: delete streams: %w", err)
+	}
+	return nil
+}
+
+// SizeBytes — размер файла базы.
+func (s *boltStore) SizeBytes(context.Context) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Size()
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
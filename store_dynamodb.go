@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// --- DynamoDB store ---
+// PK order_id, SK version (версия потока агрегата). Уникальность (order_id, version)
+// обеспечивается условной записью, глобальный порядок — атомарным счётчиком seq в служебном элементе;
+// seq же служит позицией события. Служебные элементы (счётчик, снимки, ключи покупателей, позиции обработчиков)
+// имеют order_id с префиксом "$".
+// Глобальный индекс "position" (PK log — у всех событий "events", SK seq) отдаёт журнал с позиции запросом Query;
+// служебные элементы в него не попадают. Индекс читается eventually consistent, а с одним разделом
+// ограничивает запись событий пропускной способностью раздела индекса.
+const (
+	dynamoSystemPrefix      = "$"
+	dynamoCounterKey        = dynamoSystemPrefix + "seq"
+	dynamoSnapshotPrefix    = dynamoSystemPrefix + "snapshot:"
+	dynamoCustomerKeyPrefix = dynamoSystemPrefix + "customer-key:"
+	dynamoCheckpointPrefix  = dynamoSystemPrefix + "checkpoint:"
+	dynamoMaxAttempts       = 5
+	dynamoPositionIndex     = "position"
+	dynamoLog               = "events" // значение log у событий
+)
+
+type dynamoStore struct {
+	mu    sync.Mutex // порядок локальных уведомлений совпадает с порядком seq
+	db    *dynamodb.Client
+	table string
+	subs  subscribers
+
+	indexed bool // индекс position готов; до этого журнал читается Scan
+}
+
+type dynamoItem struct {
+	OrderID   string `dynamodbav:"order_id"`
+	Version   int64  `dynamodbav:"version"`
+	Seq       int64  `dynamodbav:"seq"`
+	Log       string `dynamodbav:"log,omitempty"` // ключ раздела индекса position
+	StreamID  string `dynamodbav:"stream_id"`
+	Type      string `dynamodbav:"type"`
+	Schema    int    `dynamodbav:"schema_version,omitempty"`
+	Timestamp string `dynamodbav:"timestamp"`
+	Metadata  string `dynamodbav:"metadata,omitempty"` // JSON EventMetadata
+	Data      string `dynamodbav:"data"`
+}
+
+type dynamoOptions struct {
+	Table       string
+	Region      string
+	Endpoint    string // для DynamoDB Local / LocalStack
+	CreateTable bool
+}
+
+func newDynamoStore(ctx context.Context, opts dynamoOptions) (*dynamoStore, error) {
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(opts.Region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb: load aws config: %w", err)
+	}
+	db := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+	})
+	s := &dynamoStore{db: db, table: opts.Table}
+	if err := s.ensureTable(ctx, opts.CreateTable); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *dynamoStore) ensureTable(ctx context.Context, create bool) error {
+	desc, err := s.db.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(s.table)})
+	var notFound *types.ResourceNotFoundException
+	switch {
+	case err == nil:
+		return s.ensureIndex(ctx, desc.Table, create)
+	case !errors.As(err, &notFound) || !create:
+		return fmt.Errorf("dynamodb: describe table %s: %w", s.table, err)
+	}
+	_, err = s.db.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String(s.table),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("order_id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("version"), AttributeType: types.ScalarAttributeTypeN},
+			{AttributeName: aws.String("log"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("seq"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("order_id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("version"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{dynamoPositionGSI()},
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb: create table %s: %w", s.table, err)
+	}
+	w := dynamodb.NewTableExistsWaiter(s.db)
+	if err := w.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(s.table)}, 2*time.Minute); err != nil {
+		return fmt.Errorf("dynamodb: wait for table %s: %w", s.table, err)
+	}
+	s.indexed = true
+	return nil
+}
+
+func dynamoPositionGSI() types.GlobalSecondaryIndex {
+	return types.GlobalSecondaryIndex{
+		IndexName: aws.String(dynamoPositionIndex),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("log"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("seq"), KeyType: types.KeyTypeRange},
+		},
+		Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+	}
+}
+
+// ensureIndex проверяет индекс position у существующей таблицы. Если его нет, а create включён,
+// индекс создаётся, а событиям без log (записанным до индекса) он проставляется; пока DynamoDB
+// строит индекс, журнал читается Scan — до перезапуска.
+func (s *dynamoStore) ensureIndex(ctx context.Context, table *types.TableDescription, create bool) error {
+	for _, gsi := range table.GlobalSecondaryIndexes {
+		if aws.ToString(gsi.IndexName) != dynamoPositionIndex {
+			continue
+		}
+		s.indexed = gsi.IndexStatus == types.IndexStatusActive
+		if !s.indexed {
+			slog.Warn("dynamodb: position index is not active yet, scanning the table", "table", s.table, "status", gsi.IndexStatus)
+		}
+		return nil
+	}
+	if !create {
+		slog.Warn("dynamodb: no position index, scanning the table", "table", s.table, "index", dynamoPositionIndex)
+		return nil
+	}
+	gsi := dynamoPositionGSI()
+	_, err := s.db.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName: aws.String(s.table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("log"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("seq"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{Create: &types.CreateGlobalSecondaryIndexAction{
+			IndexName: gsi.IndexName, KeySchema: gsi.KeySchema, Projection: gsi.Projection,
+		}}},
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb: create index %s: %w", dynamoPositionIndex, err)
+	}
+	p := dynamodb.NewScanPaginator(s.db, &dynamodb.ScanInput{
+		TableName:                aws.String(s.table),
+		FilterExpression:         aws.String("NOT begins_with(order_id, :sys) AND attribute_not_exists(#log)"),
+		ExpressionAttributeNames: map[string]string{"#log": "log"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sys": &types.AttributeValueMemberS{Value: dynamoSystemPrefix},
+		},
+		ProjectionExpression: aws.String("order_id, version"),
+	})
+	var n int
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("dynamodb: index events: %w", err)
+		}
+		for _, key := range page.Items {
+			_, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:                 aws.String(s.table),
+				Key:                       key,
+				UpdateExpression:          aws.String("SET #log = :log"),
+				ExpressionAttributeNames:  map[string]string{"#log": "log"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{":log": &types.AttributeValueMemberS{Value: dynamoLog}},
+			})
+			if err != nil {
+				return fmt.Errorf("dynamodb: index events: %w", err)
+			}
+			n++
+		}
+	}
+	slog.Warn("dynamodb: position index is being built, scanning the table until restart", "table", s.table, "tagged", n)
+	return nil
+}
+
+func (s *dynamoStore) nextSeq(ctx context.Context) (int64, error) {
+	out, err := s.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"order_id": &types.AttributeValueMemberS{Value: dynamoCounterKey},
+			"version":  &types.AttributeValueMemberN{Value: "0"},
+		},
+		UpdateExpression:          aws.String("ADD seq :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":one": &types.AttributeValueMemberN{Value: "1"}},
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	n, ok := out.Attributes["seq"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, errors.New("dynamodb: counter returned no seq")
+	}
+	return strconv.ParseInt(n.Value, 10, 64)
+}
+
+func (s *dynamoStore) lastVersion(ctx context.Context, orderID string) (int64, error) {
+	out, err := s.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.table),
+		KeyConditionExpression:    aws.String("order_id = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: orderID}},
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(1),
+		ProjectionExpression:      aws.String("version"),
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil || len(out.Items) == 0 {
+		return 0, err
+	}
+	var item dynamoItem
+	if err := attributevalue.UnmarshalMap(out.Items[0], &item); err != nil {
+		return 0, err
+	}
+	return item.Version, nil
+}
+
+func (s *dynamoStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, err := json.Marshal(e.Metadata)
+	if err != nil {
+		return Event{}, fmt.Errorf("dynamodb: encode metadata: %w", err)
+	}
+	seq, err := s.nextSeq(ctx)
+	if err != nil {
+		return Event{}, fmt.Errorf("dynamodb: next seq: %w", err)
+	}
+	item := dynamoItem{
+		OrderID:   e.OrderID,
+		Seq:       seq,
+		Log:       dynamoLog,
+		StreamID:  e.StreamID,
+		Type:      string(e.Type),
+		Schema:    e.SchemaVersion,
+		Timestamp: e.Timestamp.UTC().Format(time.RFC3339Nano),
+		Metadata:  string(meta),
+		Data:      string(e.Data),
+	}
+	// без ожидаемой версии другой инстанс мог занять ту же версию — перечитываем и пробуем снова
+	for attempt := 0; ; attempt++ {
+		last, err := s.lastVersion(ctx, e.OrderID)
+		if err != nil {
+			return Event{}, fmt.Errorf("dynamodb: read version: %w", err)
+		}
+		if err := checkVersion(e.StreamID, expected, last); err != nil {
+			return Event{}, err
+		}
+		item.Version = last + 1
+		av, err := attributevalue.MarshalMap(item)
+		if err != nil {
+			return Event{}, fmt.Errorf("dynamodb: encode: %w", err)
+		}
+		_, err = s.db.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(s.table),
+			Item:                av,
+			ConditionExpression: aws.String("attribute_not_exists(version)"),
+		})
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) && (expected != anyVersion || attempt < dynamoMaxAttempts) {
+			// с ожидаемой версией повторное чтение вернёт versionConflictError
+			continue
+		}
+		if err != nil {
+			return Event{}, fmt.Errorf("dynamodb: append: %w", err)
+		}
+		break
+	}
+	e.Version = item.Version
+	e.Position = seq
+	s.subs.publish(e)
+	return e, nil
+}
+
+func (s *dynamoStore) Load(ctx context.Context) ([]Event, error) {
+	return s.LoadAfter(ctx, 0, 0)
+}
+
+// LoadAfter читает индекс position с seq больше after.
+func (s *dynamoStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	if !s.indexed {
+		return s.scanAfter(ctx, after, limit)
+	}
+	return s.queryPositions(ctx, eventQuery{After: after, Limit: limit})
+}
+
+// queryPositions читает индекс position после q.After; тип проверяет DynamoDB (FilterExpression),
+// время — после чтения. Чтение останавливается, как только набрано q.Limit событий.
+func (s *dynamoStore) queryPositions(ctx context.Context, q eventQuery) ([]Event, error) {
+	in := &dynamodb.QueryInput{
+		TableName:                aws.String(s.table),
+		IndexName:                aws.String(dynamoPositionIndex),
+		KeyConditionExpression:   aws.String("#log = :log AND seq > :after"),
+		ExpressionAttributeNames: map[string]string{"#log": "log"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":log":   &types.AttributeValueMemberS{Value: dynamoLog},
+			":after": &types.AttributeValueMemberN{Value: strconv.FormatInt(q.After, 10)},
+		},
+	}
+	if len(q.Types) > 0 {
+		names := make([]string, len(q.Types))
+		for i, t := range q.Types {
+			names[i] = ":t" + strconv.Itoa(i)
+			in.ExpressionAttributeValues[names[i]] = &types.AttributeValueMemberS{Value: string(t)}
+		}
+		in.ExpressionAttributeNames["#type"] = "type"
+		in.FilterExpression = aws.String("#type IN (" + strings.Join(names, ", ") + ")")
+	} else if q.Limit > 0 && q.Since.IsZero() && q.Until.IsZero() {
+		in.Limit = aws.Int32(int32(min(q.Limit, math.MaxInt32)))
+	}
+	var out []Event
+	p := dynamodb.NewQueryPaginator(s.db, in)
+	for p.HasMorePages() && (q.Limit <= 0 || len(out) < q.Limit) {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("dynamodb: load: %w", err)
+		}
+		var batch []dynamoItem
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return nil, fmt.Errorf("dynamodb: decode: %w", err)
+		}
+		events, err := dynamoEvents(batch)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, filterEvents(events, eventQuery{Since: q.Since, Until: q.Until})...)
+	}
+	return limitEvents(out, q.Limit), nil
+}
+
+// scanAfter сканирует всю таблицу, пока нет индекса: Scan не упорядочен по seq, поэтому limit
+// применяется после сортировки.
+func (s *dynamoStore) scanAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	var items []dynamoItem
+	p := dynamodb.NewScanPaginator(s.db, &dynamodb.ScanInput{
+		TableName:        aws.String(s.table),
+		FilterExpression: aws.String("NOT begins_with(order_id, :sys) AND seq > :after"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sys":   &types.AttributeValueMemberS{Value: dynamoSystemPrefix},
+			":after": &types.AttributeValueMemberN{Value: strconv.FormatInt(after, 10)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("dynamodb: load: %w", err)
+		}
+		var batch []dynamoItem
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return nil, fmt.Errorf("dynamodb: decode: %w", err)
+		}
+		items = append(items, batch...)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Seq < items[j].Seq })
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return dynamoEvents(items)
+}
+
+// QueryEvents с OrderID выбирает события заказа запросом по ключу раздела, иначе читает индекс position.
+func (s *dynamoStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	if q.OrderID == "" && s.indexed {
+		return s.queryPositions(ctx, q)
+	}
+	var events []Event
+	var err error
+	if q.OrderID != "" {
+		events, err = s.LoadByOrderAfter(ctx, q.OrderID, 0)
+	} else {
+		events, err = s.scanAfter(ctx, q.After, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filterEvents(events, q), nil
+}
+
+func (s *dynamoStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.LoadByOrderAfter(ctx, orderID, 0)
+}
+
+func (s *dynamoStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	var items []dynamoItem
+	p := dynamodb.NewQueryPaginator(s.db, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("order_id = :id AND version > :after"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":    &types.AttributeValueMemberS{Value: orderID},
+			":after": &types.AttributeValueMemberN{Value: strconv.FormatInt(after, 10)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("dynamodb: load order %s: %w", orderID, err)
+		}
+		var batch []dynamoItem
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return nil, fmt.Errorf("dynamodb: decode: %w", err)
+		}
+		items = append(items, batch...)
+	}
+	return dynamoEvents(items)
+}
+
+func dynamoEvents(items []dynamoItem) ([]Event, error) {
+	out := make([]Event, 0, len(items))
+	for _, it := range items {
+		ts, err := time.Parse(time.RFC3339Nano, it.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("dynamodb: %s/%d: bad timestamp: %w", it.OrderID, it.Version, err)
+		}
+		if it.StreamID == "" {
+			it.StreamID = orderStream(it.OrderID)
+		}
+		var meta EventMetadata
+		if it.Metadata != "" {
+			if err := json.Unmarshal([]byte(it.Metadata), &meta); err != nil {
+				return nil, fmt.Errorf("dynamodb: %s/%d: bad metadata: %w", it.OrderID, it.Version, err)
+			}
+		}
+		out = append(out, Event{
+			Type:          EventType(it.Type),
+			OrderID:       it.OrderID,
+			StreamID:      it.StreamID,
+			Version:       it.Version,
+			Position:      it.Seq,
+			SchemaVersion: it.Schema,
+			Timestamp:     ts,
+			Metadata:      meta,
+			Data:          []byte(it.Data),
+		})
+	}
+	return out, nil
+}
+
+type dynamoSnapshot struct {
+	OrderID         string `dynamodbav:"order_id"`
+	Version         int64  `dynamodbav:"version"`
+	SnapshotVersion int64  `dynamodbav:"snapshot_version"`
+	Timestamp       string `dynamodbav:"timestamp"`
+	State           string `dynamodbav:"state"`
+}
+
+func (s *dynamoStore) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	av, err := attributevalue.MarshalMap(dynamoSnapshot{
+		OrderID:         dynamoSnapshotPrefix + snap.StreamID,
+		SnapshotVersion: snap.Version,
+		Timestamp:       snap.Timestamp.UTC().Format(time.RFC3339Nano),
+		State:           string(snap.State),
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb: encode snapshot: %w", err)
+	}
+	_, err = s.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(s.table),
+		Item:                      av,
+		ConditionExpression:       aws.String("attribute_not_exists(snapshot_version) OR snapshot_version < :v"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(snap.Version, 10)}},
+	})
+	var stale *types.ConditionalCheckFailedException
+	if errors.As(err, &stale) {
+		return nil // уже есть более новый снимок
+	}
+	if err != nil {
+		return fmt.Errorf("dynamodb: save snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s *dynamoStore) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	out, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"order_id": &types.AttributeValueMemberS{Value: dynamoSnapshotPrefix + streamID},
+			"version":  &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Snapshot{}, false, fmt.Errorf("dynamodb: load snapshot: %w", err)
+	}
+	if out.Item == nil {
+		return Snapshot{}, false, nil
+	}
+	var item dynamoSnapshot
+	if err := attributevalue.UnmarshalMap(out.Item, &item); err != nil {
+		return Snapshot{}, false, fmt.Errorf("dynamodb: decode snapshot: %w", err)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, item.Timestamp)
+	if err != nil {
+		return Snapshot{}, false, fmt.Errorf("dynamodb: snapshot %s: bad timestamp: %w", streamID, err)
+	}
+	return Snapshot{StreamID: streamID, Version: item.SnapshotVersion, Timestamp: ts, State: []byte(item.State)}, true, nil
+}
+
+func dynamoCustomerKey(customerID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"order_id": &types.AttributeValueMemberS{Value: dynamoCustomerKeyPrefix + customerID},
+		"version":  &types.AttributeValueMemberN{Value: "0"},
+	}
+}
+
+func (s *dynamoStore) CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error) {
+	out, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            dynamoCustomerKey(customerID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("dynamodb: load customer key: %w", err)
+	}
+	key, ok := out.Item["key"].(*types.AttributeValueMemberB)
+	if !ok {
+		return nil, false, nil
+	}
+	return key.Value, true, nil
+}
+
+func (s *dynamoStore) CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error) {
+	item := dynamoCustomerKey(customerID)
+	item["key"] = &types.AttributeValueMemberB{Value: key}
+	_, err := s.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(order_id)"),
+	})
+	var exists *types.ConditionalCheckFailedException
+	if errors.As(err, &exists) {
+		stored, _, err := s.CustomerKey(ctx, customerID)
+		return stored, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb: save customer key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *dynamoStore) DeleteCustomerKey(ctx context.Context, customerID string) error {
+	_, err := s.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       dynamoCustomerKey(customerID),
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb: delete customer key: %w", err)
+	}
+	return nil
+}
+
+func dynamoCheckpoint(name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"order_id": &types.AttributeValueMemberS{Value: dynamoCheckpointPrefix + name},
+		"version":  &types.AttributeValueMemberN{Value: "0"},
+	}
+}
+
+func (s *dynamoStore) LoadCheckpoint(ctx context.Context, name string) (int64, bool, error) {
+	out, err := s.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            dynamoCheckpoint(name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("dynamodb: load checkpoint: %w", err)
+	}
+	n, ok := out.Item["position"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, false, nil
+	}
+	position, err := strconv.ParseInt(n.Value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("dynamodb: bad checkpoint %q: %w", n.Value, err)
+	}
+	return position, true, nil
+}
+
+func (s *dynamoStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	item := dynamoCheckpoint(name)
+	item["position"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(position, 10)}
+	_, err := s.db.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item})
+	if err != nil {
+		return fmt.Errorf("dynamodb: save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// DeleteStreams удаляет события и снимки заказов пачками BatchWriteItem.
+func (s *dynamoStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	var keys []map[string]types.AttributeValue
+	for _, id := range orderIDs {
+		p := dynamodb.NewQueryPaginator(s.db, &dynamodb.QueryInput{
+			TableName:                 aws.String(s.table),
+			KeyConditionExpression:    aws.String("order_id = :id"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: id}},
+			ProjectionExpression:      aws.String("order_id, version"),
+			ConsistentRead:            aws.Bool(true),
+		})
+		for p.HasMorePages() {
+			page, err := p.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("dynamodb: delete streams: %w", err)
+			}
+			keys = append(keys, page.Items...)
+		}
+		keys = append(keys, map[string]types.AttributeValue{
+			"order_id": &types.AttributeValueMemberS{Value: dynamoSnapshotPrefix + orderStream(id)},
+			"version":  &types.AttributeValueMemberN{Value: "0"},
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(keys) > 0 {
+		n := min(len(keys), 25) // предел BatchWriteItem
+		reqs := make([]types.WriteRequest, n)
+		for i, k := range keys[:n] {
+			reqs[i] = types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: k}}
+		}
+		keys = keys[n:]
+		for attempt := 0; len(reqs) > 0; attempt++ {
+			if attempt == dynamoMaxAttempts {
+				return fmt.Errorf("dynamodb: delete streams: %d items left unprocessed", len(reqs))
+			}
+			out, err := s.db.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{s.table: reqs},
+			})
+			if err != nil {
+				return fmt.Errorf("dynamodb: delete streams: %w", err)
+			}
+			reqs = out.UnprocessedItems[s.table]
+		}
+	}
+	return nil
+}
+
+func (s *dynamoStore) Subscribe(fn func(Event)) func() {
+	return s.subs.subscribe(fn)
+}
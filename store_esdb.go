@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
+	"github.com/google/uuid"
+)
+
+// --- EventStoreDB / Kurrent store ---
+// Каждый заказ пишется в свой поток <prefix><order_id>; Event.Type -> EventType,
+// Event.Data -> Data, order_id, stream_id, timestamp и метаданные события уходят в metadata
+// (correlation и causation — в стандартные для ESDB $correlationId/$causationId);
+// Event.Version — ревизия события в потоке ESDB плюс один, Event.Position — commit position в $all.
+// Снимки пишутся в потоки snapshot-<stream_id> с $maxCount = 1, позиции обработчиков — в checkpoint-<name>.
+type esdbStore struct {
+	client *esdb.Client
+	prefix string
+
+	mu   sync.Mutex
+	last esdb.AllPosition       // позиция после последнего Load
+	seen map[uuid.UUID]struct{} // локальные записи, уже разосланные подписчикам
+	tail sync.Once
+	subs subscribers
+}
+
+type esdbMetadata struct {
+	OrderID       string    `json:"order_id"`
+	StreamID      string    `json:"stream_id,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	CorrelationID string    `json:"$correlationId,omitempty"`
+	CausationID   string    `json:"$causationId,omitempty"`
+	Actor         string    `json:"actor,omitempty"`
+	CommandID     string    `json:"command_id,omitempty"`
+	TraceParent   string    `json:"traceparent,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	QuotaTenant   string    `json:"quota_tenant,omitempty"`
+	Signature     string    `json:"signature,omitempty"`
+	SchemaVersion int       `json:"schema_version,omitempty"`
+}
+
+func newESDBStore(ctx context.Context, connString, prefix string) (*esdbStore, error) {
+	cfg, err := esdb.ParseConnectionString(connString)
+	if err != nil {
+		return nil, fmt.Errorf("esdb: parse connection string: %w", err)
+	}
+	client, err := esdb.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("esdb: connect: %w", err)
+	}
+	// проверяем соединение коротким чтением $all
+	rs, err := client.ReadAll(ctx, esdb.ReadAllOptions{From: esdb.End{}, Direction: esdb.Backwards}, 1)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("esdb: connect: %w", err)
+	}
+	rs.Close()
+	return &esdbStore{
+		client: client,
+		prefix: prefix,
+		last:   esdb.Start{},
+		seen:   map[uuid.UUID]struct{}{},
+	}, nil
+}
+
+func (s *esdbStore) streamName(orderID string) string {
+	return s.prefix + orderID
+}
+
+func (s *esdbStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	meta, err := json.Marshal(esdbMetadata{
+		OrderID:       e.OrderID,
+		StreamID:      e.StreamID,
+		Timestamp:     e.Timestamp,
+		CorrelationID: e.Metadata.CorrelationID,
+		CausationID:   e.Metadata.CausationID,
+		Actor:         e.Metadata.Actor,
+		CommandID:     e.Metadata.CommandID,
+		TraceParent:   e.Metadata.TraceParent,
+		Tenant:        e.Metadata.Tenant,
+		QuotaTenant:   e.Metadata.QuotaTenant,
+		Signature:     e.Metadata.Signature,
+		SchemaVersion: e.SchemaVersion,
+	})
+	if err != nil {
+		return Event{}, fmt.Errorf("esdb: encode metadata: %w", err)
+	}
+	data := esdb.EventData{
+		EventID:     uuid.New(),
+		EventType:   string(e.Type),
+		ContentType: esdb.ContentTypeJson,
+		Data:        e.Data,
+		Metadata:    meta,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rev esdb.ExpectedRevision = esdb.Any{}
+	switch {
+	case expected == 0:
+		rev = esdb.NoStream{}
+	case expected > 0:
+		rev = esdb.Revision(uint64(expected - 1))
+	}
+	stream := s.streamName(e.OrderID)
+	res, err := s.client.AppendToStream(ctx, stream, esdb.AppendToStreamOptions{ExpectedRevision: rev}, data)
+	if esErr, ok := esdb.FromError(err); !ok && esErr.IsErrorCode(esdb.ErrorCodeWrongExpectedVersion) {
+		current, verr := s.currentVersion(ctx, stream)
+		if verr != nil {
+			return Event{}, fmt.Errorf("esdb: append: %w", err)
+		}
+		return Event{}, &versionConflictError{StreamID: e.StreamID, Expected: expected, Current: current}
+	}
+	if err != nil {
+		return Event{}, fmt.Errorf("esdb: append: %w", err)
+	}
+	e.Version = int64(res.NextExpectedVersion) + 1
+	e.Position = int64(res.CommitPosition)
+	s.seen[data.EventID] = struct{}{}
+	s.subs.publish(e)
+	return e, nil
+}
+
+func (s *esdbStore) currentVersion(ctx context.Context, stream string) (int64, error) {
+	rs, err := s.client.ReadStream(ctx, stream, esdb.ReadStreamOptions{From: esdb.End{}, Direction: esdb.Backwards}, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer rs.Close()
+	re, err := rs.Recv()
+	if esErr, ok := esdb.FromError(err); errors.Is(err, io.EOF) || (!ok && esErr.IsErrorCode(esdb.ErrorCodeResourceNotFound)) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(re.OriginalEvent().EventNumber) + 1, nil
+}
+
+func (s *esdbStore) fromRecorded(r *esdb.RecordedEvent) (Event, error) {
+	var meta esdbMetadata
+	if len(r.UserMetadata) > 0 {
+		if err := json.Unmarshal(r.UserMetadata, &meta); err != nil {
+			return Event{}, fmt.Errorf("esdb: event %s: bad metadata: %w", r.EventID, err)
+		}
+	}
+	if meta.OrderID == "" {
+		meta.OrderID = strings.TrimPrefix(r.StreamID, s.prefix)
+	}
+	if meta.StreamID == "" {
+		meta.StreamID = orderStream(meta.OrderID)
+	}
+	if meta.Timestamp.IsZero() {
+		meta.Timestamp = r.CreatedDate
+	}
+	return Event{
+		Type:          EventType(r.EventType),
+		OrderID:       meta.OrderID,
+		StreamID:      meta.StreamID,
+		Version:       int64(r.EventNumber) + 1,
+		Position:      int64(r.Position.Commit),
+		SchemaVersion: meta.SchemaVersion,
+		Timestamp:     meta.Timestamp,
+		Metadata: EventMetadata{
+			CorrelationID: meta.CorrelationID,
+			CausationID:   meta.CausationID,
+			Actor:         meta.Actor,
+			CommandID:     meta.CommandID,
+			TraceParent:   meta.TraceParent,
+			Tenant:        meta.Tenant,
+			QuotaTenant:   meta.QuotaTenant,
+			Signature:     meta.Signature,
+		},
+		Data: r.Data,
+	}, nil
+}
+
+func (s *esdbStore) Load(ctx context.Context) ([]Event, error) {
+	out, last, err := s.readAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.last = last
+	s.mu.Unlock()
+	return out, nil
+}
+
+// LoadAfter читает $all с позиции события after, отбирая потоки заказов на сервере.
+func (s *esdbStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	return s.readFiltered(ctx, eventQuery{After: after, Limit: limit})
+}
+
+// QueryEvents с OrderID читает поток заказа, иначе $all с позиции After с серверным фильтром
+// по типу событий (или по префиксу потоков заказов); время проверяется после чтения.
+func (s *esdbStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	if q.OrderID != "" {
+		events, err := s.LoadByOrderAfter(ctx, q.OrderID, 0)
+		if err != nil {
+			return nil, err
+		}
+		return filterEvents(events, q), nil
+	}
+	return s.readFiltered(ctx, q)
+}
+
+// readFiltered читает $all с позиции q.After catch-up подпиской с серверным фильтром: у ReadAll фильтров нет.
+// Подписка закрывается, когда догоняет позицию, бывшую последней в начале чтения, или набирает q.Limit.
+// События пишутся по одному, поэтому prepare position у них совпадает с commit position.
+func (s *esdbStore) readFiltered(ctx context.Context, q eventQuery) ([]Event, error) {
+	head, err := s.headPosition(ctx)
+	if err != nil || head <= uint64(q.After) {
+		return nil, err
+	}
+	var from esdb.AllPosition = esdb.Start{}
+	if q.After > 0 {
+		from = esdb.Position{Commit: uint64(q.After), Prepare: uint64(q.After)}
+	}
+	filter := &esdb.SubscriptionFilter{Type: esdb.StreamFilterType, Prefixes: []string{s.prefix}}
+	if len(q.Types) > 0 {
+		names := make([]string, len(q.Types))
+		for i, t := range q.Types {
+			names[i] = regexp.QuoteMeta(string(t))
+		}
+		filter = &esdb.SubscriptionFilter{Type: esdb.EventFilterType, Regex: "^(" + strings.Join(names, "|") + ")$"}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub, err := s.client.SubscribeToAll(ctx, esdb.SubscribeToAllOptions{From: from, Filter: filter})
+	if err != nil {
+		return nil, fmt.Errorf("esdb: load: %w", err)
+	}
+	defer sub.Close()
+
+	var out []Event
+	for q.Limit <= 0 || len(out) < q.Limit {
+		ev := sub.Recv()
+		switch {
+		case ev.SubscriptionDropped != nil:
+			return nil, fmt.Errorf("esdb: load: %w", ev.SubscriptionDropped.Error)
+		case ev.CaughtUp != nil:
+			return out, nil
+		case ev.CheckPointReached != nil:
+			if ev.CheckPointReached.Commit >= head {
+				return out, nil
+			}
+		case ev.EventAppeared != nil:
+			rec := ev.EventAppeared.OriginalEvent()
+			// фильтр по типу не смотрит на поток: чужие потоки с теми же типами отбрасываются здесь
+			if strings.HasPrefix(rec.StreamID, s.prefix) && int64(rec.Position.Commit) > q.After {
+				e, err := s.fromRecorded(rec)
+				if err != nil {
+					return nil, err
+				}
+				if q.matches(e) {
+					out = append(out, e)
+				}
+			}
+			if rec.Position.Commit >= head {
+				return out, nil
+			}
+		}
+	}
+	return out, nil
+}
+
+// headPosition — commit position последней записи $all; 0 — журнал пуст.
+func (s *esdbStore) headPosition(ctx context.Context) (uint64, error) {
+	rs, err := s.client.ReadAll(ctx, esdb.ReadAllOptions{From: esdb.End{}, Direction: esdb.Backwards}, 1)
+	if err != nil {
+		return 0, fmt.Errorf("esdb: load: %w", err)
+	}
+	defer rs.Close()
+	re, err := rs.Recv()
+	if errors.Is(err, io.EOF) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("esdb: load: %w", err)
+	}
+	return re.OriginalEvent().Position.Commit, nil
+}
+
+// readAll читает все события заказов из $all и возвращает позицию последней записи: с неё Subscribe продолжит.
+func (s *esdbStore) readAll(ctx context.Context) ([]Event, esdb.AllPosition, error) {
+	var last esdb.AllPosition = esdb.Start{}
+	rs, err := s.client.ReadAll(ctx, esdb.ReadAllOptions{From: esdb.Start{}}, math.MaxUint64)
+	if err != nil {
+		return nil, last, fmt.Errorf("esdb: load: %w", err)
+	}
+	defer rs.Close()
+
+	var out []Event
+	for {
+		re, err := rs.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, last, fmt.Errorf("esdb: load: %w", err)
+		}
+		rec := re.OriginalEvent()
+		last = rec.Position
+		if !strings.HasPrefix(rec.StreamID, s.prefix) {
+			continue
+		}
+		e, err := s.fromRecorded(rec)
+		if err != nil {
+			return nil, last, err
+		}
+		out = append(out, e)
+	}
+	return out, last, nil
+}
+
+func (s *esdbStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.LoadByOrderAfter(ctx, orderID, 0)
+}
+
+// LoadByOrderAfter читает поток заказа с ревизии after, то есть с версии after+1.
+func (s *esdbStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	var from esdb.StreamPosition = esdb.Start{}
+	if after > 0 {
+		from = esdb.Revision(uint64(after))
+	}
+	rs, err := s.client.ReadStream(ctx, s.streamName(orderID), esdb.ReadStreamOptions{From: from}, math.MaxUint64)
+	if err != nil {
+		return nil, fmt.Errorf("esdb: load order %s: %w", orderID, err)
+	}
+	defer rs.Close()
+
+	var out []Event
+	for {
+		re, err := rs.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if esErr, ok := esdb.FromError(err); !ok && esErr.IsErrorCode(esdb.ErrorCodeResourceNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("esdb: load order %s: %w", orderID, err)
+		}
+		e, err := s.fromRecorded(re.OriginalEvent())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func snapshotStream(streamID string) string {
+	return "snapshot-" + streamID
+}
+
+func (s *esdbStore) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	body, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("esdb: encode snapshot: %w", err)
+	}
+	if err := s.appendLatest(ctx, snapshotStream(snap.StreamID), "Snapshot", body); err != nil {
+		return fmt.Errorf("esdb: save snapshot: %w", err)
+	}
+	return nil
+}
+
+// appendLatest дописывает событие в служебный поток, в котором нужно только последнее значение.
+func (s *esdbStore) appendLatest(ctx context.Context, stream, eventType string, body []byte) error {
+	res, err := s.client.AppendToStream(ctx, stream, esdb.AppendToStreamOptions{}, esdb.EventData{
+		EventID:     uuid.New(),
+		EventType:   eventType,
+		ContentType: esdb.ContentTypeJson,
+		Data:        body,
+	})
+	if err != nil {
+		return err
+	}
+	// первое событие потока: старые значения не нужны, пусть ESDB их удаляет
+	if res.NextExpectedVersion == 0 {
+		var meta esdb.StreamMetadata
+		meta.SetMaxCount(1)
+		if _, err := s.client.SetStreamMetadata(ctx, stream, esdb.AppendToStreamOptions{}, meta); err != nil {
+			slog.WarnContext(ctx, "esdb: set stream metadata", "stream", stream, "error", err)
+		}
+	}
+	return nil
+}
+
+// readLatest читает последнее событие служебного потока; false — поток пуст или не существует.
+func (s *esdbStore) readLatest(ctx context.Context, stream string) ([]byte, bool, error) {
+	rs, err := s.client.ReadStream(ctx, stream, esdb.ReadStreamOptions{From: esdb.End{}, Direction: esdb.Backwards}, 1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rs.Close()
+	re, err := rs.Recv()
+	if esErr, ok := esdb.FromError(err); errors.Is(err, io.EOF) || (!ok && esErr.IsErrorCode(esdb.ErrorCodeResourceNotFound)) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return re.OriginalEvent().Data, true, nil
+}
+
+func (s *esdbStore) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	body, ok, err := s.readLatest(ctx, snapshotStream(streamID))
+	if err != nil || !ok {
+		if err != nil {
+			err = fmt.Errorf("esdb: load snapshot: %w", err)
+		}
+		return Snapshot{}, false, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(body, &snap); err != nil {
+		return Snapshot{}, false, fmt.Errorf("esdb: decode snapshot: %w", err)
+	}
+	return snap, true, nil
+}
+
+func checkpointStream(name string) string {
+	return "checkpoint-" + name
+}
+
+func (s *esdbStore) LoadCheckpoint(ctx context.Context, name string) (int64, bool, error) {
+	body, ok, err := s.readLatest(ctx, checkpointStream(name))
+	if err != nil || !ok {
+		if err != nil {
+			err = fmt.Errorf("esdb: load checkpoint: %w", err)
+		}
+		return 0, false, err
+	}
+	var cp struct {
+		Position int64 `json:"position"`
+	}
+	if err := json.Unmarshal(body, &cp); err != nil {
+		return 0, false, fmt.Errorf("esdb: decode checkpoint: %w", err)
+	}
+	return cp.Position, true, nil
+}
+
+func (s *esdbStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	body := fmt.Appendf(nil, `{"position":%d}`, position)
+	if err := s.appendLatest(ctx, checkpointStream(name), "Checkpoint", body); err != nil {
+		return fmt.Errorf("esdb: save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// DeleteStreams мягко удаляет потоки заказов и их снимков. Из $all события
+// исчезают только после scavenge, до него они видны при полном перечитывании журнала.
+func (s *esdbStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	for _, id := range orderIDs {
+		for _, stream := range []string{s.streamName(id), snapshotStream(orderStream(id))} {
+			_, err := s.client.DeleteStream(ctx, stream, esdb.DeleteStreamOptions{})
+			if esErr, ok := esdb.FromError(err); !ok && (esErr.IsErrorCode(esdb.ErrorCodeResourceNotFound) || esErr.IsErrorCode(esdb.ErrorCodeStreamDeleted)) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("esdb: delete stream %s: %w", stream, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Subscribe запускает catch-up подписку на $all с позиции, на которой остановился последний Load.
+func (s *esdbStore) Subscribe(fn func(Event)) func() {
+	s.tail.Do(func() {
+		s.mu.Lock()
+		from := s.last
+		s.mu.Unlock()
+		go s.follow(from)
+	})
+	return s.subs.subscribe(fn)
+}
+
+func (s *esdbStore) follow(from esdb.AllPosition) {
+	ctx := context.Background()
+	filter := &esdb.SubscriptionFilter{Type: esdb.StreamFilterType, Prefixes: []string{s.prefix}}
+	for {
+		sub, err := s.client.SubscribeToAll(ctx, esdb.SubscribeToAllOptions{From: from, Filter: filter})
+		if err != nil {
+			slog.Error("esdb: subscribe", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for {
+			ev := sub.Recv()
+			if ev.SubscriptionDropped != nil {
+				slog.Warn("esdb: subscription dropped", "error", ev.SubscriptionDropped.Error)
+				break
+			}
+			if ev.EventAppeared == nil {
+				continue
+			}
+			rec := ev.EventAppeared.OriginalEvent()
+			from = rec.Position
+			s.mu.Lock()
+			_, local := s.seen[rec.EventID]
+			delete(s.seen, rec.EventID)
+			s.mu.Unlock()
+			if local {
+				continue
+			}
+			e, err := s.fromRecorded(rec)
+			if err != nil {
+				slog.Error("esdb: decode event", "stream", rec.StreamID, "error", err)
+				continue
+			}
+			s.subs.publish(e)
+		}
+		sub.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *esdbStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// --- JSONL file store ---
+// Одно событие на строку, fsync после каждой записи.
+// Чтения обслуживаются из памяти, файл перечитывается только при открытии.
+// Снимки дописываются в <path>.snapshots и сжимаются до последнего на поток при открытии.
+// Ключи покупателей лежат в <path>.keys (fileKeyStore), позиции обработчиков — в <path>.checkpoints.
+type fileStore struct {
+	mu    sync.Mutex
+	f     *os.File
+	path  string
+	size  int64 // длина файла после последней успешной записи
+	snapf *os.File
+	mem   *memoryStore
+	*fileKeyStore
+	*fileCheckpointStore
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("file store: open %s: %w", path, err)
+	}
+	s := &fileStore{f: f, path: path, mem: newMemoryStore()}
+	if err := s.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := s.openSnapshots(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if s.fileKeyStore, err = newFileKeyStore(path + ".keys"); err != nil {
+		f.Close()
+		s.snapf.Close()
+		return nil, err
+	}
+	if s.fileCheckpointStore, err = newFileCheckpointStore(path + ".checkpoints"); err != nil {
+		f.Close()
+		s.snapf.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover читает журнал и отрезает хвост, оставшийся от незавершённой записи.
+func (s *fileStore) recover() error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("file store: seek: %w", err)
+	}
+	r := bufio.NewReader(s.f)
+	var good int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				slog.Warn("file store: dropping incomplete trailing record", "path", s.path, "bytes", len(line))
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("file store: read: %w", err)
+		}
+		rec := bytes.TrimSpace(line)
+		if len(rec) == 0 {
+			good += int64(len(line))
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(rec, &e); err != nil {
+			return fmt.Errorf("file store: corrupt record at offset %d: %w", good, err)
+		}
+		// записи до появления версий и позиций: достраиваем их по порядку в журнале
+		if e.StreamID == "" {
+			e.StreamID = orderStream(e.OrderID)
+		}
+		if e.Version == 0 {
+			e.Version = s.mem.version(e.StreamID) + 1
+		}
+		if e.Position == 0 {
+			e.Position = s.mem.lastPosition() + 1
+		}
+		s.mem.restore(e)
+		good += int64(len(line))
+	}
+	s.size = good
+	if err := s.f.Truncate(good); err != nil {
+		return fmt.Errorf("file store: truncate: %w", err)
+	}
+	if _, err := s.f.Seek(good, io.SeekStart); err != nil {
+		return fmt.Errorf("file store: seek: %w", err)
+	}
+	return s.f.Sync()
+}
+
+func (s *fileStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.mem.version(e.StreamID)
+	if err := checkVersion(e.StreamID, expected, current); err != nil {
+		return Event{}, err
+	}
+	e.Version = current + 1
+	e.Position = s.mem.lastPosition() + 1
+	line, err := json.Marshal(e)
+	if err != nil {
+		return Event{}, fmt.Errorf("file store: encode: %w", err)
+	}
+	line = append(line, '\n')
+	if _, err := s.f.Write(line); err != nil {
+		s.rollback()
+		return Event{}, fmt.Errorf("file store: write: %w", err)
+	}
+	if err := s.f.Sync(); err != nil {
+		s.rollback()
+		return Event{}, fmt.Errorf("file store: fsync: %w", err)
+	}
+	s.size += int64(len(line))
+	return s.mem.Append(ctx, e, current)
+}
+
+// openSnapshots читает файл снимков и переписывает его, оставляя последний снимок каждого потока.
+// Снимки — лишь ускорение, поэтому повреждённые строки пропускаются.
+func (s *fileStore) openSnapshots() error {
+	path := s.path + ".snapshots"
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for sc.Scan() {
+			var snap Snapshot
+			if err := json.Unmarshal(sc.Bytes(), &snap); err != nil {
+				slog.Warn("file store: skipping bad snapshot record", "path", path, "error", err)
+				continue
+			}
+			s.mem.SaveSnapshot(context.Background(), snap)
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return fmt.Errorf("file store: read snapshots: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("file store: open snapshots: %w", err)
+	}
+
+	return s.writeSnapshots()
+}
+
+// writeSnapshots переписывает файл снимков из памяти через временный файл и rename.
+func (s *fileStore) writeSnapshots() error {
+	path := s.path + ".snapshots"
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".compact-*")
+	if err != nil {
+		return fmt.Errorf("file store: compact snapshots: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	s.mem.mu.RLock()
+	for _, snap := range s.mem.snaps {
+		if err := enc.Encode(snap); err != nil {
+			s.mem.mu.RUnlock()
+			tmp.Close()
+			return fmt.Errorf("file store: compact snapshots: %w", err)
+		}
+	}
+	s.mem.mu.RUnlock()
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("file store: compact snapshots: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("file store: compact snapshots: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		tmp.Close()
+		return fmt.Errorf("file store: compact snapshots: %w", err)
+	}
+	if s.snapf != nil {
+		s.snapf.Close()
+	}
+	s.snapf = tmp
+	return nil
+}
+
+// rollback убирает частично записанную строку, чтобы следующая запись не склеилась с ней.
+func (s *fileStore) rollback() {
+	if err := s.f.Truncate(s.size); err != nil {
+		slog.Error("file store: rollback truncate", "path", s.path, "error", err)
+	}
+	if _, err := s.f.Seek(s.size, io.SeekStart); err != nil {
+		slog.Error("file store: rollback seek", "path", s.path, "error", err)
+	}
+}
+
+func (s *fileStore) Load(ctx context.Context) ([]Event, error) {
+	return s.mem.Load(ctx)
+}
+
+func (s *fileStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	return s.mem.LoadAfter(ctx, after, limit)
+}
+
+func (s *fileStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	return s.mem.QueryEvents(ctx, q)
+}
+
+func (s *fileStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.mem.LoadByOrder(ctx, orderID)
+}
+
+func (s *fileStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	return s.mem.LoadByOrderAfter(ctx, orderID, after)
+}
+
+func (s *fileStore) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	line, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("file store: encode snapshot: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.snapf.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("file store: write snapshot: %w", err)
+	}
+	if err := s.snapf.Sync(); err != nil {
+		return fmt.Errorf("file store: fsync snapshot: %w", err)
+	}
+	return s.mem.SaveSnapshot(ctx, snap)
+}
+
+func (s *fileStore) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	return s.mem.LoadSnapshot(ctx, streamID)
+}
+
+func (s *fileStore) Subscribe(fn func(Event)) func() {
+	return s.mem.Subscribe(fn)
+}
+
+// TrimPrefix переписывает журнал без первых n событий.
+func (s *fileStore) TrimPrefix(ctx context.Context, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events, err := s.mem.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if n > len(events) {
+		n = len(events)
+	}
+	if err := s.rewrite(events[n:]); err != nil {
+		return fmt.Errorf("file store: trim: %w", err)
+	}
+	return s.mem.TrimPrefix(ctx, n)
+}
+
+// DeleteStreams переписывает журнал и файл снимков без потоков заказов orderIDs.
+func (s *fileStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events, err := s.mem.Load(ctx)
+	if err != nil {
+		return err
+	}
+	drop := make(map[string]bool, len(orderIDs))
+	for _, id := range orderIDs {
+		drop[id] = true
+	}
+	kept := events[:0]
+	for _, e := range events {
+		if !drop[e.OrderID] {
+			kept = append(kept, e)
+		}
+	}
+	if err := s.rewrite(kept); err != nil {
+		return fmt.Errorf("file store: delete streams: %w", err)
+	}
+	if err := s.mem.DeleteStreams(ctx, orderIDs); err != nil {
+		return err
+	}
+	return s.writeSnapshots()
+}
+
+// rewrite заменяет журнал файлом с events через временный файл и rename.
+func (s *fileStore) rewrite(events []Event) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".rewrite-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	s.f.Close()
+	s.f, s.size = tmp, size
+	return nil
+}
+
+// SizeBytes — длина файла журнала.
+func (s *fileStore) SizeBytes(context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size, nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapf.Close()
+	return s.f.Close()
+}
+
+// writeFileAtomic заменяет содержимое path через временный файл, fsync и rename:
+// после сбоя на диске остаётся либо старая, либо новая версия целиком.
+func writeFileAtomic(path string, body []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// --- MongoDB store ---
+// Коллекция events упорядочена по _id (seq из коллекции counters, он же позиция события),
+// версии потоков агрегатов — счётчики stream:<stream_id> там же, снимки — коллекция snapshots (_id = stream_id),
+// ключи покупателей — коллекция customer_keys (_id = customer_id), позиции обработчиков — checkpoints (_id = имя).
+// Подписчики питаются из change stream, поэтому MongoDB должна работать как replica set.
+type mongoStore struct {
+	client    *mongo.Client
+	events    *mongo.Collection
+	counters  *mongo.Collection
+	snapshots *mongo.Collection
+	keys      *mongo.Collection
+	cps       *mongo.Collection
+
+	mu   sync.Mutex
+	last int64              // seq последнего события, отданного Load
+	seen map[int64]struct{} // локальные записи, уже разосланные подписчикам
+	tail sync.Once
+	subs subscribers
+}
+
+type mongoEvent struct {
+	Seq       int64         `bson:"_id"`
+	Type      string        `bson:"type"`
+	OrderID   string        `bson:"order_id"`
+	StreamID  string        `bson:"stream_id"`
+	Version   int64         `bson:"version"`
+	Schema    int           `bson:"schema_version,omitempty"`
+	Timestamp time.Time     `bson:"timestamp"`
+	Metadata  mongoMetadata `bson:"metadata"`
+	Data      string        `bson:"data"`
+}
+
+type mongoMetadata struct {
+	CorrelationID string `bson:"correlation_id,omitempty"`
+	CausationID   string `bson:"causation_id,omitempty"`
+	Actor         string `bson:"actor,omitempty"`
+	CommandID     string `bson:"command_id,omitempty"`
+	TraceParent   string `bson:"traceparent,omitempty"`
+	Tenant        string `bson:"tenant,omitempty"`
+	QuotaTenant   string `bson:"quota_tenant,omitempty"`
+	Signature     string `bson:"signature,omitempty"`
+}
+
+func (m mongoEvent) event() Event {
+	return Event{
+		Type:          EventType(m.Type),
+		OrderID:       m.OrderID,
+		StreamID:      m.StreamID,
+		Version:       m.Version,
+		Position:      m.Seq,
+		SchemaVersion: m.Schema,
+		Timestamp:     m.Timestamp,
+		Metadata:      EventMetadata(m.Metadata),
+		Data:          []byte(m.Data),
+	}
+}
+
+func newMongoStore(ctx context.Context, uri, database string) (*mongoStore, error) {
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("mongo: connect: %w", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("mongo: ping: %w", err)
+	}
+	db := client.Database(database)
+	s := &mongoStore{
+		client:    client,
+		events:    db.Collection("events"),
+		counters:  db.Collection("counters"),
+		snapshots: db.Collection("snapshots"),
+		keys:      db.Collection("customer_keys"),
+		cps:       db.Collection("checkpoints"),
+		seen:      map[int64]struct{}{},
+	}
+	_, err = s.events.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "timestamp", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "stream_id", Value: 1}, {Key: "version", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{{Key: "version", Value: bson.D{{Key: "$gt", Value: 0}}}}),
+		},
+	})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("mongo: create indexes: %w", err)
+	}
+	return s, nil
+}
+
+func (s *mongoStore) nextSeq(ctx context.Context, counter string) (int64, error) {
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := s.counters.FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: counter}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: int64(1)}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	return doc.Seq, err
+}
+
+// claimVersion атомарно переводит счётчик потока с expected на expected+1.
+func (s *mongoStore) claimVersion(ctx context.Context, streamID string, expected int64) (int64, error) {
+	id := "stream:" + streamID
+	if expected == anyVersion {
+		return s.nextSeq(ctx, id)
+	}
+	var claimed bool
+	if expected == 0 {
+		_, err := s.counters.InsertOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "seq", Value: int64(1)}})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return 0, err
+		}
+		claimed = err == nil
+	} else {
+		res, err := s.counters.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: id}, {Key: "seq", Value: expected}},
+			bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: int64(1)}}}})
+		if err != nil {
+			return 0, err
+		}
+		claimed = res.ModifiedCount == 1
+	}
+	if claimed {
+		return expected + 1, nil
+	}
+
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := s.counters.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&doc)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, err
+	}
+	return 0, &versionConflictError{StreamID: streamID, Expected: expected, Current: doc.Seq}
+}
+
+func (s *mongoStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version, err := s.claimVersion(ctx, e.StreamID, expected)
+	var conflict *versionConflictError
+	if errors.As(err, &conflict) {
+		return Event{}, err
+	}
+	if err != nil {
+		return Event{}, fmt.Errorf("mongo: next version: %w", err)
+	}
+	e.Version = version
+	seq, err := s.nextSeq(ctx, "events")
+	if err != nil {
+		return Event{}, fmt.Errorf("mongo: next seq: %w", err)
+	}
+	e.Position = seq
+	doc := mongoEvent{
+		Seq:       seq,
+		Type:      string(e.Type),
+		OrderID:   e.OrderID,
+		StreamID:  e.StreamID,
+		Version:   e.Version,
+		Schema:    e.SchemaVersion,
+		Timestamp: e.Timestamp,
+		Metadata:  mongoMetadata(e.Metadata),
+		Data:      string(e.Data),
+	}
+	if _, err := s.events.InsertOne(ctx, doc); err != nil {
+		return Event{}, fmt.Errorf("mongo: append: %w", err)
+	}
+	s.seen[seq] = struct{}{}
+	s.subs.publish(e)
+	return e, nil
+}
+
+// find возвращает до limit событий по filter в порядке позиций; limit <= 0 — все.
+func (s *mongoStore) find(ctx context.Context, filter bson.D, limit int) ([]mongoEvent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cur, err := s.events.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoEvent
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (s *mongoStore) Load(ctx context.Context) ([]Event, error) {
+	docs, err := s.find(ctx, bson.D{}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mongo: load: %w", err)
+	}
+	out := make([]Event, 0, len(docs))
+	for _, d := range docs {
+		out = append(out, d.event())
+	}
+	if len(docs) > 0 {
+		s.mu.Lock()
+		s.last = docs[len(docs)-1].Seq
+		s.mu.Unlock()
+	}
+	return out, nil
+}
+
+func (s *mongoStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	return s.QueryEvents(ctx, eventQuery{After: after, Limit: limit})
+}
+
+func (s *mongoStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: q.After}}}}
+	if q.OrderID != "" {
+		filter = append(filter, bson.E{Key: "order_id", Value: q.OrderID})
+	}
+	if len(q.Types) > 0 {
+		filter = append(filter, bson.E{Key: "type", Value: bson.D{{Key: "$in", Value: q.Types}}})
+	}
+	var ts bson.D
+	if !q.Since.IsZero() {
+		ts = append(ts, bson.E{Key: "$gte", Value: q.Since})
+	}
+	if !q.Until.IsZero() {
+		ts = append(ts, bson.E{Key: "$lt", Value: q.Until})
+	}
+	if ts != nil {
+		filter = append(filter, bson.E{Key: "timestamp", Value: ts})
+	}
+	docs, err := s.find(ctx, filter, q.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("mongo: load: %w", err)
+	}
+	out := make([]Event, 0, len(docs))
+	for _, d := range docs {
+		out = append(out, d.event())
+	}
+	return out, nil
+}
+
+func (s *mongoStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.LoadByOrderAfter(ctx, orderID, 0)
+}
+
+func (s *mongoStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	docs, err := s.find(ctx, bson.D{
+		{Key: "order_id", Value: orderID},
+		{Key: "version", Value: bson.D{{Key: "$gt", Value: after}}},
+	}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mongo: load order %s: %w", orderID, err)
+	}
+	out := make([]Event, 0, len(docs))
+	for _, d := range docs {
+		out = append(out, d.event())
+	}
+	return out, nil
+}
+
+type mongoSnapshot struct {
+	StreamID  string    `bson:"_id"`
+	Version   int64     `bson:"version"`
+	Timestamp time.Time `bson:"timestamp"`
+	State     string    `bson:"state"`
+}
+
+func (s *mongoStore) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	doc := mongoSnapshot{StreamID: snap.StreamID, Version: snap.Version, Timestamp: snap.Timestamp, State: string(snap.State)}
+	// фильтр по версии не даёт заменить более новый снимок; upsert тогда упирается в _id
+	_, err := s.snapshots.ReplaceOne(ctx,
+		bson.D{{Key: "_id", Value: snap.StreamID}, {Key: "version", Value: bson.D{{Key: "$lt", Value: snap.Version}}}},
+		doc, options.Replace().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("mongo: save snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s *mongoStore) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	var doc mongoSnapshot
+	err := s.snapshots.FindOne(ctx, bson.D{{Key: "_id", Value: streamID}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, fmt.Errorf("mongo: load snapshot: %w", err)
+	}
+	return Snapshot{StreamID: doc.StreamID, Version: doc.Version, Timestamp: doc.Timestamp, State: []byte(doc.State)}, true, nil
+}
+
+func (s *mongoStore) CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error) {
+	var doc struct {
+		Key []byte `bson:"key"`
+	}
+	err := s.keys.FindOne(ctx, bson.D{{Key: "_id", Value: customerID}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("mongo: load customer key: %w", err)
+	}
+	return doc.Key, true, nil
+}
+
+func (s *mongoStore) CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error) {
+	_, err := s.keys.InsertOne(ctx, bson.D{{Key: "_id", Value: customerID}, {Key: "key", Value: key}})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, fmt.Errorf("mongo: save customer key: %w", err)
+	}
+	stored, _, err := s.CustomerKey(ctx, customerID)
+	return stored, err
+}
+
+func (s *mongoStore) DeleteCustomerKey(ctx context.Context, customerID string) error {
+	if _, err := s.keys.DeleteOne(ctx, bson.D{{Key: "_id", Value: customerID}}); err != nil {
+		return fmt.Errorf("mongo: delete customer key: %w", err)
+	}
+	return nil
+}
+
+func (s *mongoStore) LoadCheckpoint(ctx context.Context, name string) (int64, bool, error) {
+	var doc struct {
+		Position int64 `bson:"position"`
+	}
+	err := s.cps.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("mongo: load checkpoint: %w", err)
+	}
+	return doc.Position, true, nil
+}
+
+func (s *mongoStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	_, err := s.cps.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: name}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "position", Value: position}}}},
+		options.UpdateOne().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("mongo: save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// DeleteStreams удаляет события заказов, счётчики версий их потоков и снимки.
+func (s *mongoStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	streams := make([]string, len(orderIDs))
+	counters := make([]string, len(orderIDs))
+	for i, id := range orderIDs {
+		streams[i] = orderStream(id)
+		counters[i] = "stream:" + streams[i]
+	}
+	if _, err := s.events.DeleteMany(ctx, bson.D{{Key: "order_id", Value: bson.D{{Key: "$in", Value: orderIDs}}}}); err != nil {
+		return fmt.Errorf("mongo: delete streams: %w", err)
+	}
+	if _, err := s.counters.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: counters}}}}); err != nil {
+		return fmt.Errorf("mongo: delete streams: %w", err)
+	}
+	if _, err := s.snapshots.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: streams}}}}); err != nil {
+		return fmt.Errorf("mongo: delete streams: %w", err)
+	}
+	return nil
+}
+
+// Subscribe открывает change stream и догоняет события, записанные после последнего Load.
+func (s *mongoStore) Subscribe(fn func(Event)) func() {
+	s.tail.Do(func() {
+		s.mu.Lock()
+		from := s.last
+		s.mu.Unlock()
+		go s.follow(from)
+	})
+	return s.subs.subscribe(fn)
+}
+
+func (s *mongoStore) follow(from int64) {
+	ctx := context.Background()
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}}
+	// seq, уже отданные при догонке; change stream может прислать их повторно.
+	// Сравнивать с максимумом нельзя: при нескольких писателях seq вставляются не по порядку.
+	caught := map[int64]struct{}{}
+	var resume bson.Raw
+	for {
+		opts := options.ChangeStream()
+		if resume != nil {
+			opts.SetResumeAfter(resume)
+		}
+		cs, err := s.events.Watch(ctx, pipeline, opts)
+		if err != nil {
+			slog.ErrorContext(ctx, "mongo: watch", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		// поток уже открыт, так что записи между Load и Watch не потеряются
+		if resume == nil {
+			docs, err := s.find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: from}}}}, 0)
+			if err != nil {
+				slog.ErrorContext(ctx, "mongo: catch-up", "error", err)
+			}
+			for _, d := range docs {
+				caught[d.Seq] = struct{}{}
+				s.deliver(d)
+			}
+		}
+		for cs.Next(ctx) {
+			resume = cs.ResumeToken()
+			var change struct {
+				Doc mongoEvent `bson:"fullDocument"`
+			}
+			if err := cs.Decode(&change); err != nil {
+				slog.ErrorContext(ctx, "mongo: decode change", "error", err)
+				continue
+			}
+			if _, ok := caught[change.Doc.Seq]; ok || change.Doc.Seq <= from {
+				delete(caught, change.Doc.Seq)
+				continue
+			}
+			s.deliver(change.Doc)
+		}
+		if err := cs.Err(); err != nil {
+			slog.WarnContext(ctx, "mongo: change stream", "error", err)
+		}
+		cs.Close(ctx)
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *mongoStore) deliver(d mongoEvent) {
+	s.mu.Lock()
+	_, local := s.seen[d.Seq]
+	delete(s.seen, d.Seq)
+	s.mu.Unlock()
+	if !local {
+		s.subs.publish(d.event())
+	}
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// --- PostgreSQL store ---
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	id        BIGSERIAL PRIMARY KEY,
+	type      TEXT        NOT NULL,
+	order_id  TEXT        NOT NULL,
+	timestamp TIMESTAMPTZ NOT NULL,
+	data      JSONB       NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_order_id_idx ON events (order_id, id);
+CREATE INDEX IF NOT EXISTS events_type_idx ON events (type, id);
+CREATE INDEX IF NOT EXISTS events_timestamp_idx ON events (timestamp);
+
+-- потоки агрегатов; строки, записанные до появления версий, нумеруются по порядку id
+ALTER TABLE events ADD COLUMN IF NOT EXISTS stream_id TEXT;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS version BIGINT;
+UPDATE events e SET stream_id = 'order-' || e.order_id, version = v.rn
+FROM (SELECT id, row_number() OVER (PARTITION BY order_id ORDER BY id) AS rn FROM events) v
+WHERE e.id = v.id AND e.version IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS events_stream_version_idx ON events (stream_id, version);
+
+ALTER TABLE events ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE events ADD COLUMN IF NOT EXISTS schema_version INT NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS snapshots (
+	stream_id TEXT PRIMARY KEY,
+	version   BIGINT      NOT NULL,
+	timestamp TIMESTAMPTZ NOT NULL,
+	state     JSONB       NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS customer_keys (
+	customer_id TEXT PRIMARY KEY,
+	key         BYTEA NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS checkpoints (
+	name     TEXT PRIMARY KEY,
+	position BIGINT NOT NULL
+);
+`
+
+// ключ advisory-lock, под которым сериализуются записи в events
+const postgresAppendLock = 7_000_001
+
+type postgresStore struct {
+	mu   sync.Mutex // порядок локальных уведомлений совпадает с порядком id
+	pool *pgxpool.Pool
+	subs subscribers
+}
+
+type postgresOptions struct {
+	DSN             string
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+}
+
+func newPostgresStore(ctx context.Context, opts postgresOptions) (*postgresStore, error) {
+	cfg, err := pgxpool.ParseConfig(opts.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: parse dsn: %w", err)
+	}
+	if opts.MaxConns > 0 {
+		cfg.MaxConns = opts.MaxConns
+	}
+	if opts.MinConns > 0 {
+		cfg.MinConns = opts.MinConns
+	}
+	if opts.MaxConnLifetime > 0 {
+		cfg.MaxConnLifetime = opts.MaxConnLifetime
+	}
+	if opts.MaxConnIdleTime > 0 {
+		cfg.MaxConnIdleTime = opts.MaxConnIdleTime
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: connect: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("postgres: ping: %w", err)
+	}
+	if _, err := pool.Exec(ctx, postgresSchema); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("postgres: bootstrap schema: %w", err)
+	}
+	return &postgresStore{pool: pool}, nil
+}
+
+func (s *postgresStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// advisory lock гарантирует, что порядок id совпадает с порядком коммитов
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, postgresAppendLock); err != nil {
+			return err
+		}
+		var current int64
+		err := tx.QueryRow(ctx,
+			`SELECT COALESCE(MAX(version), 0) FROM events WHERE stream_id = $1`, e.StreamID).Scan(&current)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(e.StreamID, expected, current); err != nil {
+			return err
+		}
+		e.Version = current + 1
+		meta, err := json.Marshal(e.Metadata)
+		if err != nil {
+			return err
+		}
+		// id служит глобальной позицией: откаченные транзакции оставляют пропуски, но порядок строгий
+		return tx.QueryRow(ctx,
+			`INSERT INTO events (type, order_id, stream_id, version, schema_version, timestamp, metadata, data) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+			e.Type, e.OrderID, e.StreamID, e.Version, e.SchemaVersion, e.Timestamp, meta, []byte(e.Data)).Scan(&e.Position)
+	})
+	var conflict *versionConflictError
+	if errors.As(err, &conflict) {
+		return Event{}, err
+	}
+	if err != nil {
+		return Event{}, fmt.Errorf("postgres: append: %w", err)
+	}
+	s.subs.publish(e)
+	return e, nil
+}
+
+func (s *postgresStore) Load(ctx context.Context) ([]Event, error) {
+	return s.query(ctx, `SELECT id, type, order_id, stream_id, version, schema_version, timestamp, metadata, data FROM events ORDER BY id`)
+}
+
+func (s *postgresStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	return s.QueryEvents(ctx, eventQuery{After: after, Limit: limit})
+}
+
+func (s *postgresStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where := q.sqlWhere(arg, "timestamp", func(t time.Time) string { return arg(t) })
+	var limit any // LIMIT NULL — без ограничения
+	if q.Limit > 0 {
+		limit = q.Limit
+	}
+	return s.query(ctx, `SELECT id, type, order_id, stream_id, version, schema_version, timestamp, metadata, data FROM events WHERE `+where+` ORDER BY id LIMIT `+arg(limit), args...)
+}
+
+func (s *postgresStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.query(ctx, `SELECT id, type, order_id, stream_id, version, schema_version, timestamp, metadata, data FROM events WHERE order_id = $1 ORDER BY id`, orderID)
+}
+
+func (s *postgresStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	return s.query(ctx, `SELECT id, type, order_id, stream_id, version, schema_version, timestamp, metadata, data FROM events WHERE order_id = $1 AND version > $2 ORDER BY id`, orderID, after)
+}
+
+func (s *postgresStore) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO snapshots (stream_id, version, timestamp, state) VALUES ($1, $2, $3, $4)
+ON CONFLICT (stream_id) DO UPDATE SET version = EXCLUDED.version, timestamp = EXCLUDED.timestamp, state = EXCLUDED.state
+WHERE snapshots.version < EXCLUDED.version`,
+		snap.StreamID, snap.Version, snap.Timestamp, []byte(snap.State))
+	if err != nil {
+		return fmt.Errorf("postgres: save snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	snap := Snapshot{StreamID: streamID}
+	var state []byte
+	err := s.pool.QueryRow(ctx,
+		`SELECT version, timestamp, state FROM snapshots WHERE stream_id = $1`, streamID).Scan(&snap.Version, &snap.Timestamp, &state)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, fmt.Errorf("postgres: load snapshot: %w", err)
+	}
+	snap.State = state
+	return snap, true, nil
+}
+
+func (s *postgresStore) CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error) {
+	var key []byte
+	err := s.pool.QueryRow(ctx, `SELECT key FROM customer_keys WHERE customer_id = $1`, customerID).Scan(&key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("postgres: load customer key: %w", err)
+	}
+	return key, true, nil
+}
+
+func (s *postgresStore) CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error) {
+	// DO UPDATE с тем же значением нужен, чтобы RETURNING вернул и уже существующую строку
+	err := s.pool.QueryRow(ctx, `
+INSERT INTO customer_keys (customer_id, key) VALUES ($1, $2)
+ON CONFLICT (customer_id) DO UPDATE SET key = customer_keys.key
+RETURNING key`, customerID, key).Scan(&key)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: save customer key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *postgresStore) DeleteCustomerKey(ctx context.Context, customerID string) error {
+	if _, err := s.pool.Exec(ctx, `DELETE FROM customer_keys WHERE customer_id = $1`, customerID); err != nil {
+		return fmt.Errorf("postgres: delete customer key: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) LoadCheckpoint(ctx context.Context, name string) (int64, bool, error) {
+	var position int64
+	err := s.pool.QueryRow(ctx, `SELECT position FROM checkpoints WHERE name = $1`, name).Scan(&position)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("postgres: load checkpoint: %w", err)
+	}
+	return position, true, nil
+}
+
+func (s *postgresStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO checkpoints (name, position) VALUES ($1, $2)
+ON CONFLICT (name) DO UPDATE SET position = excluded.position`, name, position)
+	if err != nil {
+		return fmt.Errorf("postgres: save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) Subscribe(fn func(Event)) func() {
+	return s.subs.subscribe(fn)
+}
+
+func (s *postgresStore) query(ctx context.Context, sql string, args ...any) ([]Event, error) {
+	rows, err := s.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: load: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Event
+	for rows.Next() {
+		var (
+			e          Event
+			meta, data []byte
+		)
+		if err := rows.Scan(&e.Position, &e.Type, &e.OrderID, &e.StreamID, &e.Version, &e.SchemaVersion, &e.Timestamp, &meta, &data); err != nil {
+			return nil, fmt.Errorf("postgres: scan: %w", err)
+		}
+		if err := json.Unmarshal(meta, &e.Metadata); err != nil {
+			return nil, fmt.Errorf("postgres: event %d: bad metadata: %w", e.Position, err)
+		}
+		e.Data = data
+		out = append(out, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres: load: %w", err)
+	}
+	return out, nil
+}
+
+func (s *postgresStore) TrimPrefix(ctx context.Context, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.pool.Exec(ctx,
+		`DELETE FROM events WHERE id IN (SELECT id FROM events ORDER BY id LIMIT $1)`, n)
+	if err != nil {
+		return fmt.Errorf("postgres: trim: %w", err)
+	}
+	return nil
+}
+
+// DeleteStreams удаляет события и снимки заказов одной транзакцией.
+func (s *postgresStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streams := make([]string, len(orderIDs))
+	for i, id := range orderIDs {
+		streams[i] = orderStream(id)
+	}
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM events WHERE order_id = ANY($1)`, orderIDs); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM snapshots WHERE stream_id = ANY($1)`, streams)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("postgres: delete streams: %w", err)
+	}
+	return nil
+}
+
+// SizeBytes — место, занятое таблицей событий вместе с индексами.
+func (s *postgresStore) SizeBytes(ctx context.Context) (int64, error) {
+	var n int64
+	if err := s.pool.QueryRow(ctx, `SELECT pg_total_relation_size('events')`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("postgres: size: %w", err)
+	}
+	return n, nil
+}
+
+func (s *postgresStore) Close() {
+	s.pool.Close()
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Redis Streams store ---
+// Общий поток <stream> содержит весь журнал, <stream>:order:<id> — поток конкретного заказа.
+// Подписчики получают события из XREAD, поэтому видят и записи других инстансов;
+// внешние потребители могут читать тот же поток через consumer groups (XREADGROUP).
+// Версии потоков агрегатов хранятся в hash <stream>:versions, глобальная позиция — счётчик <stream>:position,
+// снимки — в hash <stream>:snapshots, ключи покупателей — в hash <stream>:customer_keys,
+// позиции фоновых обработчиков — в hash <stream>:checkpoints.
+// Sorted set <stream>:index (score — позиция, member — id записи общего потока) и такие же
+// <stream>:type:<type> по типам событий позволяют читать журнал с позиции и по типу без полного XRANGE.
+type redisStore struct {
+	rdb    *redis.Client
+	stream string
+
+	mu   sync.Mutex
+	last string              // id последней записи, отданной Load
+	seen map[string]struct{} // локальные записи, уже разосланные подписчикам
+	tail sync.Once
+	subs subscribers
+}
+
+type redisOptions struct {
+	Addr     string
+	Password string
+	DB       int
+	Stream   string
+}
+
+func newRedisStore(ctx context.Context, opts redisOptions) (*redisStore, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("redis: ping %s: %w", opts.Addr, err)
+	}
+	s := &redisStore{
+		rdb:    rdb,
+		stream: opts.Stream,
+		last:   "0-0",
+		seen:   map[string]struct{}{},
+	}
+	if err := s.ensureIndex(ctx); err != nil {
+		rdb.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *redisStore) indexKey() string {
+	return s.stream + ":index"
+}
+
+func (s *redisStore) typeIndexKey(t EventType) string {
+	return s.stream + ":type:" + string(t)
+}
+
+// ensureIndex дописывает в индексы записи, сделанные до их появления: если в индексе меньше записей,
+// чем в общем потоке, поток читается один раз целиком.
+func (s *redisStore) ensureIndex(ctx context.Context) error {
+	n, err := s.rdb.XLen(ctx, s.stream).Result()
+	if err != nil {
+		return fmt.Errorf("redis: index: %w", err)
+	}
+	indexed, err := s.rdb.ZCard(ctx, s.indexKey()).Result()
+	if err != nil {
+		return fmt.Errorf("redis: index: %w", err)
+	}
+	if indexed >= n {
+		return nil
+	}
+	msgs, err := s.rdb.XRange(ctx, s.stream, "-", "+").Result()
+	if err != nil {
+		return fmt.Errorf("redis: index: %w", err)
+	}
+	events, err := s.positioned(msgs)
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, e := range events {
+			z := redis.Z{Score: float64(e.Position), Member: msgs[i].ID}
+			p.ZAdd(ctx, s.indexKey(), z)
+			p.ZAdd(ctx, s.typeIndexKey(e.Type), z)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis: index: %w", err)
+	}
+	slog.Info("redis: indexed stream", "stream", s.stream, "entries", len(events))
+	return nil
+}
+
+func (s *redisStore) orderStream(orderID string) string {
+	return s.stream + ":order:" + orderID
+}
+
+// redisAppendScript атомарно увеличивает версию потока и глобальную позицию и пишет событие в оба stream.
+// KEYS: общий поток, поток заказа, hash версий, счётчик позиций, индекс позиций, индекс типа события.
+// ARGV: stream_id, ожидаемая версия (-1 — любая), затем пары поле/значение. При конфликте возвращает {"CONFLICT", текущая версия}.
+// Если версии или счётчика ещё нет (данные до их появления), они начинаются с длины соответствующего потока.
+var redisAppendScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[3], ARGV[1]) == 0 then
+	redis.call('HSET', KEYS[3], ARGV[1], redis.call('XLEN', KEYS[2]))
+end
+local current = tonumber(redis.call('HGET', KEYS[3], ARGV[1]))
+local expected = tonumber(ARGV[2])
+if expected >= 0 and expected ~= current then
+	return {'CONFLICT', current}
+end
+redis.call('SET', KEYS[4], redis.call('XLEN', KEYS[1]), 'NX')
+local version = redis.call('HINCRBY', KEYS[3], ARGV[1], 1)
+local position = redis.call('INCR', KEYS[4])
+local fields = {}
+for i = 3, #ARGV do fields[#fields + 1] = ARGV[i] end
+fields[#fields + 1] = 'version'
+fields[#fields + 1] = tostring(version)
+fields[#fields + 1] = 'position'
+fields[#fields + 1] = tostring(position)
+local id = redis.call('XADD', KEYS[1], '*', unpack(fields))
+redis.call('XADD', KEYS[2], '*', unpack(fields))
+redis.call('ZADD', KEYS[5], position, id)
+redis.call('ZADD', KEYS[6], position, id)
+return {id, version, position}
+`)
+
+func redisValues(e Event) ([]any, error) {
+	meta, err := json.Marshal(e.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return []any{
+		"type", string(e.Type),
+		"order_id", e.OrderID,
+		"stream_id", e.StreamID,
+		"schema_version", strconv.Itoa(e.SchemaVersion),
+		"timestamp", e.Timestamp.UTC().Format(time.RFC3339Nano),
+		"metadata", string(meta),
+		"data", string(e.Data),
+	}, nil
+}
+
+func redisEvent(msg redis.XMessage) (Event, error) {
+	str := func(k string) string {
+		v, _ := msg.Values[k].(string)
+		return v
+	}
+	ts, err := time.Parse(time.RFC3339Nano, str("timestamp"))
+	if err != nil {
+		return Event{}, fmt.Errorf("redis: entry %s: bad timestamp: %w", msg.ID, err)
+	}
+	var version, position int64
+	if v := str("version"); v != "" {
+		if version, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return Event{}, fmt.Errorf("redis: entry %s: bad version: %w", msg.ID, err)
+		}
+	}
+	if v := str("position"); v != "" {
+		if position, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return Event{}, fmt.Errorf("redis: entry %s: bad position: %w", msg.ID, err)
+		}
+	}
+	var schema int
+	if v := str("schema_version"); v != "" {
+		if schema, err = strconv.Atoi(v); err != nil {
+			return Event{}, fmt.Errorf("redis: entry %s: bad schema_version: %w", msg.ID, err)
+		}
+	}
+	var meta EventMetadata
+	if v := str("metadata"); v != "" {
+		if err := json.Unmarshal([]byte(v), &meta); err != nil {
+			return Event{}, fmt.Errorf("redis: entry %s: bad metadata: %w", msg.ID, err)
+		}
+	}
+	return Event{
+		Type:          EventType(str("type")),
+		OrderID:       str("order_id"),
+		StreamID:      str("stream_id"),
+		Version:       version,
+		Position:      position,
+		SchemaVersion: schema,
+		Metadata:      meta,
+		Timestamp:     ts,
+		Data:          []byte(str("data")),
+	}, nil
+}
+
+func (s *redisStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	keys := []string{s.stream, s.orderStream(e.OrderID), s.stream + ":versions", s.stream + ":position",
+		s.indexKey(), s.typeIndexKey(e.Type)}
+	values, err := redisValues(e)
+	if err != nil {
+		return Event{}, fmt.Errorf("redis: encode: %w", err)
+	}
+	args := append([]any{e.StreamID, expected}, values...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, err := redisAppendScript.Run(ctx, s.rdb, keys, args...).Slice()
+	if err != nil {
+		return Event{}, fmt.Errorf("redis: append: %w", err)
+	}
+	id, _ := res[0].(string)
+	version, _ := res[1].(int64)
+	if id == "CONFLICT" {
+		return Event{}, &versionConflictError{StreamID: e.StreamID, Expected: expected, Current: version}
+	}
+	e.Version = version
+	e.Position, _ = res[2].(int64)
+	s.seen[id] = struct{}{}
+	s.subs.publish(e)
+	return e, nil
+}
+
+func (s *redisStore) Load(ctx context.Context) ([]Event, error) {
+	out, last, err := s.loadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if last != "" {
+		s.mu.Lock()
+		s.last = last
+		s.mu.Unlock()
+	}
+	return out, nil
+}
+
+// LoadAfter находит по индексу позиций id записей после after и читает их одним XRANGE.
+func (s *redisStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	zs, err := s.indexed(ctx, []string{s.indexKey()}, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.entries(ctx, zs, true)
+}
+
+// redisQueryBatch — сколько записей индекса QueryEvents читает за раз.
+const redisQueryBatch = 1000
+
+// QueryEvents с OrderID читает только поток заказа, с Types — индексы этих типов, иначе индекс позиций;
+// время проверяется после чтения.
+func (s *redisStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	if q.OrderID != "" {
+		events, err := s.LoadByOrderAfter(ctx, q.OrderID, 0)
+		if err != nil {
+			return nil, err
+		}
+		return filterEvents(events, q), nil
+	}
+	keys := []string{s.indexKey()}
+	if len(q.Types) > 0 {
+		keys = keys[:0]
+		for _, t := range q.Types {
+			keys = append(keys, s.typeIndexKey(t))
+		}
+	}
+	var out []Event
+	after := q.After
+	for {
+		zs, err := s.indexed(ctx, keys, after, redisQueryBatch)
+		if err != nil {
+			return nil, err
+		}
+		batch, err := s.entries(ctx, zs, len(q.Types) == 0)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, filterEvents(batch, eventQuery{Types: q.Types, Since: q.Since, Until: q.Until})...)
+		if len(zs) < redisQueryBatch || q.Limit > 0 && len(out) >= q.Limit {
+			return limitEvents(out, q.Limit), nil
+		}
+		after = int64(zs[len(zs)-1].Score)
+	}
+}
+
+// indexed — записи индексов keys с позицией больше after в порядке позиций, не больше limit (0 — все).
+func (s *redisStore) indexed(ctx context.Context, keys []string, after int64, limit int) ([]redis.Z, error) {
+	by := &redis.ZRangeBy{Min: "(" + strconv.FormatInt(after, 10), Max: "+inf", Count: int64(max(limit, 0))}
+	cmds, err := s.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, k := range keys {
+			p.ZRangeByScoreWithScores(ctx, k, by)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis: read index: %w", err)
+	}
+	var zs []redis.Z
+	for _, c := range cmds {
+		zs = append(zs, c.(*redis.ZSliceCmd).Val()...)
+	}
+	if len(keys) > 1 {
+		// из каждого индекса взято не больше limit записей, поэтому первые limit после слияния точны
+		sort.Slice(zs, func(i, j int) bool { return zs[i].Score < zs[j].Score })
+		if limit > 0 && len(zs) > limit {
+			zs = zs[:limit]
+		}
+	}
+	return zs, nil
+}
+
+// entries читает записи общего потока из индекса zs: подряд идущие — одним XRANGE, иначе по одной.
+// Позиция записей без поля position берётся из индекса.
+func (s *redisStore) entries(ctx context.Context, zs []redis.Z, contiguous bool) ([]Event, error) {
+	if len(zs) == 0 {
+		return nil, nil
+	}
+	var msgs []redis.XMessage
+	if contiguous {
+		first, _ := zs[0].Member.(string)
+		last, _ := zs[len(zs)-1].Member.(string)
+		var err error
+		if msgs, err = s.rdb.XRange(ctx, s.stream, first, last).Result(); err != nil {
+			return nil, fmt.Errorf("redis: load: %w", err)
+		}
+	} else {
+		cmds, err := s.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+			for _, z := range zs {
+				id, _ := z.Member.(string)
+				p.XRange(ctx, s.stream, id, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("redis: load: %w", err)
+		}
+		for _, c := range cmds {
+			msgs = append(msgs, c.(*redis.XMessageSliceCmd).Val()...)
+		}
+	}
+	positions := make(map[string]int64, len(zs))
+	for _, z := range zs {
+		id, _ := z.Member.(string)
+		positions[id] = int64(z.Score)
+	}
+	out, err := redisEvents(msgs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range out {
+		if out[i].Position == 0 {
+			out[i].Position = positions[msgs[i].ID]
+		}
+	}
+	return out, nil
+}
+
+// loadAll возвращает общий поток и id последней записи.
+func (s *redisStore) loadAll(ctx context.Context) ([]Event, string, error) {
+	msgs, err := s.rdb.XRange(ctx, s.stream, "-", "+").Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("redis: load: %w", err)
+	}
+	out, err := s.positioned(msgs)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(msgs) == 0 {
+		return out, "", nil
+	}
+	return out, msgs[len(msgs)-1].ID, nil
+}
+
+// positioned декодирует записи общего потока msgs; записям без позиции (до её появления)
+// позиции назначаются по порядку в потоке.
+func (s *redisStore) positioned(msgs []redis.XMessage) ([]Event, error) {
+	out, err := redisEvents(msgs)
+	if err != nil {
+		return nil, err
+	}
+	var prev int64
+	for i := range out {
+		if out[i].Position == 0 {
+			out[i].Position = prev + 1
+		}
+		prev = out[i].Position
+	}
+	return out, nil
+}
+
+func (s *redisStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.LoadByOrderAfter(ctx, orderID, 0)
+}
+
+// LoadByOrderAfter читает поток заказа целиком и отбрасывает события до after.
+// Записям без версии (до её появления) версии назначаются по порядку в потоке.
+func (s *redisStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	msgs, err := s.rdb.XRange(ctx, s.orderStream(orderID), "-", "+").Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis: load order %s: %w", orderID, err)
+	}
+	events, err := redisEvents(msgs)
+	if err != nil {
+		return nil, err
+	}
+	out := events[:0]
+	var prev int64
+	for _, e := range events {
+		if e.Version == 0 {
+			e.Version = prev + 1
+		}
+		prev = e.Version
+		if e.Version > after {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (s *redisStore) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	val, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("redis: encode snapshot: %w", err)
+	}
+	if err := s.rdb.HSet(ctx, s.stream+":snapshots", snap.StreamID, val).Err(); err != nil {
+		return fmt.Errorf("redis: save snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStore) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	val, err := s.rdb.HGet(ctx, s.stream+":snapshots", streamID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, fmt.Errorf("redis: load snapshot: %w", err)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(val, &snap); err != nil {
+		return Snapshot{}, false, fmt.Errorf("redis: decode snapshot: %w", err)
+	}
+	return snap, true, nil
+}
+
+func (s *redisStore) CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error) {
+	key, err := s.rdb.HGet(ctx, s.stream+":customer_keys", customerID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("redis: load customer key: %w", err)
+	}
+	return key, true, nil
+}
+
+func (s *redisStore) CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error) {
+	if err := s.rdb.HSetNX(ctx, s.stream+":customer_keys", customerID, key).Err(); err != nil {
+		return nil, fmt.Errorf("redis: save customer key: %w", err)
+	}
+	stored, _, err := s.CustomerKey(ctx, customerID)
+	return stored, err
+}
+
+func (s *redisStore) DeleteCustomerKey(ctx context.Context, customerID string) error {
+	if err := s.rdb.HDel(ctx, s.stream+":customer_keys", customerID).Err(); err != nil {
+		return fmt.Errorf("redis: delete customer key: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStore) LoadCheckpoint(ctx context.Context, name string) (int64, bool, error) {
+	position, err := s.rdb.HGet(ctx, s.stream+":checkpoints", name).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("redis: load checkpoint: %w", err)
+	}
+	return position, true, nil
+}
+
+func (s *redisStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	if err := s.rdb.HSet(ctx, s.stream+":checkpoints", name, position).Err(); err != nil {
+		return fmt.Errorf("redis: save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func redisEvents(msgs []redis.XMessage) ([]Event, error) {
+	out := make([]Event, 0, len(msgs))
+	for _, m := range msgs {
+		e, err := redisEvent(m)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// Subscribe запускает чтение потока с позиции, на которой остановился последний Load.
+func (s *redisStore) Subscribe(fn func(Event)) func() {
+	s.tail.Do(func() {
+		s.mu.Lock()
+		from := s.last
+		s.mu.Unlock()
+		go s.follow(from)
+	})
+	return s.subs.subscribe(fn)
+}
+
+func (s *redisStore) follow(from string) {
+	ctx := context.Background()
+	for {
+		res, err := s.rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{s.stream, from},
+			Block:   5 * time.Second,
+			Count:   100,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if errors.Is(err, redis.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("redis: tail", "stream", s.stream, "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, st := range res {
+			for _, msg := range st.Messages {
+				from = msg.ID
+				s.mu.Lock()
+				_, local := s.seen[msg.ID]
+				delete(s.seen, msg.ID)
+				s.mu.Unlock()
+				if local {
+					continue
+				}
+				e, err := redisEvent(msg)
+				if err != nil {
+					slog.Error("redis: decode event", "stream", s.stream, "message_id", msg.ID, "error", err)
+					continue
+				}
+				s.subs.publish(e)
+			}
+		}
+	}
+}
+
+// DeleteStreams удаляет записи заказов из общего потока (XDEL) и индексов, их потоки, версии и снимки.
+// Общий поток не индексирован по заказу, поэтому он читается целиком.
+func (s *redisStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	msgs, err := s.rdb.XRange(ctx, s.stream, "-", "+").Result()
+	if err != nil {
+		return fmt.Errorf("redis: delete streams: %w", err)
+	}
+	drop := make(map[string]bool, len(orderIDs))
+	for _, id := range orderIDs {
+		drop[id] = true
+	}
+	var ids []string
+	byType := map[EventType][]any{}
+	for _, m := range msgs {
+		if id, _ := m.Values["order_id"].(string); drop[id] {
+			ids = append(ids, m.ID)
+			t, _ := m.Values["type"].(string)
+			byType[EventType(t)] = append(byType[EventType(t)], m.ID)
+		}
+	}
+	streams := make([]string, len(orderIDs))
+	keys := make([]string, len(orderIDs))
+	for i, id := range orderIDs {
+		streams[i] = orderStream(id)
+		keys[i] = s.orderStream(id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		if len(ids) > 0 {
+			p.XDel(ctx, s.stream, ids...)
+			members := make([]any, len(ids))
+			for i, id := range ids {
+				members[i] = id
+			}
+			p.ZRem(ctx, s.indexKey(), members...)
+		}
+		for t, members := range byType {
+			p.ZRem(ctx, s.typeIndexKey(t), members...)
+		}
+		p.Del(ctx, keys...)
+		p.HDel(ctx, s.stream+":versions", streams...)
+		p.HDel(ctx, s.stream+":snapshots", streams...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis: delete streams: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStore) Close() error {
+	return s.rdb.Close()
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// --- SQLite store ---
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	type      TEXT    NOT NULL,
+	order_id  TEXT    NOT NULL,
+	timestamp TEXT    NOT NULL,
+	data      BLOB    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_order_id_idx ON events (order_id, id);
+CREATE INDEX IF NOT EXISTS events_type_idx ON events (type, id);
+-- timestamp хранится как RFC 3339 с переменной длиной дробной части, строки сравнивать нельзя
+CREATE INDEX IF NOT EXISTS events_time_idx ON events (julianday(timestamp));
+
+CREATE TABLE IF NOT EXISTS snapshots (
+	stream_id TEXT PRIMARY KEY,
+	version   INTEGER NOT NULL,
+	timestamp TEXT    NOT NULL,
+	state     BLOB    NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS customer_keys (
+	customer_id TEXT PRIMARY KEY,
+	key         BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS checkpoints (
+	name     TEXT PRIMARY KEY,
+	position INTEGER NOT NULL
+);
+`
+
+// миграция на потоки агрегатов; строки, записанные до появления версий, нумеруются по порядку id
+const sqliteStreamsMigration = `
+ALTER TABLE events ADD COLUMN stream_id TEXT;
+ALTER TABLE events ADD COLUMN version INTEGER;
+UPDATE events SET stream_id = 'order-' || order_id,
+	version = (SELECT COUNT(*) FROM events e2 WHERE e2.order_id = events.order_id AND e2.id <= events.id);
+`
+
+const sqliteStreamsIndex = `
+CREATE UNIQUE INDEX IF NOT EXISTS events_stream_version_idx ON events (stream_id, version);
+`
+
+type sqliteStore struct {
+	mu   sync.Mutex // SQLite всё равно пишет в один поток; держим порядок уведомлений
+	db   *sql.DB
+	subs subscribers
+}
+
+func newSQLiteStore(ctx context.Context, path string) (*sqliteStore, error) {
+	// в URI "?" и "#" начинают параметры и фрагмент — в пути их нужно экранировать
+	uriPath := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(FULL)&_pragma=secure_delete(ON)&_txlock=immediate", uriPath)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: open %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: bootstrap schema: %w", err)
+	}
+	if err := sqliteMigrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+const sqliteMetadataMigration = `
+ALTER TABLE events ADD COLUMN metadata BLOB NOT NULL DEFAULT '{}';
+`
+
+const sqliteSchemaVersionMigration = `
+ALTER TABLE events ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 1;
+`
+
+func sqliteMigrate(ctx context.Context, db *sql.DB) error {
+	hasVersion, err := sqliteHasColumn(ctx, db, "events", "version")
+	if err != nil {
+		return err
+	}
+	if !hasVersion {
+		if _, err := db.ExecContext(ctx, sqliteStreamsMigration); err != nil {
+			return fmt.Errorf("sqlite: migrate streams: %w", err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, sqliteStreamsIndex); err != nil {
+		return fmt.Errorf("sqlite: migrate streams: %w", err)
+	}
+	hasMetadata, err := sqliteHasColumn(ctx, db, "events", "metadata")
+	if err != nil {
+		return err
+	}
+	if !hasMetadata {
+		if _, err := db.ExecContext(ctx, sqliteMetadataMigration); err != nil {
+			return fmt.Errorf("sqlite: migrate metadata: %w", err)
+		}
+	}
+	hasSchemaVersion, err := sqliteHasColumn(ctx, db, "events", "schema_version")
+	if err != nil {
+		return err
+	}
+	if !hasSchemaVersion {
+		if _, err := db.ExecContext(ctx, sqliteSchemaVersionMigration); err != nil {
+			return fmt.Errorf("sqlite: migrate schema_version: %w", err)
+		}
+	}
+	return nil
+}
+
+func sqliteHasColumn(ctx context.Context, db *sql.DB, table, column string) (bool, error) {
+	var ok bool
+	err := db.QueryRowContext(ctx,
+		`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&ok)
+	if err != nil {
+		return false, fmt.Errorf("sqlite: inspect schema: %w", err)
+	}
+	return ok, nil
+}
+
+func (s *sqliteStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.insert(ctx, &e, expected); err != nil {
+		return Event{}, err
+	}
+	s.subs.publish(e)
+	return e, nil
+}
+
+func (s *sqliteStore) insert(ctx context.Context, e *Event, expected int64) error {
+	// _txlock=immediate: блокировка на запись берётся сразу, проверка версии не устареет до INSERT
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlite: append: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM events WHERE stream_id = ?`, e.StreamID).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("sqlite: append: %w", err)
+	}
+	if err := checkVersion(e.StreamID, expected, current); err != nil {
+		return err
+	}
+	e.Version = current + 1
+	meta, err := json.Marshal(e.Metadata)
+	if err != nil {
+		return fmt.Errorf("sqlite: encode metadata: %w", err)
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO events (type, order_id, stream_id, version, schema_version, timestamp, metadata, data) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		string(e.Type), e.OrderID, e.StreamID, e.Version, e.SchemaVersion, e.Timestamp.UTC().Format(time.RFC3339Nano), meta, []byte(e.Data))
+	if err != nil {
+		return fmt.Errorf("sqlite: append: %w", err)
+	}
+	// AUTOINCREMENT не переиспользует id, поэтому он годится как глобальная позиция
+	if e.Position, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("sqlite: append: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("sqlite: append: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Load(ctx context.Context) ([]Event, error) {
+	return s.query(ctx, `SELECT id, type, order_id, stream_id, version, schema_version, timestamp, metadata, data FROM events ORDER BY id`)
+}
+
+func (s *sqliteStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	return s.QueryEvents(ctx, eventQuery{After: after, Limit: limit})
+}
+
+func (s *sqliteStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "?"
+	}
+	where := q.sqlWhere(arg, "julianday(timestamp)", func(t time.Time) string {
+		return "julianday(" + arg(t.UTC().Format(time.RFC3339Nano)) + ")"
+	})
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1 // LIMIT -1 — без ограничения
+	}
+	return s.query(ctx, `SELECT id, type, order_id, stream_id, version, schema_version, timestamp, metadata, data FROM events WHERE `+where+` ORDER BY id LIMIT `+arg(limit), args...)
+}
+
+func (s *sqliteStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	return s.query(ctx, `SELECT id, type, order_id, stream_id, version, schema_version, timestamp, metadata, data FROM events WHERE order_id = ? ORDER BY id`, orderID)
+}
+
+func (s *sqliteStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	return s.query(ctx, `SELECT id, type, order_id, stream_id, version, schema_version, timestamp, metadata, data FROM events WHERE order_id = ? AND version > ? ORDER BY id`, orderID, after)
+}
+
+func (s *sqliteStore) SaveSnapshot(ctx context.Context, snap Snapshot) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO snapshots (stream_id, version, timestamp, state) VALUES (?, ?, ?, ?)
+ON CONFLICT (stream_id) DO UPDATE SET version = excluded.version, timestamp = excluded.timestamp, state = excluded.state
+WHERE snapshots.version < excluded.version`,
+		snap.StreamID, snap.Version, snap.Timestamp.UTC().Format(time.RFC3339Nano), []byte(snap.State))
+	if err != nil {
+		return fmt.Errorf("sqlite: save snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) LoadSnapshot(ctx context.Context, streamID string) (Snapshot, bool, error) {
+	snap := Snapshot{StreamID: streamID}
+	var (
+		ts    string
+		state []byte
+	)
+	err := s.db.QueryRowContext(ctx,
+		`SELECT version, timestamp, state FROM snapshots WHERE stream_id = ?`, streamID).Scan(&snap.Version, &ts, &state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, fmt.Errorf("sqlite: load snapshot: %w", err)
+	}
+	if snap.Timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+		return Snapshot{}, false, fmt.Errorf("sqlite: bad snapshot timestamp %q: %w", ts, err)
+	}
+	snap.State = state
+	return snap, true, nil
+}
+
+func (s *sqliteStore) CustomerKey(ctx context.Context, customerID string) ([]byte, bool, error) {
+	var key []byte
+	err := s.db.QueryRowContext(ctx, `SELECT key FROM customer_keys WHERE customer_id = ?`, customerID).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("sqlite: load customer key: %w", err)
+	}
+	return key, true, nil
+}
+
+func (s *sqliteStore) CreateCustomerKey(ctx context.Context, customerID string, key []byte) ([]byte, error) {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO customer_keys (customer_id, key) VALUES (?, ?) ON CONFLICT (customer_id) DO NOTHING`, customerID, key)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: save customer key: %w", err)
+	}
+	stored, _, err := s.CustomerKey(ctx, customerID)
+	return stored, err
+}
+
+// DeleteCustomerKey удаляет ключ; secure_delete затирает освободившиеся страницы файла.
+func (s *sqliteStore) DeleteCustomerKey(ctx context.Context, customerID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM customer_keys WHERE customer_id = ?`, customerID)
+	if err != nil {
+		return fmt.Errorf("sqlite: delete customer key: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) LoadCheckpoint(ctx context.Context, name string) (int64, bool, error) {
+	var position int64
+	err := s.db.QueryRowContext(ctx, `SELECT position FROM checkpoints WHERE name = ?`, name).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("sqlite: load checkpoint: %w", err)
+	}
+	return position, true, nil
+}
+
+func (s *sqliteStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO checkpoints (name, position) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET position = excluded.position`,
+		name, position)
+	if err != nil {
+		return fmt.Errorf("sqlite: save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Subscribe(fn func(Event)) func() {
+	return s.subs.subscribe(fn)
+}
+
+func (s *sqliteStore) query(ctx context.Context, query string, args ...any) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: load: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Event
+	for rows.Next() {
+		var (
+			e          Event
+			typ, ts    string
+			meta, data []byte
+		)
+		if err := rows.Scan(&e.Position, &typ, &e.OrderID, &e.StreamID, &e.Version, &e.SchemaVersion, &ts, &meta, &data); err != nil {
+			return nil, fmt.Errorf("sqlite: scan: %w", err)
+		}
+		if err := json.Unmarshal(meta, &e.Metadata); err != nil {
+			return nil, fmt.Errorf("sqlite: event %d: bad metadata: %w", e.Position, err)
+		}
+		if e.Timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return nil, fmt.Errorf("sqlite: bad timestamp %q: %w", ts, err)
+		}
+		e.Type = EventType(typ)
+		e.Data = data
+		out = append(out, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite: load: %w", err)
+	}
+	return out, nil
+}
+
+func (s *sqliteStore) TrimPrefix(ctx context.Context, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM events WHERE id IN (SELECT id FROM events ORDER BY id LIMIT ?)`, n)
+	if err != nil {
+		return fmt.Errorf("sqlite: trim: %w", err)
+	}
+	return nil
+}
+
+// DeleteStreams удаляет события и снимки заказов одной транзакцией.
+func (s *sqliteStore) DeleteStreams(ctx context.Context, orderIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlite: delete streams: %w", err)
+	}
+	defer tx.Rollback()
+	for _, id := range orderIDs {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM events WHERE order_id = ?`, id); err != nil {
+			return fmt.Errorf("sqlite: delete streams: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM snapshots WHERE stream_id = ?`, orderStream(id)); err != nil {
+			return fmt.Errorf("sqlite: delete streams: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("sqlite: delete streams: %w", err)
+	}
+	return nil
+}
+
+// SizeBytes — размер файла базы по числу страниц.
+func (s *sqliteStore) SizeBytes(ctx context.Context) (int64, error) {
+	var n int64
+	if err := s.db.QueryRowContext(ctx, `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("sqlite: size: %w", err)
+	}
+	return n, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// --- EventStore conformance ---
+// Одни и те же проверки контракта EventStore (store.go) для каждого backend, которому не нужен внешний сервер.
+
+// conformanceBackend открывает хранилище; reopen открывает его заново на тех же данных,
+// у хранилища в памяти — возвращает то же.
+type conformanceBackend struct {
+	name string
+	open func(t *testing.T) (store EventStore, reopen func() EventStore)
+}
+
+var conformanceBackends = []conformanceBackend{
+	{"memory", func(t *testing.T) (EventStore, func() EventStore) {
+		s := newMemoryStore()
+		return s, func() EventStore { return s }
+	}},
+	{"file", func(t *testing.T) (EventStore, func() EventStore) {
+		path := filepath.Join(t.TempDir(), "events.jsonl")
+		open := func() EventStore {
+			s, err := newFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		}
+		return open(), open
+	}},
+	{"sqlite", func(t *testing.T) (EventStore, func() EventStore) {
+		path := filepath.Join(t.TempDir(), "events.db")
+		open := func() EventStore {
+			s, err := newSQLiteStore(context.Background(), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		}
+		return open(), open
+	}},
+	{"bolt", func(t *testing.T) (EventStore, func() EventStore) {
+		path := filepath.Join(t.TempDir(), "events.bolt")
+		var current *boltStore
+		open := func() EventStore {
+			if current != nil {
+				current.Close() // bbolt держит файл под эксклюзивной блокировкой
+			}
+			s, err := newBoltStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			current = s
+			return s
+		}
+		t.Cleanup(func() { current.Close() })
+		return open(), open
+	}},
+}
+
+var storeEpoch = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// testEvent — событие заказа orderID с временем storeEpoch + minutes.
+func testEvent(typ EventType, orderID string, minutes int) Event {
+	return Event{
+		Type:      typ,
+		OrderID:   orderID,
+		StreamID:  orderStream(orderID),
+		Timestamp: storeEpoch.Add(time.Duration(minutes) * time.Minute),
+		Data:      []byte(`{"order_id":"` + orderID + `"}`),
+	}
+}
+
+func mustAppend(t *testing.T, s EventStore, e Event, expected int64) Event {
+	t.Helper()
+	stored, err := s.Append(context.Background(), e, expected)
+	if err != nil {
+		t.Fatalf("append %s %s: %v", e.Type, e.OrderID, err)
+	}
+	return stored
+}
+
+func positions(events []Event) []int64 {
+	out := make([]int64, len(events))
+	for i, e := range events {
+		out[i] = e.Position
+	}
+	return out
+}
+
+func equalPositions(got []Event, want ...int64) bool {
+	return slices.Equal(positions(got), want)
+}
+
+func orderIDs(events []Event) []string {
+	out := make([]string, len(events))
+	for i, e := range events {
+		out[i] = e.OrderID + "/" + string(e.Type)
+	}
+	return out
+}
+
+func TestEventStoreConformance(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, s EventStore, reopen func() EventStore)
+	}{
+		{"append checks expected version", func(t *testing.T, s EventStore, _ func() EventStore) {
+			first := mustAppend(t, s, testEvent(EventOrderCreated, "o1", 0), 0)
+			if first.Version != 1 {
+				t.Fatalf("version = %d, want 1", first.Version)
+			}
+			_, err := s.Append(context.Background(), testEvent(EventOrderShipped, "o1", 1), 0)
+			var conflict *versionConflictError
+			if !errors.As(err, &conflict) {
+				t.Fatalf("append with stale version: err = %v, want *versionConflictError", err)
+			}
+			if conflict.Expected != 0 || conflict.Current != 1 {
+				t.Fatalf("conflict = %+v, want expected 0, current 1", conflict)
+			}
+			if second := mustAppend(t, s, testEvent(EventOrderShipped, "o1", 1), 1); second.Version != 2 {
+				t.Fatalf("version = %d, want 2", second.Version)
+			}
+			if third := mustAppend(t, s, testEvent(EventOrderDelivered, "o1", 2), anyVersion); third.Version != 3 {
+				t.Fatalf("version = %d, want 3", third.Version)
+			}
+			events, err := s.LoadByOrder(context.Background(), "o1")
+			if err != nil || len(events) != 3 {
+				t.Fatalf("load order: %d events, err %v; want 3", len(events), err)
+			}
+		}},
+		{"load by order", func(t *testing.T, s EventStore, _ func() EventStore) {
+			mustAppend(t, s, testEvent(EventOrderCreated, "o1", 0), anyVersion)
+			mustAppend(t, s, testEvent(EventOrderCreated, "o2", 1), anyVersion)
+			mustAppend(t, s, testEvent(EventOrderCanceled, "o1", 2), anyVersion)
+			events, err := s.LoadByOrder(context.Background(), "o1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := orderIDs(events); len(got) != 2 || got[0] != "o1/OrderCreated" || got[1] != "o1/OrderCanceled" {
+				t.Fatalf("load order = %v", got)
+			}
+			if events, err := s.LoadByOrder(context.Background(), "missing"); err != nil || len(events) != 0 {
+				t.Fatalf("load missing order = %v, %v; want none", orderIDs(events), err)
+			}
+		}},
+		{"versions count per stream", func(t *testing.T, s EventStore, _ func() EventStore) {
+			for i, want := range []struct {
+				id      string
+				version int64
+			}{{"o1", 1}, {"o2", 1}, {"o1", 2}, {"o1", 3}, {"o2", 2}} {
+				if e := mustAppend(t, s, testEvent(EventOrderCreated, want.id, i), anyVersion); e.Version != want.version {
+					t.Fatalf("append %d to %s: version %d, want %d", i, want.id, e.Version, want.version)
+				}
+			}
+		}},
+		{"subscribers see appends", func(t *testing.T, s EventStore, _ func() EventStore) {
+			var seen []Event
+			unsubscribe := s.Subscribe(func(e Event) { seen = append(seen, e) })
+			mustAppend(t, s, testEvent(EventOrderCreated, "o1", 0), anyVersion)
+			unsubscribe()
+			mustAppend(t, s, testEvent(EventOrderShipped, "o1", 1), anyVersion)
+			if len(seen) != 1 || seen[0].Type != EventOrderCreated {
+				t.Fatalf("subscriber saw %v, want only o1/OrderCreated", orderIDs(seen))
+			}
+		}},
+		{"positions increase across streams", func(t *testing.T, s EventStore, _ func() EventStore) {
+			var last int64
+			for i, id := range []string{"o1", "o2", "o1", "o3", "o2"} {
+				e := mustAppend(t, s, testEvent(EventOrderCreated, id, i), anyVersion)
+				if e.Position <= last {
+					t.Fatalf("append %d: position %d after %d", i, e.Position, last)
+				}
+				last = e.Position
+			}
+			events, err := s.Load(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < len(events); i++ {
+				if events[i].Position <= events[i-1].Position {
+					t.Fatalf("load: positions %v are not increasing", positions(events))
+				}
+			}
+		}},
+		{"load after with limit", func(t *testing.T, s EventStore, _ func() EventStore) {
+			var all []Event
+			for i := range 5 {
+				all = append(all, mustAppend(t, s, testEvent(EventOrderCreated, "o1", i), anyVersion))
+			}
+			ctx := context.Background()
+			got, err := s.LoadAfter(ctx, all[1].Position, 2)
+			if err != nil || !equalPositions(got, all[2].Position, all[3].Position) {
+				t.Fatalf("LoadAfter(%d, 2) = %v, %v", all[1].Position, positions(got), err)
+			}
+			got, err = s.LoadAfter(ctx, all[1].Position, 0)
+			if err != nil || !equalPositions(got, all[2].Position, all[3].Position, all[4].Position) {
+				t.Fatalf("LoadAfter(%d, 0) = %v, %v", all[1].Position, positions(got), err)
+			}
+			got, err = s.LoadAfter(ctx, all[4].Position, 10)
+			if err != nil || len(got) != 0 {
+				t.Fatalf("LoadAfter(last) = %v, %v; want none", positions(got), err)
+			}
+		}},
+		{"query events filters", func(t *testing.T, s EventStore, _ func() EventStore) {
+			e := []Event{
+				mustAppend(t, s, testEvent(EventOrderCreated, "o1", 0), anyVersion),
+				mustAppend(t, s, testEvent(EventOrderCreated, "o2", 10), anyVersion),
+				mustAppend(t, s, testEvent(EventOrderShipped, "o1", 20), anyVersion),
+				mustAppend(t, s, testEvent(EventOrderCanceled, "o2", 30), anyVersion),
+				mustAppend(t, s, testEvent(EventOrderDelivered, "o1", 40), anyVersion),
+			}
+			queries := []struct {
+				name string
+				q    eventQuery
+				want []int64
+			}{
+				{"all", eventQuery{}, positions(e)},
+				{"after", eventQuery{After: e[2].Position}, positions(e[3:])},
+				{"limit", eventQuery{Limit: 2}, positions(e[:2])},
+				{"types", eventQuery{Types: []EventType{EventOrderShipped, EventOrderCanceled}}, positions(e[2:4])},
+				{"order", eventQuery{OrderID: "o2"}, []int64{e[1].Position, e[3].Position}},
+				{"order and type", eventQuery{OrderID: "o1", Types: []EventType{EventOrderCreated}}, positions(e[:1])},
+				{"since", eventQuery{Since: storeEpoch.Add(20 * time.Minute)}, positions(e[2:])},
+				{"until", eventQuery{Until: storeEpoch.Add(20 * time.Minute)}, positions(e[:2])},
+				{"type after limit", eventQuery{Types: []EventType{EventOrderCreated, EventOrderDelivered}, After: e[0].Position, Limit: 1}, positions(e[1:2])},
+			}
+			for _, qc := range queries {
+				got, err := s.QueryEvents(context.Background(), qc.q)
+				if err != nil || !equalPositions(got, qc.want...) {
+					t.Errorf("%s: QueryEvents = %v, %v; want %v", qc.name, positions(got), err, qc.want)
+				}
+			}
+		}},
+		{"persists metadata, schema version and position", func(t *testing.T, s EventStore, reopen func() EventStore) {
+			in := testEvent(EventOrderCreated, tenantOrderID("acme", "o1"), 0)
+			in.SchemaVersion = 2
+			in.Metadata = EventMetadata{
+				CorrelationID: "corr-1",
+				CausationID:   "cause-1",
+				Actor:         "apikey:ci",
+				CommandID:     "key-1",
+				TraceParent:   "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				Tenant:        "acme",
+				QuotaTenant:   "acme",
+				Signature:     "sig",
+			}
+			stored := mustAppend(t, s, in, 0)
+			events, err := reopen().Load(context.Background())
+			if err != nil || len(events) != 1 {
+				t.Fatalf("load after reopen: %d events, err %v; want 1", len(events), err)
+			}
+			got := events[0]
+			if got.Metadata != in.Metadata {
+				t.Errorf("metadata = %+v, want %+v", got.Metadata, in.Metadata)
+			}
+			if got.SchemaVersion != 2 {
+				t.Errorf("schema version = %d, want 2", got.SchemaVersion)
+			}
+			if got.Position != stored.Position || got.Version != 1 {
+				t.Errorf("position/version = %d/%d, want %d/1", got.Position, got.Version, stored.Position)
+			}
+			if !got.Timestamp.Equal(in.Timestamp) || got.StreamID != in.StreamID || string(got.Data) != string(in.Data) {
+				t.Errorf("event = %+v, want %+v", got, in)
+			}
+		}},
+	}
+	for _, b := range conformanceBackends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					s, reopen := b.open(t)
+					c.run(t, s, reopen)
+				})
+			}
+		})
+	}
+}
+
+func TestSQLiteStorePathWithURICharacters(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "a#b?c%20")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "events.db")
+	s, err := newSQLiteStore(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	mustAppend(t, s, testEvent(EventOrderCreated, "o1", 0), anyVersion)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("database is not at %s: %v", path, err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Live event feed ---
+// eventFollower отдаёт в C события после заданной позиции: сначала из журнала, затем новые, по порядку позиций.
+// Подписка оформляется до чтения журнала, поэтому событие, записанное между ними, не теряется,
+// а пришедшее дважды отбрасывается по позиции. C закрывается при отмене контекста, ошибке чтения,
+// остановке сервиса или когда клиент не успевает за записью (буфер LIVE_BUFFER); причину возвращает Err.
+type eventFollower struct {
+	C   <-chan Event
+	err error
+}
+
+var errSlowConsumer = errors.New("client is too slow, reconnect from the last received position")
+
+func followEvents(ctx context.Context, after int64) *eventFollower {
+	out := make(chan Event)
+	f := &eventFollower{C: out}
+	live := make(chan Event, getenvInt("LIVE_BUFFER", 1024))
+	overflow := make(chan struct{})
+	var once sync.Once
+	unsubscribe := store.Subscribe(func(e Event) {
+		select {
+		case live <- e:
+		default:
+			once.Do(func() { close(overflow) })
+		}
+	})
+	go func() {
+		defer close(out)
+		defer unsubscribe()
+		send := func(e Event) bool {
+			if e.Position <= after || !tenantOwns(ctx, e.OrderID) {
+				return true
+			}
+			select {
+			case out <- sensitive.event(ctx, e): // новые события приходят с зашифрованными полями (pii.go)
+				after = e.Position
+				return true
+			case <-ctx.Done():
+				f.err = ctx.Err()
+				return false
+			}
+		}
+		backlog, err := store.LoadAfter(ctx, after, 0)
+		if err != nil {
+			f.err = err
+			return
+		}
+		for _, e := range backlog {
+			if !send(e) {
+				return
+			}
+		}
+		for {
+			select {
+			case e := <-live:
+				if !send(e) {
+					return
+				}
+			case <-overflow:
+				f.err = errSlowConsumer
+				return
+			case <-draining:
+				f.err = errShuttingDown
+				return
+			case <-ctx.Done():
+				f.err = ctx.Err()
+				return
+			}
+		}
+	}()
+	return f
+}
+
+// Err возвращает причину закрытия C; вызывать после того, как C закрыт.
+func (f *eventFollower) Err() error {
+	return f.err
+}
+
+// --- Server-Sent Events ---
+// GET /events/stream отдаёт новые события как text/event-stream: id — позиция события, event — его тип.
+// Браузерный EventSource при переподключении сам присылает Last-Event-ID и продолжает с того же места;
+// ?after=<position> задаёт начальную позицию явно. Без них поток начинается с начала журнала.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	after, err := streamStart(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx не должен копить поток в буфере
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	f := followEvents(r.Context(), after)
+	heartbeat := time.NewTicker(getenvDuration("SSE_HEARTBEAT", 15*time.Second))
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-f.C:
+			if !ok {
+				if err := f.Err(); err != nil && !errors.Is(err, context.Canceled) {
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+					flusher.Flush()
+				}
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Position, e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			// комментарий не даёт прокси закрыть простаивающее соединение
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// streamStart читает позицию, после которой начинать поток: Last-Event-ID важнее ?after.
+func streamStart(r *http.Request) (int64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("after")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid position %q: expected event position", v)
+	}
+	return n, nil
+}
+
+// pollEvents выполняет запрос к журналу; если событий нет, ждёт до wait первого подходящего нового события
+// (long-poll). Подписка оформляется до первого запроса, поэтому событие, записанное между ними, будит ожидание.
+// Ожидание заканчивается за секунду до срока запроса (HTTP_REQUEST_TIMEOUT): пустой ответ лучше 503.
+func pollEvents(ctx context.Context, eq eventQuery, wait time.Duration) ([]Event, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		wait = min(wait, time.Until(dl)-time.Second)
+	}
+	if wait <= 0 {
+		return store.QueryEvents(ctx, eq)
+	}
+	wake := make(chan struct{}, 1)
+	unsubscribe := store.Subscribe(func(Event) {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		events, err := store.QueryEvents(ctx, eq)
+		if err != nil || len(events) > 0 {
+			return events, err
+		}
+		select {
+		case <-wake:
+		case <-timeout.C:
+			return events, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// --- Multi-tenancy ---
+// С MULTI_TENANT заказы и их журнал разделены между арендаторами. Арендатор запроса — claim TENANT_CLAIM
+// токена (tenant_id), поле tenant ключа API или заголовок TENANT_HEADER (X-Tenant-ID; в gRPC — метаданные
+// x-tenant-id). Привязанные к арендатору учётные данные другого арендатора в заголовке не допускают (403);
+// не привязанные — сервисные — выбирают арендатора заголовком. Id нового заказа — <tenant>:<uuid>, его
+// поток в журнале — <tenant>/order-<uuid>, арендатор записан в метаданных событий и в заказе.
+// Запрос арендатора видит только его заказы и события (read model, поиск, GraphQL, журнал, SSE, WebSocket,
+// gRPC), отложенные команды над его заказами и свои асинхронные команды: чужой заказ для него не существует
+// — 404, а команду над ним шина отклоняет так же. Без арендатора обходится только область admin — она видит
+// всех. Webhooks арендатора получают только события его заказов, а чужие подписки ему не видны (webhooks.go).
+// Склад, статистика и /admin общие для сервиса; закрыть их от арендаторов можно через RBAC_ROUTES.
+
+const tenantSeparator = ":"
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+var (
+	errTenantRequired = errors.New("tenant is required")
+	errInvalidTenant  = errors.New("invalid tenant")
+)
+
+type tenantOptions struct {
+	Header string // заголовок запроса с арендатором
+	Claim  string // claim JWT с арендатором
+}
+
+// tenancy — настройки MULTI_TENANT; nil — арендатор один.
+var tenancy *tenantOptions
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom — арендатор запроса; "" — без ограничения.
+func tenantFrom(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+// tenantOrderID — id заказа id арендатора tenant.
+func tenantOrderID(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + tenantSeparator + id
+}
+
+// orderTenant — арендатор заказа по его id; "" — заказ без арендатора или не заказ.
+func orderTenant(orderID string) string {
+	if t, _, ok := strings.Cut(orderID, tenantSeparator); ok {
+		return t
+	}
+	return ""
+}
+
+// tenantOwns — заказ виден запросу с контекстом ctx.
+func tenantOwns(ctx context.Context, orderID string) bool {
+	return tenantSees(ctx, orderTenant(orderID))
+}
+
+// tenantSees — запись арендатора tenant ("" — общая для сервиса) видна запросу с контекстом ctx.
+func tenantSees(ctx context.Context, tenant string) bool {
+	t := tenantFrom(ctx)
+	return t == "" || tenant == t
+}
+
+// foreignOrder — заказ принадлежит другому арендатору; потоки без арендатора (расписания, склад) не чужие.
+func foreignOrder(ctx context.Context, orderID string) bool {
+	t, owner := tenantFrom(ctx), orderTenant(orderID)
+	return t != "" && owner != "" && owner != t
+}
+
+// resolve — арендатор запроса по учётным данным в ctx и заголовку header.
+func (o *tenantOptions) resolve(ctx context.Context, header string) (string, error) {
+	var bound string
+	if k := apiKeyFrom(ctx); k != nil {
+		bound = k.Tenant
+	} else if c := jwtClaimsFrom(ctx); c != nil {
+		bound = c.string(o.Claim)
+	}
+	tenant := cmp.Or(bound, header)
+	switch {
+	case bound != "" && header != "" && header != bound:
+		return "", fmt.Errorf("%w: credentials are bound to tenant %q", errForbidden, bound)
+	case tenant == "":
+		if scopes, _ := rbac.granted(ctx, false); slices.Contains(scopes, scopeAdmin) {
+			return "", nil
+		}
+		return "", fmt.Errorf("%w: send %s", errTenantRequired, o.Header)
+	case !tenantPattern.MatchString(tenant):
+		return "", fmt.Errorf("%w %q: expected %s", errInvalidTenant, tenant, tenantPattern)
+	}
+	return tenant, nil
+}
+
+// middleware — звено mux после RBAC: арендатор в контексте запроса, чужой заказ — 404.
+func (o *tenantOptions) middleware(next http.Handler) http.Handler {
+	if o == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr := mux.CurrentRoute(r)
+		if cr == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, err := cr.GetPathTemplate()
+		if err != nil || probeRoutes[route] || publicRoutes[route] {
+			next.ServeHTTP(w, r) // прослойка registerLegacyAPI: арендатора проверит переписанный запрос
+			return
+		}
+		tenant, err := o.resolve(r.Context(), r.Header.Get(o.Header))
+		switch {
+		case errors.Is(err, errForbidden):
+			writeError(w, err, http.StatusForbidden)
+			return
+		case err != nil:
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		ctx := withTenant(r.Context(), tenant)
+		if id, ok := mux.Vars(r)["id"]; ok && strings.HasPrefix(route, apiVersionPrefix+"/orders/{id}") && !tenantOwns(ctx, id) {
+			writeError(w, fmt.Errorf("%w: %s", errOrderNotFound, id), http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// grpcTenant — арендатор вызова gRPC после authorizeGRPC.
+func (o *tenantOptions) grpcTenant(ctx context.Context, method string) (context.Context, error) {
+	if o == nil || strings.HasPrefix(method, "/grpc.reflection.") {
+		return ctx, nil
+	}
+	var header string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(strings.ToLower(o.Header)); len(v) > 0 {
+			header = v[0]
+		}
+	}
+	tenant, err := o.resolve(ctx, header)
+	switch {
+	case errors.Is(err, errForbidden):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return withTenant(ctx, tenant), nil
+}
+
+// isolateTenants — звено шины: команда арендатора над чужим заказом — как над несуществующим.
+func isolateTenants(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		t := c.Target()
+		if t.Metadata.Tenant != "" && t.OrderID != "" && orderTenant(t.OrderID) != t.Metadata.Tenant {
+			return Event{}, false, fmt.Errorf("%w: %s", errOrderNotFound, t.OrderID)
+		}
+		return next(ctx, c)
+	}
+}
+
+// tenantStore — журнал, из которого запрос арендатора читает только события его заказов.
+// Проекции, саги и прочие фоновые чтения идут без арендатора и видят весь журнал.
+type tenantStore struct{ EventStore }
+
+func (s tenantStore) Load(ctx context.Context) ([]Event, error) {
+	if tenantFrom(ctx) == "" {
+		return s.EventStore.Load(ctx)
+	}
+	return s.QueryEvents(ctx, eventQuery{})
+}
+
+func (s tenantStore) LoadAfter(ctx context.Context, after int64, limit int) ([]Event, error) {
+	if tenantFrom(ctx) == "" {
+		return s.EventStore.LoadAfter(ctx, after, limit)
+	}
+	return s.QueryEvents(ctx, eventQuery{After: after, Limit: limit})
+}
+
+// QueryEvents дочитывает журнал страницами, пока не наберёт q.Limit событий арендатора.
+func (s tenantStore) QueryEvents(ctx context.Context, q eventQuery) ([]Event, error) {
+	t := tenantFrom(ctx)
+	switch {
+	case t == "":
+		return s.EventStore.QueryEvents(ctx, q)
+	case q.OrderID != "" && orderTenant(q.OrderID) != t:
+		return nil, nil
+	case q.OrderID != "":
+		return s.EventStore.QueryEvents(ctx, q)
+	}
+	var out []Event
+	for {
+		page, err := s.EventStore.QueryEvents(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			if orderTenant(e.OrderID) == t {
+				out = append(out, e)
+			}
+			if q.Limit > 0 && len(out) == q.Limit {
+				return out, nil
+			}
+		}
+		if q.Limit <= 0 || len(page) < q.Limit {
+			return out, nil
+		}
+		q.After = page[len(page)-1].Position
+	}
+}
+
+func (s tenantStore) LoadByOrder(ctx context.Context, orderID string) ([]Event, error) {
+	if foreignOrder(ctx, orderID) {
+		return nil, nil
+	}
+	return s.EventStore.LoadByOrder(ctx, orderID)
+}
+
+func (s tenantStore) LoadByOrderAfter(ctx context.Context, orderID string, after int64) ([]Event, error) {
+	if foreignOrder(ctx, orderID) {
+		return nil, nil
+	}
+	return s.EventStore.LoadByOrderAfter(ctx, orderID, after)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tsc-p7-cqrs/orderspb"
+)
+
+var (
+	tenantServiceOnce sync.Once
+	tenantService     http.Handler
+	tenantServiceErr  error
+	tenantServiceDir  string // файл подписок webhooks; удаляется в TestMain
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if tenantServiceDir != "" {
+		os.RemoveAll(tenantServiceDir)
+	}
+	os.Exit(code)
+}
+
+// openTenantService собирает сервис с MULTI_TENANT поверх журнала в памяти — один на все тесты пакета,
+// как в main: шина, проекции и webhooks живут в глобальных переменных.
+func openTenantService(t *testing.T) http.Handler {
+	t.Helper()
+	tenantServiceOnce.Do(func() {
+		ctx := context.Background()
+		var err error
+		if tenantServiceDir, err = os.MkdirTemp("", "tenancy"); err != nil {
+			tenantServiceErr = err
+			return
+		}
+		deadLetters.opts = retryOptions{Attempts: 1, Max: 100}
+		bus.Use(requireActor, isolateTenants, validateCommands, dedupCommands(commands), usage.enforce, deadLetters.retry)
+		asyncCommands = newCommandQueue(asyncOptions{Workers: 1, QueueSize: 100, Retention: time.Hour})
+		asyncCommands.start(ctx)
+		stores, err := openEventStore(ctx)
+		if err != nil {
+			tenantServiceErr = err
+			return
+		}
+		store, snapshots, customerKeys, storeBackend = stores.events, stores.snapshots, stores.keys, stores.backend
+		if tenantServiceErr = registerProjections(ctx); tenantServiceErr != nil {
+			return
+		}
+		if tenantServiceErr = projections.start(ctx, store, stores.checkpoints); tenantServiceErr != nil {
+			return
+		}
+		webhooks, tenantServiceErr = openWebhooks(store, stores.checkpoints, webhookOptions{
+			Path: filepath.Join(tenantServiceDir, "webhooks.json"), Timeout: time.Second, MaxAttempts: 1, AllowPrivate: true,
+		})
+		if tenantServiceErr != nil {
+			return
+		}
+		tenancy = &tenantOptions{Header: "X-Tenant-ID", Claim: "tenant_id"}
+		r := mux.NewRouter()
+		r.Use(rbac.middleware, tenancy.middleware)
+		registerAPI(r)
+		tenantService = r
+	})
+	if tenantServiceErr != nil {
+		t.Fatal(tenantServiceErr)
+	}
+	withAuth(t, nil, nil, nil) // без аутентификации арендатора выбирает заголовок
+	return tenantService
+}
+
+// tenantCall выполняет запрос арендатора tenant и разбирает ответ в out, если он передан.
+func tenantCall(t *testing.T, h http.Handler, tenant, method, path string, body any, header http.Header, out any) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, apiVersionPrefix+path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-ID", tenant)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q: %v", method, path, rec.Body, err)
+		}
+	}
+	return rec.Code
+}
+
+var tenantOrderBody = map[string]any{
+	"customer_id": "c1", "currency": "USD",
+	"items": []map[string]any{{"product_id": "p1", "sku": "s1", "quantity": 1, "unit_price": 1000}},
+}
+
+// createTenantOrder создаёт заказ арендатора и дожидается его в read model.
+func createTenantOrder(t *testing.T, h http.Handler, tenant string, header http.Header) string {
+	t.Helper()
+	var res struct {
+		OrderID  string `json:"order_id"`
+		Position int64  `json:"position"`
+	}
+	if code := tenantCall(t, h, tenant, http.MethodPost, "/orders", tenantOrderBody, header, &res); code != http.StatusCreated {
+		t.Fatalf("create order for %s: status %d", tenant, code)
+	}
+	err := awaitReadModel(context.Background(), func(p *projectionRunner) (bool, error) {
+		return p.status().Position >= res.Position, nil
+	})
+	if err != nil {
+		t.Fatalf("read model: %v", err)
+	}
+	return res.OrderID
+}
+
+func TestTenantIsolationHTTP(t *testing.T) {
+	h := openTenantService(t)
+	own := createTenantOrder(t, h, "alpha", nil)
+	foreign := createTenantOrder(t, h, "beta", nil)
+
+	for _, path := range []string{"/orders/" + foreign, "/orders/" + foreign + "/events"} {
+		if code := tenantCall(t, h, "alpha", http.MethodGet, path, nil, nil, nil); code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", path, code)
+		}
+	}
+	if code := tenantCall(t, h, "alpha", http.MethodGet, "/orders/"+own, nil, nil, nil); code != http.StatusOK {
+		t.Errorf("own order: status %d, want 200", code)
+	}
+	for _, action := range []string{"pay", "cancel", "apply-coupon"} {
+		if code := tenantCall(t, h, "alpha", http.MethodPost, "/orders/"+foreign+"/"+action, map[string]any{}, nil, nil); code != http.StatusNotFound {
+			t.Errorf("POST %s on foreign order: status %d, want 404", action, code)
+		}
+	}
+
+	var list []Order
+	tenantCall(t, h, "alpha", http.MethodGet, "/orders", nil, nil, &list)
+	var events []Event
+	tenantCall(t, h, "alpha", http.MethodGet, "/events", nil, nil, &events)
+	for _, o := range list {
+		if orderTenant(o.ID) != "alpha" {
+			t.Errorf("order list leaks %s", o.ID)
+		}
+	}
+	for _, e := range events {
+		if orderTenant(e.OrderID) != "alpha" {
+			t.Errorf("event log leaks %s", e.OrderID)
+		}
+	}
+	if len(list) == 0 || len(events) == 0 {
+		t.Errorf("own orders %d and events %d, want both non-empty", len(list), len(events))
+	}
+}
+
+func TestTenantIsolationGraphQL(t *testing.T) {
+	h := openTenantService(t)
+	own := createTenantOrder(t, h, "alpha", nil)
+	foreign := createTenantOrder(t, h, "beta", nil)
+
+	var res struct {
+		Data struct {
+			Order  *struct{ ID string }
+			Orders []struct{ ID string }
+		}
+	}
+	query := `query($id: ID!) { order(id: $id) { id } orders { id } }`
+	body := map[string]any{"query": query, "variables": map[string]any{"id": foreign}}
+	if code := tenantCall(t, h, "alpha", http.MethodPost, "/graphql", body, nil, &res); code != http.StatusOK {
+		t.Fatalf("graphql: status %d", code)
+	}
+	if res.Data.Order != nil {
+		t.Errorf("order(%s) = %v, want null", foreign, res.Data.Order)
+	}
+	found := false
+	for _, o := range res.Data.Orders {
+		found = found || o.ID == own
+		if orderTenant(o.ID) != "alpha" {
+			t.Errorf("orders leaks %s", o.ID)
+		}
+	}
+	if !found {
+		t.Errorf("orders misses own order %s", own)
+	}
+}
+
+func TestTenantIsolationGRPC(t *testing.T) {
+	h := openTenantService(t)
+	own := createTenantOrder(t, h, "alpha", nil)
+	foreign := createTenantOrder(t, h, "beta", nil)
+	ctx := withTenant(context.Background(), "alpha")
+	var srv ordersServer
+
+	if _, err := srv.GetOrder(ctx, &orderspb.GetOrderRequest{OrderId: foreign}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetOrder(foreign): %v, want NotFound", err)
+	}
+	if _, err := srv.GetOrder(ctx, &orderspb.GetOrderRequest{OrderId: own}); err != nil {
+		t.Errorf("GetOrder(own): %v", err)
+	}
+	if _, err := srv.CancelOrder(ctx, &orderspb.CancelOrderRequest{OrderId: foreign}); status.Code(err) != codes.NotFound {
+		t.Errorf("CancelOrder(foreign): %v, want NotFound", err)
+	}
+	res, err := srv.ListEvents(ctx, &orderspb.ListEventsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range res.Events {
+		if orderTenant(e.OrderId) != "alpha" {
+			t.Errorf("ListEvents leaks %s", e.OrderId)
+		}
+	}
+}
+
+func TestTenantIdempotencyKeys(t *testing.T) {
+	h := openTenantService(t)
+	key := http.Header{"Idempotency-Key": {"tenant-key-" + time.Now().Format(time.RFC3339Nano)}}
+	a := createTenantOrder(t, h, "alpha", key)
+	b := createTenantOrder(t, h, "beta", key)
+	if a == b || orderTenant(b) != "beta" {
+		t.Errorf("same key in two tenants: %s and %s, want two orders", a, b)
+	}
+	if again := createTenantOrder(t, h, "alpha", key); again != a {
+		t.Errorf("replay in alpha = %s, want %s", again, a)
+	}
+}
+
+func TestTenantSchedules(t *testing.T) {
+	h := openTenantService(t)
+	own := createTenantOrder(t, h, "alpha", nil)
+	foreign := createTenantOrder(t, h, "beta", nil)
+
+	schedule := func(tenant, orderID string) (int, string) {
+		var sc struct{ ID string }
+		body := map[string]any{"command": map[string]any{"command": "cancel", "order_id": orderID}, "delay": "1h"}
+		code := tenantCall(t, h, tenant, http.MethodPost, "/scheduled-commands", body, nil, &sc)
+		return code, sc.ID
+	}
+	if code, _ := schedule("alpha", foreign); code != http.StatusNotFound {
+		t.Errorf("schedule on foreign order: status %d, want 404", code)
+	}
+	code, id := schedule("beta", foreign)
+	if code != http.StatusCreated && code != http.StatusAccepted {
+		t.Fatalf("schedule own order: status %d", code)
+	}
+	if _, ownID := schedule("alpha", own); ownID == "" {
+		t.Fatal("schedule for alpha not created")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if tenantCall(t, h, "beta", http.MethodGet, "/scheduled-commands/"+id, nil, nil, nil) == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("schedule %s not visible to its tenant", id)
+		}
+	}
+	if code := tenantCall(t, h, "alpha", http.MethodGet, "/scheduled-commands/"+id, nil, nil, nil); code != http.StatusNotFound {
+		t.Errorf("GET foreign schedule: status %d, want 404", code)
+	}
+	if code := tenantCall(t, h, "alpha", http.MethodDelete, "/scheduled-commands/"+id, nil, nil, nil); code != http.StatusNotFound {
+		t.Errorf("DELETE foreign schedule: status %d, want 404", code)
+	}
+	var list []ScheduledCommand
+	tenantCall(t, h, "alpha", http.MethodGet, "/scheduled-commands", nil, nil, &list)
+	for _, sc := range list {
+		if orderTenant(sc.Command.OrderID) != "alpha" {
+			t.Errorf("schedule list leaks %s", sc.ID)
+		}
+	}
+}
+
+func TestTenantAsyncCommands(t *testing.T) {
+	h := openTenantService(t)
+	var ac asyncCommand
+	async := http.Header{"Prefer": {"respond-async"}}
+	if code := tenantCall(t, h, "beta", http.MethodPost, "/orders", tenantOrderBody, async, &ac); code != http.StatusAccepted {
+		t.Fatalf("async create: status %d", code)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ac.State == asyncPending; time.Sleep(5 * time.Millisecond) {
+		if code := tenantCall(t, h, "beta", http.MethodGet, "/commands/"+ac.ID, nil, nil, &ac); code != http.StatusOK {
+			t.Fatalf("own command status: %d, want 200", code)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("command %s still pending", ac.ID)
+		}
+	}
+	if ac.State != asyncSucceeded {
+		t.Errorf("command state %s, want %s", ac.State, asyncSucceeded)
+	}
+	if code := tenantCall(t, h, "alpha", http.MethodGet, "/commands/"+ac.ID, nil, nil, nil); code != http.StatusNotFound {
+		t.Errorf("foreign command status: %d, want 404", code)
+	}
+}
+
+func TestTenantWebhooks(t *testing.T) {
+	h := openTenantService(t)
+	var sub webhookSubscription
+	body := map[string]any{"url": "http://127.0.0.1:9/hook"}
+	if code := tenantCall(t, h, "beta", http.MethodPost, "/webhooks", body, nil, &sub); code != http.StatusCreated {
+		t.Fatalf("create webhook: status %d", code)
+	}
+	if sub.Tenant != "beta" {
+		t.Errorf("subscription tenant %q, want beta", sub.Tenant)
+	}
+	var list []webhookSubscription
+	tenantCall(t, h, "alpha", http.MethodGet, "/webhooks", nil, nil, &list)
+	for _, s := range list {
+		if s.ID == sub.ID {
+			t.Errorf("alpha sees beta's webhook %s", sub.ID)
+		}
+	}
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/webhooks/" + sub.ID + "/deliveries"},
+		{http.MethodDelete, "/webhooks/" + sub.ID},
+	} {
+		if code := tenantCall(t, h, "alpha", req.method, req.path, nil, nil, nil); code != http.StatusNotFound {
+			t.Errorf("%s %s: status %d, want 404", req.method, req.path, code)
+		}
+	}
+	if !sub.matches(Event{Type: EventOrderCreated, OrderID: tenantOrderID("beta", "o1")}) ||
+		sub.matches(Event{Type: EventOrderCreated, OrderID: tenantOrderID("alpha", "o1")}) {
+		t.Error("subscription of beta must match only beta's events")
+	}
+	tenantCall(t, h, "beta", http.MethodDelete, "/webhooks/"+sub.ID, nil, nil, nil)
+}
+
+func TestTenantStore(t *testing.T) {
+	mem := newMemoryStore()
+	s := tenantStore{mem}
+	ctx := context.Background()
+	for i, id := range []string{tenantOrderID("alpha", "o1"), tenantOrderID("beta", "o2"), tenantOrderID("alpha", "o3"), tenantOrderID("beta", "o4")} {
+		mustAppend(t, mem, testEvent(EventOrderCreated, id, i), 0)
+	}
+	alpha := withTenant(ctx, "alpha")
+	all, err := s.LoadAfter(alpha, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := s.LoadAfter(alpha, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := s.LoadByOrder(alpha, tenantOrderID("beta", "o2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := s.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := orderIDs(all); strings.Join(got, ",") != "alpha:o1/OrderCreated,alpha:o3/OrderCreated" {
+		t.Errorf("LoadAfter = %v", got)
+	}
+	if len(page) != 1 || page[0].OrderID != "alpha:o1" {
+		t.Errorf("LoadAfter(limit 1) = %v", orderIDs(page))
+	}
+	if len(foreign) != 0 {
+		t.Errorf("LoadByOrder(foreign) = %v, want none", orderIDs(foreign))
+	}
+	if len(admin) != 4 {
+		t.Errorf("Load without tenant = %d events, want 4", len(admin))
+	}
+}
+
+func TestIsolateTenants(t *testing.T) {
+	next := func(context.Context, Command) (Event, bool, error) { return Event{}, false, nil }
+	cases := []struct {
+		name    string
+		tenant  string
+		orderID string
+		wantErr bool
+	}{
+		{"own order", "alpha", tenantOrderID("alpha", "o1"), false},
+		{"foreign order", "alpha", tenantOrderID("beta", "o1"), true},
+		{"order without tenant", "alpha", "o1", true},
+		{"no tenant", "", tenantOrderID("beta", "o1"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cmd := CancelOrder{CommandTarget: CommandTarget{OrderID: c.orderID, Metadata: EventMetadata{Tenant: c.tenant}}}
+			_, _, err := isolateTenants(next)(context.Background(), cmd)
+			if (err != nil) != c.wantErr {
+				t.Errorf("err = %v, want error %v", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// --- TLS ---
+// HTTP и gRPC шифруются одним и тем же TLS. Сертификат берётся либо из файлов TLS_CERT_FILE
+// и TLS_KEY_FILE (оба сразу), либо автоматически у ACME-сервера (Let's Encrypt) для доменов
+// TLS_AUTOCERT_DOMAINS: сертификаты и ключ аккаунта хранятся в TLS_AUTOCERT_CACHE и продлеваются сами.
+// Проверка владения доменом — TLS-ALPN-01 на том же порту и HTTP-01 на TLS_AUTOCERT_HTTP_ADDR (:80),
+// который остальные запросы перенаправляет на https; off выключает этот порт. Без обоих способов —
+// открытый HTTP, как раньше.
+
+type tlsOptions struct {
+	CertFile, KeyFile string
+	Domains           []string // autocert: домены, для которых выпускается сертификат
+	CacheDir          string
+	Email             string // контакт аккаунта ACME, необязателен
+	DirectoryURL      string // ACME-сервер; пусто — Let's Encrypt
+	ChallengeAddr     string // HTTP-01 и перенаправление на https; off — не слушать
+}
+
+// serverTLS — конфигурация TLS серверов; nil — без TLS. Второй результат — сервер HTTP-01 для autocert
+// (nil, если не нужен), он запускается отдельно.
+func serverTLS(opts tlsOptions) (*tls.Config, *http.Server, error) {
+	files := opts.CertFile != "" || opts.KeyFile != ""
+	switch {
+	case files && len(opts.Domains) > 0:
+		return nil, nil, errors.New("tls: TLS_CERT_FILE/TLS_KEY_FILE and TLS_AUTOCERT_DOMAINS are mutually exclusive")
+	case files:
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, nil, errors.New("tls: TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tls: %w", err)
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}, nil, nil
+	case len(opts.Domains) > 0:
+		if err := os.MkdirAll(opts.CacheDir, 0o700); err != nil {
+			return nil, nil, fmt.Errorf("tls: autocert cache: %w", err)
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(opts.CacheDir),
+			HostPolicy: autocert.HostWhitelist(opts.Domains...),
+			Email:      opts.Email,
+		}
+		if opts.DirectoryURL != "" {
+			m.Client = &acme.Client{DirectoryURL: opts.DirectoryURL}
+		}
+		cfg := m.TLSConfig()
+		cfg.MinVersion = tls.VersionTLS12
+		var challenge *http.Server
+		if opts.ChallengeAddr != "off" {
+			challenge = &http.Server{Addr: opts.ChallengeAddr, Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+		}
+		slog.Info("tls: autocert", "domains", strings.Join(opts.Domains, ","), "cache", opts.CacheDir)
+		return cfg, challenge, nil
+	default:
+		return nil, nil, nil
+	}
+}
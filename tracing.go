@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// --- Tracing (OpenTelemetry) ---
+// Спаны: запрос HTTP (по шаблону маршрута, с контекстом из входящих traceparent/tracestate), команда шины,
+// Append в хранилище и применение события каждой проекцией. Append пишет traceparent своего спана
+// в Metadata.TraceParent события, поэтому проекции, применяющие событие позже и в другой горутине (или
+// в другом инстансе), продолжают ту же трассу. С OTEL_EXPORTER_OTLP_ENDPOINT (или
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) спаны пачками уходят по OTLP/HTTP в JSON-кодировке; без него трассы
+// не собираются, но входящий контекст всё равно передаётся дальше. OTEL_SERVICE_NAME — имя сервиса,
+// OTEL_TRACES_SAMPLER_ARG — доля трасс (0..1), у которых нет решения родителя.
+
+var tracer = otel.Tracer("tsc-p7-cqrs")
+
+// tracePropagator читает и пишет W3C Trace Context и Baggage.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+type tracingOptions struct {
+	Endpoint    string // URL приёмника спанов, например http://collector:4318/v1/traces
+	ServiceName string
+	SampleRatio float64
+	Timeout     time.Duration
+}
+
+// openTracing ставит глобальный TracerProvider; возвращает функцию, которая досылает спаны при остановке.
+func openTracing(opts tracingOptions) func(context.Context) {
+	otel.SetTextMapPropagator(tracePropagator)
+	if opts.Endpoint == "" {
+		return func(context.Context) {}
+	}
+	exp := &otlpHTTPExporter{opts: opts, client: &http.Client{Timeout: opts.Timeout}}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	slog.Info("tracing: exporting spans", "service", opts.ServiceName, "endpoint", opts.Endpoint)
+	return func(ctx context.Context) {
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Warn("tracing: shutdown", "error", err)
+		}
+	}
+}
+
+// endSpan завершает спан, отмечая ошибку.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceHTTP — middleware mux: спан на запрос с родителем из заголовков запроса.
+func traceHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if t, err := cr.GetPathTemplate(); err == nil {
+				route = t
+			}
+		}
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+		))
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// traceCommands — звено шины: спан на команду.
+func traceCommands(next CommandHandler) CommandHandler {
+	return func(ctx context.Context, c Command) (Event, bool, error) {
+		t := c.Target()
+		ctx, span := tracer.Start(ctx, "command "+c.CommandName(), trace.WithAttributes(
+			attribute.String("command.name", c.CommandName()),
+			attribute.String("order.id", t.OrderID),
+			attribute.String("correlation.id", t.Metadata.CorrelationID),
+		))
+		stored, replayed, err := next(ctx, c)
+		if err == nil {
+			span.SetAttributes(attribute.String("order.id", stored.OrderID), attribute.Int64("order.version", stored.Version),
+				attribute.Bool("command.replayed", replayed))
+		}
+		endSpan(span, err)
+		return stored, replayed, err
+	}
+}
+
+// tracingStore пишет спан на Append и сохраняет его traceparent в событии.
+type tracingStore struct {
+	EventStore
+}
+
+func (s tracingStore) Append(ctx context.Context, e Event, expected int64) (Event, error) {
+	ctx, span := tracer.Start(ctx, "event_store.append", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("event.type", string(e.Type)),
+		attribute.String("event.stream_id", e.StreamID),
+	))
+	if sc := span.SpanContext(); sc.IsValid() && e.Metadata.TraceParent == "" {
+		carrier := propagation.MapCarrier{}
+		propagation.TraceContext{}.Inject(ctx, carrier)
+		e.Metadata.TraceParent = carrier["traceparent"]
+	}
+	stored, err := s.EventStore.Append(ctx, e, expected)
+	if err == nil {
+		span.SetAttributes(attribute.Int64("event.version", stored.Version), attribute.Int64("event.position", stored.Position))
+	}
+	endSpan(span, err)
+	return stored, err
+}
+
+// eventTraceContext — контекст трассы, в которой событие было записано.
+func eventTraceContext(ctx context.Context, e Event) context.Context {
+	if e.Metadata.TraceParent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": e.Metadata.TraceParent})
+}
+
+// --- OTLP/HTTP exporter ---
+// Спаны кодируются в JSON-отображение OTLP (id — hex, времена — строки наносекунд) и отправляются
+// POST-запросом на Endpoint.
+
+type otlpHTTPExporter struct {
+	opts   tracingOptions
+	client *http.Client
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpAttributes(kvs []attribute.KeyValue) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		var v map[string]any
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			v = map[string]any{"boolValue": kv.Value.AsBool()}
+		case attribute.INT64:
+			v = map[string]any{"intValue": strconv.FormatInt(kv.Value.AsInt64(), 10)}
+		case attribute.FLOAT64:
+			v = map[string]any{"doubleValue": kv.Value.AsFloat64()}
+		default:
+			v = map[string]any{"stringValue": kv.Value.Emit()}
+		}
+		out = append(out, otlpKeyValue{Key: string(kv.Key), Value: v})
+	}
+	return out
+}
+
+func otlpTime(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) }
+
+// otlpStatusCode переводит codes.Code в STATUS_CODE_* OTLP: у них разный порядок.
+func otlpStatusCode(c codes.Code) int {
+	switch c {
+	case codes.Ok:
+		return 1
+	case codes.Error:
+		return 2
+	}
+	return 0
+}
+
+func (x *otlpHTTPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	list := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		sp := map[string]any{
+			"traceId":           s.SpanContext().TraceID().String(),
+			"spanId":            s.SpanContext().SpanID().String(),
+			"name":              s.Name(),
+			"kind":              int(s.SpanKind()), // trace.SpanKind совпадает с SPAN_KIND_* OTLP
+			"startTimeUnixNano": otlpTime(s.StartTime()),
+			"endTimeUnixNano":   otlpTime(s.EndTime()),
+			"attributes":        otlpAttributes(s.Attributes()),
+			"status":            map[string]any{"code": otlpStatusCode(s.Status().Code), "message": s.Status().Description},
+		}
+		if p := s.Parent(); p.IsValid() {
+			sp["parentSpanId"] = p.SpanID().String()
+		}
+		var events []map[string]any
+		for _, ev := range s.Events() {
+			events = append(events, map[string]any{"name": ev.Name, "timeUnixNano": otlpTime(ev.Time), "attributes": otlpAttributes(ev.Attributes)})
+		}
+		if len(events) > 0 {
+			sp["events"] = events
+		}
+		list = append(list, sp)
+	}
+	body, err := json.Marshal(map[string]any{"resourceSpans": []any{map[string]any{
+		"resource":   map[string]any{"attributes": otlpAttributes([]attribute.KeyValue{attribute.String("service.name", x.opts.ServiceName)})},
+		"scopeSpans": []any{map[string]any{"scope": map[string]any{"name": "tsc-p7-cqrs"}, "spans": list}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, x.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("otlp: HTTP %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+func (x *otlpHTTPExporter) Shutdown(context.Context) error { return nil }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// --- API versioning ---
+// Маршруты API живут под префиксом версии (/v1/orders, /v1/events). Пути без версии — прослойка
+// совместимости для старых клиентов: запрос переписывается на текущую версию и обслуживается тем же
+// роутером, ответ помечается Deprecation и Link rel="successor-version". Несовместимые изменения
+// ответов выходят под новым префиксом, пока прежние пути продолжают работать.
+
+const apiVersionPrefix = "/v1"
+
+// registerAPI регистрирует маршруты версии v1. Префикс дописывается к путям, а не задаётся подроутером:
+// в подроутере mux отвечает на неподходящий метод 404 вместо 405.
+func registerAPI(r *mux.Router) {
+	const v1 = apiVersionPrefix
+	// Команды
+	r.HandleFunc(v1+"/orders", createOrder).Methods("POST").Name("createOrder")
+	r.HandleFunc(v1+"/orders/batch", executeBatch).Methods("POST").Name("executeBatch")
+	r.HandleFunc(v1+"/orders/{id}/pay", payOrder).Methods("POST").Name("payOrder")
+	r.HandleFunc(v1+"/orders/{id}/cancel", cancelOrder).Methods("POST").Name("cancelOrder")
+	r.HandleFunc(v1+"/orders/{id}/refund", refundOrder).Methods("POST").Name("refundOrder")
+	r.HandleFunc(v1+"/orders/{id}/ship", shipOrder).Methods("POST").Name("shipOrder")
+	r.HandleFunc(v1+"/orders/{id}/deliver", deliverOrder).Methods("POST").Name("deliverOrder")
+	r.HandleFunc(v1+"/orders/{id}/apply-coupon", applyCoupon).Methods("POST").Name("applyCoupon")
+	r.HandleFunc(v1+"/customers/{id}/data", eraseCustomerData).Methods("DELETE").Name("eraseCustomerData")
+	r.HandleFunc(v1+"/cloudevents", acceptCloudEvent).Methods("POST").Name("acceptCloudEvent")
+	r.HandleFunc(v1+"/scheduled-commands", createSchedule).Methods("POST").Name("createSchedule")
+	r.HandleFunc(v1+"/scheduled-commands/{id}", cancelSchedule).Methods("DELETE").Name("cancelSchedule")
+	r.HandleFunc(v1+"/inventory/{sku}/stock", addStock).Methods("POST").Name("addStock")
+	r.HandleFunc(v1+"/webhooks", createWebhook).Methods("POST").Name("createWebhook")
+	r.HandleFunc(v1+"/webhooks/{id}", deleteWebhook).Methods("DELETE").Name("deleteWebhook")
+	r.HandleFunc(v1+"/admin/orders/cancel", bulkCancelOrders).Methods("POST").Name("bulkCancelOrders")
+	r.HandleFunc(v1+"/admin/projections/{name}/rebuild", rebuildProjection).Methods("POST").Name("rebuildProjection")
+	r.HandleFunc(v1+"/admin/dead-letters/{id}/retry", retryDeadLetter).Methods("POST").Name("retryDeadLetter")
+	r.HandleFunc(v1+"/admin/dead-letters/{id}", deleteDeadLetter).Methods("DELETE").Name("deleteDeadLetter")
+	r.HandleFunc(v1+"/admin/backup", createBackup).Methods("POST").Name("createBackup")
+	r.HandleFunc(v1+"/admin/config/reload", reloadConfig).Methods("POST").Name("reloadConfig")
+	r.HandleFunc(v1+"/admin/events/verify", verifyEvents).Methods("POST").Name("verifyEvents")
+	r.HandleFunc(v1+"/admin/api-keys", createAPIKey).Methods("POST").Name("createAPIKey")
+	r.HandleFunc(v1+"/admin/api-keys/{id}/rotate", rotateAPIKey).Methods("POST").Name("rotateAPIKey")
+	r.HandleFunc(v1+"/admin/api-keys/{id}", deleteAPIKey).Methods("DELETE").Name("deleteAPIKey")
+
+	// Запросы
+	r.HandleFunc(v1+"/orders", listOrders).Methods("GET").Name("listOrders")
+	r.HandleFunc(v1+"/orders/search", searchOrders).Methods("GET").Name("searchOrders") // до /orders/{id}
+	r.HandleFunc(v1+"/orders/{id}", getOrder).Methods("GET").Name("getOrder")
+	r.HandleFunc(v1+"/orders/{id}/events", getOrderEvents).Methods("GET").Name("getOrderEvents")
+	r.HandleFunc(v1+"/customers/{id}/orders", listCustomerOrders).Methods("GET").Name("listCustomerOrders")
+	r.HandleFunc(v1+"/scheduled-commands", listSchedules).Methods("GET").Name("listSchedules")
+	r.HandleFunc(v1+"/scheduled-commands/{id}", getSchedule).Methods("GET").Name("getSchedule")
+	r.HandleFunc(v1+"/inventory/{sku}", getStock).Methods("GET").Name("getStock")
+	r.HandleFunc(v1+"/commands/{id}", getCommandStatus).Methods("GET").Name("getCommandStatus")
+	r.HandleFunc(v1+"/metrics/commands", getCommandMetrics).Methods("GET").Name("getCommandMetrics")
+	r.HandleFunc(v1+"/stats", getStats).Methods("GET").Name("getStats")
+	r.HandleFunc(v1+"/usage", getUsage).Methods("GET").Name("getUsage")
+	r.HandleFunc(v1+"/events", getAllEvents).Methods("GET").Name("getAllEvents")
+	r.HandleFunc(v1+"/events/stream", streamEvents).Methods("GET").Name("streamEvents")
+	r.HandleFunc(v1+"/events/ws", subscribeEventsWS).Methods("GET").Name("subscribeEventsWS")
+	r.Handle(v1+"/graphql", graphqlHandler()).Methods("POST").Name("graphql")
+	r.HandleFunc(v1+"/webhooks", listWebhooks).Methods("GET").Name("listWebhooks")
+	r.HandleFunc(v1+"/webhooks/{id}/deliveries", getWebhookDeliveries).Methods("GET").Name("getWebhookDeliveries")
+	r.HandleFunc(v1+"/admin/dead-letters", listDeadLetters).Methods("GET").Name("listDeadLetters")
+	r.HandleFunc(v1+"/admin/commands", getAuditCommands).Methods("GET").Name("getAuditCommands")
+	r.HandleFunc(v1+"/admin/projections", listProjections).Methods("GET").Name("listProjections")
+	r.HandleFunc(v1+"/admin/projections/{name}", getProjection).Methods("GET").Name("getProjection")
+	r.HandleFunc(v1+"/admin/audit", getAdminAudit).Methods("GET").Name("getAdminAudit")
+	r.HandleFunc(v1+"/admin/event-stats", getEventStats).Methods("GET").Name("getEventStats")
+	r.HandleFunc(v1+"/admin/usage", listUsage).Methods("GET").Name("listUsage")
+	r.HandleFunc(v1+"/admin/status", getAdminStatus).Methods("GET").Name("getAdminStatus")
+	r.HandleFunc(v1+"/admin/api-keys", listAPIKeys).Methods("GET").Name("listAPIKeys")
+}
+
+// registerLegacyAPI направляет пути без версии в текущую версию API. Регистрируется последним:
+// документация и маршруты с версией совпадают раньше. Ссылки пагинации в ответах ведут уже на пути с версией.
+func registerLegacyAPI(r *mux.Router) {
+	unversioned := func(req *http.Request, _ *mux.RouteMatch) bool {
+		p := req.URL.Path
+		return p != apiVersionPrefix && !strings.HasPrefix(p, apiVersionPrefix+"/")
+	}
+	r.MatcherFunc(unversioned).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, apiVersionPrefix, req.URL.Path))
+		req = req.Clone(req.Context())
+		req.URL.Path = apiVersionPrefix + req.URL.Path
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = apiVersionPrefix + req.URL.RawPath
+		}
+		r.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// --- Webhook target guard ---
+// URL подписки задаёт клиент, поэтому без проверки webhooks позволили бы слать запросы от имени сервиса
+// во внутреннюю сеть (SSRF). Доставки не уходят на loopback, частные сети, link-local (в том числе
+// метаданные облака 169.254.169.254), CGNAT, 0.0.0.0/8, multicast и unspecified, а адрес NAT64
+// (64:ff9b::/96) проверяется по встроенному в него IPv4. Адрес проверяется при каждом
+// соединении в Control диалера — уже после DNS, поэтому не помогают ни перенаправления, ни DNS rebinding.
+// POST /webhooks с таким адресом отклоняется сразу (400). С проверкой доставки идут напрямую, мимо
+// HTTP(S)_PROXY: иначе проверялся бы адрес прокси. WEBHOOK_ALLOW_PRIVATE=true снимает ограничение —
+// для получателей внутри периметра и локальной разработки.
+
+var errWebhookTarget = errors.New("webhook target address is not allowed")
+
+var (
+	// webhookSharedPrefix — адреса CGNAT (RFC 6598): не частные по IsPrivate, но и не публичные.
+	webhookSharedPrefix = netip.MustParsePrefix("100.64.0.0/10")
+	// webhookThisNetwork — «эта сеть» (RFC 1122): Linux соединяет 0.x.x.x с самим хостом.
+	webhookThisNetwork = netip.MustParsePrefix("0.0.0.0/8")
+	// webhookNAT64Prefix — IPv4, транслированные в IPv6 (RFC 6052); IPv4 — в последних четырёх байтах.
+	webhookNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+)
+
+// webhookBlocked — адрес не публичный и доставка на него запрещена без WEBHOOK_ALLOW_PRIVATE.
+func webhookBlocked(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if webhookNAT64Prefix.Contains(addr) {
+		b := addr.As16()
+		addr = netip.AddrFrom4([4]byte(b[12:]))
+	}
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() ||
+		webhookSharedPrefix.Contains(addr) || webhookThisNetwork.Contains(addr)
+}
+
+// webhookDialControl отказывает в соединении с запрещённым адресом.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWebhookTarget, address)
+	}
+	if webhookBlocked(addr) {
+		return fmt.Errorf("%w: %s", errWebhookTarget, address)
+	}
+	return nil
+}
+
+// newWebhookClient — клиент доставок; без allowPrivate соединения с непубличными адресами запрещены.
+func newWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	if allowPrivate {
+		return &http.Client{Timeout: timeout}
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: webhookDialControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// checkWebhookHost проверяет адреса host при создании подписки. Имя, которое сейчас не разрешается,
+// принимается: при доставке адрес всё равно проверит webhookDialControl.
+func checkWebhookHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if webhookBlocked(addr) {
+			return fmt.Errorf("%w: %s", errWebhookTarget, host)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if webhookBlocked(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", errWebhookTarget, host, addr)
+		}
+	}
+	return nil
+}
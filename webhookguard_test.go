@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestWebhookBlocked(t *testing.T) {
+	cases := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"64:ff9b::7f00:1", true},    // NAT64 127.0.0.1
+		{"64:ff9b::a9fe:a9fe", true}, // NAT64 169.254.169.254
+		{"64:ff9b::1.2.3.4", false},  // NAT64 публичного адреса
+		{"93.184.216.34", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, c := range cases {
+		if got := webhookBlocked(netip.MustParseAddr(c.addr)); got != c.blocked {
+			t.Errorf("webhookBlocked(%s) = %v, want %v", c.addr, got, c.blocked)
+		}
+	}
+}
+
+func TestCreateWebhookLocation(t *testing.T) {
+	h := openTenantService(t)
+	req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/webhooks", bytes.NewBufferString(`{"url":"http://127.0.0.1:9/hook"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-ID", "hooks")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var sub webhookSubscription
+	if err := json.Unmarshal(rec.Body.Bytes(), &sub); err != nil {
+		t.Fatal(err)
+	}
+	if loc, want := rec.Header().Get("Location"), apiVersionPrefix+"/webhooks/"+sub.ID; loc != want {
+		t.Errorf("Location = %q, want %q", loc, want)
+	}
+	if code := tenantCall(t, h, "hooks", http.MethodDelete, "/webhooks/"+sub.ID, nil, nil, nil); code != http.StatusNoContent {
+		t.Errorf("DELETE webhook: status %d, want 204", code)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// --- Webhooks ---
+// Внешние системы регистрируют URL (POST /webhooks) и получают новые события журнала POST-запросами.
+// У каждой подписки свой релей (outboxRelay) с позицией в checkpointStore, так что медленный
+// или недоступный получатель не задерживает остальных, а после перезапуска доставка продолжается
+// с того же места. Тело подписывается HMAC-SHA256 секретом подписки:
+//
+//	Webhook-Signature: t=<unix time>,v1=<hex(hmac(secret, "<unix time>.<body>"))>
+//
+// Время входит в подпись, чтобы получатель мог отбросить перехваченный и повторённый запрос.
+// Тело — JSON события (format json) или CloudEvent в структурном либо бинарном режиме.
+// Неудачная доставка повторяется с экспоненциальной паузой; после WEBHOOK_MAX_ATTEMPTS попыток
+// событие помечается failed и подписка переходит к следующему. Статусы последних доставок
+// хранятся в памяти и отдаются через GET /webhooks/{id}/deliveries. Файл подписок можно править
+// руками: перезагрузка настроек (reload.go) запускает новые подписки, останавливает удалённые и
+// перезапускает изменённые с их прежней позиции. Доставки во внутреннюю сеть запрещены (webhookguard.go).
+//
+// С мультиарендностью (tenancy.go) подписка, созданная арендатором, принадлежит ему: получает события
+// только его заказов, а в списке, истории доставок и при удалении видна только ему и области admin.
+// Подписка без арендатора (создана admin без заголовка арендатора) получает все события.
+
+const (
+	webhookBackoffMin = time.Second
+	webhookBackoffMax = 5 * time.Minute
+	webhookHistory    = 100 // последних доставок на подписку
+)
+
+type webhookSubscription struct {
+	ID         string      `json:"id"`
+	URL        string      `json:"url"`
+	EventTypes []EventType `json:"event_types,omitempty"` // пусто — все события
+	Format     string      `json:"format,omitempty"`      // json (по умолчанию), cloudevents, cloudevents-binary
+	Secret     string      `json:"secret,omitempty"`      // отдаётся только при создании
+	Tenant     string      `json:"tenant,omitempty"`      // арендатор подписки; пусто — все события
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+func (s webhookSubscription) matches(e Event) bool {
+	return (len(s.EventTypes) == 0 || slices.Contains(s.EventTypes, e.Type)) && (s.Tenant == "" || orderTenant(e.OrderID) == s.Tenant)
+}
+
+type webhookDelivery struct {
+	EventID    string    `json:"event_id"` // stream_id@version, совпадает с заголовком Webhook-Id
+	EventType  EventType `json:"event_type"`
+	Position   int64     `json:"position"`
+	Status     string    `json:"status"` // pending, delivered, failed
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"` // ответ получателя на последнюю попытку
+	Error      string    `json:"error,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// webhookDeliveries — ответ GET /webhooks/{id}/deliveries: позиция подписки и последние доставки, от новых к старым.
+type webhookDeliveries struct {
+	Subscription webhookSubscription `json:"subscription"`
+	Position     int64               `json:"position"`
+	Deliveries   []webhookDelivery   `json:"deliveries"`
+}
+
+type webhookOptions struct {
+	Path         string // JSON-файл с подписками
+	Timeout      time.Duration
+	MaxAttempts  int
+	AllowPrivate bool // доставка на непубличные адреса (webhookguard.go)
+}
+
+// webhookRegistry хранит подписки в файле и держит по релею на каждую.
+type webhookRegistry struct {
+	opts   webhookOptions
+	events EventStore
+	cps    checkpointStore
+	client *http.Client
+
+	mu      sync.Mutex
+	workers map[string]*webhookWorker
+}
+
+type webhookWorker struct {
+	sub    webhookSubscription
+	relay  *outboxRelay
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	deliveries []webhookDelivery // от старых к новым
+}
+
+var webhooks *webhookRegistry
+
+func openWebhooks(s EventStore, cps checkpointStore, opts webhookOptions) (*webhookRegistry, error) {
+	reg := &webhookRegistry{
+		opts:    opts,
+		events:  s,
+		cps:     cps,
+		client:  newWebhookClient(opts.Timeout, opts.AllowPrivate),
+		workers: map[string]*webhookWorker{},
+	}
+	subs, err := readWebhooks(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		if err := reg.start(sub, nil); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+func readWebhooks(path string) ([]webhookSubscription, error) {
+	body, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("webhooks: read %s: %w", path, err)
+	}
+	var subs []webhookSubscription
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &subs); err != nil {
+			return nil, fmt.Errorf("webhooks: decode %s: %w", path, err)
+		}
+	}
+	for _, sub := range subs {
+		if sub.ID == "" || sub.URL == "" {
+			return nil, fmt.Errorf("webhooks: %s: subscription without id or url", path)
+		}
+	}
+	return subs, nil
+}
+
+// webhookReload — что изменила перезагрузка файла подписок.
+type webhookReload struct {
+	Started   []string `json:"started,omitempty"`
+	Stopped   []string `json:"stopped,omitempty"`
+	Restarted []string `json:"restarted,omitempty"`
+}
+
+// reload сверяет запущенные подписки с файлом. Изменённая подписка перезапускается после того, как
+// прежний релей вернётся, с той же позицией и историей доставок.
+func (reg *webhookRegistry) reload() (webhookReload, error) {
+	var res webhookReload
+	subs, err := readWebhooks(reg.opts.Path)
+	if err != nil {
+		return res, err
+	}
+	reg.mu.Lock()
+	running := maps.Clone(reg.workers)
+	reg.mu.Unlock()
+	stop := func(w *webhookWorker) {
+		reg.mu.Lock()
+		if reg.workers[w.sub.ID] == w {
+			delete(reg.workers, w.sub.ID)
+		}
+		reg.mu.Unlock()
+		w.cancel()
+		<-w.relay.done
+	}
+	for _, sub := range subs {
+		w, ok := running[sub.ID]
+		delete(running, sub.ID)
+		switch {
+		case !ok:
+			res.Started = append(res.Started, sub.ID)
+		case !reflect.DeepEqual(w.sub, sub):
+			stop(w)
+			res.Restarted = append(res.Restarted, sub.ID)
+		default:
+			continue
+		}
+		var history []webhookDelivery
+		if ok {
+			history = w.deliveries // релей остановлен, записей больше не будет
+		}
+		if err := reg.start(sub, history); err != nil {
+			return res, err
+		}
+	}
+	for id, w := range running {
+		stop(w)
+		res.Stopped = append(res.Stopped, id)
+	}
+	slices.Sort(res.Stopped)
+	return res, nil
+}
+
+// start запускает релей подписки; новая подписка получает события, записанные после её создания.
+// Релей живёт дольше запроса, создавшего подписку, поэтому работает в собственном контексте.
+// history — доставки прежнего релея той же подписки.
+func (reg *webhookRegistry) start(sub webhookSubscription, history []webhookDelivery) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhookWorker{sub: sub, cancel: cancel, deliveries: history}
+	w.relay = newOutboxRelay("webhook-"+sub.ID, reg.events, reg.cps, func(ctx context.Context, e Event) {
+		reg.deliver(ctx, w, e)
+	})
+	if err := w.relay.start(ctx); err != nil {
+		cancel()
+		return fmt.Errorf("webhooks: %s: %w", sub.ID, err)
+	}
+	reg.mu.Lock()
+	reg.workers[sub.ID] = w
+	reg.mu.Unlock()
+	return nil
+}
+
+// save переписывает файл подписок. Вызывается под reg.mu.
+func (reg *webhookRegistry) save() error {
+	subs := make([]webhookSubscription, 0, len(reg.workers))
+	for _, w := range reg.workers {
+		subs = append(subs, w.sub)
+	}
+	slices.SortFunc(subs, func(a, b webhookSubscription) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	body, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(reg.opts.Path, body); err != nil {
+		return fmt.Errorf("webhooks: save %s: %w", reg.opts.Path, err)
+	}
+	return nil
+}
+
+func (reg *webhookRegistry) create(sub webhookSubscription) error {
+	if err := reg.start(sub, nil); err != nil {
+		return err
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if err := reg.save(); err != nil {
+		reg.workers[sub.ID].cancel()
+		delete(reg.workers, sub.ID)
+		return err
+	}
+	return nil
+}
+
+func (reg *webhookRegistry) remove(id string) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	w, ok := reg.workers[id]
+	if !ok {
+		return false, nil
+	}
+	delete(reg.workers, id)
+	if err := reg.save(); err != nil {
+		reg.workers[id] = w
+		return false, err
+	}
+	w.cancel()
+	return true, nil
+}
+
+// worker — релей подписки id, видимой запросу с контекстом ctx.
+func (reg *webhookRegistry) worker(ctx context.Context, id string) (*webhookWorker, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	w, ok := reg.workers[id]
+	if !ok || !tenantSees(ctx, w.sub.Tenant) {
+		return nil, false
+	}
+	return w, true
+}
+
+// list — подписки, видимые запросу с контекстом ctx.
+func (reg *webhookRegistry) list(ctx context.Context) []webhookSubscription {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	subs := make([]webhookSubscription, 0, len(reg.workers))
+	for _, w := range reg.workers {
+		if !tenantSees(ctx, w.sub.Tenant) {
+			continue
+		}
+		sub := w.sub
+		sub.Secret = ""
+		subs = append(subs, sub)
+	}
+	slices.SortFunc(subs, func(a, b webhookSubscription) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return subs
+}
+
+// deliver отправляет событие получателю, повторяя неудачные попытки; возвращается после
+// успешной доставки, исчерпания попыток или остановки релея (удаление подписки).
+func (reg *webhookRegistry) deliver(ctx context.Context, w *webhookWorker, e Event) {
+	if !w.sub.matches(e) {
+		return
+	}
+	body, header, err := webhookPayload(w.sub.Format, e)
+	if err != nil {
+		slog.ErrorContext(ctx, "webhooks: encode event", "subscription_id", w.sub.ID, "stream_id", e.StreamID, "version", e.Version, "error", err)
+		return
+	}
+	d := webhookDelivery{
+		EventID:   e.StreamID + "@" + strconv.FormatInt(e.Version, 10),
+		EventType: e.Type,
+		Position:  e.Position,
+		Status:    "pending",
+	}
+	backoff := webhookBackoffMin
+	for d.Attempts < reg.opts.MaxAttempts {
+		d.Attempts++
+		d.StatusCode, err = reg.post(ctx, w.sub, d.EventID, e.Type, header, body)
+		d.UpdatedAt = time.Now()
+		if err == nil {
+			d.Status, d.Error = "delivered", ""
+			w.record(d)
+			return
+		}
+		d.Error = err.Error()
+		if d.Attempts == reg.opts.MaxAttempts {
+			break
+		}
+		w.record(d)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, webhookBackoffMax)
+	}
+	d.Status = "failed"
+	w.record(d)
+	slog.ErrorContext(ctx, "webhooks: giving up", "subscription_id", w.sub.ID, "event_id", d.EventID, "event_type", d.EventType,
+		"attempts", d.Attempts, "error", d.Error)
+}
+
+// webhookPayload кодирует событие в формате подписки; header — заголовки, зависящие от формата.
+func webhookPayload(format string, e Event) ([]byte, http.Header, error) {
+	header := http.Header{}
+	switch format {
+	case "cloudevents":
+		header.Set("Content-Type", cloudEventsJSON)
+		body, err := json.Marshal(toCloudEvent(e))
+		return body, header, err
+	case "cloudevents-binary":
+		toCloudEvent(e).binaryHeaders(header)
+		return e.Data, header, nil
+	default:
+		header.Set("Content-Type", "application/json")
+		body, err := json.Marshal(e)
+		return body, header, err
+	}
+}
+
+func (reg *webhookRegistry) post(ctx context.Context, sub webhookSubscription, eventID string, t EventType, header http.Header, body []byte) (int, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	maps.Copy(req.Header, header)
+	req.Header.Set("User-Agent", "tsc-p7-cqrs-webhooks")
+	req.Header.Set("Webhook-Id", eventID)
+	req.Header.Set("Webhook-Event", string(t))
+	req.Header.Set("Webhook-Signature", "t="+ts+",v1="+webhookSignature(sub.Secret, ts, body))
+	resp, err := reg.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func webhookSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// record обновляет статус доставки события или добавляет новую, вытесняя самые старые.
+func (w *webhookWorker) record(d webhookDelivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n := len(w.deliveries); n > 0 && w.deliveries[n-1].EventID == d.EventID {
+		w.deliveries[n-1] = d
+		return
+	}
+	w.deliveries = append(w.deliveries, d)
+	if len(w.deliveries) > webhookHistory {
+		w.deliveries = slices.Delete(w.deliveries, 0, len(w.deliveries)-webhookHistory)
+	}
+}
+
+// --- Webhook Handlers ---
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		httpError(w, "url must be an absolute http(s) URL", http.StatusBadRequest)
+		return
+	}
+	if !webhooks.opts.AllowPrivate {
+		if err := checkWebhookHost(r.Context(), u.Hostname()); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	switch req.Format {
+	case "", "json", "cloudevents", "cloudevents-binary":
+	default:
+		httpError(w, "format must be json, cloudevents or cloudevents-binary", http.StatusBadRequest)
+		return
+	}
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+	sub := webhookSubscription{
+		ID:         uuid.New().String(),
+		URL:        req.URL,
+		EventTypes: req.EventTypes,
+		Format:     req.Format,
+		Secret:     req.Secret,
+		Tenant:     tenantFrom(r.Context()),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := webhooks.create(sub); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", apiVersionPrefix+"/webhooks/"+sub.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(webhooks.list(r.Context()))
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := webhooks.worker(r.Context(), id); !ok {
+		httpError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	ok, err := webhooks.remove(id)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		httpError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getWebhookDeliveries отдаёт подписку, позицию журнала, до которой она дошла, и статусы последних доставок.
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	wk, ok := webhooks.worker(r.Context(), mux.Vars(r)["id"])
+	if !ok {
+		httpError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	position, _, err := webhooks.cps.LoadCheckpoint(r.Context(), wk.relay.name)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	sub := wk.sub
+	sub.Secret = ""
+	wk.mu.Lock()
+	deliveries := slices.Clone(wk.deliveries)
+	wk.mu.Unlock()
+	slices.Reverse(deliveries)
+	json.NewEncoder(w).Encode(webhookDeliveries{Subscription: sub, Position: position, Deliveries: deliveries})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- WebSocket subscriptions ---
+// GET /events/ws открывает WebSocket, по которому сервер присылает события, подходящие под фильтр подписки.
+// Подписку задают параметры запроса (?types=OrderPaid,OrderCanceled&order_ids=<id>,<id>&after=<position>)
+// или сообщение клиента, которое заменяет текущую подписку:
+//
+//	{"action": "subscribe", "types": ["OrderPaid"], "order_ids": ["..."], "after": 42}
+//
+// Сначала приходят подходящие события журнала после after, затем новые. Сервер отвечает сообщениями
+// {"type": "subscribed", "after": N}, {"type": "event", "event": {...}} и {"type": "error", "error": "..."};
+// клиент, переподключаясь, передаёт в after позицию последнего полученного события.
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingEvery    = wsPongTimeout * 9 / 10
+)
+
+var wsUpgrader = websocket.Upgrader{} // CheckOrigin по умолчанию отклоняет чужие Origin
+
+type wsSubscription struct {
+	Action   string      `json:"action"`
+	Types    []EventType `json:"types,omitempty"`     // пусто — все типы
+	OrderIDs []string    `json:"order_ids,omitempty"` // пусто — все заказы
+	After    int64       `json:"after"`
+}
+
+func (s wsSubscription) matches(e Event) bool {
+	return (len(s.Types) == 0 || slices.Contains(s.Types, e.Type)) &&
+		(len(s.OrderIDs) == 0 || slices.Contains(s.OrderIDs, e.OrderID))
+}
+
+type wsMessage struct {
+	Type  string `json:"type"`
+	Event *Event `json:"event,omitempty"`
+	After *int64 `json:"after,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func subscribeEventsWS(w http.ResponseWriter, r *http.Request) {
+	initial, hasInitial, err := wsQuerySubscription(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade уже ответил клиенту
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	requests := make(chan wsSubscription)
+	go wsReadLoop(ctx, cancel, conn, requests)
+
+	var sub wsSubscription
+	var feed *eventFollower
+	var stopFeed context.CancelFunc = func() {}
+	defer func() { stopFeed() }()
+	subscribe := func(s wsSubscription) error {
+		stopFeed()
+		var feedCtx context.Context
+		feedCtx, stopFeed = context.WithCancel(ctx)
+		sub, feed = s, followEvents(feedCtx, s.After)
+		return wsWrite(conn, wsMessage{Type: "subscribed", After: &s.After})
+	}
+	if hasInitial {
+		if err := subscribe(initial); err != nil {
+			return
+		}
+	}
+	ping := time.NewTicker(wsPingEvery)
+	defer ping.Stop()
+	for {
+		var events <-chan Event
+		if feed != nil {
+			events = feed.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-requests:
+			if s.Action != "subscribe" {
+				err = wsWrite(conn, wsMessage{Type: "error", Error: `expected {"action": "subscribe", ...} with a non-negative after`})
+			} else {
+				err = subscribe(s)
+			}
+			if err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				if err := feed.Err(); err != nil && !errors.Is(err, context.Canceled) {
+					wsClose(conn, err)
+				}
+				return
+			}
+			if !sub.matches(e) {
+				continue
+			}
+			if err := wsWrite(conn, wsMessage{Type: "event", Event: &e}); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsReadLoop читает сообщения клиента и передаёт новые подписки; завершение чтения закрывает соединение.
+func wsReadLoop(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn, requests chan<- wsSubscription) {
+	defer cancel()
+	conn.SetReadLimit(64 << 10)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			var closed *websocket.CloseError
+			if !errors.As(err, &closed) && ctx.Err() == nil {
+				slog.WarnContext(ctx, "websocket: read", "error", err)
+			}
+			return
+		}
+		var s wsSubscription
+		if json.Unmarshal(body, &s) != nil || s.After < 0 {
+			s.Action = "" // ошибку пишет обработчик: у соединения может быть только один писатель
+		}
+		select {
+		case requests <- s:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func wsWrite(conn *websocket.Conn, msg wsMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteJSON(msg)
+}
+
+func wsClose(conn *websocket.Conn, err error) {
+	wsWrite(conn, wsMessage{Type: "error", Error: err.Error()})
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseTryAgainLater, ""), time.Now().Add(wsWriteTimeout))
+}
+
+// wsQuerySubscription читает подписку из параметров запроса; ok = false, если их нет.
+func wsQuerySubscription(r *http.Request) (s wsSubscription, ok bool, err error) {
+	q := r.URL.Query()
+	s.Action = "subscribe"
+	for _, t := range splitList(q.Get("types")) {
+		s.Types = append(s.Types, EventType(t))
+	}
+	s.OrderIDs = splitList(q.Get("order_ids"))
+	if v := q.Get("after"); v != "" {
+		if s.After, err = strconv.ParseInt(v, 10, 64); err != nil || s.After < 0 {
+			return s, false, errors.New("invalid after: expected event position")
+		}
+	}
+	return s, q.Has("types") || q.Has("order_ids") || q.Has("after"), nil
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}